@@ -0,0 +1,451 @@
+package main
+
+import (
+	"archive/zip"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"subscription-service/data"
+	"subscription-service/forms"
+	"time"
+)
+
+// confirmDeletion is what a user has to type to delete their account
+const confirmDeletion = "DELETE"
+
+// The types below are the files of a data export. They only hold what is about the
+// user; secrets such as password and token hashes are left out.
+
+type exportProfile struct {
+	ID               int                    `json:"id"`
+	Email            string                 `json:"email"`
+	FirstName        string                 `json:"first_name"`
+	LastName         string                 `json:"last_name"`
+	CreatedAt        time.Time              `json:"created_at"`
+	UpdatedAt        time.Time              `json:"updated_at"`
+	TwoFactorEnabled bool                   `json:"two_factor_enabled"`
+	BillingProfile   *exportBillingProfile  `json:"billing_profile"`
+	EmailPreferences exportEmailPreferences `json:"email_preferences"`
+	APITokens        []exportToken          `json:"api_tokens"`
+	Identities       []exportIdentity       `json:"identities"`
+}
+
+type exportBillingProfile struct {
+	CompanyName  string    `json:"company_name"`
+	TaxID        string    `json:"tax_id"`
+	AddressLine1 string    `json:"address_line1"`
+	AddressLine2 string    `json:"address_line2"`
+	City         string    `json:"city"`
+	State        string    `json:"state"`
+	PostalCode   string    `json:"postal_code"`
+	Country      string    `json:"country"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+type exportEmailPreferences struct {
+	Invoices    bool `json:"invoices"`
+	Manuals     bool `json:"manuals"`
+	LoginAlerts bool `json:"login_alerts"`
+}
+
+type exportToken struct {
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+type exportIdentity struct {
+	Issuer      string    `json:"issuer"`
+	Subject     string    `json:"subject"`
+	Email       string    `json:"email"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastLoginAt time.Time `json:"last_login_at"`
+}
+
+type exportSubscription struct {
+	PlanID           int        `json:"plan_id"`
+	PlanName         string     `json:"plan_name"`
+	Status           string     `json:"status"`
+	CurrentPeriodEnd time.Time  `json:"current_period_end"`
+	PastDueSince     *time.Time `json:"past_due_since"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+type exportInvoice struct {
+	Number           string             `json:"number"`
+	PlanName         string             `json:"plan_name"`
+	Amount           int                `json:"amount"`
+	AmountPaid       int                `json:"amount_paid"`
+	AmountRefunded   int                `json:"amount_refunded"`
+	BillingName      string             `json:"billing_name"`
+	BillingEmail     string             `json:"billing_email"`
+	BillingAddress   []string           `json:"billing_address"`
+	PaymentReference string             `json:"payment_reference"`
+	IssuedAt         time.Time          `json:"issued_at"`
+	PaidAt           *time.Time         `json:"paid_at"`
+	LineItems        []exportLineItem   `json:"line_items"`
+	CreditNotes      []exportCreditNote `json:"credit_notes"`
+}
+
+type exportLineItem struct {
+	Description string `json:"description"`
+	Quantity    int    `json:"quantity"`
+	UnitAmount  int    `json:"unit_amount"`
+	Amount      int    `json:"amount"`
+}
+
+type exportCreditNote struct {
+	Number   string    `json:"number"`
+	Amount   int       `json:"amount"`
+	Reason   string    `json:"reason"`
+	Status   string    `json:"status"`
+	IssuedAt time.Time `json:"issued_at"`
+}
+
+type exportAuditEntry struct {
+	Action     string         `json:"action"`
+	ActorEmail string         `json:"actor_email"`
+	TargetType string         `json:"target_type"`
+	TargetID   string         `json:"target_id"`
+	IP         string         `json:"ip"`
+	UserAgent  string         `json:"user_agent"`
+	Metadata   map[string]any `json:"metadata"`
+	CreatedAt  time.Time      `json:"created_at"`
+}
+
+type exportEmail struct {
+	Recipient string    `json:"recipient"`
+	Subject   string    `json:"subject"`
+	Template  string    `json:"template"`
+	SentAt    time.Time `json:"sent_at"`
+}
+
+// ExportAccountData downloads everything we hold about the logged in user, as a
+// zip of JSON files
+func (app *Config) ExportAccountData(w http.ResponseWriter, r *http.Request) {
+	user := app.currentUser(r)
+	if user == nil {
+		app.Session.Put(r.Context(), "error", "Log in first!")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	// everything is loaded before writing, so a failure can still be reported
+	files, err := app.accountExportFiles(user)
+	if err != nil {
+		app.ErrorLog.Println("exporting account data:", err)
+		app.Session.Put(r.Context(), "error", "Unable to export your data.")
+		http.Redirect(w, r, "/members/profile", http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, data.AuditDataExported, "user", user.ID, nil)
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="my-data-%s.zip"`, time.Now().Format("20060102")))
+
+	archive := zip.NewWriter(w)
+	for _, name := range []string{"profile.json", "subscriptions.json", "invoices.json", "audit-log.json", "emails.json"} {
+		f, err := archive.Create(name)
+		if err != nil {
+			app.ErrorLog.Println("exporting account data:", err)
+			return
+		}
+
+		_, err = f.Write(files[name])
+		if err != nil {
+			app.ErrorLog.Println("exporting account data:", err)
+			return
+		}
+	}
+
+	err = archive.Close()
+	if err != nil {
+		app.ErrorLog.Println("exporting account data:", err)
+	}
+}
+
+// accountExportFiles returns the contents of each file in a data export of user
+func (app *Config) accountExportFiles(user *data.User) (map[string][]byte, error) {
+	profile, err := app.exportProfile(user)
+	if err != nil {
+		return nil, err
+	}
+
+	var subscriptions []exportSubscription
+	subscription, err := app.Models.Subscription.GetByUserID(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if subscription != nil {
+		exported := exportSubscription{
+			PlanID:           subscription.PlanID,
+			Status:           subscription.Status,
+			CurrentPeriodEnd: subscription.CurrentPeriodEnd,
+			PastDueSince:     optionalTime(subscription.PastDueSince),
+			CreatedAt:        subscription.CreatedAt,
+		}
+		if plan, err := app.Models.Plan.GetOne(subscription.PlanID); err == nil {
+			exported.PlanName = plan.PlanName
+		}
+		subscriptions = append(subscriptions, exported)
+	}
+
+	invoices, err := app.exportInvoices(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := app.Models.AuditLog.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	auditLog := make([]exportAuditEntry, 0, len(entries))
+	for _, entry := range entries {
+		auditLog = append(auditLog, exportAuditEntry{
+			Action:     entry.Action,
+			ActorEmail: entry.ActorEmail,
+			TargetType: entry.TargetType,
+			TargetID:   entry.TargetID,
+			IP:         entry.IP,
+			UserAgent:  entry.UserAgent,
+			Metadata:   entry.Metadata,
+			CreatedAt:  entry.CreatedAt,
+		})
+	}
+
+	sent, err := app.Models.EmailLog.GetAllForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+	emails := make([]exportEmail, 0, len(sent))
+	for _, email := range sent {
+		emails = append(emails, exportEmail{
+			Recipient: email.Recipient,
+			Subject:   email.Subject,
+			Template:  email.Template,
+			SentAt:    email.CreatedAt,
+		})
+	}
+
+	files := make(map[string][]byte)
+	for name, contents := range map[string]any{
+		"profile.json":       profile,
+		"subscriptions.json": subscriptions,
+		"invoices.json":      invoices,
+		"audit-log.json":     auditLog,
+		"emails.json":        emails,
+	} {
+		out, err := json.MarshalIndent(contents, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		files[name] = out
+	}
+
+	return files, nil
+}
+
+func (app *Config) exportProfile(user *data.User) (exportProfile, error) {
+	profile := exportProfile{
+		ID:         user.ID,
+		Email:      user.Email,
+		FirstName:  user.FirstName,
+		LastName:   user.LastName,
+		CreatedAt:  user.CreatedAt,
+		UpdatedAt:  user.UpdatedAt,
+		APITokens:  []exportToken{},
+		Identities: []exportIdentity{},
+	}
+
+	_, err := app.Models.TwoFactor.GetByUserID(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return profile, err
+	}
+	profile.TwoFactorEnabled = err == nil
+
+	billing, err := app.Models.BillingProfile.GetByUserID(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return profile, err
+	}
+	if billing != nil {
+		profile.BillingProfile = &exportBillingProfile{
+			CompanyName:  billing.CompanyName,
+			TaxID:        billing.TaxID,
+			AddressLine1: billing.AddressLine1,
+			AddressLine2: billing.AddressLine2,
+			City:         billing.City,
+			State:        billing.State,
+			PostalCode:   billing.PostalCode,
+			Country:      billing.Country,
+			UpdatedAt:    billing.UpdatedAt,
+		}
+	}
+
+	prefs, err := app.Models.EmailPreferences.GetByUserID(user.ID)
+	if err != nil {
+		return profile, err
+	}
+	profile.EmailPreferences = exportEmailPreferences{
+		Invoices:    prefs.Invoices,
+		Manuals:     prefs.Manuals,
+		LoginAlerts: prefs.LoginAlerts,
+	}
+
+	tokens, err := app.Models.Token.GetAllForUser(user.ID)
+	if err != nil {
+		return profile, err
+	}
+	for _, token := range tokens {
+		profile.APITokens = append(profile.APITokens, exportToken{
+			Name:       token.Name,
+			Scopes:     token.Scopes,
+			CreatedAt:  token.CreatedAt,
+			LastUsedAt: optionalTime(token.LastUsedAt),
+		})
+	}
+
+	identities, err := app.Models.Identity.GetAllForUser(user.ID)
+	if err != nil {
+		return profile, err
+	}
+	for _, identity := range identities {
+		profile.Identities = append(profile.Identities, exportIdentity{
+			Issuer:      identity.Issuer,
+			Subject:     identity.Subject,
+			Email:       identity.Email,
+			CreatedAt:   identity.CreatedAt,
+			LastLoginAt: identity.LastLoginAt,
+		})
+	}
+
+	return profile, nil
+}
+
+func (app *Config) exportInvoices(userID int) ([]exportInvoice, error) {
+	invoices, err := app.Models.Invoice.GetAllForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	exported := make([]exportInvoice, 0, len(invoices))
+	for _, summary := range invoices {
+		// only GetOne loads the line items
+		invoice, err := app.Models.Invoice.GetOne(summary.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		notes, err := app.Models.CreditNote.GetAllForInvoice(invoice.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		out := exportInvoice{
+			Number:           invoice.Number(),
+			PlanName:         invoice.PlanName,
+			Amount:           invoice.Amount,
+			AmountPaid:       invoice.AmountPaid,
+			AmountRefunded:   invoice.AmountRefunded,
+			BillingName:      invoice.BillingName,
+			BillingEmail:     invoice.BillingEmail,
+			BillingAddress:   invoice.Billing.AddressLines(),
+			PaymentReference: invoice.PaymentReference,
+			IssuedAt:         invoice.IssuedAt,
+			PaidAt:           optionalTime(invoice.PaidAt),
+			LineItems:        []exportLineItem{},
+			CreditNotes:      []exportCreditNote{},
+		}
+		for _, item := range invoice.LineItems {
+			out.LineItems = append(out.LineItems, exportLineItem{
+				Description: item.Description,
+				Quantity:    item.Quantity,
+				UnitAmount:  item.UnitAmount,
+				Amount:      item.Amount,
+			})
+		}
+		for _, note := range notes {
+			out.CreditNotes = append(out.CreditNotes, exportCreditNote{
+				Number:   note.Number(),
+				Amount:   note.Amount,
+				Reason:   note.Reason,
+				Status:   note.Status,
+				IssuedAt: note.IssuedAt,
+			})
+		}
+
+		exported = append(exported, out)
+	}
+
+	return exported, nil
+}
+
+// optionalTime returns nil for the zero time, so it is exported as null
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
+
+// PostDeleteAccount deletes the account of the logged in user, once they have
+// given their password and typed DELETE to confirm. Invoices are kept, since we
+// have to retain them; the rest of their personal data is wiped.
+func (app *Config) PostDeleteAccount(w http.ResponseWriter, r *http.Request) {
+	user := app.currentUser(r)
+	if user == nil {
+		app.Session.Put(r.Context(), "error", "Log in first!")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("delete-password", "confirm")
+	form.Check(form.Get("confirm") == confirmDeletion, "confirm", fmt.Sprintf("Type %s to confirm", confirmDeletion))
+
+	if form.Has("delete-password") {
+		matches, err := user.PasswordMatches(form.Get("delete-password"))
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+		form.Check(matches, "delete-password", "Your password is not right")
+	}
+
+	if !form.Valid() {
+		form.Del("delete-password")
+		app.renderProfilePage(w, r, form, "Your account was not deleted. Please correct the errors below.")
+		return
+	}
+
+	err = user.Delete()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to delete your account.")
+		http.Redirect(w, r, "/members/profile", http.StatusSeeOther)
+		return
+	}
+
+	// written after the redaction, so it mustn't bring back the email address, IP
+	// address or user agent
+	app.recordAudit(data.AuditLog{
+		ActorID:    user.ID,
+		Action:     data.AuditAccountDeleted,
+		TargetType: "user",
+		TargetID:   auditTargetID(user.ID),
+	})
+
+	_ = app.Session.Destroy(r.Context())
+	_ = app.Session.RenewToken(r.Context())
+
+	app.Session.Put(r.Context(), "flash", "Your account has been deleted.")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
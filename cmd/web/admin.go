@@ -0,0 +1,683 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"subscription-service/data"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func (app *Config) AdminInvoicesPage(w http.ResponseWriter, r *http.Request) {
+	invoices, err := app.Models.Invoice.GetAll()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "Unable to load invoices", http.StatusInternalServerError)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["invoices"] = invoices
+
+	app.render(w, r, "admin-invoices.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (app *Config) AdminInvoicePage(w http.ResponseWriter, r *http.Request) {
+	invoiceID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	invoice, err := app.Models.Invoice.GetOne(invoiceID)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Unable to find invoice.")
+		http.Redirect(w, r, "/admin/invoices", http.StatusSeeOther)
+		return
+	}
+
+	notes, err := app.Models.CreditNote.GetAllForInvoice(invoice.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["invoice"] = invoice
+	dataMap["notes"] = notes
+
+	app.render(w, r, "admin-invoice.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// AdminRefundInvoice refunds all or part of an invoice through the payment provider,
+// records a credit note and emails it to the customer
+func (app *Config) AdminRefundInvoice(w http.ResponseWriter, r *http.Request) {
+	invoiceID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	invoiceURL := fmt.Sprintf("/admin/invoices/%d", invoiceID)
+
+	err = r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	invoice, err := app.Models.Invoice.GetOne(invoiceID)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Unable to find invoice.")
+		http.Redirect(w, r, "/admin/invoices", http.StatusSeeOther)
+		return
+	}
+
+	// an empty amount means a full refund of whatever is left
+	amount := invoice.Refundable()
+	if x := strings.TrimSpace(r.Form.Get("amount")); x != "" {
+		amount, err = parseAmount(x)
+		if err != nil {
+			app.Session.Put(r.Context(), "error", "Invalid refund amount.")
+			http.Redirect(w, r, invoiceURL, http.StatusSeeOther)
+			return
+		}
+	}
+
+	if amount <= 0 || amount > invoice.Refundable() {
+		app.Session.Put(r.Context(), "error", fmt.Sprintf("Refund must be between $0.01 and %s.", invoice.RefundableForDisplay()))
+		http.Redirect(w, r, invoiceURL, http.StatusSeeOther)
+		return
+	}
+
+	note := data.CreditNote{
+		InvoiceID: invoice.ID,
+		UserID:    invoice.UserID,
+		Amount:    amount,
+		Reason:    strings.TrimSpace(r.Form.Get("reason")),
+		Status:    data.CreditNotePending,
+		IssuedAt:  time.Now(),
+	}
+
+	// the amount is reserved on the invoice before any money moves, so a refund
+	// submitted twice, or by two admins at once, can't go through twice
+	note.ID, err = app.Models.CreditNote.Reserve(note)
+	if errors.Is(err, data.ErrRefundExceedsBalance) {
+		app.Session.Put(r.Context(), "error", "Refund exceeds the refundable balance.")
+		http.Redirect(w, r, invoiceURL, http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to record the credit note.")
+		http.Redirect(w, r, invoiceURL, http.StatusSeeOther)
+		return
+	}
+
+	reference, err := app.Payments.Refund(invoice, amount)
+	if err != nil {
+		app.ErrorLog.Println("refunding invoice", invoice.Number(), err)
+
+		err = app.Models.CreditNote.Cancel(note.ID)
+		if err != nil {
+			app.ErrorLog.Printf("declined refund %s on invoice %s is still reserved: %v", note.Number(), invoice.Number(), err)
+		}
+
+		app.Session.Put(r.Context(), "error", "The payment provider declined the refund.")
+		http.Redirect(w, r, invoiceURL, http.StatusSeeOther)
+		return
+	}
+
+	err = app.Models.CreditNote.Issue(note.ID, reference)
+	if err != nil {
+		// the money has moved and the amount stays reserved, so make sure this gets noticed
+		app.ErrorLog.Printf("refund %s on invoice %s is recorded as pending credit note %s: %v", reference, invoice.Number(), note.Number(), err)
+		app.Session.Put(r.Context(), "error", fmt.Sprintf("The refund went through, but credit note %s could not be issued.", note.Number()))
+		http.Redirect(w, r, invoiceURL, http.StatusSeeOther)
+		return
+	}
+	note.Status = data.CreditNoteIssued
+	note.RefundReference = reference
+	invoice.AmountRefunded += amount
+
+	app.Events.Publish(invoiceRefunded{Invoice: *invoice, Note: note})
+
+	app.audit(r, data.AuditInvoiceRefunded, "invoice", invoice.ID, map[string]any{
+		"amount":      amount,
+		"credit_note": note.Number(),
+		"reference":   reference,
+		"reason":      note.Reason,
+	})
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("Refunded %s, credit note %s issued.", note.AmountForDisplay(), note.Number()))
+	http.Redirect(w, r, invoiceURL, http.StatusSeeOther)
+}
+
+// sendCreditNote generates the PDF of a credit note and emails it
+func (app *Config) sendCreditNote(note *data.CreditNote, invoice *data.Invoice) error {
+	if !app.emailPreferences(invoice.UserID).Invoices {
+		return nil
+	}
+
+	pdf := app.generateCreditNote(note, invoice)
+	fileName := fmt.Sprintf("./tmp/%d_credit_note.pdf", note.ID)
+	err := pdf.OutputFileAndClose(fileName)
+	if err != nil {
+		return err
+	}
+
+	msg := Message{
+		To:       invoice.BillingEmail,
+		Subject:  fmt.Sprintf("Your credit note %s", note.Number()),
+		Data:     note.AmountForDisplay(),
+		DataMap:  map[string]any{"note": note, "invoice": invoice},
+		Template: "credit-note",
+		AttachmentMap: map[string]string{
+			fmt.Sprintf("%s.pdf", note.Number()): fileName,
+		},
+	}
+
+	app.sendEmail(msg)
+
+	return nil
+}
+
+var featureNameRegex = regexp.MustCompile(`^[a-z0-9_-]{1,100}$`)
+
+// parseAmount converts a currency string such as "12.50" to cents
+func parseAmount(s string) (int, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "$")
+
+	amount, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	// amounts are stored in integer columns
+	cents := math.Round(amount * 100)
+	if math.IsNaN(cents) || cents > math.MaxInt32 || cents < math.MinInt32 {
+		return 0, fmt.Errorf("invalid amount %q", s)
+	}
+
+	return int(cents), nil
+}
+
+func (app *Config) AdminPlansPage(w http.ResponseWriter, r *http.Request) {
+	plans, err := app.Models.Plan.GetAll()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "Unable to load plans", http.StatusInternalServerError)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["plans"] = plans
+	dataMap["entitlements"] = app.planEntitlements(plans)
+
+	meteredPrices := make(map[int][]*data.MeteredPrice)
+	for _, plan := range plans {
+		prices, err := app.Models.MeteredPrice.GetAllForPlan(plan.ID)
+		if err != nil {
+			app.ErrorLog.Println(err)
+			continue
+		}
+		meteredPrices[plan.ID] = prices
+	}
+	dataMap["meteredPrices"] = meteredPrices
+
+	app.render(w, r, "admin-plans.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// AdminUpdateDunningSchedule sets the days on which failed renewals of a plan are retried
+func (app *Config) AdminUpdateDunningSchedule(w http.ResponseWriter, r *http.Request) {
+	planID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	plan, err := app.Models.Plan.GetOne(planID)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Unable to find plan.")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+
+	schedule, err := data.ParseDunningSchedule(r.Form.Get("dunning-schedule"))
+	if err != nil || len(schedule) == 0 {
+		app.Session.Put(r.Context(), "error", "Enter the retry days as increasing numbers, e.g. 1,3,7,14.")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+
+	err = plan.UpdateDunningSchedule(schedule)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to update plan.")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, data.AuditDunningUpdated, "plan", plan.ID, map[string]any{
+		"from": data.FormatDunningSchedule(plan.DunningSchedule),
+		"to":   data.FormatDunningSchedule(schedule),
+	})
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("Dunning schedule for %s updated", plan.PlanName))
+	http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+}
+
+// AdminAddEntitlement grants a feature, optionally with a numeric limit, to a plan
+func (app *Config) AdminAddEntitlement(w http.ResponseWriter, r *http.Request) {
+	planID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	entitlement := data.Entitlement{
+		PlanID:  planID,
+		Feature: strings.ToLower(strings.TrimSpace(r.Form.Get("feature"))),
+	}
+
+	if !featureNameRegex.MatchString(entitlement.Feature) {
+		app.Session.Put(r.Context(), "error", "Feature names may only contain lowercase letters, digits, dashes and underscores.")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+
+	if x := strings.TrimSpace(r.Form.Get("limit")); x != "" {
+		entitlement.Limit, err = strconv.Atoi(x)
+		if err != nil || entitlement.Limit < 0 {
+			app.Session.Put(r.Context(), "error", "The limit must be a whole number of at least 0.")
+			http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+			return
+		}
+		entitlement.Limited = true
+	}
+
+	err = app.Models.Entitlement.Upsert(entitlement)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to save entitlement.")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+
+	metadata := map[string]any{"feature": entitlement.Feature}
+	if entitlement.Limited {
+		metadata["limit"] = entitlement.Limit
+	}
+	app.audit(r, data.AuditEntitlementSaved, "plan", planID, metadata)
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("Entitlement %s saved", entitlement.Feature))
+	http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+}
+
+// AdminDeleteEntitlement removes a feature from a plan
+func (app *Config) AdminDeleteEntitlement(w http.ResponseWriter, r *http.Request) {
+	entitlementID, err := strconv.Atoi(chi.URLParam(r, "entitlementID"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	err = app.Models.Entitlement.DeleteByID(entitlementID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to remove entitlement.")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, data.AuditEntitlementRemoved, "plan", chi.URLParam(r, "id"), map[string]any{"entitlement_id": entitlementID})
+
+	app.Session.Put(r.Context(), "flash", "Entitlement removed")
+	http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+}
+
+// AdminSaveMeteredPrice sets the per-unit or tiered price of a usage metric on a plan
+func (app *Config) AdminSaveMeteredPrice(w http.ResponseWriter, r *http.Request) {
+	planID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	err = r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	price := data.MeteredPrice{
+		PlanID:       planID,
+		Metric:       strings.ToLower(strings.TrimSpace(r.Form.Get("metric"))),
+		PricingModel: r.Form.Get("pricing-model"),
+	}
+
+	if !metricNameRegex.MatchString(price.Metric) {
+		app.Session.Put(r.Context(), "error", "Metric names may only contain lowercase letters, digits, dots, dashes and underscores.")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+
+	switch price.PricingModel {
+	case data.PricingPerUnit:
+		price.UnitAmount, err = strconv.Atoi(strings.TrimSpace(r.Form.Get("unit-amount")))
+		if err != nil || price.UnitAmount < 0 {
+			app.Session.Put(r.Context(), "error", "Enter the price per unit in cents.")
+			http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+			return
+		}
+	case data.PricingTiered:
+		price.Tiers, err = data.ParsePriceTiers(r.Form.Get("tiers"))
+		if err != nil || len(price.Tiers) == 0 {
+			app.Session.Put(r.Context(), "error", "Enter the tiers as up_to:cents pairs, e.g. 1000:0, 10000:2, inf:1.")
+			http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+			return
+		}
+	default:
+		app.Session.Put(r.Context(), "error", "Unknown pricing model.")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+
+	err = app.Models.MeteredPrice.Upsert(price)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to save metered price.")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, data.AuditMeteredPriceSaved, "plan", planID, map[string]any{"metric": price.Metric, "price": price.Describe()})
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("Price for %s saved", price.Metric))
+	http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+}
+
+// AdminDeleteMeteredPrice stops billing a usage metric on a plan
+func (app *Config) AdminDeleteMeteredPrice(w http.ResponseWriter, r *http.Request) {
+	priceID, err := strconv.Atoi(chi.URLParam(r, "priceID"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	err = app.Models.MeteredPrice.DeleteByID(priceID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to remove metered price.")
+		http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, data.AuditMeteredPriceRemoved, "plan", chi.URLParam(r, "id"), map[string]any{"metered_price_id": priceID})
+
+	app.Session.Put(r.Context(), "flash", "Metered price removed")
+	http.Redirect(w, r, "/admin/plans", http.StatusSeeOther)
+}
+
+func (app *Config) AdminWebhooksPage(w http.ResponseWriter, r *http.Request) {
+	endpoints, err := app.Models.WebhookEndpoint.GetAll()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "Unable to load webhook endpoints", http.StatusInternalServerError)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["endpoints"] = endpoints
+	dataMap["eventTypes"] = webhookEventTypes
+
+	app.render(w, r, "admin-webhooks.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// AdminAddWebhook registers a new endpoint with a freshly generated signing secret
+func (app *Config) AdminAddWebhook(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	endpoint, ok := app.readWebhookForm(w, r, "/admin/webhooks")
+	if !ok {
+		return
+	}
+
+	endpoint.Secret, err = newWebhookSecret()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to add webhook endpoint.")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+		return
+	}
+	endpoint.Active = true
+
+	id, err := app.Models.WebhookEndpoint.Insert(*endpoint)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to add webhook endpoint.")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, data.AuditWebhookCreated, "webhook", id, map[string]any{"url": endpoint.URL, "events": endpoint.Events})
+
+	app.Session.Put(r.Context(), "flash", "Webhook endpoint added")
+	http.Redirect(w, r, fmt.Sprintf("/admin/webhooks/%d", id), http.StatusSeeOther)
+}
+
+// AdminWebhookPage shows an endpoint, its signing secret and its delivery log
+func (app *Config) AdminWebhookPage(w http.ResponseWriter, r *http.Request) {
+	endpointID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	endpoint, err := app.Models.WebhookEndpoint.GetOne(endpointID)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Unable to find webhook endpoint.")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+		return
+	}
+
+	deliveries, err := app.Models.WebhookDelivery.GetRecentForEndpoint(endpoint.ID, 100)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["endpoint"] = endpoint
+	dataMap["deliveries"] = deliveries
+	dataMap["eventTypes"] = webhookEventTypes
+
+	app.render(w, r, "admin-webhook.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// AdminUpdateWebhook changes the URL and events of an endpoint, or disables it
+func (app *Config) AdminUpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	endpointID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	endpointURL := fmt.Sprintf("/admin/webhooks/%d", endpointID)
+
+	err = r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	endpoint, err := app.Models.WebhookEndpoint.GetOne(endpointID)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Unable to find webhook endpoint.")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+		return
+	}
+
+	form, ok := app.readWebhookForm(w, r, endpointURL)
+	if !ok {
+		return
+	}
+	endpoint.URL = form.URL
+	endpoint.Events = form.Events
+	endpoint.Active = r.Form.Get("active") != ""
+
+	err = endpoint.Update()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to update webhook endpoint.")
+		http.Redirect(w, r, endpointURL, http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, data.AuditWebhookUpdated, "webhook", endpoint.ID, map[string]any{
+		"url":    endpoint.URL,
+		"events": endpoint.Events,
+		"active": endpoint.Active,
+	})
+
+	app.Session.Put(r.Context(), "flash", "Webhook endpoint updated")
+	http.Redirect(w, r, endpointURL, http.StatusSeeOther)
+}
+
+func (app *Config) AdminDeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	endpointID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	err = app.Models.WebhookEndpoint.DeleteByID(endpointID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to delete webhook endpoint.")
+		http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, data.AuditWebhookDeleted, "webhook", endpointID, nil)
+
+	app.Session.Put(r.Context(), "flash", "Webhook endpoint deleted")
+	http.Redirect(w, r, "/admin/webhooks", http.StatusSeeOther)
+}
+
+// AdminRedeliverWebhook queues a logged delivery to be sent again right away
+func (app *Config) AdminRedeliverWebhook(w http.ResponseWriter, r *http.Request) {
+	endpointID, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	deliveryID, err := strconv.Atoi(chi.URLParam(r, "deliveryID"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	endpointURL := fmt.Sprintf("/admin/webhooks/%d", endpointID)
+
+	delivery, err := app.Models.WebhookDelivery.GetOne(deliveryID)
+	if err != nil || delivery.EndpointID != endpointID {
+		app.Session.Put(r.Context(), "error", "Unable to find delivery.")
+		http.Redirect(w, r, endpointURL, http.StatusSeeOther)
+		return
+	}
+
+	err = app.Models.WebhookDelivery.Redeliver(delivery.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to redeliver event.")
+		http.Redirect(w, r, endpointURL, http.StatusSeeOther)
+		return
+	}
+	app.nudgeWebhooks()
+	app.audit(r, data.AuditWebhookRedelivered, "webhook", endpointID, map[string]any{"event_id": delivery.EventID})
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("Event %s queued for redelivery", delivery.EventID))
+	http.Redirect(w, r, endpointURL, http.StatusSeeOther)
+}
+
+// readWebhookForm reads and validates the URL and events of an endpoint form. On
+// error it redirects back to redirectURL with a message, and returns false.
+func (app *Config) readWebhookForm(w http.ResponseWriter, r *http.Request, redirectURL string) (*data.WebhookEndpoint, bool) {
+	endpoint := &data.WebhookEndpoint{
+		URL: strings.TrimSpace(r.Form.Get("url")),
+	}
+
+	u, err := url.Parse(endpoint.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		app.Session.Put(r.Context(), "error", "Enter an http or https URL.")
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return nil, false
+	}
+
+	for _, eventType := range webhookEventTypes {
+		if r.Form.Get("event-"+eventType) != "" {
+			endpoint.Events = append(endpoint.Events, eventType)
+		}
+	}
+	if len(endpoint.Events) == 0 {
+		app.Session.Put(r.Context(), "error", "Choose at least one event.")
+		http.Redirect(w, r, redirectURL, http.StatusSeeOther)
+		return nil, false
+	}
+
+	return endpoint, true
+}
+
+func (app *Config) AdminSettingsPage(w http.ResponseWriter, r *http.Request) {
+	requireAdmin2FA, err := app.Models.Setting.GetBool(data.SettingRequireAdmin2FA)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["requireAdmin2FA"] = requireAdmin2FA
+
+	app.render(w, r, "admin-settings.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (app *Config) AdminUpdateSettings(w http.ResponseWriter, r *http.Request) {
+	requireAdmin2FA := r.PostFormValue("require-admin-2fa") != ""
+
+	err := app.Models.Setting.SetBool(data.SettingRequireAdmin2FA, requireAdmin2FA)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to save settings.")
+		http.Redirect(w, r, "/admin/settings", http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, data.AuditSettingsUpdated, "setting", data.SettingRequireAdmin2FA, map[string]any{"value": requireAdmin2FA})
+
+	app.Session.Put(r.Context(), "flash", "Settings saved")
+	http.Redirect(w, r, "/admin/settings", http.StatusSeeOther)
+}
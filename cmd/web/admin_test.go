@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    int
+		wantErr bool
+	}{
+		{"dollars and cents", "12.50", 1250, false},
+		{"whole dollars", "3", 300, false},
+		{"dollar sign", "$7.25", 725, false},
+		{"surrounding space", "  0.10 ", 10, false},
+		{"one cent", "0.01", 1, false},
+		{"float error rounds", "0.29", 29, false},
+		{"half a cent rounds up", "0.005", 1, false},
+		{"negative", "-5", -500, false},
+		{"exponent", "1e3", 100000, false},
+		{"largest", "21474836.47", 2147483647, false},
+		{"too large", "21474836.48", 0, true},
+		{"far too large", "1e300", 0, true},
+		{"empty", "", 0, true},
+		{"text", "ten dollars", 0, true},
+		{"comma", "1,000", 0, true},
+		{"not a number", "NaN", 0, true},
+		{"infinity", "Inf", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseAmount(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseAmount(%q) = %d, want an error", tt.input, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseAmount(%q): %v", tt.input, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseAmount(%q) = %d, want %d", tt.input, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"subscription-service/data"
+	"time"
+)
+
+const (
+	defaultPerPage = 20
+	maxPerPage     = 100
+	// maxPage keeps the offset of a page well within an int, and a Postgres integer
+	maxPage = math.MaxInt32 / maxPerPage
+)
+
+// apiError is the envelope of every error response of the JSON API
+type apiError struct {
+	Error apiErrorBody `json:"error"`
+}
+
+type apiErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiResponse is the envelope of every successful response of the JSON API. Meta is
+// only set on paginated lists.
+type apiResponse struct {
+	Data any      `json:"data"`
+	Meta *apiMeta `json:"meta,omitempty"`
+}
+
+type apiMeta struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	Total      int `json:"total"`
+	TotalPages int `json:"total_pages"`
+}
+
+type apiFeature struct {
+	Feature string `json:"feature"`
+	Limit   *int   `json:"limit,omitempty"`
+}
+
+type apiPlan struct {
+	ID              int          `json:"id"`
+	Name            string       `json:"name"`
+	Amount          int          `json:"amount"`
+	AmountFormatted string       `json:"amount_formatted"`
+	Features        []apiFeature `json:"features"`
+}
+
+type apiSubscription struct {
+	PlanID           int        `json:"plan_id"`
+	Status           string     `json:"status"`
+	CurrentPeriodEnd time.Time  `json:"current_period_end"`
+	PastDueSince     *time.Time `json:"past_due_since,omitempty"`
+}
+
+type apiUser struct {
+	ID           int              `json:"id"`
+	Email        string           `json:"email"`
+	FirstName    string           `json:"first_name"`
+	LastName     string           `json:"last_name"`
+	Subscription *apiSubscription `json:"subscription,omitempty"`
+	CreatedAt    time.Time        `json:"created_at"`
+}
+
+type apiInvoice struct {
+	ID              int        `json:"id"`
+	Number          string     `json:"number"`
+	PlanName        string     `json:"plan_name"`
+	Amount          int        `json:"amount"`
+	AmountFormatted string     `json:"amount_formatted"`
+	AmountPaid      int        `json:"amount_paid"`
+	AmountRefunded  int        `json:"amount_refunded"`
+	IssuedAt        time.Time  `json:"issued_at"`
+	PaidAt          *time.Time `json:"paid_at,omitempty"`
+}
+
+type apiSubscribeRequest struct {
+	PlanID int `json:"plan_id" minimum:"1"`
+}
+
+func (app *Config) APIListPlans(w http.ResponseWriter, r *http.Request) {
+	page, perPage, err := readPagination(r)
+	if err != nil {
+		app.errorJSON(w, http.StatusBadRequest, "invalid_pagination", err.Error())
+		return
+	}
+
+	plans, err := app.Models.Plan.GetAll()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.errorJSON(w, http.StatusInternalServerError, "internal_error", "Unable to load plans.")
+		return
+	}
+
+	total := len(plans)
+	start := max(0, min((page-1)*perPage, total))
+	end := min(start+perPage, total)
+
+	out := make([]apiPlan, 0, end-start)
+	for _, plan := range plans[start:end] {
+		out = append(out, app.toAPIPlan(plan))
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, apiResponse{Data: out, Meta: newAPIMeta(page, perPage, total)})
+}
+
+func (app *Config) APIGetMe(w http.ResponseWriter, r *http.Request) {
+	user := app.apiUser(r)
+
+	out := toAPIUser(user)
+
+	sub, err := app.Models.Subscription.GetByUserID(user.ID)
+	if err == nil {
+		out.Subscription = toAPISubscription(sub)
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		app.ErrorLog.Println(err)
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, apiResponse{Data: out})
+}
+
+func (app *Config) APIGetSubscription(w http.ResponseWriter, r *http.Request) {
+	sub, err := app.Models.Subscription.GetByUserID(app.apiUser(r).ID)
+	if err != nil {
+		app.errorJSON(w, http.StatusNotFound, "not_found", "You have no subscription.")
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, apiResponse{Data: toAPISubscription(sub)})
+}
+
+// APISubscribe subscribes the user to a plan, replacing any current subscription
+func (app *Config) APISubscribe(w http.ResponseWriter, r *http.Request) {
+	user := app.apiUser(r)
+
+	var req apiSubscribeRequest
+	err := app.readJSON(w, r, &req)
+	if err != nil {
+		app.errorJSON(w, http.StatusBadRequest, "invalid_body", err.Error())
+		return
+	}
+
+	plan, err := app.Models.Plan.GetOne(req.PlanID)
+	if err != nil {
+		app.errorJSON(w, http.StatusUnprocessableEntity, "unknown_plan", "Unable to find plan.")
+		return
+	}
+
+	sub, err := app.Models.Subscription.GetByUserID(user.ID)
+	if err == nil && sub.IsPastDue() {
+		app.errorJSON(w, http.StatusConflict, "past_due", "Your subscription has an unpaid invoice.")
+		return
+	}
+
+	profile, err := app.Models.BillingProfile.GetByUserID(user.ID)
+	if err != nil {
+		app.errorJSON(w, http.StatusUnprocessableEntity, "billing_profile_required", "Enter your billing details before subscribing.")
+		return
+	}
+
+	err = app.subscribe(*user, plan, profile)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.errorJSON(w, http.StatusInternalServerError, "internal_error", "Error subscribing to plan.")
+		return
+	}
+
+	app.audit(r, data.AuditSubscribed, "plan", plan.ID, map[string]any{"plan_name": plan.PlanName})
+
+	sub, err = app.Models.Subscription.GetByUserID(user.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.errorJSON(w, http.StatusInternalServerError, "internal_error", "Error getting subscription.")
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, apiResponse{Data: toAPISubscription(sub)})
+}
+
+// APICancelSubscription cancels the user's subscription with immediate effect
+func (app *Config) APICancelSubscription(w http.ResponseWriter, r *http.Request) {
+	user := app.apiUser(r)
+
+	sub, err := app.Models.Subscription.GetByUserID(user.ID)
+	if err != nil || sub.Status == data.SubscriptionCancelled {
+		app.errorJSON(w, http.StatusNotFound, "not_found", "You have no subscription to cancel.")
+		return
+	}
+
+	err = sub.Cancel()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.errorJSON(w, http.StatusInternalServerError, "internal_error", "Error cancelling subscription.")
+		return
+	}
+	sub.Status = data.SubscriptionCancelled
+	app.audit(r, data.AuditCancelled, "plan", sub.PlanID, nil)
+
+	plan, err := app.Models.Plan.GetOne(sub.PlanID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	} else {
+		app.Events.Publish(subscriptionCancelled{User: *user, Plan: plan})
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, apiResponse{Data: toAPISubscription(sub)})
+}
+
+func (app *Config) APIListInvoices(w http.ResponseWriter, r *http.Request) {
+	page, perPage, err := readPagination(r)
+	if err != nil {
+		app.errorJSON(w, http.StatusBadRequest, "invalid_pagination", err.Error())
+		return
+	}
+
+	invoices, total, err := app.Models.Invoice.GetPageForUser(app.apiUser(r).ID, perPage, (page-1)*perPage)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.errorJSON(w, http.StatusInternalServerError, "internal_error", "Unable to load invoices.")
+		return
+	}
+
+	out := make([]apiInvoice, 0, len(invoices))
+	for _, invoice := range invoices {
+		out = append(out, toAPIInvoice(invoice))
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, apiResponse{Data: out, Meta: newAPIMeta(page, perPage, total)})
+}
+
+// APINotFound and APIMethodNotAllowed keep unmatched API requests in the JSON envelope
+func (app *Config) APINotFound(w http.ResponseWriter, r *http.Request) {
+	app.errorJSON(w, http.StatusNotFound, "not_found", "No such endpoint.")
+}
+
+func (app *Config) APIMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	app.errorJSON(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed.")
+}
+
+// errorJSON writes an error response in the API's error envelope
+func (app *Config) errorJSON(w http.ResponseWriter, status int, code, message string) {
+	err := app.writeJSON(w, status, apiError{Error: apiErrorBody{Code: code, Message: message}})
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+}
+
+func (app *Config) toAPIPlan(plan *data.Plan) apiPlan {
+	out := apiPlan{
+		ID:              plan.ID,
+		Name:            plan.PlanName,
+		Amount:          plan.PlanAmount,
+		AmountFormatted: plan.AmountForDisplay(),
+		Features:        []apiFeature{},
+	}
+
+	entitlements, err := app.Models.Entitlement.GetAllForPlan(plan.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+	for _, x := range entitlements {
+		feature := apiFeature{Feature: x.Feature}
+		if x.Limited {
+			feature.Limit = &x.Limit
+		}
+		out.Features = append(out.Features, feature)
+	}
+
+	return out
+}
+
+func toAPISubscription(sub *data.Subscription) *apiSubscription {
+	out := &apiSubscription{
+		PlanID:           sub.PlanID,
+		Status:           sub.Status,
+		CurrentPeriodEnd: sub.CurrentPeriodEnd,
+	}
+	if sub.IsPastDue() {
+		out.PastDueSince = &sub.PastDueSince
+	}
+
+	return out
+}
+
+func toAPIInvoice(invoice *data.Invoice) apiInvoice {
+	out := apiInvoice{
+		ID:              invoice.ID,
+		Number:          invoice.Number(),
+		PlanName:        invoice.PlanName,
+		Amount:          invoice.Amount,
+		AmountFormatted: invoice.AmountForDisplay(),
+		AmountPaid:      invoice.AmountPaid,
+		AmountRefunded:  invoice.AmountRefunded,
+		IssuedAt:        invoice.IssuedAt,
+	}
+	if invoice.IsPaid() {
+		out.PaidAt = &invoice.PaidAt
+	}
+
+	return out
+}
+
+func toAPIUser(user *data.User) apiUser {
+	return apiUser{
+		ID:        user.ID,
+		Email:     user.Email,
+		FirstName: user.FirstName,
+		LastName:  user.LastName,
+		CreatedAt: user.CreatedAt,
+	}
+}
+
+// readPagination reads the page and per_page query parameters
+func readPagination(r *http.Request) (int, int, error) {
+	page, perPage := 1, defaultPerPage
+	var err error
+
+	if x := r.URL.Query().Get("page"); x != "" {
+		page, err = strconv.Atoi(x)
+		if err != nil || page < 1 || page > maxPage {
+			return 0, 0, fmt.Errorf("page must be between 1 and %d", maxPage)
+		}
+	}
+
+	if x := r.URL.Query().Get("per_page"); x != "" {
+		perPage, err = strconv.Atoi(x)
+		if err != nil || perPage < 1 || perPage > maxPerPage {
+			return 0, 0, fmt.Errorf("per_page must be between 1 and %d", maxPerPage)
+		}
+	}
+
+	return page, perPage, nil
+}
+
+func newAPIMeta(page, perPage, total int) *apiMeta {
+	return &apiMeta{
+		Page:       page,
+		PerPage:    perPage,
+		Total:      total,
+		TotalPages: int(math.Ceil(float64(total) / float64(perPage))),
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestReadPagination(t *testing.T) {
+	tests := []struct {
+		name        string
+		query       string
+		wantPage    int
+		wantPerPage int
+		wantErr     bool
+	}{
+		{"defaults", "", 1, defaultPerPage, false},
+		{"page", "page=3", 3, defaultPerPage, false},
+		{"per page", "per_page=50", 1, 50, false},
+		{"both", "page=2&per_page=100", 2, 100, false},
+		{"last page", "page=" + strconv.Itoa(maxPage), maxPage, defaultPerPage, false},
+		{"page zero", "page=0", 0, 0, true},
+		{"negative page", "page=-1", 0, 0, true},
+		{"page past the last", "page=" + strconv.Itoa(maxPage+1), 0, 0, true},
+		{"page which overflows the offset", "page=4611686018427387904", 0, 0, true},
+		{"page out of int range", "page=99999999999999999999", 0, 0, true},
+		{"page not a number", "page=two", 0, 0, true},
+		{"per page zero", "per_page=0", 0, 0, true},
+		{"per page too large", "per_page=101", 0, 0, true},
+		{"per page not a number", "per_page=all", 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/api/v1/invoices?"+tt.query, nil)
+
+			page, perPage, err := readPagination(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("readPagination(%q) = %d, %d, want an error", tt.query, page, perPage)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readPagination(%q): %v", tt.query, err)
+			}
+			if page != tt.wantPage || perPage != tt.wantPerPage {
+				t.Errorf("readPagination(%q) = %d, %d, want %d, %d", tt.query, page, perPage, tt.wantPage, tt.wantPerPage)
+			}
+
+			// the offset of any page it lets through must be a valid one
+			if offset := (page - 1) * perPage; offset < 0 {
+				t.Errorf("readPagination(%q) allows offset %d", tt.query, offset)
+			}
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"subscription-service/data"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+// testApp returns an app on the fake database, with sessions kept in memory
+func testApp(t *testing.T, database *fakeDatabase) *Config {
+	t.Helper()
+
+	return &Config{
+		Session:  scs.New(),
+		InfoLog:  log.New(io.Discard, "", 0),
+		ErrorLog: log.New(io.Discard, "", 0),
+		Models:   data.New(database.open(t)),
+	}
+}
+
+// withSession gives a request a new, empty session, so a handler can be called
+// without the session middleware and what it put in the session read afterwards
+func withSession(t *testing.T, app *Config, r *http.Request) *http.Request {
+	t.Helper()
+
+	ctx, err := app.Session.Load(r.Context(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return r.WithContext(ctx)
+}
+
+// testSigner signs URLs with a random key, as main does without URL_SIGNING_KEY
+func testSigner(t *testing.T) {
+	t.Helper()
+
+	err := NewURLSigner("")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// userRows answers the queries of data.User.GetOne and GetByEmail with user, and
+// finds nothing else
+func userRows(user data.User) func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+	return func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		byID := strings.Contains(query, "from users where id = $1") && args[0] == int64(user.ID)
+		byEmail := strings.Contains(query, "from users where lower(email) = lower($1)") && strings.EqualFold(args[0].(string), user.Email)
+		if !byID && !byEmail {
+			return nil, nil
+		}
+
+		return []string{"id", "email", "first_name", "last_name", "password", "user_active", "is_admin", "created_at", "updated_at"},
+			[][]driver.Value{{int64(user.ID), user.Email, user.FirstName, user.LastName, user.Password,
+				int64(user.Active), int64(user.IsAdmin), user.CreatedAt, user.UpdatedAt}}
+	}
+}
+
+// noRedis is a Redis pool which can't connect, so rate limits let everything through
+var noRedis = &redis.Pool{
+	Dial: func() (redis.Conn, error) {
+		return nil, errors.New("connection refused")
+	},
+}
+
+// apiTokenRows answers the lookup of an API token of user, along with the queries
+// of userRows; the user has no subscription
+func apiTokenRows(user data.User, scopes string) func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+	users := userRows(user)
+
+	return func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		if strings.HasPrefix(query, "update api_tokens set last_used_at") {
+			return []string{"id", "user_id", "name", "scopes", "last_used_at", "created_at", "updated_at"},
+				[][]driver.Value{{int64(1), int64(user.ID), "cli", scopes, time.Now(), time.Now(), time.Now()}}
+		}
+
+		return users(query, args)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"subscription-service/data"
+	"time"
+)
+
+const (
+	auditLogPerPage = 50
+	// auditExportTimeout bounds the query of a CSV export, which may be much larger
+	// than a page
+	auditExportTimeout = time.Minute
+)
+
+// audit records an action taken in a request. The actor is the user authenticated by
+// an API token, or else the logged in user, if any.
+func (app *Config) audit(r *http.Request, action, targetType string, targetID any, metadata map[string]any) {
+	entry := data.AuditLog{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   auditTargetID(targetID),
+		IP:         clientIP(r),
+		UserAgent:  r.UserAgent(),
+		Metadata:   metadata,
+	}
+
+	if user := app.apiUser(r); user != nil {
+		entry.ActorID = user.ID
+		entry.ActorEmail = user.Email
+	} else if user := app.currentUser(r); user != nil {
+		entry.ActorID = user.ID
+		entry.ActorEmail = user.Email
+	}
+
+	app.recordAudit(entry)
+}
+
+// auditSystem records an action taken by the application itself, such as
+// cancelling a subscription which could not be charged
+func (app *Config) auditSystem(action, targetType string, targetID any, metadata map[string]any) {
+	app.recordAudit(data.AuditLog{
+		Action:     action,
+		TargetType: targetType,
+		TargetID:   auditTargetID(targetID),
+		Metadata:   metadata,
+	})
+}
+
+func (app *Config) recordAudit(entry data.AuditLog) {
+	err := app.Models.AuditLog.Insert(entry)
+	if err != nil {
+		app.ErrorLog.Printf("writing audit log entry %s: %v", entry.Action, err)
+	}
+}
+
+func auditTargetID(id any) string {
+	if id == nil {
+		return ""
+	}
+
+	return fmt.Sprint(id)
+}
+
+// clientIP returns the IP address the request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+func (app *Config) AdminAuditLogPage(w http.ResponseWriter, r *http.Request) {
+	filter, values, err := readAuditLogFilter(r)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", err.Error())
+		http.Redirect(w, r, "/admin/audit-log", http.StatusSeeOther)
+		return
+	}
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	entries, total, err := app.Models.AuditLog.GetPage(filter, auditLogPerPage, (page-1)*auditLogPerPage)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Error(w, "Unable to load the audit log", http.StatusInternalServerError)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["entries"] = entries
+	dataMap["actions"] = data.AuditActions
+	dataMap["filter"] = values
+	// the filters are already encoded, so they mustn't be escaped again
+	dataMap["query"] = template.URL(values.Encode())
+	dataMap["total"] = total
+	dataMap["page"] = page
+	if page > 1 {
+		dataMap["previousPage"] = page - 1
+	}
+	if page*auditLogPerPage < total {
+		dataMap["nextPage"] = page + 1
+	}
+
+	app.render(w, r, "admin-audit-log.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// AdminExportAuditLog downloads every entry matching the filters as CSV
+func (app *Config) AdminExportAuditLog(w http.ResponseWriter, r *http.Request) {
+	filter, _, err := readAuditLogFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), auditExportTimeout)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="audit-log-%s.csv"`, time.Now().Format("20060102-150405")))
+
+	out := csv.NewWriter(w)
+	_ = out.Write([]string{"id", "created_at", "actor_id", "actor_email", "action", "target_type", "target_id", "ip", "user_agent", "metadata"})
+
+	err = app.Models.AuditLog.ForEach(ctx, filter, func(entry *data.AuditLog) error {
+		actorID := ""
+		if entry.ActorID > 0 {
+			actorID = strconv.Itoa(entry.ActorID)
+		}
+
+		return out.Write([]string{
+			strconv.Itoa(entry.ID),
+			entry.CreatedAt.UTC().Format(time.RFC3339),
+			actorID,
+			csvSafe(entry.ActorEmail),
+			entry.Action,
+			entry.TargetType,
+			csvSafe(entry.TargetID),
+			entry.IP,
+			csvSafe(entry.UserAgent),
+			csvSafe(entry.MetadataJSON()),
+		})
+	})
+	out.Flush()
+
+	if err != nil {
+		// the headers are gone by now, so all we can do is log it
+		app.ErrorLog.Println("exporting audit log:", err)
+	}
+}
+
+// readAuditLogFilter reads the filters of the audit log viewer from the query
+// string. It also returns the filters which were set, to put back in links.
+func readAuditLogFilter(r *http.Request) (data.AuditLogFilter, url.Values, error) {
+	query := r.URL.Query()
+	values := url.Values{}
+
+	filter := data.AuditLogFilter{
+		Action:     strings.TrimSpace(query.Get("action")),
+		Actor:      strings.TrimSpace(query.Get("actor")),
+		TargetType: strings.TrimSpace(query.Get("target-type")),
+		TargetID:   strings.TrimSpace(query.Get("target-id")),
+	}
+
+	for key, value := range map[string]string{
+		"action":      filter.Action,
+		"actor":       filter.Actor,
+		"target-type": filter.TargetType,
+		"target-id":   filter.TargetID,
+	} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+
+	if x := query.Get("from"); x != "" {
+		from, err := time.Parse("2006-01-02", x)
+		if err != nil {
+			return filter, nil, fmt.Errorf("invalid from date %q", x)
+		}
+		filter.From = from
+		values.Set("from", x)
+	}
+
+	if x := query.Get("to"); x != "" {
+		to, err := time.Parse("2006-01-02", x)
+		if err != nil {
+			return filter, nil, fmt.Errorf("invalid to date %q", x)
+		}
+		// the to date is inclusive
+		filter.To = to.AddDate(0, 0, 1)
+		values.Set("to", x)
+	}
+
+	return filter, values, nil
+}
+
+// csvSafe stops spreadsheet applications from reading user controlled values as
+// formulas when the export is opened
+func csvSafe(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+
+	return s
+}
@@ -4,19 +4,37 @@ import (
 	"database/sql"
 	"log"
 	"subscription-service/data"
+	"subscription-service/oidc"
+	"subscription-service/passwords"
 	"sync"
 
 	"github.com/alexedwards/scs/v2"
+	"github.com/gomodule/redigo/redis"
 )
 
 type Config struct {
-	Session       *scs.SessionManager
-	DB            *sql.DB
-	InfoLog       *log.Logger
-	ErrorLog      *log.Logger
-	Wait          *sync.WaitGroup
-	Models        data.Models
-	Mailer        Mail
-	ErrorChan     chan error
-	ErrorChanDone chan bool
+	Session  *scs.SessionManager
+	DB       *sql.DB
+	Redis    *redis.Pool
+	InfoLog  *log.Logger
+	ErrorLog *log.Logger
+	Wait     *sync.WaitGroup
+	Models   data.Models
+	Mailer   Mail
+	Payments PaymentProvider
+	// PasswordPolicy is checked whenever a user chooses a password
+	PasswordPolicy passwords.Policy
+	// OIDC is the identity provider users can log in with, or nil if there is none
+	OIDC *oidc.Provider
+	// OIDCName is the name of the identity provider shown on the login page
+	OIDCName string
+	Events   *EventBus
+	// InternalAPIKey authenticates other services on the /internal endpoints
+	InternalAPIKey string
+	ErrorChan      chan error
+	ErrorChanDone  chan bool
+	RenewalsDone   chan bool
+	// WebhookNudge wakes up webhook delivery when events are queued
+	WebhookNudge chan bool
+	WebhooksDone chan bool
 }
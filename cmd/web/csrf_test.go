@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestVerifyCSRF(t *testing.T) {
+	// {token} in what is sent stands for the token of the session
+	const other = "x2eQ0H5-WWmT9QJ3pJ2hYk0H7Hc2n4V_f3b4d6mU6yk"
+
+	tests := []struct {
+		name   string
+		method string
+		// field and header are the tokens sent in the form and the header
+		field  string
+		header string
+		// noToken leaves the session without a token, as before any form was rendered
+		noToken    bool
+		wantStatus int
+	}{
+		{"get without a token", http.MethodGet, "", "", false, http.StatusOK},
+		{"head without a token", http.MethodHead, "", "", false, http.StatusOK},
+		{"options without a token", http.MethodOptions, "", "", false, http.StatusOK},
+		{"post without a token", http.MethodPost, "", "", false, http.StatusForbidden},
+		{"post with a wrong token", http.MethodPost, other, "", false, http.StatusForbidden},
+		{"post with the token and more", http.MethodPost, "{token}x", "", false, http.StatusForbidden},
+		{"post with the token", http.MethodPost, "{token}", "", false, http.StatusOK},
+		{"post with the token in the header", http.MethodPost, "", "{token}", false, http.StatusOK},
+		{"post with a wrong token in the header", http.MethodPost, "{token}", other, false, http.StatusForbidden},
+		{"delete without a token", http.MethodDelete, "", "", false, http.StatusForbidden},
+		{"delete with the token in the header", http.MethodDelete, "", "{token}", false, http.StatusOK},
+		{"post to a session without a token", http.MethodPost, "", "", true, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := testApp(t, &fakeDatabase{})
+
+			// render a form, as a page would
+			page := withSession(t, app, httptest.NewRequest(http.MethodGet, "/members/profile", nil))
+			var token string
+			if !tt.noToken {
+				token = app.csrfToken(page)
+			}
+
+			form := url.Values{}
+			if tt.field != "" {
+				form.Set(csrfField, strings.ReplaceAll(tt.field, "{token}", token))
+			}
+
+			r := httptest.NewRequest(tt.method, "/members/profile", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.header != "" {
+				r.Header.Set(csrfHeader, strings.ReplaceAll(tt.header, "{token}", token))
+			}
+			r = r.WithContext(page.Context())
+
+			var reached bool
+			next := http.HandlerFunc(func(http.ResponseWriter, *http.Request) { reached = true })
+
+			w := httptest.NewRecorder()
+			app.VerifyCSRF(next).ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if reached != (tt.wantStatus == http.StatusOK) {
+				t.Errorf("handler reached: %v", reached)
+			}
+		})
+	}
+}
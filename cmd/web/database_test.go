@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDatabase is a database/sql connector standing in for Postgres. Unless a test
+// says otherwise, every query returns no rows and every statement changes one. It
+// records the statements, so a test can tell what was looked up or written.
+type fakeDatabase struct {
+	mu         sync.Mutex
+	statements []string
+
+	// rows, if set, answers the queries it knows, returning its columns and rows;
+	// nil columns means no rows
+	rows func(query string, args []driver.Value) ([]string, [][]driver.Value)
+	// exec, if set, tells how many rows a statement changes
+	exec func(query string, args []driver.Value) int64
+	// err, if set, fails every statement, as when the database is down
+	err error
+}
+
+// open returns a *sql.DB on the fake database, closed when the test ends
+func (d *fakeDatabase) open(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db := sql.OpenDB(d)
+	t.Cleanup(func() { _ = db.Close() })
+
+	return db
+}
+
+func (d *fakeDatabase) Connect(context.Context) (driver.Conn, error) { return fakeConn{d}, nil }
+func (d *fakeDatabase) Driver() driver.Driver                        { return nil }
+
+// record keeps a statement, with its white space collapsed
+func (d *fakeDatabase) record(query string) string {
+	query = strings.Join(strings.Fields(query), " ")
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.statements = append(d.statements, query)
+
+	return query
+}
+
+// ran reports whether a statement containing s was run
+func (d *fakeDatabase) ran(s string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, statement := range d.statements {
+		if strings.Contains(statement, s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+type fakeConn struct{ db *fakeDatabase }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.db, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+type fakeStmt struct {
+	db    *fakeDatabase
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	query := s.db.record(s.query)
+
+	if s.db.err != nil {
+		return nil, s.db.err
+	}
+	if s.db.exec != nil {
+		return driver.RowsAffected(s.db.exec(query, args)), nil
+	}
+
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	query := s.db.record(s.query)
+
+	if s.db.err != nil {
+		return nil, s.db.err
+	}
+	if s.db.rows != nil {
+		columns, rows := s.db.rows(query, args)
+		return &fakeRows{columns: columns, rows: rows}, nil
+	}
+
+	return &fakeRows{}, nil
+}
+
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+
+	return nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"subscription-service/data"
+	"time"
+)
+
+// renewalInterval is how often subscriptions are checked for renewals and for
+// dunning retries which have come due
+const renewalInterval = time.Hour
+
+// listenForRenewals renews subscriptions at the end of their billing period and
+// works through the dunning schedule of those whose renewal charge failed
+func (app *Config) listenForRenewals() {
+	ticker := time.NewTicker(renewalInterval)
+	defer ticker.Stop()
+
+	app.processRenewals()
+
+	for {
+		select {
+		case <-ticker.C:
+			app.processRenewals()
+		case <-app.RenewalsDone:
+			return
+		}
+	}
+}
+
+func (app *Config) processRenewals() {
+	now := time.Now()
+
+	due, err := app.Models.Subscription.GetDueForRenewal(now)
+	if err != nil {
+		app.ErrorLog.Println("getting subscriptions due for renewal:", err)
+	}
+	for _, sub := range due {
+		app.renewSubscription(sub)
+	}
+
+	pastDue, err := app.Models.Subscription.GetPastDue()
+	if err != nil {
+		app.ErrorLog.Println("getting past due subscriptions:", err)
+	}
+	for _, sub := range pastDue {
+		app.runDunningStep(sub, now)
+	}
+}
+
+// renewSubscription invoices the next billing period and charges it. If the charge
+// fails the subscription becomes past due and the dunning schedule starts.
+//
+// There is one renewal invoice per subscription and period, so a renewal which
+// failed part way is picked up again on the next run without charging twice. A
+// subscription whose period ended long ago is billed once, and its next period
+// starts from when it was billed.
+func (app *Config) renewSubscription(sub *data.Subscription) {
+	user, plan, err := app.subscriptionDetails(sub)
+	if err != nil {
+		app.ErrorLog.Printf("renewing subscription of user %d: %v", sub.UserID, err)
+		return
+	}
+
+	invoice, err := app.Models.Invoice.GetRenewal(user.ID, sub.CurrentPeriodEnd)
+	if errors.Is(err, sql.ErrNoRows) {
+		invoice, err = app.issueRenewal(sub, *user, plan)
+	}
+	if err != nil {
+		app.ErrorLog.Printf("invoicing renewal of user %d: %v", sub.UserID, err)
+		return
+	}
+
+	// an earlier run may have been paid and then failed to renew
+	if invoice.IsPaid() || app.collectPayment(invoice) {
+		err = sub.Renew(invoice.ID, renewedUntil(sub, invoice))
+		if err != nil {
+			app.ErrorLog.Printf("renewing subscription of user %d: %v", sub.UserID, err)
+			return
+		}
+		app.Events.Publish(invoicePaid{User: *user, Invoice: *invoice})
+		return
+	}
+
+	err = sub.MarkPastDue(invoice.ID)
+	if err != nil {
+		app.ErrorLog.Printf("marking subscription of user %d past due: %v", sub.UserID, err)
+		return
+	}
+	sub.PastDueSince = time.Now()
+
+	app.sendEmail(app.dunningMessage(*user, plan, invoice, sub, 0))
+}
+
+// issueRenewal issues the invoice for the billing period which starts where the
+// current one of the subscription ends. Usage is billed in arrears, up to the
+// time the invoice is issued.
+func (app *Config) issueRenewal(sub *data.Subscription, user data.User, plan *data.Plan) (*data.Invoice, error) {
+	profile, err := app.Models.BillingProfile.GetByUserID(user.ID)
+	if err != nil {
+		profile = &data.BillingProfile{UserID: user.ID}
+	}
+
+	billedUntil := sub.CurrentPeriodEnd
+	if now := time.Now(); now.After(billedUntil) {
+		billedUntil = now
+	}
+
+	usage, err := app.usageLineItems(user.ID, plan.ID, sub.CurrentPeriodEnd.AddDate(0, -1, 0), billedUntil)
+	if err != nil {
+		return nil, fmt.Errorf("pricing usage: %w", err)
+	}
+
+	return app.getInvoice(user, plan, profile, sub.CurrentPeriodEnd, usage...)
+}
+
+// renewedUntil returns the end of the billing period a renewal invoice pays for:
+// a month after the old period ended, or after the invoice was issued if that
+// was later
+func renewedUntil(sub *data.Subscription, invoice *data.Invoice) time.Time {
+	start := sub.CurrentPeriodEnd
+	if invoice.IssuedAt.After(start) {
+		start = invoice.IssuedAt
+	}
+
+	return start.AddDate(0, 1, 0)
+}
+
+// runDunningStep retries the charge of a past due subscription once the next day of
+// the plan's dunning schedule has been reached. Every failed retry sends a sterner
+// reminder, and the subscription is cancelled when the schedule runs out.
+func (app *Config) runDunningStep(sub *data.Subscription, now time.Time) {
+	user, plan, err := app.subscriptionDetails(sub)
+	if err != nil {
+		app.ErrorLog.Printf("dunning subscription of user %d: %v", sub.UserID, err)
+		return
+	}
+
+	schedule := plan.DunningSchedule
+	if sub.DunningStep >= len(schedule) {
+		app.cancelPastDue(sub, *user, plan)
+		return
+	}
+
+	if now.Before(sub.PastDueSince.AddDate(0, 0, schedule[sub.DunningStep])) {
+		return
+	}
+
+	invoice, err := app.Models.Invoice.GetOne(sub.LastInvoiceID)
+	if err != nil {
+		app.ErrorLog.Printf("getting past due invoice of user %d: %v", sub.UserID, err)
+		return
+	}
+
+	if app.settlePastDue(sub, *user, invoice) {
+		return
+	}
+
+	step := sub.DunningStep + 1
+	err = sub.SetDunningStep(step)
+	if err != nil {
+		app.ErrorLog.Printf("advancing dunning of user %d: %v", sub.UserID, err)
+		return
+	}
+	sub.DunningStep = step
+
+	if step >= len(schedule) {
+		app.cancelPastDue(sub, *user, plan)
+		return
+	}
+
+	app.sendEmail(app.dunningMessage(*user, plan, invoice, sub, step))
+}
+
+// settlePastDue retries the charge of the unpaid invoice of a past due subscription,
+// and reactivates the subscription if it goes through
+func (app *Config) settlePastDue(sub *data.Subscription, user data.User, invoice *data.Invoice) bool {
+	// an earlier retry may have been paid and then failed to reactivate
+	if !invoice.IsPaid() && !app.collectPayment(invoice) {
+		return false
+	}
+
+	err := sub.Renew(invoice.ID, time.Now().AddDate(0, 1, 0))
+	if err != nil {
+		app.ErrorLog.Printf("reactivating subscription of user %d: %v", sub.UserID, err)
+		return true
+	}
+
+	app.Events.Publish(invoicePaid{User: user, Invoice: *invoice})
+
+	return true
+}
+
+func (app *Config) cancelPastDue(sub *data.Subscription, user data.User, plan *data.Plan) {
+	err := sub.Cancel()
+	if err != nil {
+		app.ErrorLog.Printf("cancelling subscription of user %d: %v", sub.UserID, err)
+		return
+	}
+
+	app.auditSystem(data.AuditCancelled, "plan", plan.ID, map[string]any{"user_id": user.ID, "reason": "unpaid invoice"})
+	app.Events.Publish(subscriptionCancelled{User: user, Plan: plan})
+
+	app.sendEmail(Message{
+		To:       user.Email,
+		Subject:  fmt.Sprintf("Your %s subscription has been cancelled", plan.PlanName),
+		Template: "dunning",
+		Data:     plan.PlanName,
+		DataMap: map[string]any{
+			"plan":      plan,
+			"cancelled": true,
+		},
+	})
+}
+
+// collectPayment charges the invoice through the payment provider and records the payment
+func (app *Config) collectPayment(invoice *data.Invoice) bool {
+	reference, err := app.Payments.Charge(invoice)
+	if err != nil {
+		app.ErrorLog.Println("charging invoice", invoice.Number(), err)
+		return false
+	}
+
+	err = invoice.MarkPaid(reference)
+	if err != nil {
+		app.ErrorLog.Printf("payment %s for invoice %s was not recorded: %v", reference, invoice.Number(), err)
+	}
+	invoice.AmountPaid = invoice.Amount
+	invoice.PaymentReference = reference
+
+	return true
+}
+
+func (app *Config) subscriptionDetails(sub *data.Subscription) (*data.User, *data.Plan, error) {
+	user, err := app.Models.User.GetOne(sub.UserID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plan, err := app.Models.Plan.GetOne(sub.PlanID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return user, plan, nil
+}
+
+// dunningMessage builds the reminder sent after the step'th failed retry of a past
+// due invoice; step 0 is the failed renewal itself
+func (app *Config) dunningMessage(user data.User, plan *data.Plan, invoice *data.Invoice, sub *data.Subscription, step int) Message {
+	schedule := plan.DunningSchedule
+	final := step >= len(schedule)-1
+
+	var subject string
+	switch {
+	case final:
+		subject = fmt.Sprintf("Final notice: your %s subscription will be cancelled", plan.PlanName)
+	case step == 0:
+		subject = fmt.Sprintf("Payment failed for your %s subscription", plan.PlanName)
+	default:
+		subject = fmt.Sprintf("Reminder: payment for your %s subscription is overdue", plan.PlanName)
+	}
+
+	var nextRetry time.Time
+	if step < len(schedule) {
+		nextRetry = sub.PastDueSince.AddDate(0, 0, schedule[step])
+	}
+
+	return Message{
+		To:       user.Email,
+		Subject:  subject,
+		Template: "dunning",
+		Data:     invoice.AmountForDisplay(),
+		DataMap: map[string]any{
+			"plan":      plan,
+			"invoice":   invoice,
+			"step":      step,
+			"final":     final,
+			"nextRetry": nextRetry,
+		},
+	}
+}
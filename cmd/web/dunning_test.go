@@ -0,0 +1,34 @@
+package main
+
+import (
+	"subscription-service/data"
+	"testing"
+	"time"
+)
+
+func TestRenewedUntil(t *testing.T) {
+	periodEnd := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		issuedAt time.Time
+		want     time.Time
+	}{
+		{"issued when the period ended", periodEnd, time.Date(2024, 4, 10, 12, 0, 0, 0, time.UTC)},
+		{"issued in the hour after", periodEnd.Add(time.Hour), time.Date(2024, 4, 10, 13, 0, 0, 0, time.UTC)},
+		{"issued before the period ended", periodEnd.Add(-time.Hour), time.Date(2024, 4, 10, 12, 0, 0, 0, time.UTC)},
+		{"fallen months behind", time.Date(2024, 9, 2, 8, 0, 0, 0, time.UTC), time.Date(2024, 10, 2, 8, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sub := &data.Subscription{CurrentPeriodEnd: periodEnd}
+			invoice := &data.Invoice{IssuedAt: tt.issuedAt}
+
+			got := renewedUntil(sub, invoice)
+			if !got.Equal(tt.want) {
+				t.Errorf("renewedUntil = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"subscription-service/data"
+	"subscription-service/forms"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Email change links. The confirm link sent to the new address and the revert
+// link sent to the old one each hold a random token; Redis keeps only the hash of
+// the token, with the change it makes. Following a link takes its token out of
+// Redis, so each link works once, and the revert link takes out the confirm
+// link's token too.
+const (
+	// emailChangeMinutes is how long the confirmation link sent to a new address works
+	emailChangeMinutes = 60 * 24
+	// emailRevertMinutes is how long the revert link sent to the old address works
+	emailRevertMinutes = 60 * 24 * 7
+
+	emailChangeConfirm = "confirm"
+	emailChangeRevert  = "revert"
+)
+
+// emailChange is what is kept in Redis for a confirm or revert link which hasn't
+// been used
+type emailChange struct {
+	UserID int    `json:"user_id"`
+	From   string `json:"from"`
+	To     string `json:"to"`
+	// Confirm is the key of the confirm link a revert link stops from working
+	Confirm string `json:"confirm,omitempty"`
+}
+
+// emailChangeKey is where the change a confirm or revert link makes is kept
+func emailChangeKey(kind, token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return "email-change:" + kind + ":" + hex.EncodeToString(hash[:])
+}
+
+func (app *Config) ChangeEmailPage(w http.ResponseWriter, r *http.Request) {
+	app.render(w, r, "email.page.gohtml", nil)
+}
+
+// PostChangeEmailPage starts changing the email address of the logged in user. The
+// address isn't changed until the user follows the link sent to the new one; the
+// old one gets a notice with a link to undo the change.
+func (app *Config) PostChangeEmailPage(w http.ResponseWriter, r *http.Request) {
+	user := app.currentUser(r)
+	if user == nil {
+		app.Session.Put(r.Context(), "error", "Log in first!")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email", "password")
+	form.IsEmail("email")
+	form.MaxLength("email", 255)
+
+	newEmail := strings.TrimSpace(form.Get("email"))
+	form.Check(!strings.EqualFold(newEmail, user.Email), "email", "This is already your email address")
+
+	err = form.Unique("email", "An account with this email address already exists", app.emailTaken)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to change email address.")
+		http.Redirect(w, r, "/members/email", http.StatusSeeOther)
+		return
+	}
+
+	if form.Has("password") {
+		matches, err := user.PasswordMatches(form.Get("password"))
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+		form.Check(matches, "password", "Your password is not right")
+	}
+
+	if !form.Valid() {
+		form.Del("password")
+
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		app.render(w, r, "email.page.gohtml", &TemplateData{
+			Form:  form,
+			Error: "Please correct the errors below.",
+		})
+		return
+	}
+
+	confirmURL, revertURL, err := app.startEmailChange(user.ID, user.Email, newEmail)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to change email address.")
+		http.Redirect(w, r, "/members/email", http.StatusSeeOther)
+		return
+	}
+
+	app.sendEmail(Message{
+		To:       newEmail,
+		Subject:  "Confirm your new email address",
+		Template: "email-change",
+		DataMap: map[string]any{
+			"oldEmail": user.Email,
+			"newEmail": newEmail,
+			"link":     template.HTML(confirmURL),
+		},
+	})
+
+	app.sendEmail(Message{
+		To:       user.Email,
+		Subject:  "Your email address is being changed",
+		Template: "email-change",
+		DataMap: map[string]any{
+			"notice":   true,
+			"oldEmail": user.Email,
+			"newEmail": newEmail,
+			"link":     template.HTML(revertURL),
+		},
+	})
+
+	app.audit(r, data.AuditEmailChangeStarted, "user", user.ID, map[string]any{"from": user.Email, "to": newEmail})
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("We've sent a link to %s. Follow it to confirm your new email address.", newEmail))
+	http.Redirect(w, r, "/members/email", http.StatusSeeOther)
+}
+
+// ConfirmEmailChange changes a user's email address, when they follow the link
+// sent to the new one. The link works once, and only while the account still has
+// the address it was sent from and the change hasn't been undone from the old one.
+func (app *Config) ConfirmEmailChange(w http.ResponseWriter, r *http.Request) {
+	change, err := app.takeEmailChange(r, emailChangeConfirm, emailChangeMinutes)
+	if err != nil {
+		if !errors.Is(err, redis.ErrNil) {
+			app.ErrorLog.Println(err)
+		}
+		app.Session.Put(r.Context(), "error", "Invalid or expired confirmation link.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(change.UserID)
+	if err != nil || !strings.EqualFold(user.Email, change.From) {
+		app.Session.Put(r.Context(), "error", "Invalid or expired confirmation link.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	err = user.UpdateEmail(change.To)
+	if errors.Is(err, data.ErrEmailTaken) {
+		app.Session.Put(r.Context(), "error", "Another account already uses that email address.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to change email address.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, data.AuditEmailChanged, "user", user.ID, map[string]any{"from": change.From, "to": change.To})
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("Your email address is now %s", change.To))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// RevertEmailChange undoes a change of email address, when the owner of the old
+// address follows the link in the notice sent to it. If the change hasn't been
+// confirmed yet, it is cancelled instead.
+func (app *Config) RevertEmailChange(w http.ResponseWriter, r *http.Request) {
+	change, err := app.takeEmailChange(r, emailChangeRevert, emailRevertMinutes)
+	if err != nil {
+		if !errors.Is(err, redis.ErrNil) {
+			app.ErrorLog.Println(err)
+		}
+		app.Session.Put(r.Context(), "error", "Invalid or expired link.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	// stop the confirmation link from working, in case it hasn't been used yet
+	app.cancelEmailChange(change.Confirm)
+
+	user, err := app.Models.User.GetOne(change.UserID)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "Invalid or expired link.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if strings.EqualFold(user.Email, change.From) {
+		err = user.UpdateEmail(change.To)
+		if err != nil {
+			app.ErrorLog.Println(err)
+			app.Session.Put(r.Context(), "error", "Unable to restore your email address.")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		app.audit(r, data.AuditEmailReverted, "user", user.ID, map[string]any{"from": change.From, "to": change.To})
+	}
+
+	app.Session.Put(r.Context(), "warning", fmt.Sprintf("Your email address is %s. If you didn't ask to change it, change your password now.", user.Email))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// startEmailChange saves the confirm and revert links for changing a user's email
+// address from one address to another, and returns them
+func (app *Config) startEmailChange(userID int, from, to string) (string, string, error) {
+	confirmToken, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	revertToken, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+
+	confirm, err := json.Marshal(emailChange{UserID: userID, From: from, To: to})
+	if err != nil {
+		return "", "", err
+	}
+
+	revert, err := json.Marshal(emailChange{
+		UserID:  userID,
+		From:    to,
+		To:      from,
+		Confirm: emailChangeKey(emailChangeConfirm, confirmToken),
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	expiry := time.Duration(emailChangeMinutes) * time.Minute
+	_, err = conn.Do("SET", emailChangeKey(emailChangeConfirm, confirmToken), confirm, "PX", expiry.Milliseconds())
+	if err != nil {
+		return "", "", err
+	}
+
+	expiry = time.Duration(emailRevertMinutes) * time.Minute
+	_, err = conn.Do("SET", emailChangeKey(emailChangeRevert, revertToken), revert, "PX", expiry.Milliseconds())
+	if err != nil {
+		return "", "", err
+	}
+
+	return emailChangeURL("/email/confirm", confirmToken), emailChangeURL("/email/revert", revertToken), nil
+}
+
+// emailChangeURL returns a signed link to path holding a token
+func emailChangeURL(path, token string) string {
+	query := url.Values{}
+	query.Set("token", token)
+
+	return GenerateTokenFromString(fmt.Sprintf("http://localhost:8080%s?%s", path, query.Encode()))
+}
+
+// takeEmailChange checks the signature and age of a link from emailChangeURL, and
+// returns the change its token makes, removing it so the link can't be used again.
+// A link which isn't valid gets redis.ErrNil.
+func (app *Config) takeEmailChange(r *http.Request, kind string, minutesUntilExpire int) (*emailChange, error) {
+	testURL := fmt.Sprintf("http://localhost:8080%s", r.RequestURI)
+	if !VerifyToken(testURL) || Expired(testURL, minutesUntilExpire) {
+		return nil, redis.ErrNil
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return nil, redis.ErrNil
+	}
+
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	b, err := redis.Bytes(takeScript.Do(conn, emailChangeKey(kind, token)))
+	if err != nil {
+		return nil, err
+	}
+
+	var change emailChange
+	err = json.Unmarshal(b, &change)
+	if err != nil {
+		return nil, err
+	}
+
+	return &change, nil
+}
+
+// cancelEmailChange stops a confirmation link from working
+func (app *Config) cancelEmailChange(key string) {
+	if key == "" {
+		return
+	}
+
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", key)
+	if err != nil {
+		app.ErrorLog.Println("cancelling email change:", err)
+	}
+}
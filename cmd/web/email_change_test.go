@@ -0,0 +1,321 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"subscription-service/data"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// requestFor returns a GET request for a link from emailChangeURL or the like, as
+// the router would pass it to the handler
+func requestFor(link string) *http.Request {
+	return httptest.NewRequest(http.MethodGet, strings.TrimPrefix(link, "http://localhost:8080"), nil)
+}
+
+// linkToken returns the token a link holds
+func linkToken(t *testing.T, link string) string {
+	t.Helper()
+
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return u.Query().Get("token")
+}
+
+// TestTakeEmailChange runs against Redis, so it is skipped unless REDIS is set
+func TestTakeEmailChange(t *testing.T) {
+	app := testRedis(t)
+	testSigner(t)
+
+	const (
+		oldEmail = "jane@example.com"
+		newEmail = "jane.doe@example.com"
+	)
+
+	tests := []struct {
+		name string
+		// before is done with the links before the one under test is followed
+		before func(t *testing.T, confirm, revert string)
+		// link picks the link followed, and the kind of link it is followed as
+		link func(confirm, revert string) (string, string)
+		want *emailChange
+	}{
+		{
+			name: "confirm link",
+			link: func(confirm, _ string) (string, string) { return emailChangeConfirm, confirm },
+			want: &emailChange{UserID: 42, From: oldEmail, To: newEmail},
+		},
+		{
+			name: "revert link",
+			link: func(_, revert string) (string, string) { return emailChangeRevert, revert },
+			want: &emailChange{UserID: 42, From: newEmail, To: oldEmail},
+		},
+		{
+			name: "confirm link followed twice",
+			before: func(t *testing.T, confirm, _ string) {
+				_, err := app.takeEmailChange(requestFor(confirm), emailChangeConfirm, emailChangeMinutes)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			link: func(confirm, _ string) (string, string) { return emailChangeConfirm, confirm },
+		},
+		{
+			name: "revert link followed twice",
+			before: func(t *testing.T, _, revert string) {
+				_, err := app.takeEmailChange(requestFor(revert), emailChangeRevert, emailRevertMinutes)
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			link: func(_, revert string) (string, string) { return emailChangeRevert, revert },
+		},
+		{
+			name: "confirm link after the change was reverted",
+			before: func(t *testing.T, _, revert string) {
+				change, err := app.takeEmailChange(requestFor(revert), emailChangeRevert, emailRevertMinutes)
+				if err != nil {
+					t.Fatal(err)
+				}
+				app.cancelEmailChange(change.Confirm)
+			},
+			link: func(confirm, _ string) (string, string) { return emailChangeConfirm, confirm },
+		},
+		{
+			name: "expired confirm link",
+			before: func(t *testing.T, confirm, _ string) {
+				conn := app.Redis.Get()
+				defer conn.Close()
+
+				_, err := conn.Do("PEXPIRE", emailChangeKey(emailChangeConfirm, linkToken(t, confirm)), 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			},
+			link: func(confirm, _ string) (string, string) { return emailChangeConfirm, confirm },
+		},
+		{
+			name: "revert link followed as a confirm link",
+			link: func(_, revert string) (string, string) {
+				return emailChangeConfirm, emailChangeURL("/email/confirm", linkToken(t, revert))
+			},
+		},
+		{
+			name: "confirm link followed as a revert link",
+			link: func(confirm, _ string) (string, string) { return emailChangeRevert, confirm },
+		},
+		{
+			name: "forged token",
+			link: func(string, string) (string, string) {
+				token, _ := randomToken()
+				return emailChangeConfirm, emailChangeURL("/email/confirm", token)
+			},
+		},
+		{
+			name: "token changed",
+			link: func(confirm, _ string) (string, string) {
+				token := linkToken(t, confirm)
+				return emailChangeConfirm, strings.Replace(confirm, token, token[1:]+"A", 1)
+			},
+		},
+		{
+			name: "link of the old kind",
+			link: func(string, string) (string, string) {
+				return emailChangeConfirm, GenerateTokenFromString("http://localhost:8080/email/confirm?" +
+					url.Values{"id": {"42"}, "from": {oldEmail}, "to": {"mallory@example.com"}}.Encode())
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			confirm, revert, err := app.startEmailChange(42, oldEmail, newEmail)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				app.cancelEmailChange(emailChangeKey(emailChangeConfirm, linkToken(t, confirm)))
+				app.cancelEmailChange(emailChangeKey(emailChangeRevert, linkToken(t, revert)))
+			})
+
+			if tt.before != nil {
+				tt.before(t, confirm, revert)
+			}
+
+			kind, link := tt.link(confirm, revert)
+			minutes := emailChangeMinutes
+			if kind == emailChangeRevert {
+				minutes = emailRevertMinutes
+			}
+
+			change, err := app.takeEmailChange(requestFor(link), kind, minutes)
+			if tt.want == nil {
+				if !errors.Is(err, redis.ErrNil) {
+					t.Fatalf("takeEmailChange = %+v, %v; want redis.ErrNil", change, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if kind == emailChangeRevert {
+				if change.Confirm != emailChangeKey(emailChangeConfirm, linkToken(t, confirm)) {
+					t.Errorf("revert link cancels %q, not its confirm link", change.Confirm)
+				}
+				change.Confirm = ""
+			}
+			if !reflect.DeepEqual(change, tt.want) {
+				t.Errorf("takeEmailChange = %+v, want %+v", change, tt.want)
+			}
+		})
+	}
+}
+
+// TestConfirmEmailChange runs against Redis, so it is skipped unless REDIS is set
+func TestConfirmEmailChange(t *testing.T) {
+	redisApp := testRedis(t)
+	testSigner(t)
+
+	user := data.User{ID: 42, Email: "jane@example.com", Active: 1, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+
+	tests := []struct {
+		name        string
+		follow      int
+		email       string
+		wantFlash   string
+		wantError   string
+		wantUpdates int
+	}{
+		{"confirmed", 1, user.Email, "Your email address is now jane.doe@example.com", "", 1},
+		{"followed twice", 2, user.Email, "", "Invalid or expired confirmation link.", 1},
+		{"address changed since", 1, "joe@example.com", "", "Invalid or expired confirmation link.", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			current := user
+			current.Email = tt.email
+
+			var updates int
+			database := &fakeDatabase{
+				rows: userRows(current),
+				exec: func(query string, _ []driver.Value) int64 {
+					if strings.HasPrefix(query, "update users set email") {
+						updates++
+					}
+					return 1
+				},
+			}
+			app := testApp(t, database)
+			app.Redis = redisApp.Redis
+
+			confirm, _, err := app.startEmailChange(user.ID, user.Email, "jane.doe@example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var r *http.Request
+			for i := 0; i < tt.follow; i++ {
+				r = withSession(t, app, requestFor(confirm))
+				app.ConfirmEmailChange(httptest.NewRecorder(), r)
+			}
+
+			if flash := app.Session.GetString(r.Context(), "flash"); flash != tt.wantFlash {
+				t.Errorf("flash = %q, want %q", flash, tt.wantFlash)
+			}
+			if got := app.Session.GetString(r.Context(), "error"); got != tt.wantError {
+				t.Errorf("error = %q, want %q", got, tt.wantError)
+			}
+			if updates != tt.wantUpdates {
+				t.Errorf("email updated %d times, want %d", updates, tt.wantUpdates)
+			}
+		})
+	}
+}
+
+// TestEmailChangeForgedLink follows links which are turned away before Redis is
+// asked, so it runs without it
+func TestEmailChangeForgedLink(t *testing.T) {
+	testSigner(t)
+
+	forged := "/email/confirm?" + url.Values{"id": {"42"}, "from": {"jane@example.com"}, "to": {"mallory@example.com"}}.Encode()
+
+	tests := []struct {
+		name      string
+		handler   func(app *Config) http.HandlerFunc
+		link      string
+		wantError string
+	}{
+		{
+			name:      "confirm link of the old kind",
+			handler:   func(app *Config) http.HandlerFunc { return app.ConfirmEmailChange },
+			link:      GenerateTokenFromString("http://localhost:8080" + forged),
+			wantError: "Invalid or expired confirmation link.",
+		},
+		{
+			name:      "unsigned confirm link",
+			handler:   func(app *Config) http.HandlerFunc { return app.ConfirmEmailChange },
+			link:      forged,
+			wantError: "Invalid or expired confirmation link.",
+		},
+		{
+			name:      "revert link of the old kind",
+			handler:   func(app *Config) http.HandlerFunc { return app.RevertEmailChange },
+			link:      GenerateTokenFromString("http://localhost:8080" + strings.Replace(forged, "confirm", "revert", 1)),
+			wantError: "Invalid or expired link.",
+		},
+		{
+			name:      "confirm link signed with another key",
+			handler:   func(app *Config) http.HandlerFunc { return app.ConfirmEmailChange },
+			link:      signedWith(t, "abc123abc123abc123", emailChangeURL("/email/confirm", "token")),
+			wantError: "Invalid or expired confirmation link.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database := &fakeDatabase{rows: userRows(data.User{ID: 42, Email: "jane@example.com"})}
+			app := testApp(t, database)
+
+			r := withSession(t, app, requestFor(tt.link))
+			tt.handler(app)(httptest.NewRecorder(), r)
+
+			if got := app.Session.GetString(r.Context(), "error"); got != tt.wantError {
+				t.Errorf("error = %q, want %q", got, tt.wantError)
+			}
+			if database.ran("update users") {
+				t.Error("the email address was changed")
+			}
+		})
+	}
+}
+
+// signedWith signs a link again with another key
+func signedWith(t *testing.T, key, link string) string {
+	t.Helper()
+
+	unsigned, _, _ := strings.Cut(link, "&hash=")
+
+	saved := secretKey
+	defer func() { secretKey = saved }()
+
+	err := NewURLSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return GenerateTokenFromString(unsigned)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"subscription-service/data"
+)
+
+// Features which the application itself gates. Plans may have other features too,
+// for the templates and other systems to check.
+const (
+	// featureAPI gives access to the JSON API; its limit, if any, is how many API
+	// tokens a member may have at once
+	featureAPI = "api"
+	// featureMeteredUsage lets usage of a member be reported, and billed
+	featureMeteredUsage = "metered_usage"
+)
+
+// userEntitlements returns the features and limits the user of the request, logged
+// in or authenticated by an API token, is entitled to
+func (app *Config) userEntitlements(r *http.Request) *data.Entitlements {
+	user := app.currentUser(r)
+	if user == nil {
+		user = app.apiUser(r)
+	}
+	if user == nil {
+		return nil
+	}
+
+	return app.entitlementsFor(user.ID)
+}
+
+// entitlementsFor returns the features and limits a user is entitled to. Only an
+// active subscription grants anything; users without one, or whose payment is past
+// due, get an empty set.
+func (app *Config) entitlementsFor(userID int) *data.Entitlements {
+	sub, err := app.Models.Subscription.GetByUserID(userID)
+	if err != nil || sub.Status != data.SubscriptionActive {
+		return nil
+	}
+
+	entitlements, err := app.Models.Entitlement.GetForPlan(sub.PlanID)
+	if err != nil {
+		app.ErrorLog.Println("getting entitlements:", err)
+		return nil
+	}
+
+	return entitlements
+}
+
+// RequireFeature returns middleware which only lets through users whose plan includes
+// feature. Everyone else gets an upgrade prompt listing the plans which include it,
+// or a JSON error on the API.
+func (app *Config) RequireFeature(feature string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !app.userEntitlements(r).Has(feature) {
+				if app.apiUser(r) != nil {
+					app.errorJSON(w, http.StatusForbidden, "upgrade_required", fmt.Sprintf("Your plan does not include %s.", feature))
+					return
+				}
+				app.upgradePrompt(w, r, feature)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// withinLimit reports whether a user who has count of something may add one more,
+// under the limit of feature. A feature without a limit allows any number.
+func withinLimit(entitlements *data.Entitlements, feature string, count int) bool {
+	limit, limited := entitlements.Limit(feature)
+
+	return !limited || count < limit
+}
+
+// upgradePrompt renders the upgrade page for a feature the user is not entitled to
+func (app *Config) upgradePrompt(w http.ResponseWriter, r *http.Request, feature string) {
+	plans, err := app.Models.Entitlement.GetPlansWithFeature(feature)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["feature"] = feature
+	dataMap["plans"] = plans
+
+	w.WriteHeader(http.StatusForbidden)
+	app.render(w, r, "upgrade.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// planEntitlements returns the entitlements of each plan, keyed by plan id
+func (app *Config) planEntitlements(plans []*data.Plan) map[int][]*data.Entitlement {
+	entitlements := make(map[int][]*data.Entitlement)
+
+	for _, plan := range plans {
+		x, err := app.Models.Entitlement.GetAllForPlan(plan.ID)
+		if err != nil {
+			app.ErrorLog.Println("getting entitlements:", err)
+			continue
+		}
+		entitlements[plan.ID] = x
+	}
+
+	return entitlements
+}
+
+// templateFuncs returns the functions available to page templates. hasFeature and
+// featureLimit check the logged in user's entitlements, which are loaded at most
+// once per render.
+func (app *Config) templateFuncs(r *http.Request) template.FuncMap {
+	var entitlements *data.Entitlements
+	loaded := false
+
+	load := func() *data.Entitlements {
+		if !loaded {
+			entitlements = app.userEntitlements(r)
+			loaded = true
+		}
+		return entitlements
+	}
+
+	return template.FuncMap{
+		"hasFeature": func(feature string) bool {
+			return load().Has(feature)
+		},
+		"featureLimit": func(feature string) int {
+			limit, _ := load().Limit(feature)
+			return limit
+		},
+	}
+}
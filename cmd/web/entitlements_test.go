@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"subscription-service/data"
+	"testing"
+	"time"
+)
+
+func TestWithinLimit(t *testing.T) {
+	entitlements := &data.Entitlements{
+		Features: map[string]bool{featureAPI: true, "reports": true, "exports": true},
+		Limits:   map[string]int{featureAPI: 3, "exports": 0},
+	}
+
+	tests := []struct {
+		name    string
+		feature string
+		count   int
+		want    bool
+	}{
+		{"none yet", featureAPI, 0, true},
+		{"below the limit", featureAPI, 2, true},
+		{"at the limit", featureAPI, 3, false},
+		{"over the limit", featureAPI, 5, false},
+		{"no limit", "reports", 1000, true},
+		{"limit of zero", "exports", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withinLimit(entitlements, tt.feature, tt.count); got != tt.want {
+				t.Errorf("withinLimit(%q, %d) = %v, want %v", tt.feature, tt.count, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestAPIWithoutPlan checks a user with no subscription can still subscribe, and
+// see or cancel their subscription, through the API
+func TestAPIWithoutPlan(t *testing.T) {
+	user := data.User{ID: 42, Email: "jane@example.com", Active: 1, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+
+	tests := []struct {
+		method     string
+		target     string
+		body       string
+		wantStatus int
+		wantCode   string
+	}{
+		{http.MethodGet, "/me", "", http.StatusOK, ""},
+		{http.MethodGet, "/subscription", "", http.StatusNotFound, "not_found"},
+		{http.MethodPost, "/subscription", `{"plan_id": 2}`, http.StatusUnprocessableEntity, "unknown_plan"},
+		{http.MethodDelete, "/subscription", "", http.StatusNotFound, "not_found"},
+		{http.MethodGet, "/invoices", "", http.StatusForbidden, "upgrade_required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			app := testApp(t, &fakeDatabase{rows: apiTokenRows(user, "read,write")})
+			app.Redis = noRedis
+
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			r.Header.Set("Authorization", "Bearer token")
+			if tt.body != "" {
+				r.Header.Set("Content-Type", "application/json")
+			}
+			w := httptest.NewRecorder()
+			app.apiRouter().ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantCode != "" && !strings.Contains(w.Body.String(), `"`+tt.wantCode+`"`) {
+				t.Errorf("body = %s, want error %s", w.Body, tt.wantCode)
+			}
+		})
+	}
+}
+
+// TestCreateTokenWithoutPlan checks a member with no subscription can create a
+// token, but only one
+func TestCreateTokenWithoutPlan(t *testing.T) {
+	pathToTemplates = "./templates"
+
+	tests := []struct {
+		name       string
+		tokens     int
+		wantInsert bool
+		wantBody   string
+	}{
+		{"first token", 0, true, "Copy it now"},
+		{"second token", 1, false, "Your plan doesn&#39;t allow any more tokens"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database := &fakeDatabase{
+				rows: func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+					columns := []string{"id", "user_id", "name", "scopes", "last_used_at", "created_at", "updated_at"}
+					switch {
+					case strings.HasPrefix(query, "insert into api_tokens"):
+						return []string{"id"}, [][]driver.Value{{int64(7)}}
+					case strings.Contains(query, "from api_tokens where user_id = $1"):
+						var rows [][]driver.Value
+						for i := 0; i < tt.tokens; i++ {
+							rows = append(rows, []driver.Value{int64(i + 1), int64(42), "cli", "read", nil, time.Now(), time.Now()})
+						}
+						return columns, rows
+					}
+					return nil, nil
+				},
+			}
+			app := testApp(t, database)
+			app.Redis = noRedis
+
+			form := url.Values{"name": {"cli"}, "scope-read": {"1"}}
+			r := httptest.NewRequest(http.MethodPost, "/tokens", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r = withSession(t, app, r)
+			app.Session.Put(r.Context(), "userID", 42)
+
+			w := httptest.NewRecorder()
+			app.authRouter().ServeHTTP(w, r)
+
+			if w.Code == http.StatusForbidden {
+				t.Fatal("a member without a plan is refused a token")
+			}
+			if inserted := database.ran("insert into api_tokens"); inserted != tt.wantInsert {
+				t.Errorf("token created = %v, want %v", inserted, tt.wantInsert)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("page doesn't say %q", tt.wantBody)
+			}
+		})
+	}
+}
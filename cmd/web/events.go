@@ -0,0 +1,202 @@
+package main
+
+import (
+	"log"
+	"runtime/debug"
+	"subscription-service/data"
+	"sync"
+)
+
+// Event is a domain event published on the EventBus. Its name is also the event
+// type sent to webhook endpoints.
+type Event interface {
+	EventName() string
+}
+
+type subscriber struct {
+	name   string
+	handle func(Event) error
+}
+
+// EventBus is an in-process publish/subscribe bus. Handlers publish what happened,
+// and the side effects (emails, PDFs, webhooks, ...) live in subscribers, so adding
+// one doesn't mean editing the handler.
+type EventBus struct {
+	mu          sync.RWMutex
+	subscribers map[string][]subscriber
+	wait        *sync.WaitGroup
+	errorLog    *log.Logger
+}
+
+func NewEventBus(wait *sync.WaitGroup, errorLog *log.Logger) *EventBus {
+	return &EventBus{
+		subscribers: make(map[string][]subscriber),
+		wait:        wait,
+		errorLog:    errorLog,
+	}
+}
+
+// On registers handle, under the subscriber name used in logs, for events of type E
+func On[E Event](bus *EventBus, name string, handle func(E) error) {
+	var zero E
+
+	bus.mu.Lock()
+	defer bus.mu.Unlock()
+
+	bus.subscribers[zero.EventName()] = append(bus.subscribers[zero.EventName()], subscriber{
+		name: name,
+		handle: func(e Event) error {
+			return handle(e.(E))
+		},
+	})
+}
+
+// Publish hands the event to each of its subscribers in a goroutine of its own, and
+// returns without waiting for them. The goroutines are tracked by the wait group so
+// shutdown waits for them to finish. A subscriber which fails or panics is logged,
+// and doesn't affect the others.
+func (bus *EventBus) Publish(e Event) {
+	bus.mu.RLock()
+	subscribers := bus.subscribers[e.EventName()]
+	bus.mu.RUnlock()
+
+	for _, s := range subscribers {
+		bus.wait.Add(1)
+
+		go func() {
+			defer bus.wait.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					bus.errorLog.Printf("subscriber %s panicked handling %s: %v\n%s", s.name, e.EventName(), r, debug.Stack())
+				}
+			}()
+
+			err := s.handle(e)
+			if err != nil {
+				bus.errorLog.Printf("subscriber %s handling %s: %v", s.name, e.EventName(), err)
+			}
+		}()
+	}
+}
+
+// Domain events
+const (
+	eventSubscriptionCreated   = "subscription.created"
+	eventSubscriptionUpdated   = "subscription.updated"
+	eventSubscriptionCancelled = "subscription.cancelled"
+	eventInvoiceIssued         = "invoice.issued"
+	eventInvoicePaid           = "invoice.paid"
+	eventInvoiceRefunded       = "invoice.refunded"
+	eventUserActivated         = "user.activated"
+)
+
+// subscriptionCreated is published when a user without a subscription subscribes
+type subscriptionCreated struct {
+	User    data.User
+	Plan    *data.Plan
+	Profile *data.BillingProfile
+}
+
+// subscriptionUpdated is published when a subscribed user switches plans
+type subscriptionUpdated struct {
+	User    data.User
+	Plan    *data.Plan
+	Profile *data.BillingProfile
+}
+
+type subscriptionCancelled struct {
+	User data.User
+	Plan *data.Plan
+}
+
+// invoiceIssued and invoicePaid carry a copy of the invoice, as the original goes
+// on being updated while subscribers run
+type invoiceIssued struct {
+	User    data.User
+	Invoice data.Invoice
+}
+
+type invoicePaid struct {
+	User    data.User
+	Invoice data.Invoice
+}
+
+// invoiceRefunded is published when an admin refunds an invoice, in full or in part
+type invoiceRefunded struct {
+	Invoice data.Invoice
+	Note    data.CreditNote
+}
+
+type userActivated struct {
+	User data.User
+}
+
+func (subscriptionCreated) EventName() string   { return eventSubscriptionCreated }
+func (subscriptionUpdated) EventName() string   { return eventSubscriptionUpdated }
+func (subscriptionCancelled) EventName() string { return eventSubscriptionCancelled }
+func (invoiceIssued) EventName() string         { return eventInvoiceIssued }
+func (invoicePaid) EventName() string           { return eventInvoicePaid }
+func (invoiceRefunded) EventName() string       { return eventInvoiceRefunded }
+func (userActivated) EventName() string         { return eventUserActivated }
+
+// registerSubscribers wires up every side effect of the domain events
+func (app *Config) registerSubscribers() {
+	bus := app.Events
+
+	// a new subscription, or a switch of plan, is invoiced and charged, and the
+	// user manual emailed
+	On(bus, "billing", func(e subscriptionCreated) error {
+		return app.chargeSubscription(e.User, e.Plan, e.Profile)
+	})
+	On(bus, "billing", func(e subscriptionUpdated) error {
+		return app.chargeSubscription(e.User, e.Plan, e.Profile)
+	})
+	On(bus, "manual", func(e subscriptionCreated) error {
+		return app.sendManual(e.User, e.Plan)
+	})
+	On(bus, "manual", func(e subscriptionUpdated) error {
+		return app.sendManual(e.User, e.Plan)
+	})
+
+	On(bus, "mailer", func(e invoicePaid) error {
+		app.sendInvoice(e.User, &e.Invoice)
+		return nil
+	})
+	On(bus, "credit-notes", func(e invoiceRefunded) error {
+		return app.sendCreditNote(&e.Note, &e.Invoice)
+	})
+
+	// invoices are issued and paid in the background as often as in a request, so
+	// the audit log hears of them here. Actions taken in a request are audited by
+	// their handlers instead, as only the request knows the actor, IP and user agent.
+	On(bus, "audit", func(e invoiceIssued) error {
+		app.auditSystem(data.AuditInvoiceIssued, "invoice", e.Invoice.ID, map[string]any{"user_id": e.User.ID, "amount": e.Invoice.Amount})
+		return nil
+	})
+	On(bus, "audit", func(e invoicePaid) error {
+		app.auditSystem(data.AuditInvoicePaid, "invoice", e.Invoice.ID, map[string]any{"user_id": e.User.ID, "amount": e.Invoice.Amount})
+		return nil
+	})
+
+	On(bus, "webhooks", func(e subscriptionCreated) error {
+		return app.emitSubscriptionEvent(e.EventName(), e.User, e.Plan)
+	})
+	On(bus, "webhooks", func(e subscriptionUpdated) error {
+		return app.emitSubscriptionEvent(e.EventName(), e.User, e.Plan)
+	})
+	On(bus, "webhooks", func(e subscriptionCancelled) error {
+		return app.emitSubscriptionEvent(e.EventName(), e.User, e.Plan)
+	})
+	On(bus, "webhooks", func(e invoiceIssued) error {
+		return app.emitEvent(e.EventName(), invoiceEventData{UserID: e.User.ID, Invoice: toAPIInvoice(&e.Invoice)})
+	})
+	On(bus, "webhooks", func(e invoicePaid) error {
+		return app.emitEvent(e.EventName(), invoiceEventData{UserID: e.User.ID, Invoice: toAPIInvoice(&e.Invoice)})
+	})
+	On(bus, "webhooks", func(e invoiceRefunded) error {
+		return app.emitEvent(e.EventName(), invoiceEventData{UserID: e.Invoice.UserID, Invoice: toAPIInvoice(&e.Invoice)})
+	})
+	On(bus, "webhooks", func(e userActivated) error {
+		return app.emitEvent(e.EventName(), userEventData{User: toAPIUser(&e.User)})
+	})
+}
@@ -1,24 +1,61 @@
 package main
 
 import (
-	
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/url"
+	"regexp"
 	"strconv"
+	"strings"
 	"subscription-service/data"
+	"subscription-service/forms"
 	"time"
 
+	"github.com/gomodule/redigo/redis"
 	"github.com/phpdave11/gofpdf"
 	"github.com/phpdave11/gofpdf/contrib/gofpdi"
 )
 
+// activationMinutes is how long the link emailed to activate a new account works
+const activationMinutes = 60 * 24
+
 func (app *Config) HomePage(w http.ResponseWriter, r *http.Request) {
 	app.render(w, r, "home.page.gohtml", nil)
 }
 
 func (app *Config) LoginPage(w http.ResponseWriter, r *http.Request) {
-	app.render(w, r, "login.page.gohtml", nil)
+	app.render(w, r, "login.page.gohtml", &TemplateData{
+		StringMap: app.loginStringMap(),
+	})
+}
+
+// loginStringMap tells the login page which identity provider to offer, if any
+func (app *Config) loginStringMap() map[string]string {
+	stringMap := make(map[string]string)
+	if app.OIDC != nil {
+		stringMap["oidcName"] = app.OIDCName
+	}
+
+	return stringMap
+}
+
+// renderLoginPage renders the login page again after a failed attempt, with the
+// email address the user entered
+func (app *Config) renderLoginPage(w http.ResponseWriter, r *http.Request, form *forms.Form, errorMessage string) {
+	// never send the password back
+	form.Del("password")
+
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	app.render(w, r, "login.page.gohtml", &TemplateData{
+		StringMap: app.loginStringMap(),
+		Form:      form,
+		Error:     errorMessage,
+	})
 }
 
 func (app *Config) PostLoginPage(w http.ResponseWriter, r *http.Request) {
@@ -29,47 +66,134 @@ func (app *Config) PostLoginPage(w http.ResponseWriter, r *http.Request) {
 		app.ErrorLog.Println(err)
 	}
 
-	email := r.Form.Get("email")
-	password := r.Form.Get("password")
+	form := forms.New(r.PostForm)
+	form.Required("email", "password")
+	form.IsEmail("email")
+	if !form.Valid() {
+		app.renderLoginPage(w, r, form, "")
+		return
+	}
+
+	email := strings.TrimSpace(form.Get("email"))
+	password := form.Get("password")
+	ip := clientIP(r)
+
+	// throttled attempts are turned away before the password is even checked
+	if wait := app.loginBlockedFor(email, ip); wait > 0 {
+		app.audit(r, data.AuditLoginFailed, "user", nil, map[string]any{"email": email, "reason": "throttled"})
+		app.renderLoginPage(w, r, form, fmt.Sprintf("Too many failed attempts. Try again in %s.", formatWait(wait)))
+		return
+	}
 
 	user, err := app.Models.User.GetByEmail(email)
 	if err != nil {
-		app.Session.Put(r.Context(), "error", "Invalid credentials")
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		app.recordLoginFailure(email, ip)
+		app.audit(r, data.AuditLoginFailed, "user", nil, map[string]any{"email": email, "reason": "unknown email"})
+		app.renderLoginPage(w, r, form, "Invalid credentials")
 		return
 	}
 
+	reason := "wrong password"
 	validPassword, err := user.PasswordMatches(password)
 	if err != nil {
-		app.Session.Put(r.Context(), "error", "Invalid credentials")
-		http.Redirect(w, r, "/login", http.StatusSeeOther)
-		return
+		// a hash which can't be checked fails like a wrong password, and counts
+		// towards the throttle the same, so it can't be used to get round it
+		app.ErrorLog.Println("checking password:", err)
+		reason = "password could not be checked"
 	}
 
 	if !validPassword {
-		msg := Message{
-			To:      email,
-			Subject: "failed login in attempt",
-			Data:    "Invalid login attempt!",
+		locked := app.recordLoginFailure(email, ip)
+		app.audit(r, data.AuditLoginFailed, "user", user.ID, map[string]any{"email": email, "reason": reason})
+		if locked {
+			app.audit(r, data.AuditLoginLocked, "user", user.ID, map[string]any{"minutes": int(accountLockout.Minutes())})
 		}
 
-		app.sendEmail(msg)
+		if app.emailPreferences(user.ID).LoginAlerts && app.shouldNotifyFailedLogin(email) {
+			msg := Message{
+				To:      user.Email,
+				Subject: "failed login in attempt",
+				Data:    fmt.Sprintf("Invalid login attempt from %s! If this wasn't you, consider changing your password.", ip),
+			}
+
+			app.sendEmail(msg)
+		}
 
-		app.Session.Put(r.Context(), "error", "Invalid credentials")
+		app.renderLoginPage(w, r, form, "Invalid credentials")
+		return
+	}
+
+	// the password is at hand, so this is the one chance to bring its hash up to date
+	if user.PasswordOutdated() {
+		err = user.RehashPassword(password)
+		if err != nil {
+			app.ErrorLog.Println("rehashing password:", err)
+		}
+	}
+
+	app.completeLogin(w, r, user)
+}
+
+// completeLogin logs in a user who has proven who they are, with their password
+// or an identity provider. With two-factor authentication on, that only gets them
+// as far as asking for their code.
+func (app *Config) completeLogin(w http.ResponseWriter, r *http.Request, user *data.User) {
+	_, err := app.Models.TwoFactor.GetByUserID(user.ID)
+	if err == nil {
+		app.Session.Put(r.Context(), "twoFactorUserID", user.ID)
+		app.Session.Put(r.Context(), "twoFactorStartedAt", time.Now().Unix())
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to log in.")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
+	app.logIn(w, r, user)
+}
+
+// logIn puts a user who has proven who they are in the session
+func (app *Config) logIn(w http.ResponseWriter, r *http.Request, user *data.User) {
+	app.clearLoginFailures(user.Email)
+
+	// a new CSRF token for the logged in session
+	app.Session.Remove(r.Context(), csrfField)
+
 	app.Session.Put(r.Context(), "userID", user.ID)
-	app.Session.Put(r.Context(), "user", user)
+	app.trackSession(r, user.ID)
+
+	// LoadUser ran before anyone was logged in
+	r = withUser(r, user)
+
+	app.audit(r, data.AuditLogin, "user", user.ID, nil)
+
+	if app.twoFactorRequired(r) {
+		if _, err := app.Models.TwoFactor.GetByUserID(user.ID); err != nil {
+			app.Session.Put(r.Context(), "warning", "Admin accounts must use two-factor authentication. Please turn it on.")
+			http.Redirect(w, r, "/members/2fa", http.StatusSeeOther)
+			return
+		}
+	}
 
 	app.Session.Put(r.Context(), "flash", "successful login")
 
 	http.Redirect(w, r, "/", http.StatusSeeOther)
-
 }
 
 func (app *Config) LogoutPage(w http.ResponseWriter, r *http.Request) {
+	if app.IsAuthenticated(r) {
+		userID := app.Session.GetInt(r.Context(), "userID")
+		app.audit(r, data.AuditLogout, "user", userID, nil)
+
+		_, err := app.revokeSession(userID, app.Session.GetString(r.Context(), sessionIDKey))
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+	}
+
 	_ = app.Session.Destroy(r.Context())
 	_ = app.Session.RenewToken(r.Context())
 
@@ -85,33 +209,68 @@ func (app *Config) PostRegisterPage(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		app.ErrorLog.Println(err)
 	}
-	//validate data
+
+	// validate data
+	form := forms.New(r.PostForm)
+	form.Required("email", "password", "verify-password", "first-name", "last-name")
+	form.IsEmail("email")
+	form.MaxLength("email", 255)
+	form.Matches("verify-password", "password")
+	form.MaxLength("first-name", 255)
+	form.MaxLength("last-name", 255)
+	app.checkPassword(form, "password", form.Get("email"), form.Get("first-name"), form.Get("last-name"))
+
+	err = form.Unique("email", "An account with this email address already exists", app.emailTaken)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to create user.")
+		http.Redirect(w, r, "/register", http.StatusSeeOther)
+		return
+	}
+
+	if !form.Valid() {
+		// never send passwords back
+		form.Del("password")
+		form.Del("verify-password")
+
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		app.render(w, r, "register.page.gohtml", &TemplateData{
+			Form:  form,
+			Error: "Please correct the errors below.",
+		})
+		return
+	}
 
 	//create a user
 	u := data.User{
-		Email:     r.Form.Get("email"),
-		FirstName: r.Form.Get("first-name"),
-		LastName:  r.Form.Get("last-name"),
-		Password:  r.Form.Get("password"),
+		Email:     strings.TrimSpace(form.Get("email")),
+		FirstName: strings.TrimSpace(form.Get("first-name")),
+		LastName:  strings.TrimSpace(form.Get("last-name")),
+		Password:  form.Get("password"),
 		Active:    0,
 		IsAdmin:   0,
 	}
 
-	_, err = u.Insert(u)
+	userID, err := u.Insert(u)
 	if err != nil {
 		app.Session.Put(r.Context(), "error", "Unable to create user.")
 		http.Redirect(w, r, "/register", http.StatusSeeOther)
 		return
 	}
+	app.audit(r, data.AuditRegistered, "user", userID, map[string]any{"email": u.Email})
 
-	url := fmt.Sprintf("http://localhost:8080/activate?email=%s", u.Email)
-	signedURL := GenerateTokenFromString(url)
-	app.InfoLog.Println(signedURL)
+	signedURL, err := app.newActivationLink(userID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Your account was created, but we couldn't send the activation email.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
 
 	msg := Message{
 		To:       u.Email,
 		Subject:  "Activate account",
-		Template: "confirm-email",
+		Template: "confirmation-email",
 		Data:     template.HTML(signedURL),
 	}
 
@@ -121,10 +280,104 @@ func (app *Config) PostRegisterPage(w http.ResponseWriter, r *http.Request) {
 
 }
 
+// emailTaken reports whether an account already uses an email address
+func (app *Config) emailTaken(email string) (bool, error) {
+	_, err := app.Models.User.GetByEmail(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// ActivateAccount activates the account an activation link was sent for. Each link
+// works once.
 func (app *Config) ActivateAccount(w http.ResponseWriter, r *http.Request) {
-	// Handle account activation logic here
-	// For now, just redirect to home page
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	userID, err := app.takeActivationLink(r)
+	if err != nil {
+		if !errors.Is(err, redis.ErrNil) {
+			app.ErrorLog.Println(err)
+		}
+		app.Session.Put(r.Context(), "error", "Invalid or expired activation link.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	// activate account
+	u, err := app.Models.User.GetOne(userID)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "No user found.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if u.Active == 0 {
+		u.Active = 1
+		err = u.Update()
+		if err != nil {
+			app.ErrorLog.Println(err)
+			app.Session.Put(r.Context(), "error", "Unable to activate account.")
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		}
+
+		app.audit(r, data.AuditActivated, "user", u.ID, map[string]any{"email": u.Email})
+		app.Events.Publish(userActivated{User: *u})
+	}
+
+	app.Session.Put(r.Context(), "flash", "Account activated. You can now log in.")
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+func activationKey(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return "activation:" + hex.EncodeToString(hash[:])
+}
+
+// newActivationLink returns a signed link which activates the account of a user.
+// The link holds a random token; Redis keeps only its hash, with the user's ID.
+func (app *Config) newActivationLink(userID int) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	expiry := time.Duration(activationMinutes) * time.Minute
+	_, err = conn.Do("SET", activationKey(token), userID, "PX", expiry.Milliseconds())
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{}
+	query.Set("token", token)
+
+	return GenerateTokenFromString(fmt.Sprintf("http://localhost:8080/activate-account?%s", query.Encode())), nil
+}
+
+// takeActivationLink checks the signature and age of an activation link, and
+// returns the ID of the user it activates, removing its token so it can't be used
+// again. A link which isn't valid gets redis.ErrNil.
+func (app *Config) takeActivationLink(r *http.Request) (int, error) {
+	testURL := fmt.Sprintf("http://localhost:8080%s", r.RequestURI)
+	if !VerifyToken(testURL) || Expired(testURL, activationMinutes) {
+		return 0, redis.ErrNil
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return 0, redis.ErrNil
+	}
+
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	return redis.Int(takeScript.Do(conn, activationKey(token)))
 }
 
 func (app *Config) ChooseSubscription(w http.ResponseWriter, r *http.Request) {
@@ -135,8 +388,17 @@ func (app *Config) ChooseSubscription(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// each subscribe button carries a token confirming the choice of plan
+	userID := app.Session.GetInt(r.Context(), "userID")
+	confirmations := make(map[int]string)
+	for _, plan := range plans {
+		confirmations[plan.ID] = subscribeConfirmation(userID, plan.ID)
+	}
+
 	dataMap := make(map[string]any)
 	dataMap["plans"] = plans
+	dataMap["entitlements"] = app.planEntitlements(plans)
+	dataMap["confirmations"] = confirmations
 
 	app.render(w, r, "plans.page.gohtml", &TemplateData{
 		Data: dataMap,
@@ -146,13 +408,19 @@ func (app *Config) ChooseSubscription(w http.ResponseWriter, r *http.Request) {
 
 func (app *Config) SubscribeToPlan(w http.ResponseWriter, r *http.Request) {
 	// get the id of the plan that is chosen
-	id := r.URL.Query().Get("id")
+	id := r.PostFormValue("id")
 
 	planID, err := strconv.Atoi(id)
 	if err != nil {
 		app.ErrorLog.Println("Error getting planid:", err)
 	}
 
+	if !validSubscribeConfirmation(r.PostFormValue("confirmation"), app.Session.GetInt(r.Context(), "userID"), planID) {
+		app.Session.Put(r.Context(), "error", "Your choice of plan has expired. Please choose again.")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
+
 	// get the plan from the database
 	plan, err := app.Models.Plan.GetOne(planID)
 	if err != nil {
@@ -161,105 +429,397 @@ func (app *Config) SubscribeToPlan(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// get the user from the session
-	user, ok := app.Session.Get(r.Context(), "user").(data.User)
-	if !ok {
+	user := app.currentUser(r)
+	if user == nil {
 		app.Session.Put(r.Context(), "error", "Log in first!")
 		http.Redirect(w, r, "/login", http.StatusSeeOther)
 		return
 	}
 
-	// generate an invoice and email it
-	app.Wait.Add(1)
+	// an invoice can't be issued without billing details
+	profile, err := app.Models.BillingProfile.GetByUserID(user.ID)
+	if err != nil {
+		app.Session.Put(r.Context(), "warning", "Please enter your billing details before subscribing.")
+		http.Redirect(w, r, "/members/billing", http.StatusSeeOther)
+		return
+	}
 
-	go func() {
-		defer app.Wait.Done()
+	// subscribe the user to a plan
+	err = app.subscribe(*user, plan, profile)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Error subscribing to plan!")
+		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+		return
+	}
 
-		invoice, err := app.getInvoice(user, plan)
-		if err != nil {
-			app.ErrorChan <- err
-		}
+	app.audit(r, data.AuditSubscribed, "plan", plan.ID, map[string]any{"plan_name": plan.PlanName})
 
-		msg := Message{
-			To:       user.Email,
-			Subject:  "Your invoice",
-			Data:     invoice,
-			Template: "invoice",
-		}
+	// redirect
+	app.Session.Put(r.Context(), "flash", "Subscribed!")
+	http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+}
 
-		app.sendEmail(msg)
-	}()
+// subscribe subscribes the user to a plan. Invoicing, charging and emailing the
+// user manual are left to the subscribers of the event it publishes.
+func (app *Config) subscribe(user data.User, plan *data.Plan, profile *data.BillingProfile) error {
+	previous, err := app.Models.Subscription.GetByUserID(user.ID)
+	switching := err == nil && previous.Status != data.SubscriptionCancelled
 
-	// generate a manual
-	app.Wait.Add(1)
-	go func() {
-		defer app.Wait.Done()
+	err = app.Models.Plan.SubscribeUserToPlan(user, *plan)
+	if err != nil {
+		return err
+	}
 
-		pdf := app.generateManual(user, plan)
-		err := pdf.OutputFileAndClose(fmt.Sprintf("./tmp/%d_manual.pdf", user.ID))
-		if err != nil {
-			app.ErrorChan <- err
-			return
-		}
+	if switching {
+		app.Events.Publish(subscriptionUpdated{User: user, Plan: plan, Profile: profile})
+	} else {
+		app.Events.Publish(subscriptionCreated{User: user, Plan: plan, Profile: profile})
+	}
+
+	return nil
+}
 
-		msg := Message{
-			To:      user.Email,
-			Subject: "Your manual",
-			Data:    "Your user manual is attached",
-			AttachmentMap: map[string]string{
-				"Manual.pdf": fmt.Sprintf("./tmp/%d_manual.pdf", user.ID),
-			},
+// chargeSubscription issues the invoice for the first period of a subscription and
+// charges it. If the charge fails the subscription becomes past due.
+func (app *Config) chargeSubscription(user data.User, plan *data.Plan, profile *data.BillingProfile) error {
+	invoice, err := app.getInvoice(user, plan, profile, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	sub, err := app.Models.Subscription.GetByUserID(user.ID)
+	if err != nil {
+		return err
+	}
+
+	if !app.collectPayment(invoice) {
+		err = sub.MarkPastDue(invoice.ID)
+		if err != nil {
+			return err
 		}
+		sub.PastDueSince = time.Now()
 
-		app.sendEmail(msg)
-	}()
+		app.sendEmail(app.dunningMessage(user, plan, invoice, sub, 0))
+		return nil
+	}
 
-	// subscribe the user to a plan
-	err = app.Models.Plan.SubscribeUserToPlan(user, *plan)
+	err = sub.Renew(invoice.ID, sub.CurrentPeriodEnd)
 	if err != nil {
-		app.Session.Put(r.Context(), "error", "Error subscribing to plan!")
-		http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
-		return
+		return err
+	}
+
+	app.Events.Publish(invoicePaid{User: user, Invoice: *invoice})
+
+	return nil
+}
+
+// sendManual generates the user manual of a plan and emails it
+func (app *Config) sendManual(user data.User, plan *data.Plan) error {
+	if !app.emailPreferences(user.ID).Manuals {
+		return nil
 	}
 
-	u, err := app.Models.User.GetOne(user.ID)
+	pdf := app.generateManual(user, plan)
+	err := pdf.OutputFileAndClose(fmt.Sprintf("./tmp/%d_manual.pdf", user.ID))
 	if err != nil {
-		app.Session.Put(r.Context(), "error", "Error getting user from database!")
-		http.Redirect(w, r, "/members/plan", http.StatusSeeOther)
-		return
+		return err
+	}
+
+	msg := Message{
+		To:      user.Email,
+		Subject: "Your manual",
+		Data:    "Your user manual is attached",
+		AttachmentMap: map[string]string{
+			"Manual.pdf": fmt.Sprintf("./tmp/%d_manual.pdf", user.ID),
+		},
 	}
 
-	app.Session.Put(r.Context(), "user", u)
+	app.sendEmail(msg)
 
-	// redirect
-	app.Session.Put(r.Context(), "flash", "Subscribed!")
-	http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+	return nil
 }
 
-func (app *Config) generateManual(u data.User , plan *data.Plan) *gofpdf.Fpdf {
-	pdf := gofpdf.New("P","mm","Letter","")
-	pdf.SetMargins(10,13,10)
+func (app *Config) generateManual(u data.User, plan *data.Plan) *gofpdf.Fpdf {
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	pdf.SetMargins(10, 13, 10)
 
 	importer := gofpdi.NewImporter()
 	time.Sleep(5 * time.Second)
 
-	t := importer.ImportPage(pdf, "./pdf/manual.pdf",1,"/MediaBox")
+	t := importer.ImportPage(pdf, "./pdf/manual.pdf", 1, "/MediaBox")
 	pdf.AddPage()
 
-	importer.UseImportedTemplate(pdf, t,0,0,215.9,0)
+	importer.UseImportedTemplate(pdf, t, 0, 0, 215.9, 0)
 
 	pdf.SetX(75)
 	pdf.SetY(150)
 
-	pdf.SetFont("Arial","",12)
-	pdf.MultiCell(0,4,fmt.Sprintf("%s %s",u.FirstName,u.LastName),"","C",false)
+	pdf.SetFont("Arial", "", 12)
+	pdf.MultiCell(0, 4, fmt.Sprintf("%s %s", u.FirstName, u.LastName), "", "C", false)
 	pdf.Ln(5)
-	pdf.MultiCell(0,4,fmt.Sprintf("%s User Guide",plan.PlanName),"","C",false)
+	pdf.MultiCell(0, 4, fmt.Sprintf("%s User Guide", plan.PlanName), "", "C", false)
+	return pdf
+}
+
+// generateCreditNote builds the PDF for a credit note issued against an invoice
+func (app *Config) generateCreditNote(note *data.CreditNote, invoice *data.Invoice) *gofpdf.Fpdf {
+	pdf := gofpdf.New("P", "mm", "Letter", "")
+	pdf.SetMargins(20, 20, 20)
+	pdf.AddPage()
+
+	pdf.SetFont("Arial", "B", 18)
+	pdf.Cell(0, 10, fmt.Sprintf("Credit Note %s", note.Number()))
+	pdf.Ln(12)
+
+	pdf.SetFont("Arial", "", 11)
+	pdf.Cell(0, 6, fmt.Sprintf("Issued: %s", note.IssuedAt.Format("2006-01-02")))
+	pdf.Ln(6)
+	pdf.Cell(0, 6, fmt.Sprintf("Against invoice: %s (issued %s)", invoice.Number(), invoice.IssuedAt.Format("2006-01-02")))
+	pdf.Ln(12)
+
+	pdf.SetFont("Arial", "B", 11)
+	pdf.Cell(0, 6, "Credited to:")
+	pdf.Ln(6)
+	pdf.SetFont("Arial", "", 11)
+	lines := []string{invoice.BillingName}
+	if invoice.Billing.CompanyName != "" {
+		lines = append(lines, invoice.Billing.CompanyName)
+	}
+	lines = append(lines, invoice.Billing.AddressLines()...)
+	if invoice.Billing.TaxID != "" {
+		lines = append(lines, fmt.Sprintf("Tax ID: %s", invoice.Billing.TaxID))
+	}
+	for _, x := range lines {
+		pdf.Cell(0, 6, x)
+		pdf.Ln(6)
+	}
+	pdf.Ln(6)
+
+	pdf.SetFont("Arial", "B", 11)
+	pdf.CellFormat(120, 8, "Description", "B", 0, "L", false, 0, "")
+	pdf.CellFormat(0, 8, "Amount", "B", 1, "R", false, 0, "")
+	pdf.SetFont("Arial", "", 11)
+	description := fmt.Sprintf("Refund of %s", invoice.PlanName)
+	if note.Reason != "" {
+		description = fmt.Sprintf("%s: %s", description, note.Reason)
+	}
+	pdf.CellFormat(120, 8, description, "", 0, "L", false, 0, "")
+	pdf.CellFormat(0, 8, fmt.Sprintf("-%s", note.AmountForDisplay()), "", 1, "R", false, 0, "")
+	pdf.Ln(6)
+
+	pdf.Cell(0, 6, fmt.Sprintf("Invoice total: %s", invoice.AmountForDisplay()))
+	pdf.Ln(6)
+	pdf.Cell(0, 6, fmt.Sprintf("Remaining balance after refunds: %s", invoice.RefundableForDisplay()))
+
 	return pdf
 }
 
+// getInvoice issues an invoice for the plan, taking a snapshot of the user's
+// billing profile at the time of issue. periodStart is the start of the billing
+// period a renewal pays for, or zero for the first invoice of a subscription. Any
+// extra line items, such as metered usage, are added after the plan itself.
+func (app *Config) getInvoice(u data.User, plan *data.Plan, profile *data.BillingProfile, periodStart time.Time, extra ...*data.LineItem) (*data.Invoice, error) {
+	invoice := data.Invoice{
+		UserID:       u.ID,
+		PeriodStart:  periodStart,
+		PlanID:       plan.ID,
+		PlanName:     plan.PlanName,
+		BillingName:  fmt.Sprintf("%s %s", u.FirstName, u.LastName),
+		BillingEmail: u.Email,
+		Billing:      *profile,
+		IssuedAt:     time.Now(),
+	}
+
+	invoice.LineItems = append([]*data.LineItem{{
+		Description: fmt.Sprintf("%s subscription", plan.PlanName),
+		Quantity:    1,
+		UnitAmount:  plan.PlanAmount,
+		Amount:      plan.PlanAmount,
+	}}, extra...)
+
+	for _, item := range invoice.LineItems {
+		invoice.Amount += item.Amount
+	}
+
+	id, err := app.Models.Invoice.Insert(invoice)
+	if err != nil {
+		return nil, err
+	}
+	invoice.ID = id
+
+	app.Events.Publish(invoiceIssued{User: u, Invoice: invoice})
+
+	return &invoice, nil
+}
+
+// sendInvoice emails an issued invoice to the user
+func (app *Config) sendInvoice(u data.User, invoice *data.Invoice) {
+	if !app.emailPreferences(u.ID).Invoices {
+		return
+	}
+
+	msg := Message{
+		To:       u.Email,
+		Subject:  fmt.Sprintf("Your invoice %s", invoice.Number()),
+		Data:     invoice.AmountForDisplay(),
+		DataMap:  map[string]any{"invoice": invoice},
+		Template: "invoice",
+	}
+
+	app.sendEmail(msg)
+}
+
+func (app *Config) BillingPage(w http.ResponseWriter, r *http.Request) {
+	user := app.currentUser(r)
+	if user == nil {
+		app.Session.Put(r.Context(), "error", "Log in first!")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	profile, err := app.Models.BillingProfile.GetByUserID(user.ID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			app.ErrorLog.Println(err)
+		}
+		profile = &data.BillingProfile{UserID: user.ID}
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["profile"] = profile
+
+	sub, err := app.Models.Subscription.GetByUserID(user.ID)
+	if err == nil && sub.Status == data.SubscriptionActive {
+		usage, err := app.Models.UsageRecord.TotalsForPeriod(user.ID, sub.CurrentPeriodEnd.AddDate(0, -1, 0), sub.CurrentPeriodEnd)
+		if err != nil {
+			app.ErrorLog.Println(err)
+		} else {
+			dataMap["usage"] = usage
+			dataMap["subscription"] = sub
+		}
+	}
+	if err == nil && sub.IsPastDue() {
+		invoice, err := app.Models.Invoice.GetOne(sub.LastInvoiceID)
+		if err != nil {
+			app.ErrorLog.Println(err)
+		} else {
+			dataMap["pastDueInvoice"] = invoice
+		}
+	}
+
+	app.render(w, r, "billing.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+func (app *Config) PostBillingPage(w http.ResponseWriter, r *http.Request) {
+	user := app.currentUser(r)
+	if user == nil {
+		app.Session.Put(r.Context(), "error", "Log in first!")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	profile := data.BillingProfile{
+		UserID:       user.ID,
+		CompanyName:  strings.TrimSpace(r.Form.Get("company-name")),
+		TaxID:        strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(r.Form.Get("tax-id")), " ", "")),
+		AddressLine1: strings.TrimSpace(r.Form.Get("address-line1")),
+		AddressLine2: strings.TrimSpace(r.Form.Get("address-line2")),
+		City:         strings.TrimSpace(r.Form.Get("city")),
+		State:        strings.TrimSpace(r.Form.Get("state")),
+		PostalCode:   strings.TrimSpace(r.Form.Get("postal-code")),
+		Country:      strings.ToUpper(strings.TrimSpace(r.Form.Get("country"))),
+	}
+
+	// validate data
+	form := forms.New(r.PostForm)
+	validateBillingProfile(form, profile)
+	if !form.Valid() {
+		dataMap := make(map[string]any)
+		dataMap["profile"] = &profile
+
+		app.render(w, r, "billing.page.gohtml", &TemplateData{
+			Data:  dataMap,
+			Form:  form,
+			Error: "Please correct the errors below.",
+		})
+		return
+	}
+
+	err = app.Models.BillingProfile.Upsert(profile)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to save billing details.")
+		http.Redirect(w, r, "/members/billing", http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, data.AuditBillingUpdated, "user", user.ID, nil)
+
+	app.Session.Put(r.Context(), "flash", "Billing details saved")
+	http.Redirect(w, r, "/members/billing", http.StatusSeeOther)
+}
+
+// RetryPayment lets a member whose subscription is past due retry the charge of the
+// unpaid invoice right away, instead of waiting for the next dunning retry
+func (app *Config) RetryPayment(w http.ResponseWriter, r *http.Request) {
+	user := app.currentUser(r)
+	if user == nil {
+		app.Session.Put(r.Context(), "error", "Log in first!")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
 
+	sub, err := app.Models.Subscription.GetByUserID(user.ID)
+	if err != nil || !sub.IsPastDue() {
+		app.Session.Put(r.Context(), "error", "There is no outstanding payment.")
+		http.Redirect(w, r, "/members/billing", http.StatusSeeOther)
+		return
+	}
 
-func (app *Config) getInvoice(u data.User , plan *data.Plan)(string,error) {
-	return plan.PlanAmountFormatted , nil
-}	
\ No newline at end of file
+	invoice, err := app.Models.Invoice.GetOne(sub.LastInvoiceID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to find the outstanding invoice.")
+		http.Redirect(w, r, "/members/billing", http.StatusSeeOther)
+		return
+	}
+
+	paid := app.settlePastDue(sub, *user, invoice)
+	app.audit(r, data.AuditPaymentRetried, "invoice", invoice.ID, map[string]any{"paid": paid})
+
+	if !paid {
+		app.Session.Put(r.Context(), "error", "The payment failed again. Please check your billing details.")
+		http.Redirect(w, r, "/members/billing", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Payment received, thank you!")
+	http.Redirect(w, r, "/members/plans", http.StatusSeeOther)
+}
+
+var (
+	countryCodeRegex = regexp.MustCompile(`^[A-Z]{2}$`)
+	taxIDRegex       = regexp.MustCompile(`^[A-Z0-9][A-Z0-9.\-]{3,31}$`)
+)
+
+// validateBillingProfile checks the billing profile read from form, and adds an
+// error to the form for each invalid field
+func validateBillingProfile(form *forms.Form, p data.BillingProfile) {
+	form.Required("address-line1", "city", "postal-code")
+	form.MaxLength("postal-code", 20)
+
+	form.Check(countryCodeRegex.MatchString(p.Country), "country", "Use a two letter country code, e.g. CA")
+
+	if p.TaxID != "" {
+		form.Check(taxIDRegex.MatchString(p.TaxID), "tax-id", "Tax ID may only contain letters, digits, dots and dashes")
+		form.Check(p.CompanyName != "", "company-name", "Company name is required when a tax ID is given")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"subscription-service/data"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestActivateAccount runs against Redis, so it is skipped unless REDIS is set
+func TestActivateAccount(t *testing.T) {
+	redisApp := testRedis(t)
+	testSigner(t)
+
+	user := data.User{ID: 42, Email: "jane@example.com", CreatedAt: time.Now(), UpdatedAt: time.Now()}
+
+	tests := []struct {
+		name string
+		// before is done with the link before it is followed
+		before      func(t *testing.T, app *Config, link string)
+		follow      int
+		wantFlash   string
+		wantError   string
+		wantUpdates int
+	}{
+		{
+			name:        "activated",
+			follow:      1,
+			wantFlash:   "Account activated. You can now log in.",
+			wantUpdates: 1,
+		},
+		{
+			name:        "followed twice",
+			follow:      2,
+			wantError:   "Invalid or expired activation link.",
+			wantUpdates: 1,
+		},
+		{
+			name: "expired",
+			before: func(t *testing.T, app *Config, link string) {
+				conn := app.Redis.Get()
+				defer conn.Close()
+
+				_, err := conn.Do("PEXPIRE", activationKey(linkToken(t, link)), 1)
+				if err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(10 * time.Millisecond)
+			},
+			follow:    1,
+			wantError: "Invalid or expired activation link.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var updates int
+			database := &fakeDatabase{
+				rows: userRows(user),
+				exec: func(query string, _ []driver.Value) int64 {
+					if strings.HasPrefix(query, "update users set") {
+						updates++
+					}
+					return 1
+				},
+			}
+			app := testApp(t, database)
+			app.Redis = redisApp.Redis
+			app.Events = NewEventBus(&sync.WaitGroup{}, app.ErrorLog)
+
+			link, err := app.newActivationLink(user.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				conn := app.Redis.Get()
+				defer conn.Close()
+				_, _ = conn.Do("DEL", activationKey(linkToken(t, link)))
+			})
+
+			if tt.before != nil {
+				tt.before(t, app, link)
+			}
+
+			var r *http.Request
+			for i := 0; i < tt.follow; i++ {
+				r = withSession(t, app, requestFor(link))
+				app.ActivateAccount(httptest.NewRecorder(), r)
+			}
+
+			if flash := app.Session.GetString(r.Context(), "flash"); flash != tt.wantFlash {
+				t.Errorf("flash = %q, want %q", flash, tt.wantFlash)
+			}
+			if got := app.Session.GetString(r.Context(), "error"); got != tt.wantError {
+				t.Errorf("error = %q, want %q", got, tt.wantError)
+			}
+			if updates != tt.wantUpdates {
+				t.Errorf("user updated %d times, want %d", updates, tt.wantUpdates)
+			}
+		})
+	}
+}
+
+// TestActivationForgedLink follows links which are turned away before Redis is
+// asked, so it runs without it
+func TestActivationForgedLink(t *testing.T) {
+	testSigner(t)
+
+	byEmail := "/activate-account?" + url.Values{"email": {"jane@example.com"}}.Encode()
+	byToken := "/activate-account?" + url.Values{"token": {"token"}}.Encode()
+
+	tests := []struct {
+		name string
+		link string
+	}{
+		{"link of the old kind", GenerateTokenFromString("http://localhost:8080" + byEmail)},
+		{"unsigned link", byToken},
+		{"link signed with another key", signedWith(t, "abc123abc123abc123", "http://localhost:8080"+byToken)},
+		{"signed link without a token", GenerateTokenFromString("http://localhost:8080/activate-account?token=")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database := &fakeDatabase{rows: userRows(data.User{ID: 42, Email: "jane@example.com"})}
+			app := testApp(t, database)
+
+			r := withSession(t, app, requestFor(tt.link))
+			app.ActivateAccount(httptest.NewRecorder(), r)
+
+			if got := app.Session.GetString(r.Context(), "error"); got != "Invalid or expired activation link." {
+				t.Errorf("error = %q, want the link refused", got)
+			}
+			if database.ran("update users") {
+				t.Error("the account was activated")
+			}
+		})
+	}
+}
@@ -1,6 +1,69 @@
 package main
 
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"subscription-service/data"
+)
+
 func (app *Config) sendEmail(msg Message) {
+	template := msg.Template
+	if template == "" {
+		template = "mail"
+	}
+
+	// keep a record of what was sent to whom, for data exports
+	err := app.Models.EmailLog.Insert(data.EmailLog{Recipient: msg.To, Subject: msg.Subject, Template: template})
+	if err != nil {
+		app.ErrorLog.Println("logging email:", err)
+	}
+
 	app.Wait.Add(1)
 	app.Mailer.MailerChan <- msg
-}
\ No newline at end of file
+}
+
+// readJSON decodes a JSON request body of at most 1MB into dst
+func (app *Config) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+	maxBytes := 1048576
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err != nil {
+		return err
+	}
+
+	err = dec.Decode(&struct{}{})
+	if !errors.Is(err, io.EOF) {
+		return errors.New("body must only contain a single JSON value")
+	}
+
+	return nil
+}
+
+// writeJSON writes data as a JSON response with the given status
+func (app *Config) writeJSON(w http.ResponseWriter, status int, data any, headers ...http.Header) error {
+	out, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if len(headers) > 0 {
+		for key, value := range headers[0] {
+			w.Header()[key] = value
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(out)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
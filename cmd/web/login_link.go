@@ -0,0 +1,313 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"subscription-service/data"
+	"subscription-service/forms"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Login links. A user who asks for one is emailed a signed link holding a random
+// token; Redis keeps only the hash of the token, with who it logs in and the
+// browser which asked for it. Following the link shows a page to confirm the
+// login, so mail scanners which open links don't use it up; confirming takes the
+// token out of Redis, so each link works once.
+const (
+	loginLinkMinutes = 15
+	// loginLinkOnce is how often a link is sent to the same address
+	loginLinkOnce = time.Minute
+	// loginLinkBrowserKey is kept in the session of the browser which asked for a
+	// link, to tell whether the link is followed on the same one
+	loginLinkBrowserKey = "loginLinkBrowser"
+)
+
+// loginLink is what is kept in Redis for a link which hasn't been used
+type loginLink struct {
+	UserID      int       `json:"user_id"`
+	Browser     string    `json:"browser"`
+	UserAgent   string    `json:"user_agent"`
+	IP          string    `json:"ip"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+// Device describes the browser and operating system which asked for the link
+func (l *loginLink) Device() string {
+	return describeDevice(l.UserAgent)
+}
+
+// takeScript gets a key and deletes it, so only one caller ever gets it
+var takeScript = redis.NewScript(1, `
+local v = redis.call('GET', KEYS[1])
+if v then
+	redis.call('DEL', KEYS[1])
+end
+return v
+`)
+
+func loginLinkKey(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return "login-link:" + hex.EncodeToString(hash[:])
+}
+
+// PostLoginLink emails a login link to the address entered. The answer is the same
+// whether or not there is an account for it, so the form can't be used to find
+// out who has one.
+func (app *Config) PostLoginLink(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("email")
+	form.IsEmail("email")
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", "Enter your email address to get a login link.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	email := strings.TrimSpace(form.Get("email"))
+
+	if app.shouldSendLoginLink(email) {
+		err = app.sendLoginLink(r, email)
+		if err != nil {
+			app.ErrorLog.Println("sending login link:", err)
+		}
+	}
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("If there is an account for %s, we've emailed it a link to log in. The link works once, for %d minutes.", email, loginLinkMinutes))
+	http.Redirect(w, r, "/login", http.StatusSeeOther)
+}
+
+// sendLoginLink emails a login link to the user with the address, if there is an
+// active one
+func (app *Config) sendLoginLink(r *http.Request, email string) error {
+	user, err := app.Models.User.GetByEmail(email)
+	if err != nil || user.Active == 0 {
+		return nil
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	browser := app.Session.GetString(r.Context(), loginLinkBrowserKey)
+	if browser == "" {
+		browser, err = randomToken()
+		if err != nil {
+			return err
+		}
+		app.Session.Put(r.Context(), loginLinkBrowserKey, browser)
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+
+	link, err := json.Marshal(loginLink{
+		UserID:      user.ID,
+		Browser:     browser,
+		UserAgent:   userAgent,
+		IP:          clientIP(r),
+		RequestedAt: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	expiry := time.Duration(loginLinkMinutes) * time.Minute
+	_, err = conn.Do("SET", loginLinkKey(token), link, "PX", expiry.Milliseconds())
+	if err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("token", token)
+	signedURL := GenerateTokenFromString(fmt.Sprintf("http://localhost:8080/login/link?%s", query.Encode()))
+
+	app.sendEmail(Message{
+		To:       user.Email,
+		Subject:  "Your login link",
+		Template: "login-link",
+		DataMap: map[string]any{
+			"link":    template.HTML(signedURL),
+			"minutes": loginLinkMinutes,
+			"device":  describeDevice(userAgent),
+			"ip":      clientIP(r),
+		},
+	})
+
+	app.audit(withUser(r, user), data.AuditLoginLinkRequested, "user", user.ID, map[string]any{"email": user.Email})
+
+	return nil
+}
+
+// shouldSendLoginLink reports whether a login link may be sent to email. It is
+// true at most once per loginLinkOnce, so nobody can flood an inbox with them.
+func (app *Config) shouldSendLoginLink(email string) bool {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	_, err := redis.String(conn.Do("SET", accountKey("link", email), 1, "NX", "PX", loginLinkOnce.Milliseconds()))
+	if errors.Is(err, redis.ErrNil) {
+		return false
+	}
+	if err != nil {
+		app.ErrorLog.Println("checking login link throttle:", err)
+		return false
+	}
+
+	return true
+}
+
+// LoginLinkPage is where a login link goes. It asks the user to confirm the login,
+// warning them if the link was asked for on another device.
+func (app *Config) LoginLinkPage(w http.ResponseWriter, r *http.Request) {
+	testURL := fmt.Sprintf("http://localhost:8080%s", r.RequestURI)
+	if !VerifyToken(testURL) || Expired(testURL, loginLinkMinutes) {
+		app.Session.Put(r.Context(), "error", "Invalid or expired login link.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+
+	link, err := app.getLoginLink(token)
+	if err != nil {
+		if !errors.Is(err, redis.ErrNil) {
+			app.ErrorLog.Println(err)
+		}
+		app.Session.Put(r.Context(), "error", "This login link has already been used, or has expired.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	app.render(w, r, "login-link.page.gohtml", &TemplateData{
+		StringMap: map[string]string{"token": token},
+		Data: map[string]any{
+			"link":         link,
+			"unrecognized": !app.sameBrowser(r, link),
+		},
+	})
+}
+
+// PostLoginLinkPage uses up a login link and logs the user in, as a password would
+func (app *Config) PostLoginLinkPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	link, err := app.takeLoginLink(r.PostForm.Get("token"))
+	if err != nil {
+		if !errors.Is(err, redis.ErrNil) {
+			app.ErrorLog.Println(err)
+		}
+		app.Session.Put(r.Context(), "error", "This login link has already been used, or has expired.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(link.UserID)
+	if err != nil || user.Active == 0 {
+		app.Session.Put(r.Context(), "error", "Unable to log in.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	unrecognized := !app.sameBrowser(r, link)
+	app.Session.Remove(r.Context(), loginLinkBrowserKey)
+
+	app.audit(withUser(r, user), data.AuditLoginLinkUsed, "user", user.ID, map[string]any{
+		"unrecognized_device": unrecognized,
+	})
+
+	if unrecognized && app.emailPreferences(user.ID).LoginAlerts {
+		app.sendEmail(Message{
+			To:      user.Email,
+			Subject: "New login to your account",
+			Data: fmt.Sprintf("Your login link was used on %s from %s, which isn't the device that asked for it. "+
+				"If this wasn't you, change your password and log out of your other sessions.",
+				describeDevice(r.UserAgent()), clientIP(r)),
+		})
+	}
+
+	_ = app.Session.RenewToken(r.Context())
+	app.completeLogin(w, r, user)
+}
+
+// sameBrowser reports whether the request comes from the browser which asked for
+// the login link
+func (app *Config) sameBrowser(r *http.Request, link *loginLink) bool {
+	browser := app.Session.GetString(r.Context(), loginLinkBrowserKey)
+
+	return browser != "" && browser == link.Browser
+}
+
+// getLoginLink returns the login link with the token, leaving it unused
+func (app *Config) getLoginLink(token string) (*loginLink, error) {
+	if token == "" {
+		return nil, redis.ErrNil
+	}
+
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	return decodeLoginLink(redis.Bytes(conn.Do("GET", loginLinkKey(token))))
+}
+
+// takeLoginLink returns the login link with the token and removes it, so it can't
+// be used again
+func (app *Config) takeLoginLink(token string) (*loginLink, error) {
+	if token == "" {
+		return nil, redis.ErrNil
+	}
+
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	return decodeLoginLink(redis.Bytes(takeScript.Do(conn, loginLinkKey(token))))
+}
+
+func decodeLoginLink(b []byte, err error) (*loginLink, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	var link loginLink
+	err = json.Unmarshal(b, &link)
+	if err != nil {
+		return nil, err
+	}
+
+	return &link, nil
+}
+
+// randomToken returns 32 random bytes, encoded for use in a URL
+func randomToken() (string, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
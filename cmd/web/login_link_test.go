@@ -0,0 +1,180 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"subscription-service/data"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/go-alone"
+)
+
+// testLoginLinkApp returns an app with a user jane@example.com, which keeps the
+// email it sends rather than sending it
+func testLoginLinkApp(t *testing.T) *Config {
+	t.Helper()
+
+	redisApp := testRedis(t)
+	testSigner(t)
+	pathToTemplates = "./templates"
+
+	user := data.User{ID: 42, Email: "jane@example.com", Active: 1, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+
+	app := testApp(t, &fakeDatabase{rows: userRows(user)})
+	app.Redis = redisApp.Redis
+	app.Wait = &sync.WaitGroup{}
+	app.Mailer = Mail{MailerChan: make(chan Message, 10)}
+
+	return app
+}
+
+// requestLoginLink asks for a login link for jane@example.com, and returns the link
+// emailed
+func requestLoginLink(t *testing.T, app *Config) string {
+	t.Helper()
+
+	r := withSession(t, app, httptest.NewRequest(http.MethodPost, "/login/link", nil))
+
+	err := app.sendLoginLink(r, "jane@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-app.Mailer.MailerChan:
+		link := string(msg.DataMap["link"].(template.HTML))
+		t.Cleanup(func() {
+			conn := app.Redis.Get()
+			defer conn.Close()
+			_, _ = conn.Do("DEL", loginLinkKey(linkToken(t, link)))
+		})
+		return link
+	default:
+		t.Fatal("no login link was emailed")
+		return ""
+	}
+}
+
+// TestLoginLink runs against Redis, so it is skipped unless REDIS is set
+func TestLoginLink(t *testing.T) {
+	const used = "This login link has already been used, or has expired."
+
+	// the steps a test takes with the link
+	const (
+		open    = "open"
+		confirm = "confirm"
+		expire  = "expire"
+	)
+
+	tests := []struct {
+		name  string
+		steps []string
+		// wantStatus is the status of the last step
+		wantStatus int
+		wantError  string
+		wantLogin  bool
+	}{
+		{"opened", []string{open}, http.StatusOK, "", false},
+		{"opened twice", []string{open, open}, http.StatusOK, "", false},
+		{"confirmed", []string{open, confirm}, http.StatusSeeOther, "", true},
+		{"confirmed after being opened twice", []string{open, open, confirm}, http.StatusSeeOther, "", true},
+		{"opened after being confirmed", []string{open, confirm, open}, http.StatusSeeOther, used, false},
+		{"confirmed twice", []string{open, confirm, confirm}, http.StatusSeeOther, used, false},
+		{"opened after it expired", []string{expire, open}, http.StatusSeeOther, used, false},
+		{"confirmed after it expired", []string{open, expire, confirm}, http.StatusSeeOther, used, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := testLoginLinkApp(t)
+
+			link := requestLoginLink(t, app)
+			token := linkToken(t, link)
+
+			var (
+				w *httptest.ResponseRecorder
+				r *http.Request
+			)
+			for _, step := range tt.steps {
+				w = httptest.NewRecorder()
+
+				switch step {
+				case open:
+					r = withSession(t, app, requestFor(link))
+					app.LoginLinkPage(w, r)
+
+				case confirm:
+					form := url.Values{"token": {token}}
+					r = httptest.NewRequest(http.MethodPost, "/login/link", strings.NewReader(form.Encode()))
+					r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+					r = withSession(t, app, r)
+					app.PostLoginLinkPage(w, r)
+
+				case expire:
+					conn := app.Redis.Get()
+					_, err := conn.Do("PEXPIRE", loginLinkKey(token), 1)
+					conn.Close()
+					if err != nil {
+						t.Fatal(err)
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := app.Session.GetString(r.Context(), "error"); got != tt.wantError {
+				t.Errorf("error = %q, want %q", got, tt.wantError)
+			}
+			if loggedIn := app.Session.GetInt(r.Context(), "userID") == 42; loggedIn != tt.wantLogin {
+				t.Errorf("logged in = %v, want %v", loggedIn, tt.wantLogin)
+			}
+		})
+	}
+}
+
+// TestLoginLinkPageForgedLink follows links which are turned away before Redis is
+// asked, so it runs without it
+func TestLoginLinkPageForgedLink(t *testing.T) {
+	testSigner(t)
+
+	byToken := "/login/link?" + url.Values{"token": {"token"}}.Encode()
+
+	tests := []struct {
+		name string
+		link string
+	}{
+		{"unsigned link", byToken},
+		{"link signed with another key", signedWith(t, "abc123abc123abc123", "http://localhost:8080"+byToken)},
+		{"link which has expired", signedAt(t, "http://localhost:8080"+byToken, time.Now().Add(-(loginLinkMinutes+1)*time.Minute))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := testApp(t, &fakeDatabase{})
+			app.Redis = noRedis
+
+			r := withSession(t, app, requestFor(tt.link))
+			app.LoginLinkPage(httptest.NewRecorder(), r)
+
+			if got := app.Session.GetString(r.Context(), "error"); got != "Invalid or expired login link." {
+				t.Errorf("error = %q, want the link refused", got)
+			}
+		})
+	}
+}
+
+// signedAt signs a link as GenerateTokenFromString would have at a time gone by
+func signedAt(t *testing.T, link string, at time.Time) string {
+	t.Helper()
+
+	s := goalone.New(secretKey, goalone.Epoch(time.Now().Unix()-at.Unix()), goalone.Timestamp)
+
+	return string(s.Sign([]byte(link + "&hash=")))
+}
@@ -67,8 +67,6 @@ func (m *Mail) sendMail(msg Message, errorChan chan error) {
 		msg.FromName = m.FromName
 	}
 
-
-
 	if msg.AttachmentMap == nil {
 		msg.AttachmentMap = make(map[string]string)
 	}
@@ -120,8 +118,8 @@ func (m *Mail) sendMail(msg Message, errorChan chan error) {
 	}
 
 	if len(msg.AttachmentMap) > 0 {
-		for key , value := range msg.AttachmentMap {
-			email.AddAttachment(value,key)
+		for key, value := range msg.AttachmentMap {
+			email.AddAttachment(value, key)
 		}
 	}
 
@@ -139,8 +137,8 @@ func (m *Mail) buildHTMLMessage(msg Message) (string, error) {
 		return "", err
 	}
 	var tpl bytes.Buffer
-	if err = t.ExecuteTemplate(&tpl, "body", msg.Data); err != nil {
-		return "", nil
+	if err = t.ExecuteTemplate(&tpl, "body", msg.DataMap); err != nil {
+		return "", err
 	}
 	formattedMessage := tpl.String()
 	formattedMessage, err = m.inlineCSS(formattedMessage)
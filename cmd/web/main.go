@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/gob"
 	"fmt"
@@ -8,7 +9,10 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"subscription-service/data"
+	"subscription-service/oidc"
+	"subscription-service/passwords"
 	"sync"
 	"syscall"
 	"time"
@@ -27,8 +31,9 @@ func main() {
 	//connect db
 	db := initDB()
 
-	// create sessions
-	session := initSession()
+	// create sessions, stored in redis
+	redisPool := initRedis()
+	session := initSession(redisPool)
 
 	//create loggers
 	infoLog := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime|log.Lshortfile)
@@ -39,14 +44,39 @@ func main() {
 	wg := sync.WaitGroup{}
 	//set up application config
 	app := Config{
-		Session:  session,
-		DB:       db,
-		InfoLog:  infoLog,
-		ErrorLog: errorLog,
-		Wait:     &wg,
-		Models:   data.New(db),
-		ErrorChan: make(chan error),
-		ErrorChanDone: make(chan bool),
+		Session:        session,
+		DB:             db,
+		Redis:          redisPool,
+		InfoLog:        infoLog,
+		ErrorLog:       errorLog,
+		Wait:           &wg,
+		Models:         data.New(db),
+		Payments:       &ManualPayments{},
+		PasswordPolicy: initPasswordPolicy(),
+		InternalAPIKey: os.Getenv("INTERNAL_API_KEY"),
+		ErrorChan:      make(chan error),
+		ErrorChanDone:  make(chan bool),
+		RenewalsDone:   make(chan bool),
+		WebhookNudge:   make(chan bool, 1),
+		WebhooksDone:   make(chan bool),
+	}
+	// set up password hashing
+	data.UsePasswordHashing(initPasswordHashing())
+	// a password change logs the user out everywhere
+	data.UseSessionRevoker(&app)
+	// set up logging in with an identity provider
+	app.OIDC, app.OIDCName = app.initOIDC()
+	// set up domain events
+	app.Events = NewEventBus(app.Wait, app.ErrorLog)
+	app.registerSubscribers()
+	// set up signed urls
+	signingKey := os.Getenv("URL_SIGNING_KEY")
+	if signingKey == "" {
+		infoLog.Println("URL_SIGNING_KEY is not set, so signed links will stop working when the app restarts")
+	}
+	err := NewURLSigner(signingKey)
+	if err != nil {
+		log.Panic(err)
 	}
 	// set up email
 	app.Mailer = app.createMail()
@@ -55,17 +85,21 @@ func main() {
 	go app.listenFotShutdown()
 	//listen for errors
 	go app.listenForErrors()
+	//renew subscriptions and chase failed payments
+	go app.listenForRenewals()
+	//deliver webhooks
+	go app.listenForWebhooks()
 	//listen for web connection
 	app.serve()
 }
 
-func (app *Config) listenForErrors(){
+func (app *Config) listenForErrors() {
 	for {
-		select{
+		select {
 		case err := <-app.ErrorChan:
 			app.ErrorLog.Panicln(err)
 		case <-app.ErrorChanDone:
-			return	
+			return
 		}
 	}
 }
@@ -130,13 +164,13 @@ func openDB(dsn string) (*sql.DB, error) {
 	return db, nil
 }
 
-func initSession() *scs.SessionManager {
+func initSession(redisPool *redis.Pool) *scs.SessionManager {
+	// users are no longer kept in the session, but sessions from before may hold one
 	gob.Register(data.User{})
-	
 
 	session := scs.New()
 	// Initialize Redis for session storage
-	session.Store = redisstore.New(initRedis())
+	session.Store = redisstore.New(redisPool)
 	session.Lifetime = 24 * time.Hour
 	session.Cookie.Persist = true
 	session.Cookie.SameSite = http.SameSiteLaxMode
@@ -155,6 +189,80 @@ func initRedis() *redis.Pool {
 	return redisPool
 }
 
+// initPasswordPolicy returns the default password policy, with any of its rules
+// overridden by the PASSWORD_MIN_LENGTH, PASSWORD_MIN_CLASSES and
+// PASSWORD_CHECK_BREACHED environment variables
+func initPasswordPolicy() passwords.Policy {
+	policy := passwords.DefaultPolicy()
+
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_LENGTH")); err == nil {
+		policy.MinLength = n
+	}
+	if n, err := strconv.Atoi(os.Getenv("PASSWORD_MIN_CLASSES")); err == nil {
+		policy.MinClasses = n
+	}
+	if b, err := strconv.ParseBool(os.Getenv("PASSWORD_CHECK_BREACHED")); err == nil {
+		policy.CheckBreached = b
+	}
+
+	return policy
+}
+
+// initPasswordHashing hashes passwords with argon2id, or with bcrypt if the
+// PASSWORD_HASHER environment variable is "bcrypt". Hashes made by the other
+// algorithm are still verified, and replaced on the next login.
+func initPasswordHashing() passwords.Hashing {
+	hashing := passwords.DefaultHashing()
+
+	if os.Getenv("PASSWORD_HASHER") == "bcrypt" {
+		hashing = passwords.Hashing{
+			Preferred: passwords.Bcrypt{Cost: 12},
+			Legacy:    []passwords.Hasher{passwords.DefaultArgon2id()},
+		}
+	}
+
+	return hashing
+}
+
+// initOIDC discovers the OpenID Connect provider set by the OIDC_ISSUER,
+// OIDC_CLIENT_ID and OIDC_CLIENT_SECRET environment variables, and returns it along
+// with its name from OIDC_NAME. Logging in with a provider is off if OIDC_ISSUER
+// isn't set, or the provider can't be reached.
+func (app *Config) initOIDC() (*oidc.Provider, string) {
+	issuer := os.Getenv("OIDC_ISSUER")
+	if issuer == "" {
+		return nil, ""
+	}
+
+	redirectURL := os.Getenv("OIDC_REDIRECT_URL")
+	if redirectURL == "" {
+		redirectURL = "http://localhost:8080/login/oidc/callback"
+	}
+
+	name := os.Getenv("OIDC_NAME")
+	if name == "" {
+		name = "single sign-on"
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	provider, err := oidc.Discover(ctx, oidc.Config{
+		Issuer:       issuer,
+		ClientID:     os.Getenv("OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("OIDC_CLIENT_SECRET"),
+		RedirectURL:  redirectURL,
+		Scopes:       []string{"email", "profile"},
+		HTTPClient:   &http.Client{Timeout: 10 * time.Second},
+	})
+	if err != nil {
+		app.ErrorLog.Println("logging in with an identity provider is off:", err)
+		return nil, ""
+	}
+
+	return provider, name
+}
+
 func (app *Config) listenFotShutdown() {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -165,35 +273,41 @@ func (app *Config) listenFotShutdown() {
 
 func (app *Config) shutdown() {
 	app.InfoLog.Println("would run cleanup tasks...")
+	// stop renewing subscriptions
+	app.RenewalsDone <- true
+	// stop delivering webhooks; queued deliveries are sent on the next start
+	app.WebhooksDone <- true
 	// block until wait group
 	app.Wait.Wait()
 	app.Mailer.DoneChan <- true
 	app.ErrorChanDone <- true
-	
+
 	app.InfoLog.Println("closing channels and shuting down.....")
 	close(app.Mailer.MailerChan)
 	close(app.Mailer.DoneChan)
 	close(app.Mailer.ErrorChan)
 	close(app.ErrorChan)
 	close(app.ErrorChanDone)
+	close(app.RenewalsDone)
+	close(app.WebhooksDone)
 }
 
-func (app *Config) createMail() Mail{
+func (app *Config) createMail() Mail {
 	errorChan := make(chan error)
-	mailerChan := make(chan Message,100)
+	mailerChan := make(chan Message, 100)
 	mailerDonChan := make(chan bool)
 
-	m :=Mail{
-		Domain: "localhost",
-		Host: "localhost",
-		Port: 1025,
-		Encryption: "none",
-		FromName: "info",
+	m := Mail{
+		Domain:      "localhost",
+		Host:        "localhost",
+		Port:        1025,
+		Encryption:  "none",
+		FromName:    "info",
 		FromAddress: "info@company.com",
-		Wait: app.Wait,
-		ErrorChan: errorChan,
-		MailerChan: mailerChan,
-		DoneChan: mailerDonChan,
+		Wait:        app.Wait,
+		ErrorChan:   errorChan,
+		MailerChan:  mailerChan,
+		DoneChan:    mailerDonChan,
 	}
-	 return m
-}
\ No newline at end of file
+	return m
+}
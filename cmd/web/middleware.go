@@ -1,18 +1,174 @@
 package main
 
-import "net/http"
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"subscription-service/data"
+)
+
+type contextKey string
+
+const (
+	apiUserKey  = contextKey("apiUser")
+	apiTokenKey = contextKey("apiToken")
+	userKey     = contextKey("user")
+)
 
 func (app *Config) SessionLoad(next http.Handler) http.Handler {
 	return app.Session.LoadAndSave(next)
 
 }
 
-func (app *Config) Auth(next http.Handler) http.Handler{
-	return http.HandlerFunc(func(w http.ResponseWriter , r *http.Request){
-		if !app.Session.Exists(r.Context(),"userID"){
-			app.Session.Put(r.Context(),"error","Log in first")
-			http.Redirect(w,r,"login",http.StatusTemporaryRedirect)
+// LoadUser loads the logged in user from the database once per request, and puts
+// them in the request context for currentUser. Only the user's ID is kept in the
+// session, so the user is never out of date. A session whose user no longer exists
+// is logged out.
+func (app *Config) LoadUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// sessions from before the user was loaded per request still hold a copy
+		if app.Session.Exists(r.Context(), "user") {
+			app.Session.Remove(r.Context(), "user")
+		}
+
+		userID := app.Session.GetInt(r.Context(), "userID")
+		if userID == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		user, err := app.Models.User.GetOne(userID)
+		if errors.Is(err, sql.ErrNoRows) {
+			_ = app.Session.Destroy(r.Context())
+			_ = app.Session.RenewToken(r.Context())
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			app.ErrorLog.Println("loading user:", err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+
+		next.ServeHTTP(w, withUser(r, user))
+	})
+}
+
+// withUser returns a copy of the request with user as the logged in user
+func withUser(r *http.Request, user *data.User) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), userKey, user))
+}
+
+// currentUser returns the logged in user loaded by LoadUser, or nil if nobody is
+// logged in
+func (app *Config) currentUser(r *http.Request) *data.User {
+	user, _ := r.Context().Value(userKey).(*data.User)
+	return user
+}
+
+func (app *Config) Auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !app.Session.Exists(r.Context(), "userID") {
+			app.Session.Put(r.Context(), "error", "Log in first")
+			http.Redirect(w, r, "/login", http.StatusTemporaryRedirect)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// AdminAuth only lets through logged in users who have the is_admin flag set, and
+// two-factor authentication turned on when that is required of admins
+func (app *Config) AdminAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.currentUser(r)
+		if user == nil || user.IsAdmin != 1 {
+			app.Session.Put(r.Context(), "error", "You are not allowed to view that page")
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		if app.twoFactorRequired(r) {
+			if _, err := app.Models.TwoFactor.GetByUserID(user.ID); err != nil {
+				app.Session.Put(r.Context(), "warning", "Admin accounts must use two-factor authentication. Please turn it on.")
+				http.Redirect(w, r, "/members/2fa", http.StatusSeeOther)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireGoodStanding keeps members whose subscription is past due out of the rest
+// of the members area, and sends them to the billing page to settle the payment
+func (app *Config) RequireGoodStanding(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sub, err := app.Models.Subscription.GetByUserID(app.Session.GetInt(r.Context(), "userID"))
+		if err == nil && sub.IsPastDue() {
+			app.Session.Put(r.Context(), "warning", "Your last payment failed. Please check your billing details and retry the payment.")
+			http.Redirect(w, r, "/members/billing", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// APIAuth authenticates requests to the JSON API with a personal access token sent
+// as a bearer token, and puts the token and its user in the request context. It
+// does not use the session, so the API can be called without a cookie.
+func (app *Config) APIAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Authorization")
+
+		plainText, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || plainText == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api"`)
+			app.errorJSON(w, http.StatusUnauthorized, "unauthenticated", "Authentication required.")
+			return
 		}
-		next.ServeHTTP(w,r)
+
+		token, err := app.Models.Token.GetByPlainText(strings.TrimSpace(plainText))
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				app.ErrorLog.Println(err)
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api", error="invalid_token"`)
+			app.errorJSON(w, http.StatusUnauthorized, "unauthenticated", "Invalid or revoked token.")
+			return
+		}
+
+		user, err := app.Models.User.GetOne(token.UserID)
+		if err != nil {
+			app.ErrorLog.Println(err)
+			app.errorJSON(w, http.StatusUnauthorized, "unauthenticated", "Invalid or revoked token.")
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), apiUserKey, user)
+		ctx = context.WithValue(ctx, apiTokenKey, token)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
-}
\ No newline at end of file
+}
+
+// RequireScope only lets through API requests whose token was granted scope
+func (app *Config) RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, ok := r.Context().Value(apiTokenKey).(*data.Token)
+			if !ok || !token.HasScope(scope) {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="api", error="insufficient_scope", scope="%s"`, scope))
+				app.errorJSON(w, http.StatusForbidden, "insufficient_scope", fmt.Sprintf("This token lacks the %s scope.", scope))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// apiUser returns the user authenticated by APIAuth
+func (app *Config) apiUser(r *http.Request) *data.User {
+	user, _ := r.Context().Value(apiUserKey).(*data.User)
+	return user
+}
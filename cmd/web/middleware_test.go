@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"subscription-service/data"
+	"sync"
+	"testing"
+	"time"
+)
+
+const pastDueWarning = "Your last payment failed. Please check your billing details and retry the payment."
+
+// subscriptionRows answers the lookup of the subscription of user 42 with one in
+// status, or finds none if status is empty; other queries go to rows, if set
+func subscriptionRows(status string, rows func(query string, args []driver.Value) ([]string, [][]driver.Value)) func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+	return func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		if strings.Contains(query, "from user_plans where user_id = $1") {
+			if status == "" || args[0] != int64(42) {
+				return nil, nil
+			}
+
+			var pastDueSince any
+			if status == data.SubscriptionPastDue {
+				pastDueSince = time.Now().Add(-72 * time.Hour)
+			}
+
+			return []string{"user_id", "plan_id", "status", "current_period_end", "past_due_since", "dunning_step",
+					"last_invoice_id", "created_at", "updated_at"},
+				[][]driver.Value{{int64(42), int64(1), status, time.Now().Add(-72 * time.Hour), pastDueSince, int64(1),
+					nil, time.Now(), time.Now()}}
+		}
+
+		if rows != nil {
+			return rows(query, args)
+		}
+
+		return nil, nil
+	}
+}
+
+func TestRequireGoodStanding(t *testing.T) {
+	tests := []struct {
+		name        string
+		database    *fakeDatabase
+		wantBlocked bool
+	}{
+		{"no subscription", &fakeDatabase{rows: subscriptionRows("", nil)}, false},
+		{"active", &fakeDatabase{rows: subscriptionRows(data.SubscriptionActive, nil)}, false},
+		{"cancelled", &fakeDatabase{rows: subscriptionRows(data.SubscriptionCancelled, nil)}, false},
+		{"past due", &fakeDatabase{rows: subscriptionRows(data.SubscriptionPastDue, nil)}, true},
+		{"database down", &fakeDatabase{err: errors.New("connection refused")}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := testApp(t, tt.database)
+
+			r := withSession(t, app, httptest.NewRequest(http.MethodGet, "/members/tokens", nil))
+			app.Session.Put(r.Context(), "userID", 42)
+
+			var reached bool
+			next := http.HandlerFunc(func(http.ResponseWriter, *http.Request) { reached = true })
+
+			w := httptest.NewRecorder()
+			app.RequireGoodStanding(next).ServeHTTP(w, r)
+
+			if reached == tt.wantBlocked {
+				t.Errorf("handler reached: %v", reached)
+			}
+			if tt.wantBlocked {
+				if location := w.Header().Get("Location"); w.Code != http.StatusSeeOther || location != "/members/billing" {
+					t.Errorf("got %d to %q, want a redirect to /members/billing", w.Code, location)
+				}
+				if warning := app.Session.GetString(r.Context(), "warning"); warning != pastDueWarning {
+					t.Errorf("warning = %q", warning)
+				}
+			}
+		})
+	}
+}
+
+// TestMembersGoodStanding checks which pages of the members area a member whose
+// subscription is past due is kept out of
+func TestMembersGoodStanding(t *testing.T) {
+	pathToTemplates = "./templates"
+
+	user := data.User{ID: 42, Email: "jane@example.com", Active: 1, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+
+	tests := []struct {
+		method      string
+		path        string
+		wantBlocked bool
+	}{
+		{http.MethodGet, "/billing", false},
+		{http.MethodGet, "/profile", false},
+		{http.MethodPost, "/profile/email-preferences", false},
+		{http.MethodGet, "/tokens", true},
+		{http.MethodPost, "/tokens", true},
+		{http.MethodPost, "/tokens/1/revoke", true},
+		{http.MethodGet, "/account/export", true},
+		{http.MethodGet, "/email", true},
+		{http.MethodPost, "/password", true},
+		{http.MethodGet, "/sessions", true},
+		{http.MethodPost, "/sessions/revoke-others", true},
+		{http.MethodGet, "/2fa", true},
+		{http.MethodGet, "/plans", true},
+		{http.MethodPost, "/subscribe", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			app := testApp(t, &fakeDatabase{rows: subscriptionRows(data.SubscriptionPastDue, userRows(user))})
+			app.Redis = noRedis
+			app.Wait = &sync.WaitGroup{}
+			app.Events = NewEventBus(app.Wait, app.ErrorLog)
+
+			r := withSession(t, app, httptest.NewRequest(tt.method, tt.path, nil))
+			app.Session.Put(r.Context(), "userID", user.ID)
+			r = withUser(r, &user)
+
+			app.authRouter().ServeHTTP(httptest.NewRecorder(), r)
+
+			if blocked := app.Session.GetString(r.Context(), "warning") == pastDueWarning; blocked != tt.wantBlocked {
+				t.Errorf("sent to settle the payment: %v, want %v", blocked, tt.wantBlocked)
+			}
+		})
+	}
+}
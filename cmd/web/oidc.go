@@ -0,0 +1,216 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+	"subscription-service/data"
+	"subscription-service/oidc"
+	"time"
+	"unicode/utf8"
+)
+
+// oidcTimeout is how long a user has to log in at the identity provider
+const oidcTimeout = 10 * time.Minute
+
+// OIDCLoginPage sends the user to the identity provider to log in. What is needed
+// to check their return is kept in the session.
+func (app *Config) OIDCLoginPage(w http.ResponseWriter, r *http.Request) {
+	if app.OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	req, err := oidc.NewAuthRequest()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to log in.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "oidcState", req.State)
+	app.Session.Put(r.Context(), "oidcNonce", req.Nonce)
+	app.Session.Put(r.Context(), "oidcVerifier", req.CodeVerifier)
+	app.Session.Put(r.Context(), "oidcStartedAt", time.Now().Unix())
+
+	http.Redirect(w, r, app.OIDC.AuthCodeURL(req), http.StatusSeeOther)
+}
+
+// OIDCCallback is where the identity provider sends the user back to. The code it
+// sends along is exchanged for an ID token, which says who the user is there.
+func (app *Config) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if app.OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	// each sign in can only come back once
+	state := app.Session.PopString(r.Context(), "oidcState")
+	nonce := app.Session.PopString(r.Context(), "oidcNonce")
+	verifier := app.Session.PopString(r.Context(), "oidcVerifier")
+	startedAt := app.Session.GetInt64(r.Context(), "oidcStartedAt")
+	app.Session.Remove(r.Context(), "oidcStartedAt")
+
+	query := r.URL.Query()
+	if state == "" || subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(state)) != 1 ||
+		time.Since(time.Unix(startedAt, 0)) > oidcTimeout {
+		app.Session.Put(r.Context(), "error", "Your login expired. Please try again.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if reason := query.Get("error"); reason != "" {
+		app.audit(r, data.AuditLoginFailed, "user", nil, map[string]any{"reason": "identity provider: " + reason})
+		app.Session.Put(r.Context(), "error", "Unable to log in with "+app.OIDCName+".")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	tokens, err := app.OIDC.Exchange(r.Context(), query.Get("code"), verifier)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to log in with "+app.OIDCName+".")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	claims, err := app.OIDC.VerifyIDToken(r.Context(), tokens.IDToken, nonce)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.audit(r, data.AuditLoginFailed, "user", nil, map[string]any{"reason": "invalid ID token"})
+		app.Session.Put(r.Context(), "error", "Unable to log in with "+app.OIDCName+".")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.oidcUser(r, claims)
+	if errors.Is(err, errUnverifiedEmail) {
+		app.Session.Put(r.Context(), "error", app.OIDCName+" has not verified your email address, so you can't log in with it.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to log in.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	_ = app.Session.RenewToken(r.Context())
+	app.completeLogin(w, r, user)
+}
+
+var errUnverifiedEmail = errors.New("identity provider has not verified the email address")
+
+// oidcUser returns the user an account at the identity provider belongs to. An
+// account seen for the first time is linked to the user with the same email
+// address, or a new user is created for it; either way the provider must have
+// verified the address, or anyone could claim someone else's.
+func (app *Config) oidcUser(r *http.Request, claims *oidc.Claims) (*data.User, error) {
+	issuer := app.OIDC.Issuer()
+
+	identity, err := app.Models.Identity.GetBySubject(issuer, claims.Subject)
+	if err == nil {
+		err = identity.Touch()
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+
+		return app.Models.User.GetOne(identity.UserID)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	email := strings.TrimSpace(claims.Email)
+	if email == "" || !claims.EmailVerified {
+		return nil, errUnverifiedEmail
+	}
+
+	user, err := app.Models.User.GetByEmail(email)
+	if errors.Is(err, sql.ErrNoRows) {
+		user, err = app.registerOIDCUser(r, claims, email)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the provider has shown the address is theirs, as the activation link would
+	if user.Active == 0 {
+		user.Active = 1
+		err = user.Update()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	identityID, err := app.Models.Identity.Insert(data.Identity{
+		UserID:  user.ID,
+		Issuer:  issuer,
+		Subject: claims.Subject,
+		Email:   email,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	app.audit(withUser(r, user), data.AuditIdentityLinked, "user", user.ID, map[string]any{
+		"identity_id": identityID,
+		"issuer":      issuer,
+		"email":       email,
+	})
+
+	return user, nil
+}
+
+// registerOIDCUser creates a user for an account at the identity provider. They
+// get a random password, which nobody knows: they log in through the provider.
+func (app *Config) registerOIDCUser(r *http.Request, claims *oidc.Claims, email string) (*data.User, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	firstName, lastName := claims.GivenName, claims.FamilyName
+	if firstName == "" && lastName == "" {
+		firstName, lastName, _ = strings.Cut(strings.TrimSpace(claims.Name), " ")
+	}
+	if firstName == "" {
+		firstName, _, _ = strings.Cut(email, "@")
+	}
+
+	u := data.User{
+		Email:     email,
+		FirstName: truncateName(firstName),
+		LastName:  truncateName(lastName),
+		Password:  base64.RawURLEncoding.EncodeToString(randomBytes),
+		Active:    1,
+		IsAdmin:   0,
+	}
+
+	userID, err := u.Insert(u)
+	if err != nil {
+		return nil, err
+	}
+
+	app.audit(r, data.AuditRegistered, "user", userID, map[string]any{"email": email, "issuer": app.OIDC.Issuer()})
+
+	return app.Models.User.GetOne(userID)
+}
+
+// truncateName shortens a name from the identity provider to fit the users table
+func truncateName(name string) string {
+	name = strings.TrimSpace(name)
+	for len(name) > 255 {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+
+	return name
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"subscription-service/oidc"
+	"subscription-service/oidc/oidctest"
+	"testing"
+)
+
+// testOIDCApp returns an app which logs in with a mock identity provider, and the
+// server it is running on
+func testOIDCApp(t *testing.T) (*Config, *fakeDatabase, *oidctest.Server, *httptest.Server) {
+	t.Helper()
+
+	database := &fakeDatabase{}
+	app := testApp(t, database)
+	app.OIDCName = "Example"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login/oidc", app.OIDCLoginPage)
+	mux.HandleFunc("/login/oidc/callback", app.OIDCCallback)
+	mux.HandleFunc("/flash", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, app.Session.PopString(r.Context(), "error"))
+	})
+
+	server := httptest.NewServer(app.Session.LoadAndSave(mux))
+	t.Cleanup(server.Close)
+
+	provider := oidctest.NewServer("subscription-service", "s3cret")
+	t.Cleanup(provider.Close)
+
+	var err error
+	app.OIDC, err = oidc.Discover(context.Background(), oidc.Config{
+		Issuer:       provider.URL,
+		ClientID:     provider.ClientID,
+		ClientSecret: provider.ClientSecret,
+		RedirectURL:  server.URL + "/login/oidc/callback",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return app, database, provider, server
+}
+
+func TestOIDCCallback(t *testing.T) {
+	verified := oidctest.User{Subject: "42", Email: "jane@example.com", EmailVerified: true, GivenName: "Jane"}
+	unverified := verified
+	unverified.EmailVerified = false
+	noEmail := verified
+	noEmail.Email = ""
+
+	tests := []struct {
+		name string
+		user oidctest.User
+		// callback changes the query the provider sends the user back with
+		callback  func(query url.Values)
+		replay    bool
+		wantFlash string
+		wantAudit bool
+	}{
+		{
+			name:      "email not verified",
+			user:      unverified,
+			wantFlash: "Example has not verified your email address, so you can't log in with it.",
+		},
+		{
+			name:      "no email",
+			user:      noEmail,
+			wantFlash: "Example has not verified your email address, so you can't log in with it.",
+		},
+		{
+			name:      "state of another sign in",
+			user:      verified,
+			callback:  func(query url.Values) { query.Set("state", query.Get("state")+"x") },
+			wantFlash: "Your login expired. Please try again.",
+		},
+		{
+			name:      "no state",
+			user:      verified,
+			callback:  func(query url.Values) { query.Del("state") },
+			wantFlash: "Your login expired. Please try again.",
+		},
+		{
+			name:      "code of another sign in",
+			user:      verified,
+			callback:  func(query url.Values) { query.Set("code", "forged") },
+			wantFlash: "Unable to log in with Example.",
+		},
+		{
+			name:      "refused at the provider",
+			user:      verified,
+			callback:  func(query url.Values) { query.Del("code"); query.Set("error", "access_denied") },
+			wantFlash: "Unable to log in with Example.",
+			wantAudit: true,
+		},
+		{
+			name:      "sent back twice",
+			user:      unverified,
+			replay:    true,
+			wantFlash: "Your login expired. Please try again.",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, database, provider, server := testOIDCApp(t)
+			provider.SetUser(tt.user)
+
+			jar, _ := cookiejar.New(nil)
+			client := &http.Client{
+				Jar: jar,
+				CheckRedirect: func(*http.Request, []*http.Request) error {
+					return http.ErrUseLastResponse
+				},
+			}
+
+			// to the provider, and back with a code
+			authorizeURL := redirectFrom(t, client, server.URL+"/login/oidc")
+			if !strings.HasPrefix(authorizeURL, provider.URL+"/authorize?") {
+				t.Fatalf("sent to %s, want the provider", authorizeURL)
+			}
+			callback, err := url.Parse(redirectFrom(t, client, authorizeURL))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.callback != nil {
+				query := callback.Query()
+				tt.callback(query)
+				callback.RawQuery = query.Encode()
+			}
+
+			if tt.replay {
+				redirectFrom(t, client, callback.String())
+				_ = get(t, client, server.URL+"/flash")
+			}
+
+			if location := redirectFrom(t, client, callback.String()); location != "/login" {
+				t.Errorf("callback redirected to %s, want /login", location)
+			}
+			if flash := get(t, client, server.URL+"/flash"); flash != tt.wantFlash {
+				t.Errorf("flash = %q, want %q", flash, tt.wantFlash)
+			}
+
+			if database.ran("insert into users") || database.ran("insert into user_identities") {
+				t.Error("an account was created or linked")
+			}
+			if audited := database.ran("insert into audit_log"); audited != tt.wantAudit {
+				t.Errorf("audited = %v, want %v", audited, tt.wantAudit)
+			}
+		})
+	}
+}
+
+func TestOIDCUser(t *testing.T) {
+	tests := []struct {
+		name           string
+		claims         oidc.Claims
+		wantUnverified bool
+	}{
+		{"email not verified", oidc.Claims{Subject: "42", Email: "jane@example.com"}, true},
+		{"no email", oidc.Claims{Subject: "42", EmailVerified: true}, true},
+		{"blank email", oidc.Claims{Subject: "42", Email: "  ", EmailVerified: true}, true},
+		{"email verified", oidc.Claims{Subject: "42", Email: "jane@example.com", EmailVerified: true}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app, database, _, _ := testOIDCApp(t)
+			r := httptest.NewRequest(http.MethodGet, "/login/oidc/callback", nil)
+
+			_, err := app.oidcUser(r, &tt.claims)
+			if errors.Is(err, errUnverifiedEmail) != tt.wantUnverified {
+				t.Fatalf("oidcUser error = %v, want errUnverifiedEmail: %v", err, tt.wantUnverified)
+			}
+
+			// an account already linked is found by its subject, before the email
+			// address is looked at
+			if !database.ran("from user_identities where issuer = $1 and subject = $2") {
+				t.Error("identity wasn't looked up by subject")
+			}
+			if looked := database.ran("from users where lower(email) = lower($1)"); looked == tt.wantUnverified {
+				t.Errorf("looked up the user by email: %v", looked)
+			}
+		})
+	}
+}
+
+// redirectFrom makes a GET request, and returns where it redirects to
+func redirectFrom(t *testing.T, client *http.Client, target string) string {
+	t.Helper()
+
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 300 || resp.StatusCode > 399 {
+		t.Fatalf("GET %s: %s, want a redirect", target, resp.Status)
+	}
+
+	return resp.Header.Get("Location")
+}
+
+func get(t *testing.T, client *http.Client, target string) string {
+	t.Helper()
+
+	resp, err := client.Get(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(body)
+}
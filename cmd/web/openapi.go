@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiRoute describes one endpoint of the JSON API. The same table registers the
+// routes and generates the OpenAPI document, so the two can't drift apart.
+type apiRoute struct {
+	Method  string
+	Pattern string
+	Summary string
+	// Scope is the token scope the endpoint requires; public endpoints have none
+	Scope string
+	// Feature is the plan feature the endpoint requires, if any. Those a user needs
+	// to subscribe, or to see and cancel their subscription, require none.
+	Feature string
+	Handler http.HandlerFunc
+	// Request is a zero value of the request body type, if the endpoint takes one
+	Request any
+	// Response is a zero value of the type in the data field of the response
+	Response  any
+	Status    int
+	Paginated bool
+}
+
+// openAPISchema is the subset of the OpenAPI 3.0 schema object we generate
+type openAPISchema struct {
+	Ref                  string                    `json:"$ref,omitempty"`
+	Type                 string                    `json:"type,omitempty"`
+	Format               string                    `json:"format,omitempty"`
+	Nullable             bool                      `json:"nullable,omitempty"`
+	Minimum              *int                      `json:"minimum,omitempty"`
+	Properties           map[string]*openAPISchema `json:"properties,omitempty"`
+	Required             []string                  `json:"required,omitempty"`
+	AdditionalProperties *bool                     `json:"additionalProperties,omitempty"`
+	Items                *openAPISchema            `json:"items,omitempty"`
+	AllOf                []*openAPISchema          `json:"allOf,omitempty"`
+}
+
+type openAPIDocument struct {
+	OpenAPI    string                               `json:"openapi"`
+	Info       map[string]string                    `json:"info"`
+	Servers    []map[string]string                  `json:"servers"`
+	Paths      map[string]map[string]map[string]any `json:"paths"`
+	Components openAPIComponents                    `json:"components"`
+}
+
+type openAPIComponents struct {
+	Schemas         map[string]*openAPISchema `json:"schemas"`
+	SecuritySchemes map[string]any            `json:"securitySchemes"`
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// newOpenAPIDocument generates the OpenAPI document of the given routes. Named
+// struct types become component schemas, named after the Go type without its api
+// prefix.
+func newOpenAPIDocument(routes []apiRoute) *openAPIDocument {
+	doc := &openAPIDocument{
+		OpenAPI: "3.0.3",
+		Info: map[string]string{
+			"title":   "Subscription Service API",
+			"version": "1",
+		},
+		Servers: []map[string]string{{"url": "/api/v1"}},
+		Paths:   make(map[string]map[string]map[string]any),
+		Components: openAPIComponents{
+			Schemas: make(map[string]*openAPISchema),
+			SecuritySchemes: map[string]any{
+				"bearerAuth": map[string]string{
+					"type":        "http",
+					"scheme":      "bearer",
+					"description": "A personal access token, created on the API Tokens page.",
+				},
+			},
+		},
+	}
+
+	errorSchema := doc.schemaFor(reflect.TypeOf(apiError{}))
+	errorResponse := func(description string) map[string]any {
+		return map[string]any{
+			"description": description,
+			"content":     map[string]any{"application/json": map[string]any{"schema": errorSchema}},
+		}
+	}
+
+	for _, route := range routes {
+		data := &openAPISchema{
+			Type:       "object",
+			Properties: map[string]*openAPISchema{"data": doc.schemaFor(reflect.TypeOf(route.Response))},
+			Required:   []string{"data"},
+		}
+		if route.Paginated {
+			data.Properties["meta"] = doc.schemaFor(reflect.TypeOf(apiMeta{}))
+			data.Required = append(data.Required, "meta")
+		}
+
+		status := route.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		operation := map[string]any{
+			"summary": route.Summary,
+			"responses": map[string]any{
+				strconv.Itoa(status): map[string]any{
+					"description": http.StatusText(status),
+					"content":     map[string]any{"application/json": map[string]any{"schema": data}},
+				},
+				"429":     errorResponse("Rate limit exceeded; see the Retry-After header"),
+				"default": errorResponse("Error"),
+			},
+		}
+		responses := operation["responses"].(map[string]any)
+
+		if route.Scope != "" {
+			operation["description"] = fmt.Sprintf("Requires a token with the %s scope.", route.Scope)
+			operation["security"] = []map[string][]string{{"bearerAuth": {}}}
+			responses["401"] = errorResponse("Missing, invalid or revoked token")
+			responses["403"] = errorResponse("Token lacks the required scope")
+		}
+		if route.Feature != "" {
+			description, _ := operation["description"].(string)
+			operation["description"] = strings.TrimSpace(fmt.Sprintf("%s Requires a plan which includes the %s feature.", description, route.Feature))
+			responses["403"] = errorResponse("Token lacks the required scope, or the plan does not include the " + route.Feature + " feature")
+		}
+
+		if route.Paginated {
+			operation["parameters"] = []map[string]any{
+				{"name": "page", "in": "query", "schema": map[string]any{"type": "integer", "minimum": 1, "default": 1}},
+				{"name": "per_page", "in": "query", "schema": map[string]any{"type": "integer", "minimum": 1, "maximum": maxPerPage, "default": defaultPerPage}},
+			}
+			responses["400"] = errorResponse("Invalid pagination parameters")
+		}
+
+		if route.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": doc.schemaFor(reflect.TypeOf(route.Request))}},
+			}
+			responses["400"] = errorResponse("Malformed request body")
+			responses["422"] = errorResponse("Request body does not match the schema")
+		}
+
+		if doc.Paths[route.Pattern] == nil {
+			doc.Paths[route.Pattern] = make(map[string]map[string]any)
+		}
+		doc.Paths[route.Pattern][strings.ToLower(route.Method)] = operation
+	}
+
+	return doc
+}
+
+// schemaFor returns the schema of a Go type, following the rules of encoding/json
+func (doc *openAPIDocument) schemaFor(t reflect.Type) *openAPISchema {
+	switch {
+	case t == nil:
+		return &openAPISchema{}
+	case t == timeType:
+		return &openAPISchema{Type: "string", Format: "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := doc.schemaFor(t.Elem())
+		if schema.Ref != "" {
+			// siblings of $ref are ignored, so wrap it to make it nullable
+			return &openAPISchema{Nullable: true, AllOf: []*openAPISchema{schema}}
+		}
+		schema.Nullable = true
+		return schema
+	case reflect.Bool:
+		return &openAPISchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &openAPISchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &openAPISchema{Type: "number"}
+	case reflect.String:
+		return &openAPISchema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		return &openAPISchema{Type: "array", Items: doc.schemaFor(t.Elem())}
+	case reflect.Struct:
+		name := strings.TrimPrefix(t.Name(), "api")
+		if _, ok := doc.Components.Schemas[name]; !ok {
+			// reserve the name first, in case the type refers to itself
+			doc.Components.Schemas[name] = &openAPISchema{}
+			*doc.Components.Schemas[name] = *doc.structSchema(t)
+		}
+		return &openAPISchema{Ref: "#/components/schemas/" + name}
+	}
+
+	return &openAPISchema{}
+}
+
+// structSchema lists the exported fields of a struct under their JSON names. Fields
+// without omitempty are required, and only the listed fields are allowed.
+func (doc *openAPIDocument) structSchema(t reflect.Type) *openAPISchema {
+	closed := false
+	schema := &openAPISchema{
+		Type:                 "object",
+		Properties:           make(map[string]*openAPISchema),
+		AdditionalProperties: &closed,
+	}
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		property := doc.schemaFor(field.Type)
+		if x := field.Tag.Get("minimum"); x != "" {
+			minimum, err := strconv.Atoi(x)
+			if err == nil {
+				property.Minimum = &minimum
+			}
+		}
+		schema.Properties[name] = property
+
+		if !slices.Contains(strings.Split(options, ","), "omitempty") {
+			schema.Required = append(schema.Required, name)
+		}
+	}
+
+	return schema
+}
+
+// OpenAPIDocument serves the OpenAPI document of the JSON API
+func (app *Config) OpenAPIDocument(doc *openAPIDocument) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := app.writeJSON(w, http.StatusOK, doc)
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+	}
+}
+
+// ValidateBody rejects request bodies which don't match schema, before they reach
+// the handler. The body is put back so the handler can decode it as usual.
+func (app *Config) ValidateBody(doc *openAPIDocument, schema *openAPISchema) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			maxBytes := 1048576
+			body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxBytes)))
+			if err != nil {
+				app.errorJSON(w, http.StatusBadRequest, "invalid_body", err.Error())
+				return
+			}
+
+			dec := json.NewDecoder(bytes.NewReader(body))
+			dec.UseNumber()
+
+			var value any
+			err = dec.Decode(&value)
+			if err != nil {
+				app.errorJSON(w, http.StatusBadRequest, "invalid_body", "body must be valid JSON")
+				return
+			}
+			if dec.More() {
+				app.errorJSON(w, http.StatusBadRequest, "invalid_body", "body must only contain a single JSON value")
+				return
+			}
+
+			err = doc.validate(schema, value, "body")
+			if err != nil {
+				app.errorJSON(w, http.StatusUnprocessableEntity, "invalid_body", err.Error())
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// validate checks a value decoded with UseNumber against a schema of the document
+func (doc *openAPIDocument) validate(schema *openAPISchema, value any, path string) error {
+	if schema.Ref != "" {
+		resolved, ok := doc.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+		if !ok {
+			return fmt.Errorf("%s: unknown schema %s", path, schema.Ref)
+		}
+		return doc.validate(resolved, value, path)
+	}
+
+	if value == nil {
+		if schema.Nullable || (schema.Type == "" && schema.AllOf == nil) {
+			return nil
+		}
+		return fmt.Errorf("%s must not be null", path)
+	}
+
+	for _, x := range schema.AllOf {
+		err := doc.validate(x, value, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch schema.Type {
+	case "object":
+		object, ok := value.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s must be an object", path)
+		}
+		for _, name := range schema.Required {
+			if _, ok := object[name]; !ok {
+				return fmt.Errorf("%s.%s is required", path, name)
+			}
+		}
+		for name, x := range object {
+			property, ok := schema.Properties[name]
+			if !ok {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					return fmt.Errorf("%s.%s is not allowed", path, name)
+				}
+				continue
+			}
+			err := doc.validate(property, x, path+"."+name)
+			if err != nil {
+				return err
+			}
+		}
+	case "array":
+		array, ok := value.([]any)
+		if !ok {
+			return fmt.Errorf("%s must be an array", path)
+		}
+		for i, x := range array {
+			err := doc.validate(schema.Items, x, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return err
+			}
+		}
+	case "integer", "number":
+		number, ok := value.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s must be a number", path)
+		}
+		if schema.Type == "integer" {
+			if _, err := number.Int64(); err != nil {
+				return fmt.Errorf("%s must be an integer", path)
+			}
+		}
+		if schema.Minimum != nil {
+			x, err := number.Float64()
+			if err != nil || x < float64(*schema.Minimum) {
+				return fmt.Errorf("%s must be at least %d", path, *schema.Minimum)
+			}
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s must be a string", path)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s must be a boolean", path)
+		}
+	case "":
+		// any value
+	default:
+		return errors.New("unsupported schema type " + schema.Type)
+	}
+
+	return nil
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testAPIDocument(t *testing.T) (*Config, []apiRoute, *openAPIDocument) {
+	t.Helper()
+
+	app := &Config{ErrorLog: log.New(io.Discard, "", 0)}
+	routes := app.apiRoutes()
+
+	return app, routes, newOpenAPIDocument(routes)
+}
+
+// TestOpenAPIDocumentIsValid checks the generated document against the rules of
+// OpenAPI 3.0 which the generator could get wrong, on the document as it is served
+func TestOpenAPIDocumentIsValid(t *testing.T) {
+	_, _, doc := testAPIDocument(t)
+
+	b, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var served map[string]any
+	err = json.Unmarshal(b, &served)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := served["openapi"].(string); !regexp.MustCompile(`^3\.0\.\d+$`).MatchString(v) {
+		t.Errorf("openapi = %q, want a 3.0 version", v)
+	}
+	info, _ := served["info"].(map[string]any)
+	for _, key := range []string{"title", "version"} {
+		if v, _ := info[key].(string); v == "" {
+			t.Errorf("info.%s is missing", key)
+		}
+	}
+
+	components, _ := served["components"].(map[string]any)
+	schemas, _ := components["schemas"].(map[string]any)
+	securitySchemes, _ := components["securitySchemes"].(map[string]any)
+
+	for name, x := range schemas {
+		checkSchema(t, "components.schemas."+name, x)
+	}
+	for name, x := range securitySchemes {
+		scheme, _ := x.(map[string]any)
+		switch scheme["type"] {
+		case "apiKey", "http", "oauth2", "openIdConnect":
+		default:
+			t.Errorf("securitySchemes.%s has type %v", name, scheme["type"])
+		}
+	}
+
+	methods := map[string]bool{"get": true, "put": true, "post": true, "delete": true, "options": true, "head": true, "patch": true, "trace": true}
+	statusCode := regexp.MustCompile(`^[1-5]\d\d$`)
+
+	paths, _ := served["paths"].(map[string]any)
+	if len(paths) == 0 {
+		t.Fatal("document has no paths")
+	}
+
+	for path, x := range paths {
+		if !strings.HasPrefix(path, "/") {
+			t.Errorf("path %q does not start with /", path)
+		}
+
+		for method, y := range x.(map[string]any) {
+			where := method + " " + path
+			if !methods[method] {
+				t.Errorf("%s: %q is not an HTTP method", where, method)
+			}
+			operation := y.(map[string]any)
+
+			responses, _ := operation["responses"].(map[string]any)
+			if len(responses) == 0 {
+				t.Errorf("%s has no responses", where)
+			}
+			for code, z := range responses {
+				if code != "default" && !statusCode.MatchString(code) {
+					t.Errorf("%s: response %q is not a status code", where, code)
+				}
+				response := z.(map[string]any)
+				if v, _ := response["description"].(string); v == "" {
+					t.Errorf("%s: response %s has no description", where, code)
+				}
+				checkContent(t, where+" response "+code, response["content"])
+			}
+
+			if body, ok := operation["requestBody"].(map[string]any); ok {
+				checkContent(t, where+" requestBody", body["content"])
+			}
+
+			if parameters, ok := operation["parameters"].([]any); ok {
+				for _, z := range parameters {
+					parameter := z.(map[string]any)
+					name, _ := parameter["name"].(string)
+					switch parameter["in"] {
+					case "query", "header", "path", "cookie":
+					default:
+						t.Errorf("%s: parameter %s is in %v", where, name, parameter["in"])
+					}
+					checkSchema(t, where+" parameter "+name, parameter["schema"])
+				}
+			}
+
+			if security, ok := operation["security"].([]any); ok {
+				for _, z := range security {
+					for name := range z.(map[string]any) {
+						if securitySchemes[name] == nil {
+							t.Errorf("%s: unknown security scheme %s", where, name)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	// every reference has to resolve, and can't have siblings, which 3.0 ignores
+	var checkRefs func(where string, x any)
+	checkRefs = func(where string, x any) {
+		switch x := x.(type) {
+		case map[string]any:
+			if ref, ok := x["$ref"].(string); ok {
+				name, found := strings.CutPrefix(ref, "#/components/schemas/")
+				if !found || schemas[name] == nil {
+					t.Errorf("%s: $ref %s does not resolve", where, ref)
+				}
+				if len(x) > 1 {
+					t.Errorf("%s: $ref %s has siblings", where, ref)
+				}
+			}
+			for key, y := range x {
+				checkRefs(where+"."+key, y)
+			}
+		case []any:
+			for i, y := range x {
+				checkRefs(where+"["+strconv.Itoa(i)+"]", y)
+			}
+		}
+	}
+	checkRefs("", served)
+}
+
+func checkContent(t *testing.T, where string, content any) {
+	t.Helper()
+
+	if content == nil {
+		return
+	}
+	for mediaType, x := range content.(map[string]any) {
+		checkSchema(t, where+" "+mediaType, x.(map[string]any)["schema"])
+	}
+}
+
+// checkSchema checks a schema object and the schemas nested in it
+func checkSchema(t *testing.T, where string, x any) {
+	t.Helper()
+
+	schema, ok := x.(map[string]any)
+	if !ok {
+		t.Errorf("%s: schema is %T, not an object", where, x)
+		return
+	}
+
+	if _, ok := schema["$ref"]; ok {
+		return
+	}
+
+	properties, _ := schema["properties"].(map[string]any)
+
+	switch schema["type"] {
+	case nil:
+		if schema["allOf"] == nil && len(schema) > 0 {
+			t.Errorf("%s: schema has no type", where)
+		}
+	case "object":
+	case "array":
+		if schema["items"] == nil {
+			t.Errorf("%s: array has no items", where)
+		}
+	case "string", "integer", "number", "boolean":
+		if properties != nil {
+			t.Errorf("%s: %v has properties", where, schema["type"])
+		}
+	default:
+		t.Errorf("%s: unknown type %v", where, schema["type"])
+	}
+
+	if required, ok := schema["required"].([]any); ok {
+		for _, name := range required {
+			if _, ok := properties[name.(string)]; !ok {
+				t.Errorf("%s: required %v is not a property", where, name)
+			}
+		}
+	}
+
+	for name, y := range properties {
+		checkSchema(t, where+"."+name, y)
+	}
+	if items, ok := schema["items"]; ok {
+		checkSchema(t, where+"[]", items)
+	}
+	if allOf, ok := schema["allOf"].([]any); ok {
+		for i, y := range allOf {
+			checkSchema(t, where+".allOf["+strconv.Itoa(i)+"]", y)
+		}
+	}
+}
+
+func TestOpenAPIDocumentHasEveryRoute(t *testing.T) {
+	_, routes, doc := testAPIDocument(t)
+
+	operations := 0
+	for _, methods := range doc.Paths {
+		operations += len(methods)
+	}
+	if operations != len(routes) {
+		t.Errorf("document has %d operations, want one for each of the %d routes", operations, len(routes))
+	}
+
+	for _, route := range routes {
+		where := route.Method + " " + route.Pattern
+
+		operation, ok := doc.Paths[route.Pattern][strings.ToLower(route.Method)]
+		if !ok {
+			t.Errorf("%s is not in the document", where)
+			continue
+		}
+
+		if operation["summary"] != route.Summary {
+			t.Errorf("%s: summary = %v, want %q", where, operation["summary"], route.Summary)
+		}
+
+		_, secured := operation["security"]
+		if secured != (route.Scope != "") {
+			t.Errorf("%s: security = %v, want it only with a scope", where, secured)
+		}
+
+		_, hasBody := operation["requestBody"]
+		if hasBody != (route.Request != nil) {
+			t.Errorf("%s: requestBody = %v, want it only with a request type", where, hasBody)
+		}
+
+		_, hasParameters := operation["parameters"]
+		if hasParameters != route.Paginated {
+			t.Errorf("%s: parameters = %v, want them only when paginated", where, hasParameters)
+		}
+
+		status := route.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		responses := operation["responses"].(map[string]any)
+		if _, ok := responses[strconv.Itoa(status)]; !ok {
+			t.Errorf("%s has no %d response", where, status)
+		}
+	}
+}
+
+// TestOpenAPIResponsesMatchSchemas encodes a value of every response type the way
+// the handlers do, and validates it against the schema the document gives for it
+func TestOpenAPIResponsesMatchSchemas(t *testing.T) {
+	_, routes, doc := testAPIDocument(t)
+
+	for _, route := range routes {
+		where := route.Method + " " + route.Pattern
+
+		envelope := apiResponse{Data: sampleValue(reflect.TypeOf(route.Response)).Interface()}
+		if route.Paginated {
+			envelope.Meta = newAPIMeta(1, defaultPerPage, 1)
+		}
+
+		b, err := json.Marshal(envelope)
+		if err != nil {
+			t.Fatalf("%s: %v", where, err)
+		}
+
+		status := route.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		response := doc.Paths[route.Pattern][strings.ToLower(route.Method)]["responses"].(map[string]any)[strconv.Itoa(status)]
+		schema := response.(map[string]any)["content"].(map[string]any)["application/json"].(map[string]any)["schema"].(*openAPISchema)
+
+		err = doc.validate(schema, decodeWithNumbers(t, b), "response")
+		if err != nil {
+			t.Errorf("%s: %s does not match its schema: %v", where, b, err)
+		}
+	}
+}
+
+// sampleValue returns a value of type t with a single element in each slice and
+// every pointer set, so that nested schemas are exercised too
+func sampleValue(t reflect.Type) reflect.Value {
+	v := reflect.New(t).Elem()
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		v.Set(sampleValue(t.Elem()).Addr())
+	case reflect.Slice:
+		v.Set(reflect.Append(reflect.MakeSlice(t, 0, 1), sampleValue(t.Elem())))
+	case reflect.Struct:
+		if t == timeType {
+			break
+		}
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				v.Field(i).Set(sampleValue(t.Field(i).Type))
+			}
+		}
+	}
+
+	return v
+}
+
+func decodeWithNumbers(t *testing.T, b []byte) any {
+	t.Helper()
+
+	dec := json.NewDecoder(strings.NewReader(string(b)))
+	dec.UseNumber()
+
+	var value any
+	err := dec.Decode(&value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return value
+}
+
+func TestValidateBody(t *testing.T) {
+	app, _, doc := testAPIDocument(t)
+	schema := doc.schemaFor(reflect.TypeOf(apiSubscribeRequest{}))
+
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantError  string
+	}{
+		{"valid", `{"plan_id": 2}`, http.StatusOK, ""},
+		{"missing field", `{}`, http.StatusUnprocessableEntity, "body.plan_id is required"},
+		{"string for integer", `{"plan_id": "2"}`, http.StatusUnprocessableEntity, "body.plan_id must be a number"},
+		{"boolean for integer", `{"plan_id": true}`, http.StatusUnprocessableEntity, "body.plan_id must be a number"},
+		{"fraction for integer", `{"plan_id": 2.5}`, http.StatusUnprocessableEntity, "body.plan_id must be an integer"},
+		{"null for integer", `{"plan_id": null}`, http.StatusUnprocessableEntity, "body.plan_id must not be null"},
+		{"below the minimum", `{"plan_id": 0}`, http.StatusUnprocessableEntity, "body.plan_id must be at least 1"},
+		{"unknown field", `{"plan_id": 2, "coupon": "FREE"}`, http.StatusUnprocessableEntity, "body.coupon is not allowed"},
+		{"array for object", `[{"plan_id": 2}]`, http.StatusUnprocessableEntity, "body must be an object"},
+		{"null body", `null`, http.StatusUnprocessableEntity, "body must not be null"},
+		{"not JSON", `plan_id=2`, http.StatusBadRequest, "body must be valid JSON"},
+		{"empty", ``, http.StatusBadRequest, "body must be valid JSON"},
+		{"two values", `{"plan_id": 2}{"plan_id": 3}`, http.StatusBadRequest, "body must only contain a single JSON value"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received string
+			next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				received = string(b)
+			})
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/subscription", strings.NewReader(tt.body))
+			app.ValidateBody(doc, schema)(next).ServeHTTP(w, r)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+
+			if tt.wantError == "" {
+				if received != tt.body {
+					t.Errorf("handler got body %q, want %q", received, tt.body)
+				}
+				return
+			}
+
+			var out apiError
+			err := json.Unmarshal(w.Body.Bytes(), &out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.Error.Code != "invalid_body" || out.Error.Message != tt.wantError {
+				t.Errorf("error = %s %q, want invalid_body %q", out.Error.Code, out.Error.Message, tt.wantError)
+			}
+			if received != "" {
+				t.Error("handler was called with an invalid body")
+			}
+		})
+	}
+}
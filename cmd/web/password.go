@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"subscription-service/data"
+	"subscription-service/forms"
+)
+
+// checkPassword checks the password in a form field against the password policy,
+// adding an error to the field for each rule it breaks. personal holds the user's
+// own details, which the password mustn't contain.
+func (app *Config) checkPassword(form *forms.Form, field string, personal ...string) {
+	if !form.Has(field) {
+		return
+	}
+
+	for _, problem := range app.PasswordPolicy.Check(form.Get(field), personal...) {
+		form.Errors.Add(field, problem)
+	}
+}
+
+// PostChangePasswordPage changes the password of the logged in user, who has to
+// enter their current one first. The form is on the profile page.
+func (app *Config) PostChangePasswordPage(w http.ResponseWriter, r *http.Request) {
+	user := app.currentUser(r)
+	if user == nil {
+		app.Session.Put(r.Context(), "error", "Log in first!")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("current-password", "password", "verify-password")
+	form.Matches("verify-password", "password")
+	app.checkPassword(form, "password", user.Email, user.FirstName, user.LastName)
+
+	if form.Has("current-password") {
+		matches, err := user.PasswordMatches(form.Get("current-password"))
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+		form.Check(matches, "current-password", "Your current password is not right")
+	}
+
+	if !form.Valid() {
+		// never send passwords back
+		form.Del("current-password")
+		form.Del("password")
+		form.Del("verify-password")
+
+		app.renderProfilePage(w, r, form, "Please correct the errors below.")
+		return
+	}
+
+	err = user.ResetPassword(form.Get("password"))
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to change password.")
+		http.Redirect(w, r, "/members/profile", http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, data.AuditPasswordChanged, "user", user.ID, nil)
+
+	// every session was revoked with the old password; this one carries on as new
+	_ = app.Session.RenewToken(r.Context())
+	app.trackSession(r, user.ID)
+
+	app.Session.Put(r.Context(), "flash", "Password changed. You have been logged out everywhere else.")
+	http.Redirect(w, r, "/members/profile", http.StatusSeeOther)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"subscription-service/data"
+	"subscription-service/forms"
+)
+
+func (app *Config) ProfilePage(w http.ResponseWriter, r *http.Request) {
+	app.renderProfilePage(w, r, forms.New(nil), "")
+}
+
+// renderProfilePage renders the profile page of the logged in user. form holds a
+// submitted form with errors, if there is one; the names are filled in from the
+// user when it doesn't have them.
+func (app *Config) renderProfilePage(w http.ResponseWriter, r *http.Request, form *forms.Form, errorMessage string) {
+	user := app.currentUser(r)
+	if user == nil {
+		app.Session.Put(r.Context(), "error", "Log in first!")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	if _, ok := form.Values["first-name"]; !ok {
+		form.Set("first-name", user.FirstName)
+	}
+	if _, ok := form.Values["last-name"]; !ok {
+		form.Set("last-name", user.LastName)
+	}
+
+	dataMap := make(map[string]any)
+
+	subscription, err := app.Models.Subscription.GetByUserID(user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		app.ErrorLog.Println(err)
+	}
+	if subscription != nil {
+		dataMap["subscription"] = subscription
+
+		plan, err := app.Models.Plan.GetOne(subscription.PlanID)
+		if err != nil {
+			app.ErrorLog.Println(err)
+		} else {
+			dataMap["plan"] = plan
+		}
+	}
+
+	prefs, err := app.Models.EmailPreferences.GetByUserID(user.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		prefs = &data.EmailPreferences{UserID: user.ID, Invoices: true, Manuals: true, LoginAlerts: true}
+	}
+	dataMap["preferences"] = prefs
+
+	_, err = app.Models.TwoFactor.GetByUserID(user.ID)
+	dataMap["twoFactor"] = err == nil
+
+	if errorMessage != "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+
+	app.render(w, r, "profile.page.gohtml", &TemplateData{
+		Data:  dataMap,
+		Form:  form,
+		Error: errorMessage,
+	})
+}
+
+// PostProfilePage changes the names of the logged in user
+func (app *Config) PostProfilePage(w http.ResponseWriter, r *http.Request) {
+	user := app.currentUser(r)
+	if user == nil {
+		app.Session.Put(r.Context(), "error", "Log in first!")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	form := forms.New(r.PostForm)
+	form.Required("first-name", "last-name")
+	form.MaxLength("first-name", 255)
+	form.MaxLength("last-name", 255)
+
+	if !form.Valid() {
+		app.renderProfilePage(w, r, form, "Please correct the errors below.")
+		return
+	}
+
+	before := map[string]any{"first_name": user.FirstName, "last_name": user.LastName}
+
+	user.FirstName = strings.TrimSpace(form.Get("first-name"))
+	user.LastName = strings.TrimSpace(form.Get("last-name"))
+
+	err = user.Update()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to update your profile.")
+		http.Redirect(w, r, "/members/profile", http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, data.AuditProfileUpdated, "user", user.ID, map[string]any{
+		"before": before,
+		"after":  map[string]any{"first_name": user.FirstName, "last_name": user.LastName},
+	})
+
+	app.Session.Put(r.Context(), "flash", "Profile updated")
+	http.Redirect(w, r, "/members/profile", http.StatusSeeOther)
+}
+
+// PostEmailPreferences saves which optional emails the logged in user wants
+func (app *Config) PostEmailPreferences(w http.ResponseWriter, r *http.Request) {
+	userID := app.Session.GetInt(r.Context(), "userID")
+
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	prefs := data.EmailPreferences{
+		UserID:      userID,
+		Invoices:    r.PostForm.Get("invoices") == "1",
+		Manuals:     r.PostForm.Get("manuals") == "1",
+		LoginAlerts: r.PostForm.Get("login-alerts") == "1",
+	}
+
+	err = app.Models.EmailPreferences.Upsert(prefs)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to save your email preferences.")
+		http.Redirect(w, r, "/members/profile", http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, data.AuditProfileUpdated, "user", userID, map[string]any{
+		"email_preferences": map[string]any{
+			"invoices":     prefs.Invoices,
+			"manuals":      prefs.Manuals,
+			"login_alerts": prefs.LoginAlerts,
+		},
+	})
+
+	app.Session.Put(r.Context(), "flash", "Email preferences saved")
+	http.Redirect(w, r, "/members/profile", http.StatusSeeOther)
+}
+
+// emailPreferences returns the email preferences of a user. If they can't be
+// loaded, every email is sent.
+func (app *Config) emailPreferences(userID int) *data.EmailPreferences {
+	prefs, err := app.Models.EmailPreferences.GetByUserID(userID)
+	if err != nil {
+		app.ErrorLog.Println("loading email preferences:", err)
+		return &data.EmailPreferences{UserID: userID, Invoices: true, Manuals: true, LoginAlerts: true}
+	}
+
+	return prefs
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"subscription-service/data"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// rateLimit is a limit on the number of requests a client may make within a sliding
+// window. Limits with different names are counted separately, so a client can use
+// up one without affecting another.
+type rateLimit struct {
+	Name   string
+	Limit  int
+	Window time.Duration
+	// Key identifies the client a request is counted against. Requests for which it
+	// returns "" are not limited.
+	Key func(r *http.Request) string
+	// JSON makes a limited request get an API error rather than a plain text one
+	JSON bool
+}
+
+// slidingWindowScript keeps the time of each request in the window in a sorted set.
+// It drops those which have slid out of the window, and records the new request
+// only if there's room for it. It returns whether the request is allowed, how many
+// requests are in the window, and the time of the oldest one, in milliseconds.
+var slidingWindowScript = redis.NewScript(1, `
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+
+local count = redis.call('ZCARD', KEYS[1])
+local allowed = 0
+if count < limit then
+	redis.call('ZADD', KEYS[1], now, ARGV[4])
+	count = count + 1
+	allowed = 1
+end
+redis.call('PEXPIRE', KEYS[1], window)
+
+local oldest = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+return {allowed, count, tonumber(oldest[2] or now)}
+`)
+
+// RateLimit limits requests according to limit, setting the RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers on every response, and
+// Retry-After on those which are turned away with a 429. If Redis is unavailable
+// requests are let through rather than failing.
+func (app *Config) RateLimit(limit rateLimit) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client := limit.Key(r)
+			if client == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			allowed, remaining, reset, err := app.takeRateLimit(limit, client)
+			if err != nil {
+				app.ErrorLog.Println("checking rate limit:", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			resetSeconds := strconv.Itoa(int(math.Ceil(reset.Seconds())))
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+			w.Header().Set("RateLimit-Reset", resetSeconds)
+
+			if !allowed {
+				w.Header().Set("Retry-After", resetSeconds)
+				if limit.JSON {
+					app.errorJSON(w, http.StatusTooManyRequests, "rate_limited", "Too many requests. Try again later.")
+					return
+				}
+				http.Error(w, "Too many requests. Try again in "+formatWait(reset)+".", http.StatusTooManyRequests)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// takeRateLimit counts a request by client against limit. It returns whether the
+// request is allowed, how many more are, and how long until the window has room again.
+func (app *Config) takeRateLimit(limit rateLimit, client string) (bool, int, time.Duration, error) {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	now := time.Now().UnixMilli()
+	window := limit.Window.Milliseconds()
+
+	member, err := randomHex(8)
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	key := fmt.Sprintf("ratelimit:%s:%s", limit.Name, client)
+	values, err := redis.Int64s(slidingWindowScript.Do(conn, key, now, window, limit.Limit, fmt.Sprintf("%d-%s", now, member)))
+	if err != nil {
+		return false, 0, 0, err
+	}
+
+	allowed, count, oldest := values[0] == 1, int(values[1]), values[2]
+
+	reset := time.Duration(max(oldest+window-now, 0)) * time.Millisecond
+
+	return allowed, max(limit.Limit-count, 0), reset, nil
+}
+
+// rateLimitByIP counts requests against the client's IP address
+func (app *Config) rateLimitByIP(r *http.Request) string {
+	return "ip:" + clientIP(r)
+}
+
+// rateLimitByUser counts requests against the logged in user, or the IP address of
+// visitors who aren't logged in
+func (app *Config) rateLimitByUser(r *http.Request) string {
+	if userID := app.Session.GetInt(r.Context(), "userID"); userID > 0 {
+		return "user:" + strconv.Itoa(userID)
+	}
+
+	return app.rateLimitByIP(r)
+}
+
+// rateLimitByToken counts API requests against the token they were authenticated
+// with, or the IP address of those which weren't. A bearer token which hasn't been
+// checked counts for nothing, so making one up doesn't get a client a new allowance.
+func (app *Config) rateLimitByToken(r *http.Request) string {
+	if token, ok := r.Context().Value(apiTokenKey).(*data.Token); ok {
+		return "token:" + strconv.Itoa(token.ID)
+	}
+
+	return app.rateLimitByIP(r)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"subscription-service/data"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// TestSlidingWindowScript runs the script against Redis with the clock under the
+// test's control, so it is skipped unless REDIS is set
+func TestSlidingWindowScript(t *testing.T) {
+	app := testRedis(t)
+	key := "ratelimit:" + testKeyPrefix(t)
+
+	conn := app.Redis.Get()
+	defer conn.Close()
+	t.Cleanup(func() { _, _ = conn.Do("DEL", key) })
+
+	const limit, window = 3, 1000
+
+	// each step is a request at a time after the start, in milliseconds
+	steps := []struct {
+		at          int64
+		wantAllowed int64
+		wantCount   int64
+		wantOldest  int64
+	}{
+		{0, 1, 1, 0},
+		{100, 1, 2, 0},
+		{200, 1, 3, 0},
+		{300, 0, 3, 0},     // full
+		{999, 0, 3, 0},     // still full until the first slides out
+		{1000, 1, 3, 100},  // the first has slid out, making room
+		{1050, 0, 3, 100},  // a turned away request isn't counted
+		{1100, 1, 3, 200},  // and doesn't hold up the next
+		{5000, 1, 1, 5000}, // all have slid out
+		{5000, 1, 2, 5000}, // requests in the same millisecond are counted apart
+		{5001, 1, 3, 5000},
+		{5002, 0, 3, 5000},
+	}
+
+	start := time.Now().UnixMilli()
+	for i, step := range steps {
+		now := start + step.at
+		values, err := redis.Int64s(slidingWindowScript.Do(conn, key, now, window, limit, fmt.Sprintf("%d-%d", now, i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []int64{step.wantAllowed, step.wantCount, start + step.wantOldest}
+		if values[0] != want[0] || values[1] != want[1] || values[2] != want[2] {
+			t.Errorf("request at %dms = allowed %d, count %d, oldest %d; want %d, %d, %d",
+				step.at, values[0], values[1], values[2]-start, want[0], want[1], step.wantOldest)
+		}
+	}
+
+	ttl, err := redis.Int64(conn.Do("PTTL", key))
+	if err != nil || ttl <= 0 || ttl > window {
+		t.Errorf("key expires in %dms (%v), want within the window", ttl, err)
+	}
+}
+
+// TestRateLimit runs against Redis, so it is skipped unless REDIS is set
+func TestRateLimit(t *testing.T) {
+	app := testRedis(t)
+
+	tests := []struct {
+		name string
+		json bool
+	}{
+		{"page", false},
+		{"api", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit := rateLimit{
+				Name:   testKeyPrefix(t),
+				Limit:  2,
+				Window: time.Minute,
+				Key:    app.rateLimitByIP,
+				JSON:   tt.json,
+			}
+			handler := app.RateLimit(limit)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			t.Cleanup(func() {
+				conn := app.Redis.Get()
+				defer conn.Close()
+				_, _ = conn.Do("DEL", "ratelimit:"+limit.Name+":ip:192.0.2.1")
+			})
+
+			for i, want := range []struct {
+				status    int
+				remaining string
+			}{
+				{http.StatusOK, "1"},
+				{http.StatusOK, "0"},
+				{http.StatusTooManyRequests, "0"},
+			} {
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(http.MethodGet, "/", nil)
+				r.RemoteAddr = "192.0.2.1:1234"
+				handler.ServeHTTP(w, r)
+
+				if w.Code != want.status {
+					t.Fatalf("request %d: status = %d, want %d", i+1, w.Code, want.status)
+				}
+				if got := w.Header().Get("RateLimit-Limit"); got != "2" {
+					t.Errorf("request %d: RateLimit-Limit = %q", i+1, got)
+				}
+				if got := w.Header().Get("RateLimit-Remaining"); got != want.remaining {
+					t.Errorf("request %d: RateLimit-Remaining = %q, want %q", i+1, got, want.remaining)
+				}
+				if got := w.Header().Get("RateLimit-Reset"); got != "60" {
+					t.Errorf("request %d: RateLimit-Reset = %q, want 60", i+1, got)
+				}
+
+				if want.status != http.StatusTooManyRequests {
+					continue
+				}
+				if got := w.Header().Get("Retry-After"); got != "60" {
+					t.Errorf("Retry-After = %q, want 60", got)
+				}
+				if isJSON := strings.HasPrefix(w.Header().Get("Content-Type"), "application/json"); isJSON != tt.json {
+					t.Errorf("Content-Type = %q, want JSON: %v", w.Header().Get("Content-Type"), tt.json)
+				}
+			}
+		})
+	}
+}
+
+// TestRateLimitLetsThrough covers the requests which are never counted, which
+// needs no Redis
+func TestRateLimitLetsThrough(t *testing.T) {
+	unavailable := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return nil, errors.New("connection refused")
+		},
+	}
+
+	tests := []struct {
+		name string
+		key  func(r *http.Request) string
+	}{
+		{"client not limited", func(r *http.Request) string { return "" }},
+		{"redis unavailable", func(r *http.Request) string { return "ip:192.0.2.1" }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &Config{Redis: unavailable, ErrorLog: log.New(io.Discard, "", 0)}
+			limit := rateLimit{Name: "test", Limit: 1, Window: time.Minute, Key: tt.key}
+
+			for i := 0; i < 3; i++ {
+				called := false
+				handler := app.RateLimit(limit)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					called = true
+				}))
+
+				w := httptest.NewRecorder()
+				handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+				if !called || w.Code != http.StatusOK {
+					t.Fatalf("request %d: called %v, status %d, want it let through", i+1, called, w.Code)
+				}
+				if got := w.Header().Get("RateLimit-Limit"); got != "" {
+					t.Errorf("request %d: RateLimit-Limit = %q, want none", i+1, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitByToken(t *testing.T) {
+	app := &Config{}
+
+	tests := []struct {
+		name          string
+		authorization string
+		token         *data.Token
+		want          string
+	}{
+		{"anonymous", "", nil, "ip:192.0.2.1"},
+		{"token not checked", "Bearer abc", nil, "ip:192.0.2.1"},
+		{"another token not checked", "Bearer abd", nil, "ip:192.0.2.1"},
+		{"checked token", "Bearer abc", &data.Token{ID: 7}, "token:7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/me", nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.token != nil {
+				r = r.WithContext(context.WithValue(r.Context(), apiTokenKey, tt.token))
+			}
+
+			if got := app.rateLimitByToken(r); got != tt.want {
+				t.Errorf("rateLimitByToken = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestAPIRateLimitKey checks which key each API request is counted against, as
+// the router puts the limit together with authentication
+func TestAPIRateLimitKey(t *testing.T) {
+	user := data.User{ID: 42, Email: "jane@example.com", Active: 1, CreatedAt: time.Now(), UpdatedAt: time.Now()}
+
+	tests := []struct {
+		name          string
+		target        string
+		authorization string
+		tokenValid    bool
+		want          string
+	}{
+		{"public endpoint", "/plans", "", false, "ip:192.0.2.1"},
+		{"public endpoint with a token", "/plans", "Bearer made-up", false, "ip:192.0.2.1"},
+		{"valid token", "/me", "Bearer real", true, "token:1"},
+		{"made up token", "/me", "Bearer made-up", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			database := &fakeDatabase{}
+			if tt.tokenValid {
+				database.rows = apiTokenRows(user, "read")
+			}
+			app := testApp(t, database)
+
+			// Redis records the key each request is counted against, then fails, so
+			// the request is let through
+			var keys []string
+			app.Redis = &redis.Pool{
+				Dial: func() (redis.Conn, error) { return recordingConn{keys: &keys}, nil },
+			}
+
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			r.RemoteAddr = "192.0.2.1:1234"
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			app.apiRouter().ServeHTTP(httptest.NewRecorder(), r)
+
+			var want []string
+			if tt.want != "" {
+				want = []string{"ratelimit:api:" + tt.want}
+			}
+			if !reflect.DeepEqual(keys, want) {
+				t.Errorf("counted against %q, want %q", keys, want)
+			}
+		})
+	}
+}
+
+// recordingConn is a Redis connection which records the key of each script run on
+// it, and fails it
+type recordingConn struct {
+	redis.Conn
+	keys *[]string
+}
+
+func (c recordingConn) Do(command string, args ...any) (any, error) {
+	if command == "EVALSHA" || command == "EVAL" {
+		*c.keys = append(*c.keys, fmt.Sprint(args[2]))
+	}
+
+	return nil, errors.New("not connected")
+}
+
+func (c recordingConn) Err() error   { return nil }
+func (c recordingConn) Close() error { return nil }
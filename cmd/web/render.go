@@ -5,6 +5,7 @@ import (
 	"html/template"
 	"net/http"
 	"subscription-service/data"
+	"subscription-service/forms"
 	"time"
 )
 
@@ -20,7 +21,11 @@ type TemplateData struct {
 	Error         string
 	Authenticated bool
 	Now           time.Time
-	User *data.User
+	User          *data.User
+	// CSRFToken has to be sent back by every form which posts
+	CSRFToken string
+	// Form holds the values and errors of a submitted form which is rendered again
+	Form *forms.Form
 }
 
 func (app *Config) render(w http.ResponseWriter, r *http.Request, t string, td *TemplateData) {
@@ -30,6 +35,7 @@ func (app *Config) render(w http.ResponseWriter, r *http.Request, t string, td *
 		fmt.Sprintf("%s/navbar.partial.gohtml", pathToTemplates),
 		fmt.Sprintf("%s/footer.partial.gohtml", pathToTemplates),
 		fmt.Sprintf("%s/alerts.partial.gohtml", pathToTemplates),
+		fmt.Sprintf("%s/upgrade.partial.gohtml", pathToTemplates),
 	}
 
 	var templateSlice []string
@@ -43,7 +49,7 @@ func (app *Config) render(w http.ResponseWriter, r *http.Request, t string, td *
 		td = &TemplateData{}
 	}
 
-	tmpl, err := template.ParseFiles(templateSlice...)
+	tmpl, err := template.New(t).Funcs(app.templateFuncs(r)).ParseFiles(templateSlice...)
 	if err != nil {
 		app.ErrorLog.Println(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -58,20 +64,25 @@ func (app *Config) render(w http.ResponseWriter, r *http.Request, t string, td *
 }
 
 func (app *Config) AddDefaultData(td *TemplateData, r *http.Request) *TemplateData {
-	td.Flash = app.Session.PopString(r.Context(), "flash")
-	td.Warning = app.Session.PopString(r.Context(), "warning")
-	td.Error = app.Session.PopString(r.Context(), "error")
+	// messages set by the handler itself take precedence over those in the session
+	if msg := app.Session.PopString(r.Context(), "flash"); td.Flash == "" {
+		td.Flash = msg
+	}
+	if msg := app.Session.PopString(r.Context(), "warning"); td.Warning == "" {
+		td.Warning = msg
+	}
+	if msg := app.Session.PopString(r.Context(), "error"); td.Error == "" {
+		td.Error = msg
+	}
 	if app.IsAuthenticated(r) {
 		td.Authenticated = true
-		user , ok := app.Session.Get(r.Context(),"user").(data.User)
-		if !ok {
-			app.ErrorLog.Println("can t get user from session")
-
-		}else{
-			td.User = &user
-		}
+		td.User = app.currentUser(r)
+	}
+	if td.Form == nil {
+		td.Form = forms.New(nil)
 	}
 	td.Now = time.Now()
+	td.CSRFToken = app.csrfToken(r)
 
 	return td
 }
@@ -2,6 +2,9 @@ package main
 
 import (
 	"net/http"
+	"reflect"
+	"subscription-service/data"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -10,29 +13,204 @@ import (
 func (app *Config) routes() http.Handler {
 	mux := chi.NewRouter()
 
+	// limits on the endpoints which send email or create things, so they can't be
+	// hammered; login has its own, stricter throttling as well
+	loginLimit := app.RateLimit(rateLimit{Name: "login", Limit: 20, Window: time.Minute, Key: app.rateLimitByIP})
+	registerLimit := app.RateLimit(rateLimit{Name: "register", Limit: 5, Window: time.Hour, Key: app.rateLimitByIP})
+	loginLinkLimit := app.RateLimit(rateLimit{Name: "login-link", Limit: 5, Window: time.Hour, Key: app.rateLimitByIP})
+
 	mux.Use(middleware.Recoverer)
-	mux.Use(app.SessionLoad)
 
-	mux.Get("/", app.HomePage)
-	mux.Get("/login", app.LoginPage)
-	mux.Post("/login", app.PostLoginPage)
-	mux.Get("/logout", app.LogoutPage)
-	mux.Get("/register", app.RegisterPage)
-	mux.Post("/register", app.PostRegisterPage)
-	mux.Get("/activate-account", app.ActivateAccount)
+	// the JSON API and internal endpoints don't use the session cookie
+	mux.Mount("/api/v1", app.apiRouter())
+	mux.Post("/internal/usage", app.PostUsage)
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.SessionLoad)
+		mux.Use(app.CheckSession)
+		mux.Use(app.LoadUser)
+		mux.Use(app.VerifyCSRF)
+
+		mux.Get("/", app.HomePage)
+		mux.Get("/login", app.LoginPage)
+		mux.With(loginLimit).Post("/login", app.PostLoginPage)
+		mux.Get("/login/2fa", app.TwoFactorLoginPage)
+		mux.With(loginLimit).Post("/login/2fa", app.PostTwoFactorLoginPage)
+		mux.Get("/login/oidc", app.OIDCLoginPage)
+		mux.With(loginLimit).Get("/login/oidc/callback", app.OIDCCallback)
+		mux.With(loginLinkLimit).Post("/login/link", app.PostLoginLink)
+		mux.Get("/login/link", app.LoginLinkPage)
+		mux.With(loginLimit).Post("/login/link/confirm", app.PostLoginLinkPage)
+		mux.Get("/logout", app.LogoutPage)
+		mux.Get("/register", app.RegisterPage)
+		mux.With(registerLimit).Post("/register", app.PostRegisterPage)
+		mux.Get("/activate-account", app.ActivateAccount)
+		mux.Get("/email/confirm", app.ConfirmEmailChange)
+		mux.Get("/email/revert", app.RevertEmailChange)
 
-	mux.Get("/plans", app.ChooseSubscription)
+		mux.Get("/plans", app.ChooseSubscription)
 
+		mux.Mount("/members", app.authRouter())
+		mux.Mount("/admin", app.adminRouter())
+	})
 
-		mux.Mount("/members",app.authRouter())
 	return mux
 }
 
 func (app *Config) authRouter() http.Handler {
 	mux := chi.NewRouter()
 	mux.Use(app.Auth)
-	mux.Get("/plans", app.ChooseSubscription)
-	mux.Get("/subscribe",app.SubscribeToPlan)
+
+	subscribeLimit := app.RateLimit(rateLimit{Name: "subscribe", Limit: 10, Window: time.Hour, Key: app.rateLimitByUser})
+	tokenLimit := app.RateLimit(rateLimit{Name: "tokens", Limit: 20, Window: time.Hour, Key: app.rateLimitByUser})
+	passwordLimit := app.RateLimit(rateLimit{Name: "password", Limit: 10, Window: time.Hour, Key: app.rateLimitByUser})
+	// members with a past due subscription can still settle it, and keep their
+	// contact details up to date while they do
+	mux.Get("/billing", app.BillingPage)
+	mux.Post("/billing", app.PostBillingPage)
+	mux.With(subscribeLimit).Post("/billing/retry", app.RetryPayment)
+	mux.Get("/profile", app.ProfilePage)
+	mux.Post("/profile", app.PostProfilePage)
+	mux.Post("/profile/email-preferences", app.PostEmailPreferences)
+
+	// everything else is closed to them
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.RequireGoodStanding)
+		mux.Get("/tokens", app.TokensPage)
+		mux.With(tokenLimit).Post("/tokens", app.PostTokensPage)
+		mux.Post("/tokens/{id}/revoke", app.RevokeToken)
+		mux.Get("/account/export", app.ExportAccountData)
+		mux.With(passwordLimit).Post("/account/delete", app.PostDeleteAccount)
+		mux.Get("/email", app.ChangeEmailPage)
+		mux.With(passwordLimit).Post("/email", app.PostChangeEmailPage)
+		mux.With(passwordLimit).Post("/password", app.PostChangePasswordPage)
+		mux.Get("/sessions", app.SessionsPage)
+		mux.Post("/sessions/revoke-others", app.PostRevokeOtherSessions)
+		mux.Post("/sessions/{id}/revoke", app.PostRevokeSession)
+		mux.Get("/2fa", app.TwoFactorPage)
+		mux.Post("/2fa", app.PostEnableTwoFactor)
+		mux.Post("/2fa/disable", app.PostDisableTwoFactor)
+		mux.Post("/2fa/recovery-codes", app.PostRecoveryCodes)
+		mux.Get("/plans", app.ChooseSubscription)
+		mux.With(subscribeLimit).Post("/subscribe", app.SubscribeToPlan)
+	})
+
+	return mux
+}
+
+func (app *Config) adminRouter() http.Handler {
+	mux := chi.NewRouter()
+	mux.Use(app.AdminAuth)
+	mux.Get("/invoices", app.AdminInvoicesPage)
+	mux.Get("/invoices/{id}", app.AdminInvoicePage)
+	mux.Post("/invoices/{id}/refund", app.AdminRefundInvoice)
+	mux.Get("/plans", app.AdminPlansPage)
+	mux.Post("/plans/{id}/dunning", app.AdminUpdateDunningSchedule)
+	mux.Post("/plans/{id}/entitlements", app.AdminAddEntitlement)
+	mux.Post("/plans/{id}/entitlements/{entitlementID}/delete", app.AdminDeleteEntitlement)
+	mux.Post("/plans/{id}/metered-prices", app.AdminSaveMeteredPrice)
+	mux.Post("/plans/{id}/metered-prices/{priceID}/delete", app.AdminDeleteMeteredPrice)
+	mux.Get("/webhooks", app.AdminWebhooksPage)
+	mux.Post("/webhooks", app.AdminAddWebhook)
+	mux.Get("/webhooks/{id}", app.AdminWebhookPage)
+	mux.Post("/webhooks/{id}", app.AdminUpdateWebhook)
+	mux.Post("/webhooks/{id}/delete", app.AdminDeleteWebhook)
+	mux.Post("/webhooks/{id}/deliveries/{deliveryID}/redeliver", app.AdminRedeliverWebhook)
+	mux.Get("/audit-log", app.AdminAuditLogPage)
+	mux.Get("/audit-log/export", app.AdminExportAuditLog)
+	mux.Get("/settings", app.AdminSettingsPage)
+	mux.Post("/settings", app.AdminUpdateSettings)
+
+	return mux
+}
+
+func (app *Config) apiRouter() http.Handler {
+	mux := chi.NewRouter()
+	mux.NotFound(app.APINotFound)
+	mux.MethodNotAllowed(app.APIMethodNotAllowed)
+
+	// every API client gets the same allowance, counted by token on the endpoints
+	// which need one, once it has been checked, and by IP address on the others
+	limit := app.RateLimit(rateLimit{Name: "api", Limit: 120, Window: time.Minute, Key: app.rateLimitByToken, JSON: true})
+
+	routes := app.apiRoutes()
+	doc := newOpenAPIDocument(routes)
+
+	mux.With(limit).Get("/openapi.json", app.OpenAPIDocument(doc))
+
+	for _, route := range routes {
+		middlewares := []func(http.Handler) http.Handler{limit}
+		if route.Scope != "" {
+			middlewares = []func(http.Handler) http.Handler{app.APIAuth, limit, app.RequireScope(route.Scope)}
+		}
+		if route.Feature != "" {
+			middlewares = append(middlewares, app.RequireFeature(route.Feature))
+		}
+		if route.Request != nil {
+			middlewares = append(middlewares, app.ValidateBody(doc, doc.schemaFor(reflect.TypeOf(route.Request))))
+		}
+
+		mux.With(middlewares...).Method(route.Method, route.Pattern, route.Handler)
+	}
 
 	return mux
 }
+
+// apiRoutes lists the endpoints of the JSON API, which are both routed and described
+// in the OpenAPI document from this table
+func (app *Config) apiRoutes() []apiRoute {
+	return []apiRoute{
+		{
+			Method:    http.MethodGet,
+			Pattern:   "/plans",
+			Summary:   "List plans",
+			Handler:   app.APIListPlans,
+			Response:  []apiPlan{},
+			Paginated: true,
+		},
+		{
+			Method:   http.MethodGet,
+			Pattern:  "/me",
+			Summary:  "Get the authenticated user",
+			Scope:    data.ScopeRead,
+			Handler:  app.APIGetMe,
+			Response: apiUser{},
+		},
+		{
+			Method:   http.MethodGet,
+			Pattern:  "/subscription",
+			Summary:  "Get the user's subscription",
+			Scope:    data.ScopeRead,
+			Handler:  app.APIGetSubscription,
+			Response: apiSubscription{},
+		},
+		{
+			Method:   http.MethodPost,
+			Pattern:  "/subscription",
+			Summary:  "Subscribe to a plan, replacing any current subscription",
+			Scope:    data.ScopeWrite,
+			Handler:  app.APISubscribe,
+			Request:  apiSubscribeRequest{},
+			Response: apiSubscription{},
+			Status:   http.StatusCreated,
+		},
+		{
+			Method:   http.MethodDelete,
+			Pattern:  "/subscription",
+			Summary:  "Cancel the user's subscription",
+			Scope:    data.ScopeWrite,
+			Handler:  app.APICancelSubscription,
+			Response: apiSubscription{},
+		},
+		{
+			Method:    http.MethodGet,
+			Pattern:   "/invoices",
+			Summary:   "List the user's invoices",
+			Scope:     data.ScopeRead,
+			Feature:   featureAPI,
+			Handler:   app.APIListInvoices,
+			Response:  []apiInvoice{},
+			Paginated: true,
+		},
+	}
+}
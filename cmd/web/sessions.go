@@ -0,0 +1,372 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"subscription-service/data"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/gomodule/redigo/redis"
+)
+
+// Session index. Every logged in session gets a random ID, kept in the session and
+// in a Redis hash of the user's sessions along with the device, IP address and
+// when it was last seen. Revoking a session removes it from the hash; the session
+// itself is destroyed the next time it is used, by CheckSession. Session tokens
+// are never stored in the index, so reading it doesn't let anyone take over a
+// session.
+const (
+	sessionIDKey = "sessionID"
+	// sessionTouchInterval is how often the last seen time of a session is updated
+	sessionTouchInterval = time.Minute
+)
+
+// sessionInfo is one entry of a user's session index
+type sessionInfo struct {
+	ID        string    `json:"id"`
+	UserAgent string    `json:"user_agent"`
+	IP        string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// Device describes the browser and operating system of the session
+func (s *sessionInfo) Device() string {
+	return describeDevice(s.UserAgent)
+}
+
+func sessionIndexKey(userID int) string {
+	return fmt.Sprintf("sessions:user:%d", userID)
+}
+
+// trackSession gives the session of the request a new ID and adds it to the index
+// of the user's sessions. It is called whenever a user logs in.
+func (app *Config) trackSession(r *http.Request, userID int) {
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		app.ErrorLog.Println("tracking session:", err)
+		return
+	}
+
+	userAgent := r.UserAgent()
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+
+	info := sessionInfo{
+		ID:        hex.EncodeToString(randomBytes),
+		UserAgent: userAgent,
+		IP:        clientIP(r),
+		CreatedAt: time.Now(),
+		LastSeen:  time.Now(),
+	}
+
+	app.Session.Put(r.Context(), sessionIDKey, info.ID)
+
+	err = app.saveSessionInfo(userID, &info)
+	if err != nil {
+		app.ErrorLog.Println("tracking session:", err)
+	}
+}
+
+func (app *Config) saveSessionInfo(userID int, info *sessionInfo) error {
+	out, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	key := sessionIndexKey(userID)
+	_ = conn.Send("MULTI")
+	_ = conn.Send("HSET", key, info.ID, out)
+	_ = conn.Send("PEXPIRE", key, app.Session.Lifetime.Milliseconds())
+	_, err = conn.Do("EXEC")
+
+	return err
+}
+
+// touchSessionScript updates a session in the index only if it is still there, so
+// a session revoked since it was read isn't put back
+var touchSessionScript = redis.NewScript(1, `
+if redis.call('HEXISTS', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return 1
+`)
+
+// touchSession saves the last seen time and IP address of a session in the index.
+// It returns redis.ErrNil if the session has been revoked.
+func (app *Config) touchSession(userID int, info *sessionInfo) error {
+	out, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	touched, err := redis.Bool(touchSessionScript.Do(conn, sessionIndexKey(userID), info.ID, out, app.Session.Lifetime.Milliseconds()))
+	if err != nil {
+		return err
+	}
+	if !touched {
+		return redis.ErrNil
+	}
+
+	return nil
+}
+
+// getSessionInfo returns one session of a user from the index, or redis.ErrNil if
+// it has been revoked
+func (app *Config) getSessionInfo(userID int, sessionID string) (*sessionInfo, error) {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	out, err := redis.Bytes(conn.Do("HGET", sessionIndexKey(userID), sessionID))
+	if err != nil {
+		return nil, err
+	}
+
+	var info sessionInfo
+	err = json.Unmarshal(out, &info)
+	if err != nil {
+		return nil, err
+	}
+
+	return &info, nil
+}
+
+// listSessions returns the sessions of a user, most recently seen first. Sessions
+// which have outlived the session lifetime are dropped from the index.
+func (app *Config) listSessions(userID int) ([]*sessionInfo, error) {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	key := sessionIndexKey(userID)
+	entries, err := redis.StringMap(conn.Do("HGETALL", key))
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*sessionInfo
+	for id, out := range entries {
+		var info sessionInfo
+		err := json.Unmarshal([]byte(out), &info)
+		if err != nil || time.Since(info.CreatedAt) > app.Session.Lifetime {
+			_, _ = conn.Do("HDEL", key, id)
+			continue
+		}
+
+		sessions = append(sessions, &info)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+
+	return sessions, nil
+}
+
+// revokeSession removes one session of a user from the index. It reports whether
+// the session was there.
+func (app *Config) revokeSession(userID int, sessionID string) (bool, error) {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	return redis.Bool(conn.Do("HDEL", sessionIndexKey(userID), sessionID))
+}
+
+// RevokeAllSessions logs a user out of every session, including the current one.
+// It is called by the data package when a user's password changes.
+func (app *Config) RevokeAllSessions(userID int) error {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", sessionIndexKey(userID))
+
+	return err
+}
+
+// CheckSession logs out sessions which have been revoked, and keeps the last seen
+// time of the others up to date. If Redis can't be reached requests are let
+// through, as sessions can't be loaded without it anyway.
+func (app *Config) CheckSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userID := app.Session.GetInt(r.Context(), "userID")
+		if userID == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sessionID := app.Session.GetString(r.Context(), sessionIDKey)
+		if sessionID == "" {
+			// logged in before sessions were tracked
+			app.trackSession(r, userID)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		info, err := app.getSessionInfo(userID, sessionID)
+		if err == nil && time.Since(info.LastSeen) > sessionTouchInterval {
+			info.LastSeen = time.Now()
+			info.IP = clientIP(r)
+
+			err = app.touchSession(userID, info)
+		}
+		// revoked, either before the session was read or while it was touched
+		if errors.Is(err, redis.ErrNil) {
+			_ = app.Session.Destroy(r.Context())
+			_ = app.Session.RenewToken(r.Context())
+
+			app.Session.Put(r.Context(), "warning", "You have been logged out. Please log in again.")
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		if err != nil {
+			app.ErrorLog.Println("checking session:", err)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *Config) SessionsPage(w http.ResponseWriter, r *http.Request) {
+	sessions, err := app.listSessions(app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to load your sessions.")
+		http.Redirect(w, r, "/members/profile", http.StatusSeeOther)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["sessions"] = sessions
+	dataMap["current"] = app.Session.GetString(r.Context(), sessionIDKey)
+
+	app.render(w, r, "sessions.page.gohtml", &TemplateData{
+		Data: dataMap,
+	})
+}
+
+// PostRevokeSession logs the user out of one of their sessions
+func (app *Config) PostRevokeSession(w http.ResponseWriter, r *http.Request) {
+	userID := app.Session.GetInt(r.Context(), "userID")
+	sessionID := chi.URLParam(r, "id")
+
+	revoked, err := app.revokeSession(userID, sessionID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to revoke session.")
+		http.Redirect(w, r, "/members/sessions", http.StatusSeeOther)
+		return
+	}
+	if !revoked {
+		http.NotFound(w, r)
+		return
+	}
+
+	app.audit(r, data.AuditSessionRevoked, "user", userID, map[string]any{"sessions": 1})
+
+	if sessionID == app.Session.GetString(r.Context(), sessionIDKey) {
+		_ = app.Session.Destroy(r.Context())
+		_ = app.Session.RenewToken(r.Context())
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Session revoked")
+	http.Redirect(w, r, "/members/sessions", http.StatusSeeOther)
+}
+
+// PostRevokeOtherSessions logs the user out of every session but the current one
+func (app *Config) PostRevokeOtherSessions(w http.ResponseWriter, r *http.Request) {
+	userID := app.Session.GetInt(r.Context(), "userID")
+	current := app.Session.GetString(r.Context(), sessionIDKey)
+
+	sessions, err := app.listSessions(userID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to revoke sessions.")
+		http.Redirect(w, r, "/members/sessions", http.StatusSeeOther)
+		return
+	}
+
+	revoked := 0
+	for _, session := range sessions {
+		if session.ID == current {
+			continue
+		}
+
+		ok, err := app.revokeSession(userID, session.ID)
+		if err != nil {
+			app.ErrorLog.Println(err)
+			app.Session.Put(r.Context(), "error", "Unable to revoke sessions.")
+			http.Redirect(w, r, "/members/sessions", http.StatusSeeOther)
+			return
+		}
+		if ok {
+			revoked++
+		}
+	}
+
+	app.audit(r, data.AuditSessionRevoked, "user", userID, map[string]any{"sessions": revoked})
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("Logged out of %d other sessions", revoked))
+	http.Redirect(w, r, "/members/sessions", http.StatusSeeOther)
+}
+
+// describeDevice makes a short description such as "Firefox on Windows" from a
+// User-Agent header. It only knows the common browsers and systems.
+func describeDevice(userAgent string) string {
+	browser := "Unknown browser"
+	for _, b := range []struct{ token, name string }{
+		// order matters: Edge and Opera also claim to be Chrome, and Chrome claims
+		// to be Safari
+		{"Edg/", "Edge"},
+		{"OPR/", "Opera"},
+		{"Firefox/", "Firefox"},
+		{"Chrome/", "Chrome"},
+		{"Safari/", "Safari"},
+		{"curl/", "curl"},
+	} {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	system := ""
+	for _, s := range []struct{ token, name string }{
+		{"iPhone", "iPhone"},
+		{"iPad", "iPad"},
+		{"Android", "Android"},
+		{"Windows", "Windows"},
+		{"Mac OS X", "macOS"},
+		{"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, s.token) {
+			system = s.name
+			break
+		}
+	}
+
+	if system == "" {
+		return browser
+	}
+
+	return browser + " on " + system
+}
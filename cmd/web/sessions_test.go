@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+// TestTouchSession runs against Redis, so it is skipped unless REDIS is set
+func TestTouchSession(t *testing.T) {
+	app := testRedis(t)
+	app.Session = scs.New()
+	app.Session.Lifetime = time.Hour
+
+	tests := []struct {
+		name    string
+		revoke  func(app *Config, userID int, sessionID string)
+		wantErr error
+	}{
+		{"still there", func(*Config, int, string) {}, nil},
+		{"revoked", func(app *Config, userID int, sessionID string) {
+			_, _ = app.revokeSession(userID, sessionID)
+		}, redis.ErrNil},
+		{"all revoked", func(app *Config, userID int, sessionID string) {
+			_ = app.RevokeAllSessions(userID)
+		}, redis.ErrNil},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a user ID no real user has, different for each run
+			userID := -int(time.Now().UnixNano()%1e9) - i
+			t.Cleanup(func() { _ = app.RevokeAllSessions(userID) })
+
+			info := &sessionInfo{ID: "current", CreatedAt: time.Now().Add(-time.Hour), LastSeen: time.Now().Add(-time.Hour)}
+			err := app.saveSessionInfo(userID, info)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = app.saveSessionInfo(userID, &sessionInfo{ID: "other", CreatedAt: time.Now(), LastSeen: time.Now()})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.revoke(app, userID, info.ID)
+
+			info.LastSeen = time.Now()
+			info.IP = "192.0.2.1"
+			err = app.touchSession(userID, info)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("touchSession error = %v, want %v", err, tt.wantErr)
+			}
+
+			saved, err := app.getSessionInfo(userID, info.ID)
+			if tt.wantErr != nil {
+				if !errors.Is(err, redis.ErrNil) {
+					t.Errorf("revoked session is back in the index: %+v, %v", saved, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if saved.IP != info.IP || !saved.LastSeen.Equal(info.LastSeen) {
+				t.Errorf("saved session = %+v, want it touched", saved)
+			}
+		})
+	}
+}
+
+func TestDescribeDevice(t *testing.T) {
+	tests := []struct {
+		userAgent string
+		want      string
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36", "Chrome on Windows"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Edg/124.0.0.0", "Edge on Windows"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 OPR/109.0.0.0", "Opera on macOS"},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_4) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15", "Safari on macOS"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1", "Safari on iPhone"},
+		{"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36", "Chrome on Android"},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0", "Firefox on Linux"},
+		{"curl/8.5.0", "curl"},
+		{"", "Unknown browser"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := describeDevice(tt.userAgent); got != tt.want {
+				t.Errorf("describeDevice(%q) = %q, want %q", tt.userAgent, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,19 +1,27 @@
 package main
 
 import (
+	"crypto/rand"
 	"fmt"
 	"github.com/bwmarrin/go-alone"
 	"strings"
 	"time"
 )
 
-const secret = "abc123abc123abc123"
-
 var secretKey []byte
 
-// NewURLSigner creates a new signer
-func NewURLSigner() {
-	secretKey = []byte(secret)
+// NewURLSigner sets the key URLs are signed with. Without one, a random key is
+// used, so links which have been sent out stop working when the app restarts.
+func NewURLSigner(key string) error {
+	if key != "" {
+		secretKey = []byte(key)
+		return nil
+	}
+
+	secretKey = make([]byte, 32)
+	_, err := rand.Read(secretKey)
+
+	return err
 }
 
 // GenerateTokenFromString generates a signed token
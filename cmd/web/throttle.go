@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// Login throttling. Failed logins are counted per account and per IP address in
+// Redis, over a fixed window which starts at the first failure. From the third
+// failure on an account each further attempt has to wait, twice as long every
+// time; at ten the account is locked for a while. An IP address which fails too
+// often, across any number of accounts, is locked out the same way.
+const (
+	loginFailureWindow    = 15 * time.Minute
+	loginDelayAfter       = 3
+	loginMaxDelay         = time.Minute
+	accountLockoutAfter   = 10
+	accountLockout        = 15 * time.Minute
+	ipLockoutAfter        = 50
+	ipLockout             = 15 * time.Minute
+	failedLoginNoticeOnce = time.Hour
+)
+
+// incrementScript counts one failure, starting the window on the first
+var incrementScript = redis.NewScript(1, `
+local n = redis.call('INCR', KEYS[1])
+if n == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return n
+`)
+
+func accountKey(kind, email string) string {
+	return fmt.Sprintf("login:%s:account:%s", kind, strings.ToLower(strings.TrimSpace(email)))
+}
+
+func ipKey(kind, ip string) string {
+	return fmt.Sprintf("login:%s:ip:%s", kind, ip)
+}
+
+// loginBlockedFor returns how long a login to the account from the IP address must
+// wait, or 0 if it may go ahead. If Redis is unavailable logins are let through, so
+// an outage doesn't lock everybody out.
+func (app *Config) loginBlockedFor(email, ip string) time.Duration {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	var wait time.Duration
+	for _, key := range []string{accountKey("lock", email), accountKey("wait", email), ipKey("lock", ip)} {
+		ttl, err := redis.Int64(conn.Do("PTTL", key))
+		if err != nil {
+			app.ErrorLog.Println("checking login throttle:", err)
+			return 0
+		}
+
+		wait = max(wait, time.Duration(ttl)*time.Millisecond)
+	}
+
+	return wait
+}
+
+// recordLoginFailure counts a failed login, and sets the delay or lockout which
+// applies to the next attempt. It reports whether the account is now locked.
+func (app *Config) recordLoginFailure(email, ip string) bool {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	window := loginFailureWindow.Milliseconds()
+
+	failures, err := redis.Int(incrementScript.Do(conn, accountKey("failures", email), window))
+	if err != nil {
+		app.ErrorLog.Println("counting failed login:", err)
+		return false
+	}
+
+	ipFailures, err := redis.Int(incrementScript.Do(conn, ipKey("failures", ip), window))
+	if err != nil {
+		app.ErrorLog.Println("counting failed login:", err)
+		return false
+	}
+
+	if ipFailures >= ipLockoutAfter {
+		_, err = conn.Do("SET", ipKey("lock", ip), 1, "PX", ipLockout.Milliseconds())
+		if err != nil {
+			app.ErrorLog.Println("locking out ip:", err)
+		}
+	}
+
+	if failures >= accountLockoutAfter {
+		_, err = conn.Do("SET", accountKey("lock", email), 1, "PX", accountLockout.Milliseconds())
+		if err != nil {
+			app.ErrorLog.Println("locking account:", err)
+		}
+		return true
+	}
+
+	if failures >= loginDelayAfter {
+		_, err = conn.Do("SET", accountKey("wait", email), 1, "PX", loginDelay(failures).Milliseconds())
+		if err != nil {
+			app.ErrorLog.Println("delaying login:", err)
+		}
+	}
+
+	return false
+}
+
+// loginDelay is the wait after the n'th failure: 1s, 2s, 4s, ... up to loginMaxDelay
+func loginDelay(failures int) time.Duration {
+	// capped before converting, as the power soon overflows a Duration
+	seconds := math.Pow(2, float64(failures-loginDelayAfter))
+	return time.Duration(min(seconds, loginMaxDelay.Seconds())) * time.Second
+}
+
+// clearLoginFailures forgets the failures of an account after a successful login.
+// Those of the IP address are kept, as they may be against other accounts.
+func (app *Config) clearLoginFailures(email string) {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", accountKey("failures", email), accountKey("wait", email))
+	if err != nil {
+		app.ErrorLog.Println("clearing failed logins:", err)
+	}
+}
+
+// shouldNotifyFailedLogin reports whether to email the owner of an account about a
+// failed login. It is true at most once per failedLoginNoticeOnce, so a stream of
+// guesses can't be used to flood their inbox.
+func (app *Config) shouldNotifyFailedLogin(email string) bool {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	_, err := redis.String(conn.Do("SET", accountKey("notified", email), 1, "NX", "PX", failedLoginNoticeOnce.Milliseconds()))
+	if err == redis.ErrNil {
+		return false
+	}
+	if err != nil {
+		app.ErrorLog.Println("checking failed login notice:", err)
+		return false
+	}
+
+	return true
+}
+
+// formatWait rounds a wait up to whole seconds or minutes, for messages to the user
+func formatWait(d time.Duration) string {
+	if d > time.Minute {
+		return fmt.Sprintf("%d minutes", int(math.Ceil(d.Minutes())))
+	}
+
+	seconds := int(math.Ceil(d.Seconds()))
+	if seconds == 1 {
+		return "1 second"
+	}
+
+	return fmt.Sprintf("%d seconds", seconds)
+}
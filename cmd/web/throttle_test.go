@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// testRedis returns an app connected to the Redis server named by the REDIS
+// environment variable, as in main, and skips the test if there is none
+func testRedis(t *testing.T) *Config {
+	t.Helper()
+
+	addr := os.Getenv("REDIS")
+	if addr == "" {
+		t.Skip("REDIS is not set")
+	}
+
+	pool := &redis.Pool{
+		MaxIdle: 2,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}
+	t.Cleanup(func() { _ = pool.Close() })
+
+	conn := pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("PING"); err != nil {
+		t.Fatalf("connecting to redis at %s: %v", addr, err)
+	}
+
+	return &Config{
+		Redis:    pool,
+		InfoLog:  log.New(io.Discard, "", 0),
+		ErrorLog: log.New(io.Discard, "", 0),
+	}
+}
+
+// testKeyPrefix keeps the keys of one run apart from any other's
+func testKeyPrefix(t *testing.T) string {
+	return fmt.Sprintf("test-%s-%d", t.Name(), time.Now().UnixNano())
+}
+
+func TestLoginDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{loginDelayAfter, time.Second},
+		{loginDelayAfter + 1, 2 * time.Second},
+		{loginDelayAfter + 3, 8 * time.Second},
+		{loginDelayAfter + 5, 32 * time.Second},
+		{loginDelayAfter + 6, loginMaxDelay},
+		{loginDelayAfter + 40, loginMaxDelay},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.failures), func(t *testing.T) {
+			if got := loginDelay(tt.failures); got != tt.want {
+				t.Errorf("loginDelay(%d) = %s, want %s", tt.failures, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatWait(t *testing.T) {
+	tests := []struct {
+		wait time.Duration
+		want string
+	}{
+		{time.Millisecond, "1 second"},
+		{time.Second, "1 second"},
+		{1001 * time.Millisecond, "2 seconds"},
+		{30 * time.Second, "30 seconds"},
+		{time.Minute, "60 seconds"},
+		{time.Minute + time.Second, "2 minutes"},
+		{accountLockout, "15 minutes"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.wait.String(), func(t *testing.T) {
+			if got := formatWait(tt.wait); got != tt.want {
+				t.Errorf("formatWait(%s) = %q, want %q", tt.wait, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestRecordLoginFailure runs against Redis, so it is skipped unless REDIS is set
+func TestRecordLoginFailure(t *testing.T) {
+	app := testRedis(t)
+	prefix := testKeyPrefix(t)
+	email := prefix + "@example.com"
+	ip := prefix
+
+	for failure := 1; failure <= accountLockoutAfter; failure++ {
+		locked := app.recordLoginFailure(email, ip)
+		wait := app.loginBlockedFor(email, ip)
+
+		switch {
+		case failure < loginDelayAfter:
+			if locked || wait != 0 {
+				t.Errorf("after %d failures: locked %v, wait %s, want neither", failure, locked, wait)
+			}
+		case failure < accountLockoutAfter:
+			if locked || wait <= 0 || wait > loginDelay(failure) {
+				t.Errorf("after %d failures: locked %v, wait %s, want a wait of up to %s", failure, locked, wait, loginDelay(failure))
+			}
+		default:
+			if !locked || wait <= loginMaxDelay {
+				t.Errorf("after %d failures: locked %v, wait %s, want locked out", failure, locked, wait)
+			}
+		}
+	}
+
+	// an unrelated account from the same address isn't held up yet
+	if wait := app.loginBlockedFor("other-"+email, ip); wait != 0 {
+		t.Errorf("other account has to wait %s", wait)
+	}
+
+	// a successful login forgets the failures, but not the lock
+	app.clearLoginFailures(email)
+	conn := app.Redis.Get()
+	defer conn.Close()
+	failures, err := redis.Int(conn.Do("EXISTS", accountKey("failures", email)))
+	if err != nil || failures != 0 {
+		t.Errorf("failures still counted after clearing: %d, %v", failures, err)
+	}
+
+	_, _ = conn.Do("DEL", accountKey("lock", email), ipKey("failures", ip), accountKey("notified", email))
+}
+
+// TestShouldNotifyFailedLogin runs against Redis, so it is skipped unless REDIS is set
+func TestShouldNotifyFailedLogin(t *testing.T) {
+	app := testRedis(t)
+	email := testKeyPrefix(t) + "@example.com"
+
+	if !app.shouldNotifyFailedLogin(email) {
+		t.Error("first failed login is not notified")
+	}
+	for i := 0; i < 3; i++ {
+		if app.shouldNotifyFailedLogin(email) {
+			t.Error("failed login notified again within the hour")
+		}
+	}
+
+	conn := app.Redis.Get()
+	defer conn.Close()
+	_, _ = conn.Do("DEL", accountKey("notified", email))
+}
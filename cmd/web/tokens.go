@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"subscription-service/data"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// maxTokenNameLength matches the size of the name column of api_tokens
+	maxTokenNameLength = 100
+	// tokensWithoutAPI is how many tokens a member whose plan doesn't include the
+	// API may have, to subscribe, or see and cancel their subscription, through it
+	tokensWithoutAPI = 1
+)
+
+func (app *Config) TokensPage(w http.ResponseWriter, r *http.Request) {
+	app.renderTokensPage(w, r, nil, "")
+}
+
+// PostTokensPage creates a personal access token. The token is shown once, on the
+// page rendered in response, and never again; it is not put in the session.
+func (app *Config) PostTokensPage(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Redirect(w, r, "/members/tokens", http.StatusSeeOther)
+		return
+	}
+
+	name := strings.TrimSpace(r.Form.Get("name"))
+	if name == "" || len(name) > maxTokenNameLength {
+		app.renderTokensPage(w, r, nil, "Give the token a name of at most 100 characters.")
+		return
+	}
+
+	var scopes []string
+	for _, scope := range []string{data.ScopeRead, data.ScopeWrite} {
+		if r.Form.Get("scope-"+scope) != "" {
+			scopes = append(scopes, scope)
+		}
+	}
+	if len(scopes) == 0 {
+		app.renderTokensPage(w, r, nil, "Choose at least one scope.")
+		return
+	}
+
+	userID := app.Session.GetInt(r.Context(), "userID")
+
+	tokens, err := app.Models.Token.GetAllForUser(userID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.renderTokensPage(w, r, nil, "Unable to create token.")
+		return
+	}
+	entitlements := app.userEntitlements(r)
+	allowed := withinLimit(entitlements, featureAPI, len(tokens))
+	if !entitlements.Has(featureAPI) {
+		allowed = len(tokens) < tokensWithoutAPI
+	}
+	if !allowed {
+		app.renderTokensPage(w, r, nil, "Your plan doesn't allow any more tokens. Revoke one, or upgrade your plan.")
+		return
+	}
+
+	token, err := app.Models.Token.GenerateToken(userID, name, scopes)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.renderTokensPage(w, r, nil, "Unable to create token.")
+		return
+	}
+
+	tokenID, err := app.Models.Token.Insert(*token)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.renderTokensPage(w, r, nil, "Unable to create token.")
+		return
+	}
+	app.audit(r, data.AuditTokenCreated, "token", tokenID, map[string]any{"name": token.Name, "scopes": token.Scopes})
+
+	app.renderTokensPage(w, r, token, "")
+}
+
+func (app *Config) RevokeToken(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	err = app.Models.Token.Revoke(id, app.Session.GetInt(r.Context(), "userID"))
+	if errors.Is(err, sql.ErrNoRows) {
+		app.Session.Put(r.Context(), "error", "Token not found.")
+		http.Redirect(w, r, "/members/tokens", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to revoke token.")
+		http.Redirect(w, r, "/members/tokens", http.StatusSeeOther)
+		return
+	}
+
+	app.audit(r, data.AuditTokenRevoked, "token", id, nil)
+
+	app.Session.Put(r.Context(), "flash", "Token revoked")
+	http.Redirect(w, r, "/members/tokens", http.StatusSeeOther)
+}
+
+func (app *Config) renderTokensPage(w http.ResponseWriter, r *http.Request, newToken *data.Token, errorMessage string) {
+	tokens, err := app.Models.Token.GetAllForUser(app.Session.GetInt(r.Context(), "userID"))
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to load tokens.")
+		http.Redirect(w, r, "/members/billing", http.StatusSeeOther)
+		return
+	}
+
+	dataMap := make(map[string]any)
+	dataMap["tokens"] = tokens
+	dataMap["newToken"] = newToken
+
+	td := &TemplateData{
+		Data:  dataMap,
+		Error: errorMessage,
+	}
+	if errorMessage != "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+
+	app.render(w, r, "tokens.page.gohtml", td)
+}
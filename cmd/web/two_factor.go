@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"image/png"
+	"net/http"
+	"strings"
+	"subscription-service/data"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pquerna/otp/totp"
+)
+
+const (
+	// twoFactorIssuer is the name authenticator apps show next to the code
+	twoFactorIssuer = "Subscription Service"
+	// twoFactorLoginTimeout is how long a user has to enter their code after their password
+	twoFactorLoginTimeout = 5 * time.Minute
+	// totpReuseWindow covers every code which the skew of totp.Validate accepts, so
+	// an observed code can't be replayed
+	totpReuseWindow = 90 * time.Second
+)
+
+// TwoFactorLoginPage asks a user whose password checked out for their code
+func (app *Config) TwoFactorLoginPage(w http.ResponseWriter, r *http.Request) {
+	if _, ok := app.pendingTwoFactorUser(r); !ok {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	app.render(w, r, "login-2fa.page.gohtml", nil)
+}
+
+// PostTwoFactorLoginPage finishes logging in a user with an authenticator code or
+// one of their recovery codes. Wrong codes count as failed logins.
+func (app *Config) PostTwoFactorLoginPage(w http.ResponseWriter, r *http.Request) {
+	userID, ok := app.pendingTwoFactorUser(r)
+	if !ok {
+		app.Session.Put(r.Context(), "error", "Your login has expired. Please log in again.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.Models.User.GetOne(userID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	ip := clientIP(r)
+	if wait := app.loginBlockedFor(user.Email, ip); wait > 0 {
+		app.Session.Put(r.Context(), "error", fmt.Sprintf("Too many failed attempts. Try again in %s.", formatWait(wait)))
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
+
+	twoFactor, err := app.Models.TwoFactor.GetByUserID(user.ID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to log in.")
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	valid, err := app.checkTwoFactorCode(r, twoFactor, r.PostFormValue("code"), true)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+
+	if !valid {
+		locked := app.recordLoginFailure(user.Email, ip)
+		app.audit(r, data.AuditTwoFactorFailed, "user", user.ID, nil)
+		if locked {
+			app.audit(r, data.AuditLoginLocked, "user", user.ID, map[string]any{"minutes": int(accountLockout.Minutes())})
+		}
+
+		app.Session.Put(r.Context(), "error", "Invalid code")
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Remove(r.Context(), "twoFactorUserID")
+	app.Session.Remove(r.Context(), "twoFactorStartedAt")
+
+	app.logIn(w, r, user)
+}
+
+// pendingTwoFactorUser returns the ID of the user who entered their password, but
+// not yet their code, if they did so recently enough
+func (app *Config) pendingTwoFactorUser(r *http.Request) (int, bool) {
+	userID := app.Session.GetInt(r.Context(), "twoFactorUserID")
+	startedAt := time.Unix(app.Session.GetInt64(r.Context(), "twoFactorStartedAt"), 0)
+
+	if userID == 0 || time.Since(startedAt) > twoFactorLoginTimeout {
+		return 0, false
+	}
+
+	return userID, true
+}
+
+// TwoFactorPage lets a user turn two-factor authentication on, or manage it once it
+// is. While it is off, the page shows a QR code of a new secret for the user to scan.
+func (app *Config) TwoFactorPage(w http.ResponseWriter, r *http.Request) {
+	app.renderTwoFactorPage(w, r, nil, "")
+}
+
+// PostEnableTwoFactor turns on two-factor authentication, once the user proves
+// their app is set up by entering a code from it
+func (app *Config) PostEnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID := app.Session.GetInt(r.Context(), "userID")
+
+	secret := app.Session.GetString(r.Context(), "twoFactorSecret")
+	if secret == "" || !totp.Validate(strings.TrimSpace(r.PostFormValue("code")), secret) {
+		app.renderTwoFactorPage(w, r, nil, "That code isn't right. Check the time on your device, and enter the current code.")
+		return
+	}
+
+	codes, err := app.Models.TwoFactor.GenerateRecoveryCodes()
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.renderTwoFactorPage(w, r, nil, "Unable to turn on two-factor authentication.")
+		return
+	}
+
+	err = app.Models.TwoFactor.Enable(userID, secret, codes)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.renderTwoFactorPage(w, r, nil, "Unable to turn on two-factor authentication.")
+		return
+	}
+
+	app.Session.Remove(r.Context(), "twoFactorSecret")
+	app.audit(r, data.AuditTwoFactorEnabled, "user", userID, nil)
+
+	app.renderTwoFactorPage(w, r, codes, "")
+}
+
+// PostDisableTwoFactor turns off two-factor authentication, given a current code or
+// a recovery code. Admins can't while it is required of them.
+func (app *Config) PostDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	userID := app.Session.GetInt(r.Context(), "userID")
+
+	if app.twoFactorRequired(r) {
+		app.renderTwoFactorPage(w, r, nil, "Two-factor authentication is required for admin accounts.")
+		return
+	}
+
+	twoFactor, err := app.Models.TwoFactor.GetByUserID(userID)
+	if err != nil {
+		http.Redirect(w, r, "/members/2fa", http.StatusSeeOther)
+		return
+	}
+
+	valid, err := app.checkTwoFactorCode(r, twoFactor, r.PostFormValue("code"), true)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+	if !valid {
+		app.renderTwoFactorPage(w, r, nil, "Invalid code")
+		return
+	}
+
+	err = app.Models.TwoFactor.Disable(userID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.renderTwoFactorPage(w, r, nil, "Unable to turn off two-factor authentication.")
+		return
+	}
+
+	app.audit(r, data.AuditTwoFactorDisabled, "user", userID, nil)
+
+	app.Session.Put(r.Context(), "flash", "Two-factor authentication turned off")
+	http.Redirect(w, r, "/members/2fa", http.StatusSeeOther)
+}
+
+// PostRecoveryCodes replaces a user's recovery codes with new ones, given a current
+// code from their authenticator app
+func (app *Config) PostRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	userID := app.Session.GetInt(r.Context(), "userID")
+
+	twoFactor, err := app.Models.TwoFactor.GetByUserID(userID)
+	if err != nil {
+		http.Redirect(w, r, "/members/2fa", http.StatusSeeOther)
+		return
+	}
+
+	valid, err := app.checkTwoFactorCode(r, twoFactor, r.PostFormValue("code"), false)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+	if !valid {
+		app.renderTwoFactorPage(w, r, nil, "Invalid code")
+		return
+	}
+
+	codes, err := app.Models.TwoFactor.GenerateRecoveryCodes()
+	if err == nil {
+		err = app.Models.TwoFactor.ReplaceRecoveryCodes(userID, codes)
+	}
+	if err != nil {
+		app.ErrorLog.Println(err)
+		app.renderTwoFactorPage(w, r, nil, "Unable to create new recovery codes.")
+		return
+	}
+
+	app.audit(r, data.AuditRecoveryCodesReset, "user", userID, nil)
+
+	app.renderTwoFactorPage(w, r, codes, "")
+}
+
+// renderTwoFactorPage renders the two-factor page. Recovery codes are shown once,
+// right after they are generated, and never again.
+func (app *Config) renderTwoFactorPage(w http.ResponseWriter, r *http.Request, recoveryCodes []string, errorMessage string) {
+	userID := app.Session.GetInt(r.Context(), "userID")
+
+	dataMap := make(map[string]any)
+	dataMap["recoveryCodes"] = recoveryCodes
+	dataMap["required"] = app.twoFactorRequired(r)
+
+	twoFactor, err := app.Models.TwoFactor.GetByUserID(userID)
+	switch {
+	case err == nil:
+		remaining, err := app.Models.TwoFactor.RemainingRecoveryCodes(userID)
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+		dataMap["twoFactor"] = twoFactor
+		dataMap["remaining"] = remaining
+
+	case errors.Is(err, sql.ErrNoRows):
+		secret, qrCode, err := app.newTwoFactorSecret(r)
+		if err != nil {
+			app.ErrorLog.Println(err)
+			errorMessage = "Unable to set up two-factor authentication."
+			break
+		}
+		dataMap["secret"] = secret
+		dataMap["qrCode"] = qrCode
+
+	default:
+		app.ErrorLog.Println(err)
+		app.Session.Put(r.Context(), "error", "Unable to load two-factor authentication.")
+		http.Redirect(w, r, "/members/billing", http.StatusSeeOther)
+		return
+	}
+
+	td := &TemplateData{
+		Data:  dataMap,
+		Error: errorMessage,
+	}
+	if errorMessage != "" {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+
+	app.render(w, r, "two-factor.page.gohtml", td)
+}
+
+// newTwoFactorSecret returns the secret the user is setting up, generating one the
+// first time, along with a QR code of it as a data: URL. The secret is kept in the
+// session until the user confirms it with a code.
+func (app *Config) newTwoFactorSecret(r *http.Request) (string, template.URL, error) {
+	user := app.currentUser(r)
+	if user == nil {
+		return "", "", errors.New("nobody is logged in")
+	}
+
+	opts := totp.GenerateOpts{
+		Issuer:      twoFactorIssuer,
+		AccountName: user.Email,
+	}
+
+	// keep the secret the user may already have scanned
+	if secret := app.Session.GetString(r.Context(), "twoFactorSecret"); secret != "" {
+		var err error
+		opts.Secret, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	key, err := totp.Generate(opts)
+	if err != nil {
+		return "", "", err
+	}
+
+	img, err := key.Image(200, 200)
+	if err != nil {
+		return "", "", err
+	}
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, img)
+	if err != nil {
+		return "", "", err
+	}
+
+	app.Session.Put(r.Context(), "twoFactorSecret", key.Secret())
+
+	// the image is ours, so it is safe to mark the URL as trusted
+	return key.Secret(), template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())), nil
+}
+
+// checkTwoFactorCode reports whether code is the current code of the user's
+// authenticator app or, if allowRecovery is set, one of their unused recovery
+// codes. A code which has been accepted once isn't accepted again.
+func (app *Config) checkTwoFactorCode(r *http.Request, twoFactor *data.TwoFactor, code string, allowRecovery bool) (bool, error) {
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return false, nil
+	}
+
+	if totp.Validate(code, twoFactor.Secret) {
+		return app.firstUseOfCode(twoFactor.UserID, code)
+	}
+
+	if !allowRecovery {
+		return false, nil
+	}
+
+	used, err := app.Models.TwoFactor.UseRecoveryCode(twoFactor.UserID, code)
+	if err != nil || !used {
+		return false, err
+	}
+
+	remaining, err := app.Models.TwoFactor.RemainingRecoveryCodes(twoFactor.UserID)
+	if err != nil {
+		app.ErrorLog.Println(err)
+	}
+	app.audit(r, data.AuditRecoveryCodeUsed, "user", twoFactor.UserID, map[string]any{"remaining": remaining})
+
+	return true, nil
+}
+
+// firstUseOfCode records that a user's authenticator code has been used, and
+// reports whether this was the first time
+func (app *Config) firstUseOfCode(userID int, code string) (bool, error) {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	_, err := redis.String(conn.Do("SET", fmt.Sprintf("totp:used:%d:%s", userID, code), 1, "NX", "PX", totpReuseWindow.Milliseconds()))
+	if errors.Is(err, redis.ErrNil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// twoFactorRequired reports whether the logged in user is an admin who must use
+// two-factor authentication
+func (app *Config) twoFactorRequired(r *http.Request) bool {
+	user := app.currentUser(r)
+	if user == nil || user.IsAdmin != 1 {
+		return false
+	}
+
+	required, err := app.Models.Setting.GetBool(data.SettingRequireAdmin2FA)
+	if err != nil {
+		app.ErrorLog.Println(err)
+		// fail closed: it is safer to ask for a code which isn't required
+		return true
+	}
+
+	return required
+}
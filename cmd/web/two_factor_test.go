@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"subscription-service/data"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+// recoveryCodeTable stands in for the recovery_codes table of one user, keeping
+// the hashes data.TwoFactor saves and marking them used as it does
+type recoveryCodeTable struct {
+	mu     sync.Mutex
+	unused map[string]bool
+}
+
+func (c *recoveryCodeTable) exec(query string, args []driver.Value) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case strings.HasPrefix(query, "insert into recovery_codes"):
+		c.unused[string(args[1].([]byte))] = true
+	case strings.HasPrefix(query, "update recovery_codes set used_at"):
+		hash := string(args[2].([]byte))
+		if !c.unused[hash] {
+			return 0
+		}
+		c.unused[hash] = false
+	}
+
+	return 1
+}
+
+func (c *recoveryCodeTable) rows(query string, _ []driver.Value) ([]string, [][]driver.Value) {
+	if !strings.HasPrefix(query, "select count(*) from recovery_codes") {
+		return nil, nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var n int64
+	for _, unused := range c.unused {
+		if unused {
+			n++
+		}
+	}
+
+	return []string{"count"}, [][]driver.Value{{n}}
+}
+
+// TestCheckTwoFactorCode runs against Redis, so it is skipped unless REDIS is set
+func TestCheckTwoFactorCode(t *testing.T) {
+	app := testRedis(t)
+
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: twoFactorIssuer, AccountName: "jane@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := func(at time.Time) string {
+		code, err := totp.GenerateCode(key.Secret(), at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	now := code(time.Now())
+
+	type attempt struct {
+		// user is added to the ID of the test's user, so 1 is another user
+		user int
+		code string
+		want bool
+	}
+
+	tests := []struct {
+		name     string
+		attempts []attempt
+	}{
+		{"current code", []attempt{{0, now, true}}},
+		{"code replayed", []attempt{{0, now, true}, {0, now, false}}},
+		{"code replayed with spaces", []attempt{{0, now, true}, {0, " " + now + " ", false}}},
+		{"same code of another user", []attempt{{0, now, true}, {1, now, true}}},
+		{"code of an hour ago", []attempt{{0, code(time.Now().Add(-time.Hour)), false}}},
+		{"previous and current codes", []attempt{{0, code(time.Now().Add(-30 * time.Second)), true}, {0, now, true}}},
+		{"no code", []attempt{{0, "", false}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userID := int(time.Now().UnixNano() % 1e9)
+			t.Cleanup(func() {
+				conn := app.Redis.Get()
+				defer conn.Close()
+				for _, a := range tt.attempts {
+					_, _ = conn.Do("DEL", fmt.Sprintf("totp:used:%d:%s", userID+a.user, strings.TrimSpace(a.code)))
+				}
+			})
+
+			r := httptest.NewRequest(http.MethodPost, "/login/2fa", nil)
+			for i, a := range tt.attempts {
+				twoFactor := &data.TwoFactor{UserID: userID + a.user, Secret: key.Secret()}
+
+				got, err := app.checkTwoFactorCode(r, twoFactor, a.code, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != a.want {
+					t.Errorf("attempt %d with %q = %v, want %v", i+1, a.code, got, a.want)
+				}
+			}
+		})
+	}
+}
+
+// TestCheckRecoveryCode uses codes no authenticator app would give, so Redis
+// isn't asked
+func TestCheckRecoveryCode(t *testing.T) {
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: twoFactorIssuer, AccountName: "jane@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type attempt struct {
+		code          string
+		allowRecovery bool
+		want          bool
+	}
+
+	tests := []struct {
+		name     string
+		attempts []attempt
+	}{
+		{"recovery code", []attempt{{"k3j9d-2mxq7", true, true}}},
+		{"recovery code used twice", []attempt{{"k3j9d-2mxq7", true, true}, {"k3j9d-2mxq7", true, false}}},
+		{"used recovery code typed another way", []attempt{{"k3j9d-2mxq7", true, true}, {"K3J9D 2MXQ7", true, false}}},
+		{"each recovery code once", []attempt{{"k3j9d-2mxq7", true, true}, {"p8w2n-4hzt6", true, true}}},
+		{"recovery code typed another way", []attempt{{"K3J9D2MXQ7", true, true}}},
+		{"recovery code where not allowed", []attempt{{"k3j9d-2mxq7", false, false}, {"k3j9d-2mxq7", true, true}}},
+		{"unknown recovery code", []attempt{{"aaaaa-bbbbb", true, false}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			codes := &recoveryCodeTable{unused: make(map[string]bool)}
+			app := testApp(t, &fakeDatabase{rows: codes.rows, exec: codes.exec})
+
+			err := app.Models.TwoFactor.Enable(42, key.Secret(), []string{"k3j9d-2mxq7", "p8w2n-4hzt6"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(http.MethodPost, "/login/2fa", nil)
+			twoFactor := &data.TwoFactor{UserID: 42, Secret: key.Secret()}
+			for i, a := range tt.attempts {
+				got, err := app.checkTwoFactorCode(r, twoFactor, a.code, a.allowRecovery)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != a.want {
+					t.Errorf("attempt %d with %q = %v, want %v", i+1, a.code, got, a.want)
+				}
+			}
+		})
+	}
+}
+
+func TestTwoFactorRequired(t *testing.T) {
+	setting := func(value string) *fakeDatabase {
+		return &fakeDatabase{
+			rows: func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+				if value == "" || !strings.HasPrefix(query, "select value from settings") {
+					return nil, nil
+				}
+				return []string{"value"}, [][]driver.Value{{value}}
+			},
+		}
+	}
+
+	admin := &data.User{ID: 1, Email: "admin@example.com", IsAdmin: 1}
+	member := &data.User{ID: 2, Email: "jane@example.com"}
+
+	tests := []struct {
+		name     string
+		user     *data.User
+		database *fakeDatabase
+		want     bool
+	}{
+		{"admin, required", admin, setting("true"), true},
+		{"admin, not required", admin, setting("false"), false},
+		{"admin, never set", admin, setting(""), false},
+		{"admin, database down", admin, &fakeDatabase{err: errors.New("connection refused")}, true},
+		{"admin, setting unreadable", admin, setting("sometimes"), true},
+		{"member, required", member, setting("true"), false},
+		{"member, database down", member, &fakeDatabase{err: errors.New("connection refused")}, false},
+		{"nobody logged in", nil, setting("true"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := testApp(t, tt.database)
+
+			r := httptest.NewRequest(http.MethodGet, "/members/2fa", nil)
+			if tt.user != nil {
+				r = r.WithContext(context.WithValue(r.Context(), userKey, tt.user))
+			}
+
+			if got := app.twoFactorRequired(r); got != tt.want {
+				t.Errorf("twoFactorRequired = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"subscription-service/data"
+	"time"
+)
+
+var metricNameRegex = regexp.MustCompile(`^[a-z0-9_.-]{1,100}$`)
+
+// errInvalidUsage is returned by ReportUsage for reports which can never be recorded
+var errInvalidUsage = errors.New("invalid usage report")
+
+// errUsageNotIncluded is returned by ReportUsage for users whose plan doesn't
+// include metered usage
+var errUsageNotIncluded = errors.New("plan does not include metered usage")
+
+// ReportUsage records quantity units of metered usage of metric by a user. Reports
+// carrying the same non-empty idempotency key are only counted once, so callers can
+// safely retry. Usage of users whose plan doesn't include metered usage is refused.
+func (app *Config) ReportUsage(userID int, metric string, quantity int, idempotencyKey string, recordedAt time.Time) (int, error) {
+	if !metricNameRegex.MatchString(metric) {
+		return 0, fmt.Errorf("%w: bad metric name %q", errInvalidUsage, metric)
+	}
+
+	if quantity <= 0 {
+		return 0, fmt.Errorf("%w: quantity must be positive", errInvalidUsage)
+	}
+
+	if !app.entitlementsFor(userID).Has(featureMeteredUsage) {
+		return 0, errUsageNotIncluded
+	}
+
+	if recordedAt.IsZero() {
+		recordedAt = time.Now()
+	}
+
+	return app.Models.UsageRecord.Insert(data.UsageRecord{
+		UserID:         userID,
+		Metric:         metric,
+		Quantity:       quantity,
+		IdempotencyKey: idempotencyKey,
+		RecordedAt:     recordedAt,
+	})
+}
+
+// usageLineItems prices the usage of a user in [start, end) with the metered prices
+// of a plan, and returns one invoice line item per metric which was used
+func (app *Config) usageLineItems(userID int, planID int, start, end time.Time) ([]*data.LineItem, error) {
+	prices, err := app.Models.MeteredPrice.GetAllForPlan(planID)
+	if err != nil || len(prices) == 0 {
+		return nil, err
+	}
+
+	totals, err := app.Models.UsageRecord.TotalsForPeriod(userID, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []*data.LineItem
+
+	for _, price := range prices {
+		quantity := totals[price.Metric]
+		if quantity == 0 {
+			continue
+		}
+
+		item := &data.LineItem{
+			Description: fmt.Sprintf("%s usage, %s to %s", price.Metric, start.Format("2006-01-02"), end.Format("2006-01-02")),
+			Quantity:    quantity,
+			Amount:      price.Amount(quantity),
+		}
+		if price.PricingModel == data.PricingPerUnit {
+			item.UnitAmount = price.UnitAmount
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+type usagePayload struct {
+	UserID         int       `json:"user_id"`
+	Metric         string    `json:"metric"`
+	Quantity       int       `json:"quantity"`
+	IdempotencyKey string    `json:"idempotency_key"`
+	Timestamp      time.Time `json:"timestamp"`
+}
+
+// PostUsage is the internal endpoint other services use to report metered usage. It
+// expects the INTERNAL_API_KEY as a bearer token, and is disabled if none is set.
+func (app *Config) PostUsage(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if app.InternalAPIKey == "" || subtle.ConstantTimeCompare([]byte(key), []byte(app.InternalAPIKey)) != 1 {
+		_ = app.writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid internal API key"})
+		return
+	}
+
+	var payload usagePayload
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		_ = app.writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	_, err = app.Models.User.GetOne(payload.UserID)
+	if err != nil {
+		_ = app.writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": "unknown user"})
+		return
+	}
+
+	id, err := app.ReportUsage(payload.UserID, payload.Metric, payload.Quantity, payload.IdempotencyKey, payload.Timestamp)
+	if errors.Is(err, errInvalidUsage) {
+		_ = app.writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"error": err.Error()})
+		return
+	} else if errors.Is(err, errUsageNotIncluded) {
+		_ = app.writeJSON(w, http.StatusForbidden, map[string]string{"error": err.Error()})
+		return
+	} else if err != nil {
+		app.ErrorLog.Println("recording usage:", err)
+		_ = app.writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "unable to record usage"})
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, map[string]int{"id": id})
+}
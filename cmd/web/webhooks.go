@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"subscription-service/data"
+	"time"
+)
+
+// webhookEventTypes lists the event types an endpoint can subscribe to
+var webhookEventTypes = []string{
+	eventSubscriptionCreated,
+	eventSubscriptionUpdated,
+	eventSubscriptionCancelled,
+	eventInvoiceIssued,
+	eventInvoicePaid,
+	eventInvoiceRefunded,
+	eventUserActivated,
+}
+
+const (
+	// webhookRetryInterval is how often failed deliveries are checked for retries
+	// which have come due
+	webhookRetryInterval = time.Minute
+	webhookTimeout       = 10 * time.Second
+	webhookBatchSize     = 100
+)
+
+// webhookBackoff is how long to wait before each retry of a failed delivery. A
+// delivery which still fails after the last retry is given up on.
+var webhookBackoff = []time.Duration{
+	time.Minute,
+	5 * time.Minute,
+	30 * time.Minute,
+	2 * time.Hour,
+	12 * time.Hour,
+}
+
+// webhookEvent is the body of every webhook request
+type webhookEvent struct {
+	ID        string    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+// subscriptionEventData is the data of the subscription.* events
+type subscriptionEventData struct {
+	User         apiUser          `json:"user"`
+	PlanName     string           `json:"plan_name"`
+	Subscription *apiSubscription `json:"subscription"`
+}
+
+// invoiceEventData is the data of the invoice.* events
+type invoiceEventData struct {
+	UserID  int        `json:"user_id"`
+	Invoice apiInvoice `json:"invoice"`
+}
+
+// userEventData is the data of the user.* events
+type userEventData struct {
+	User apiUser `json:"user"`
+}
+
+// emitEvent queues an event for delivery to every active endpoint which subscribes
+// to its type. Delivery happens in the background, in listenForWebhooks.
+func (app *Config) emitEvent(eventType string, eventData any) error {
+	endpoints, err := app.Models.WebhookEndpoint.GetActiveForEvent(eventType)
+	if err != nil {
+		return fmt.Errorf("getting webhook endpoints: %w", err)
+	}
+	if len(endpoints) == 0 {
+		return nil
+	}
+
+	id, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(webhookEvent{
+		ID:        "evt_" + id,
+		Type:      eventType,
+		CreatedAt: time.Now().UTC(),
+		Data:      eventData,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, endpoint := range endpoints {
+		_, err := app.Models.WebhookDelivery.Insert(data.WebhookDelivery{
+			EndpointID: endpoint.ID,
+			EventID:    "evt_" + id,
+			EventType:  eventType,
+			Payload:    payload,
+		})
+		if err != nil {
+			app.ErrorLog.Printf("queueing %s for webhook endpoint %d: %v", eventType, endpoint.ID, err)
+		}
+	}
+
+	app.nudgeWebhooks()
+
+	return nil
+}
+
+// emitSubscriptionEvent sends the current state of a user's subscription
+func (app *Config) emitSubscriptionEvent(eventType string, user data.User, plan *data.Plan) error {
+	sub, err := app.Models.Subscription.GetByUserID(user.ID)
+	if err != nil {
+		return fmt.Errorf("getting subscription of user %d: %w", user.ID, err)
+	}
+
+	return app.emitEvent(eventType, subscriptionEventData{
+		User:         toAPIUser(&user),
+		PlanName:     plan.PlanName,
+		Subscription: toAPISubscription(sub),
+	})
+}
+
+// nudgeWebhooks wakes up the delivery loop without waiting for its next tick
+func (app *Config) nudgeWebhooks() {
+	select {
+	case app.WebhookNudge <- true:
+	default:
+		// a nudge is already pending
+	}
+}
+
+// listenForWebhooks delivers queued webhook events, and retries failed deliveries
+// once their backoff has passed. Deliveries are only ever made from this goroutine,
+// so an event is never sent twice at the same time.
+func (app *Config) listenForWebhooks() {
+	ticker := time.NewTicker(webhookRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			app.processWebhooks()
+		case <-app.WebhookNudge:
+			app.processWebhooks()
+		case <-app.WebhooksDone:
+			return
+		}
+	}
+}
+
+func (app *Config) processWebhooks() {
+	due, err := app.Models.WebhookDelivery.GetDue(time.Now(), webhookBatchSize)
+	if err != nil {
+		app.ErrorLog.Println("getting due webhook deliveries:", err)
+		return
+	}
+
+	endpoints := make(map[int]*data.WebhookEndpoint)
+	for _, delivery := range due {
+		endpoint, ok := endpoints[delivery.EndpointID]
+		if !ok {
+			endpoint, err = app.Models.WebhookEndpoint.GetOne(delivery.EndpointID)
+			if err != nil {
+				app.ErrorLog.Printf("getting webhook endpoint %d: %v", delivery.EndpointID, err)
+				continue
+			}
+			endpoints[delivery.EndpointID] = endpoint
+		}
+
+		app.deliverWebhook(endpoint, delivery)
+	}
+
+	// there may be more due than fit in one batch
+	if len(due) == webhookBatchSize {
+		app.nudgeWebhooks()
+	}
+}
+
+// deliverWebhook makes one attempt at delivering an event, and records the outcome
+// in the delivery log. Any 2xx response counts as delivered.
+func (app *Config) deliverWebhook(endpoint *data.WebhookEndpoint, delivery *data.WebhookDelivery) {
+	if !endpoint.Active {
+		err := delivery.RecordAttempt(data.DeliveryFailed, 0, "endpoint is disabled", time.Time{})
+		if err != nil {
+			app.ErrorLog.Println(err)
+		}
+		return
+	}
+
+	responseStatus, err := sendWebhook(endpoint, delivery)
+
+	status := data.DeliverySucceeded
+	lastError := ""
+	var nextAttemptAt time.Time
+
+	if err != nil {
+		lastError = err.Error()
+		status = data.DeliveryFailed
+		if delivery.Attempts < len(webhookBackoff) {
+			status = data.DeliveryPending
+			nextAttemptAt = time.Now().Add(webhookBackoff[delivery.Attempts])
+		}
+	}
+
+	err = delivery.RecordAttempt(status, responseStatus, lastError, nextAttemptAt)
+	if err != nil {
+		app.ErrorLog.Printf("recording webhook delivery %d: %v", delivery.ID, err)
+	}
+}
+
+func sendWebhook(endpoint *data.WebhookEndpoint, delivery *data.WebhookDelivery) (int, error) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, endpoint.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "subscription-service-webhooks/1")
+	req.Header.Set("Webhook-Id", delivery.EventID)
+	req.Header.Set("Webhook-Event", delivery.EventType)
+	req.Header.Set("Webhook-Signature", fmt.Sprintf("t=%s,v1=%s", timestamp, signWebhook(endpoint.Secret, timestamp, delivery.Payload)))
+
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	// read a little of the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded %s", resp.Status)
+	}
+
+	return resp.StatusCode, nil
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "timestamp.payload" keyed with the
+// endpoint's secret. Receivers recompute it to check that a request came from us,
+// and reject old timestamps to stop replays.
+func signWebhook(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newWebhookSecret returns a random signing secret for an endpoint
+func newWebhookSecret() (string, error) {
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+
+	return "whsec_" + secret, nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
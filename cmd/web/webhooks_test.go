@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/hmac"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"subscription-service/data"
+	"testing"
+	"time"
+)
+
+func TestSignWebhook(t *testing.T) {
+	payload := []byte(`{"id":"evt_1"}`)
+
+	// expected signatures computed independently with
+	// printf '<timestamp>.<payload>' | openssl dgst -sha256 -hmac '<secret>'
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		payload   []byte
+		want      string
+	}{
+		{"payload", "whsec_test", "1700000000", payload, "c89214b5b5da833daed6f0b8c5bb6bd58cea9022bd80ccc78230f3942d632925"},
+		{"empty payload", "whsec_test", "1700000000", nil, "5967f3c560522fa40cf2876ebc3c3a08551dd6959aaade3b413460591895bdcc"},
+		{"other timestamp", "whsec_test", "1700000001", payload, "a6b8e4670849f25456dbcceec15faae9edf44ea78d5607a06ebcb96ce7583658"},
+		{"other secret", "whsec_other", "1700000000", payload, "d8d091c76b586cff4dbd317fc47ebddff4b86de3ce18d3c03753c3c1901d475a"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := signWebhook(tt.secret, tt.timestamp, tt.payload); got != tt.want {
+				t.Errorf("signWebhook(%q, %q, %q) = %s, want %s", tt.secret, tt.timestamp, tt.payload, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSendWebhook checks a delivery from the receiver's side: the signature in the
+// header has to verify against the exact body received, with a current timestamp
+func TestSendWebhook(t *testing.T) {
+	tests := []struct {
+		name       string
+		respond    int
+		wantStatus int
+		wantErr    bool
+	}{
+		{"ok", http.StatusOK, http.StatusOK, false},
+		{"accepted", http.StatusAccepted, http.StatusAccepted, false},
+		{"not modified", http.StatusNotModified, http.StatusNotModified, true},
+		{"rejected", http.StatusUnauthorized, http.StatusUnauthorized, true},
+		{"server error", http.StatusInternalServerError, http.StatusInternalServerError, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			endpoint := &data.WebhookEndpoint{Secret: "whsec_test", Active: true}
+			delivery := &data.WebhookDelivery{
+				EventID:   "evt_123",
+				EventType: "subscription.created",
+				Payload:   []byte(`{"id":"evt_123","type":"subscription.created"}`),
+			}
+
+			var verified bool
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+
+				if r.Header.Get("Webhook-Id") != delivery.EventID || r.Header.Get("Webhook-Event") != delivery.EventType {
+					t.Errorf("headers = %v", r.Header)
+				}
+
+				timestamp, signature, ok := parseSignatureHeader(r.Header.Get("Webhook-Signature"))
+				if !ok {
+					t.Errorf("Webhook-Signature = %q", r.Header.Get("Webhook-Signature"))
+				}
+
+				sent, err := strconv.ParseInt(timestamp, 10, 64)
+				if err != nil || time.Since(time.Unix(sent, 0)).Abs() > time.Minute {
+					t.Errorf("timestamp %q is not current", timestamp)
+				}
+
+				want := signWebhook(endpoint.Secret, timestamp, body)
+				verified = hmac.Equal([]byte(signature), []byte(want))
+				if signWebhook("whsec_wrong", timestamp, body) == signature {
+					t.Error("signature verifies with the wrong secret")
+				}
+
+				w.WriteHeader(tt.respond)
+			}))
+			defer srv.Close()
+			endpoint.URL = srv.URL
+
+			status, err := sendWebhook(endpoint, delivery)
+			if status != tt.wantStatus {
+				t.Errorf("status = %d, want %d", status, tt.wantStatus)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want an error: %v", err, tt.wantErr)
+			}
+			if !verified {
+				t.Error("signature did not verify against the body received")
+			}
+		})
+	}
+}
+
+func parseSignatureHeader(header string) (timestamp, signature string, ok bool) {
+	for _, part := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(part, "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			signature = value
+		}
+	}
+
+	return timestamp, signature, timestamp != "" && signature != ""
+}
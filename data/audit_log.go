@@ -0,0 +1,430 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Audited actions
+const (
+	AuditLogin               = "user.login"
+	AuditLoginFailed         = "user.login_failed"
+	AuditLoginLocked         = "user.login_locked"
+	AuditLoginLinkRequested  = "user.login_link_requested"
+	AuditLoginLinkUsed       = "user.login_link_used"
+	AuditLogout              = "user.logout"
+	AuditRegistered          = "user.registered"
+	AuditActivated           = "user.activated"
+	AuditPasswordChanged     = "user.password_changed"
+	AuditEmailChangeStarted  = "user.email_change_requested"
+	AuditEmailChanged        = "user.email_changed"
+	AuditEmailReverted       = "user.email_reverted"
+	AuditProfileUpdated      = "user.profile_updated"
+	AuditDataExported        = "user.data_exported"
+	AuditAccountDeleted      = "user.deleted"
+	AuditSessionRevoked      = "user.session_revoked"
+	AuditIdentityLinked      = "user.identity_linked"
+	AuditTwoFactorEnabled    = "user.2fa_enabled"
+	AuditTwoFactorDisabled   = "user.2fa_disabled"
+	AuditTwoFactorFailed     = "user.2fa_failed"
+	AuditRecoveryCodeUsed    = "user.recovery_code_used"
+	AuditRecoveryCodesReset  = "user.recovery_codes_reset"
+	AuditBillingUpdated      = "billing.profile_updated"
+	AuditPaymentRetried      = "billing.payment_retried"
+	AuditInvoiceIssued       = "billing.invoice_issued"
+	AuditInvoicePaid         = "billing.invoice_paid"
+	AuditSubscribed          = "subscription.subscribed"
+	AuditCancelled           = "subscription.cancelled"
+	AuditTokenCreated        = "token.created"
+	AuditTokenRevoked        = "token.revoked"
+	AuditInvoiceRefunded     = "admin.invoice_refunded"
+	AuditDunningUpdated      = "admin.dunning_updated"
+	AuditEntitlementSaved    = "admin.entitlement_saved"
+	AuditEntitlementRemoved  = "admin.entitlement_removed"
+	AuditMeteredPriceSaved   = "admin.metered_price_saved"
+	AuditMeteredPriceRemoved = "admin.metered_price_removed"
+	AuditWebhookCreated      = "admin.webhook_created"
+	AuditWebhookUpdated      = "admin.webhook_updated"
+	AuditWebhookDeleted      = "admin.webhook_deleted"
+	AuditWebhookRedelivered  = "admin.webhook_redelivered"
+	AuditSettingsUpdated     = "admin.settings_updated"
+)
+
+// AuditActions lists the audited actions, for filtering the audit log
+var AuditActions = []string{
+	AuditLogin,
+	AuditLoginFailed,
+	AuditLoginLocked,
+	AuditLoginLinkRequested,
+	AuditLoginLinkUsed,
+	AuditLogout,
+	AuditRegistered,
+	AuditActivated,
+	AuditPasswordChanged,
+	AuditEmailChangeStarted,
+	AuditEmailChanged,
+	AuditEmailReverted,
+	AuditProfileUpdated,
+	AuditDataExported,
+	AuditAccountDeleted,
+	AuditSessionRevoked,
+	AuditIdentityLinked,
+	AuditTwoFactorEnabled,
+	AuditTwoFactorDisabled,
+	AuditTwoFactorFailed,
+	AuditRecoveryCodeUsed,
+	AuditRecoveryCodesReset,
+	AuditBillingUpdated,
+	AuditPaymentRetried,
+	AuditInvoiceIssued,
+	AuditInvoicePaid,
+	AuditSubscribed,
+	AuditCancelled,
+	AuditTokenCreated,
+	AuditTokenRevoked,
+	AuditInvoiceRefunded,
+	AuditDunningUpdated,
+	AuditEntitlementSaved,
+	AuditEntitlementRemoved,
+	AuditMeteredPriceSaved,
+	AuditMeteredPriceRemoved,
+	AuditWebhookCreated,
+	AuditWebhookUpdated,
+	AuditWebhookDeleted,
+	AuditWebhookRedelivered,
+	AuditSettingsUpdated,
+}
+
+// AuditLog is the type for one entry of the audit log, a record of who did what.
+// Entries are never deleted, and only updated to redact a deleted user's personal
+// data; the table rejects anything else.
+type AuditLog struct {
+	ID int
+	// ActorID is 0 for actions taken by the system, or by someone not logged in
+	ActorID    int
+	ActorEmail string
+	Action     string
+	TargetType string
+	TargetID   string
+	IP         string
+	UserAgent  string
+	Metadata   map[string]any
+	CreatedAt  time.Time
+}
+
+// AuditLogFilter narrows down a search of the audit log. Empty fields match anything.
+type AuditLogFilter struct {
+	Action     string
+	Actor      string
+	TargetType string
+	TargetID   string
+	From       time.Time
+	To         time.Time
+}
+
+// Insert appends an entry to the audit log
+func (a *AuditLog) Insert(entry AuditLog) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	if entry.Metadata == nil {
+		entry.Metadata = map[string]any{}
+	}
+
+	metadata, err := json.Marshal(entry.Metadata)
+	if err != nil {
+		return err
+	}
+
+	var actorID sql.NullInt64
+	if entry.ActorID > 0 {
+		actorID = sql.NullInt64{Int64: int64(entry.ActorID), Valid: true}
+	}
+
+	stmt := `insert into audit_log (actor_id, actor_email, action, target_type, target_id, ip, user_agent,
+				metadata, created_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+
+	_, err = db.ExecContext(ctx, stmt,
+		actorID,
+		entry.ActorEmail,
+		entry.Action,
+		entry.TargetType,
+		entry.TargetID,
+		truncate(entry.IP, 45),
+		truncate(entry.UserAgent, 512),
+		metadata,
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// redactAuditLog blanks the personal data in the entries about a user who is being
+// deleted, in the transaction deleting them: those the user is the actor or target
+// of, and those naming any of their email addresses. What happened stays on record.
+func redactAuditLog(ctx context.Context, tx *sql.Tx, userID int, emails []string) error {
+	// the append-only trigger lets this transaction, and only this one, redact
+	_, err := tx.ExecContext(ctx, `select set_config('app.redacting_audit_log', 'on', true)`)
+	if err != nil {
+		return err
+	}
+
+	stmt := `update audit_log set
+				actor_email = '',
+				ip = '',
+				user_agent = '',
+				metadata = metadata - case when action in ($3, $4, $5)
+					then array['email', 'from', 'to'] else array['email'] end
+			where actor_id = $1 or (target_type = 'user' and target_id = $2)`
+
+	_, err = tx.ExecContext(ctx, stmt, userID, strconv.Itoa(userID),
+		AuditEmailChangeStarted, AuditEmailChanged, AuditEmailReverted)
+	if err != nil {
+		return err
+	}
+
+	for _, email := range emails {
+		stmt = `update audit_log set actor_email = '', ip = '', user_agent = '', metadata = metadata - 'email'
+				where lower(actor_email) = lower($1) or lower(metadata->>'email') = lower($1)`
+
+		_, err = tx.ExecContext(ctx, stmt, email)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// auditedEmails returns the email addresses a user has had, according to the audit
+// log of their email changes
+func auditedEmails(ctx context.Context, tx *sql.Tx, userID int) ([]string, error) {
+	query := `select distinct lower(address) from audit_log,
+				lateral (values (metadata->>'from'), (metadata->>'to')) as addresses (address)
+			where target_type = 'user' and target_id = $1 and action in ($2, $3, $4) and address <> ''`
+
+	rows, err := tx.QueryContext(ctx, query, strconv.Itoa(userID),
+		AuditEmailChangeStarted, AuditEmailChanged, AuditEmailReverted)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []string
+
+	for rows.Next() {
+		var email string
+		err := rows.Scan(&email)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		emails = append(emails, email)
+	}
+
+	return emails, rows.Err()
+}
+
+// GetPage returns one page of the entries matching filter, newest first, along
+// with the total number of matching entries
+func (a *AuditLog) GetPage(filter AuditLogFilter, limit, offset int) ([]*AuditLog, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	where, args := filter.where()
+
+	var total int
+	err := db.QueryRowContext(ctx, `select count(*) from audit_log `+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := fmt.Sprintf(`select %s from audit_log %s order by created_at desc, id desc limit $%d offset $%d`,
+		auditLogColumns, where, len(args)+1, len(args)+2)
+
+	rows, err := db.QueryContext(ctx, query, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var entries []*AuditLog
+
+	for rows.Next() {
+		entry, err := scanAuditLog(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, 0, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, total, nil
+}
+
+// ForEach calls fn with every entry matching filter, oldest first, without loading
+// them all into memory. It stops at the first error fn returns.
+func (a *AuditLog) ForEach(ctx context.Context, filter AuditLogFilter, fn func(*AuditLog) error) error {
+	where, args := filter.where()
+
+	query := fmt.Sprintf(`select %s from audit_log %s order by created_at, id`, auditLogColumns, where)
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, err := scanAuditLog(rows)
+		if err != nil {
+			return err
+		}
+
+		err = fn(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// GetAllForUser returns the entries about a user, oldest first: those where they
+// were the actor, and those where their account was the target
+func (a *AuditLog) GetAllForUser(userID int) ([]*AuditLog, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`select %s from audit_log
+			where actor_id = $1 or (target_type = 'user' and target_id = $2)
+			order by created_at, id`, auditLogColumns)
+
+	rows, err := db.QueryContext(ctx, query, userID, strconv.Itoa(userID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []*AuditLog
+
+	for rows.Next() {
+		entry, err := scanAuditLog(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// where builds the where clause of the filter, and its arguments
+func (f AuditLogFilter) where() (string, []any) {
+	var conditions []string
+	var args []any
+
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if f.Action != "" {
+		add("action = $%d", f.Action)
+	}
+	if f.Actor != "" {
+		add("actor_email ilike '%%' || $%d || '%%'", f.Actor)
+	}
+	if f.TargetType != "" {
+		add("target_type = $%d", f.TargetType)
+	}
+	if f.TargetID != "" {
+		add("target_id = $%d", f.TargetID)
+	}
+	if !f.From.IsZero() {
+		add("created_at >= $%d", f.From)
+	}
+	if !f.To.IsZero() {
+		add("created_at < $%d", f.To)
+	}
+
+	if len(conditions) == 0 {
+		return "", nil
+	}
+
+	return "where " + strings.Join(conditions, " and "), args
+}
+
+const auditLogColumns = `id, actor_id, actor_email, action, target_type, target_id, ip, user_agent, metadata, created_at`
+
+func scanAuditLog(row scanner) (*AuditLog, error) {
+	var entry AuditLog
+	var actorID sql.NullInt64
+	var metadata []byte
+	err := row.Scan(
+		&entry.ID,
+		&actorID,
+		&entry.ActorEmail,
+		&entry.Action,
+		&entry.TargetType,
+		&entry.TargetID,
+		&entry.IP,
+		&entry.UserAgent,
+		&metadata,
+		&entry.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	entry.ActorID = int(actorID.Int64)
+
+	err = json.Unmarshal(metadata, &entry.Metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// MetadataJSON returns the metadata of the entry as compact JSON, for display
+func (a *AuditLog) MetadataJSON() string {
+	if len(a.Metadata) == 0 {
+		return ""
+	}
+
+	out, err := json.Marshal(a.Metadata)
+	if err != nil {
+		return ""
+	}
+
+	return string(out)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+
+	// don't cut a multi-byte character in half
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+
+	return s[:n]
+}
@@ -0,0 +1,119 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BillingProfile is the type for the billing details attached to a user. These
+// are the details which are printed on invoices.
+type BillingProfile struct {
+	ID           int
+	UserID       int
+	CompanyName  string
+	TaxID        string
+	AddressLine1 string
+	AddressLine2 string
+	City         string
+	State        string
+	PostalCode   string
+	Country      string
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// GetByUserID returns the billing profile for the user with the given id. If the user
+// has not entered billing details yet, sql.ErrNoRows is returned.
+func (b *BillingProfile) GetByUserID(userID int) (*BillingProfile, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, company_name, tax_id, address_line1, address_line2, city, state,
+				postal_code, country, created_at, updated_at
+				from billing_profiles
+				where user_id = $1`
+
+	var profile BillingProfile
+	row := db.QueryRowContext(ctx, query, userID)
+
+	err := row.Scan(
+		&profile.ID,
+		&profile.UserID,
+		&profile.CompanyName,
+		&profile.TaxID,
+		&profile.AddressLine1,
+		&profile.AddressLine2,
+		&profile.City,
+		&profile.State,
+		&profile.PostalCode,
+		&profile.Country,
+		&profile.CreatedAt,
+		&profile.UpdatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &profile, nil
+}
+
+// Upsert inserts the billing profile for profile.UserID, or updates it if the user
+// already has one.
+func (b *BillingProfile) Upsert(profile BillingProfile) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into billing_profiles (user_id, company_name, tax_id, address_line1, address_line2,
+				city, state, postal_code, country, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			on conflict (user_id) do update set
+				company_name = excluded.company_name,
+				tax_id = excluded.tax_id,
+				address_line1 = excluded.address_line1,
+				address_line2 = excluded.address_line2,
+				city = excluded.city,
+				state = excluded.state,
+				postal_code = excluded.postal_code,
+				country = excluded.country,
+				updated_at = excluded.updated_at`
+
+	_, err := db.ExecContext(ctx, stmt,
+		profile.UserID,
+		profile.CompanyName,
+		profile.TaxID,
+		profile.AddressLine1,
+		profile.AddressLine2,
+		profile.City,
+		profile.State,
+		profile.PostalCode,
+		profile.Country,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddressLines returns the postal address as it should be printed, skipping empty lines
+func (b *BillingProfile) AddressLines() []string {
+	var lines []string
+
+	for _, x := range []string{
+		b.AddressLine1,
+		b.AddressLine2,
+		strings.TrimSpace(fmt.Sprintf("%s %s %s", b.City, b.State, b.PostalCode)),
+		b.Country,
+	} {
+		if x != "" {
+			lines = append(lines, x)
+		}
+	}
+
+	return lines
+}
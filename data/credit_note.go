@@ -0,0 +1,216 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ErrRefundExceedsBalance is returned when a refund is larger than the amount
+// which is still refundable on an invoice
+var ErrRefundExceedsBalance = errors.New("refund exceeds the refundable balance of the invoice")
+
+// Credit note statuses. A note whose refund was declined is void rather than
+// deleted, so credit note numbers have no gaps.
+const (
+	CreditNotePending = "pending"
+	CreditNoteIssued  = "issued"
+	CreditNoteVoid    = "void"
+)
+
+// CreditNote is the type for credit notes, which are issued whenever all or part
+// of an invoice is refunded
+type CreditNote struct {
+	ID              int
+	InvoiceID       int
+	UserID          int
+	Amount          int
+	Reason          string
+	RefundReference string
+	Status          string
+	IssuedAt        time.Time
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// GetAllForInvoice returns the credit notes issued against one invoice, oldest first
+func (c *CreditNote) GetAllForInvoice(invoiceID int) ([]*CreditNote, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, invoice_id, user_id, amount, reason, refund_reference, status, issued_at, created_at,
+				updated_at
+			from credit_notes
+			where invoice_id = $1
+			order by issued_at`
+
+	rows, err := db.QueryContext(ctx, query, invoiceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var notes []*CreditNote
+
+	for rows.Next() {
+		var note CreditNote
+		err := rows.Scan(
+			&note.ID,
+			&note.InvoiceID,
+			&note.UserID,
+			&note.Amount,
+			&note.Reason,
+			&note.RefundReference,
+			&note.Status,
+			&note.IssuedAt,
+			&note.CreatedAt,
+			&note.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		notes = append(notes, &note)
+	}
+
+	return notes, nil
+}
+
+// Reserve records a pending credit note and adds its amount to the refunded
+// balance of the invoice, in one transaction, before the refund is made. The
+// invoice row is locked while the balance is checked, so two refunds of the same
+// invoice can't both pass the check. If the amount is more than what is still
+// refundable, nothing is written and ErrRefundExceedsBalance is returned.
+func (c *CreditNote) Reserve(note CreditNote) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var paid, refunded int
+	query := `select amount_paid, amount_refunded from invoices where id = $1 for update`
+	err = tx.QueryRowContext(ctx, query, note.InvoiceID).Scan(&paid, &refunded)
+	if err != nil {
+		return 0, err
+	}
+
+	if note.Amount <= 0 || note.Amount > paid-refunded {
+		return 0, ErrRefundExceedsBalance
+	}
+
+	var newID int
+	stmt := `insert into credit_notes (invoice_id, user_id, amount, reason, refund_reference, status, issued_at,
+				created_at, updated_at)
+			values ($1, $2, $3, $4, '', $5, $6, $7, $8) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		note.InvoiceID,
+		note.UserID,
+		note.Amount,
+		note.Reason,
+		CreditNotePending,
+		note.IssuedAt,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `update invoices set amount_refunded = amount_refunded + $1, updated_at = $2 where id = $3`
+	_, err = tx.ExecContext(ctx, stmt, note.Amount, time.Now(), note.InvoiceID)
+	if err != nil {
+		return 0, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Issue marks a pending credit note as issued, once the payment provider has made
+// the refund under reference
+func (c *CreditNote) Issue(id int, reference string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update credit_notes set status = $1, refund_reference = $2, updated_at = $3
+			where id = $4 and status = $5`
+
+	result, err := db.ExecContext(ctx, stmt, CreditNoteIssued, reference, time.Now(), id, CreditNotePending)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// Cancel voids a pending credit note whose refund the payment provider declined,
+// and gives its amount back to the refundable balance of the invoice. The note is
+// kept, so its number isn't missing from the sequence.
+func (c *CreditNote) Cancel(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var invoiceID, amount int
+	stmt := `update credit_notes set status = $1, updated_at = $2
+			where id = $3 and status = $4
+			returning invoice_id, amount`
+	err = tx.QueryRowContext(ctx, stmt, CreditNoteVoid, time.Now(), id, CreditNotePending).Scan(&invoiceID, &amount)
+	if err != nil {
+		return err
+	}
+
+	stmt = `update invoices set amount_refunded = amount_refunded - $1, updated_at = $2 where id = $3`
+	_, err = tx.ExecContext(ctx, stmt, amount, time.Now(), invoiceID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// IsPending reports whether the refund of the credit note hasn't been confirmed by
+// the payment provider
+func (c *CreditNote) IsPending() bool {
+	return c.Status == CreditNotePending
+}
+
+// IsVoid reports whether the credit note was voided after its refund was declined
+func (c *CreditNote) IsVoid() bool {
+	return c.Status == CreditNoteVoid
+}
+
+// Number returns the human readable credit note number
+func (c *CreditNote) Number() string {
+	return fmt.Sprintf("CN-%06d", c.ID)
+}
+
+// AmountForDisplay formats the credit note amount as a currency string
+func (c *CreditNote) AmountForDisplay() string {
+	return formatCurrency(c.Amount)
+}
@@ -0,0 +1,79 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// EmailLog is the type for a record of an email sent by the application
+type EmailLog struct {
+	ID int
+	// UserID is 0 when the recipient has no account
+	UserID    int
+	Recipient string
+	Subject   string
+	Template  string
+	CreatedAt time.Time
+}
+
+// Insert records an email. The user it was sent to is looked up by address.
+func (e *EmailLog) Insert(entry EmailLog) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into email_log (user_id, recipient, subject, template, created_at)
+			values ((select id from users where lower(email) = lower($1)), $1, $2, $3, $4)`
+
+	_, err := db.ExecContext(ctx, stmt,
+		entry.Recipient,
+		truncate(entry.Subject, 255),
+		entry.Template,
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetAllForUser returns the emails sent to a user, oldest first
+func (e *EmailLog) GetAllForUser(userID int) ([]*EmailLog, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, recipient, subject, template, created_at
+			from email_log where user_id = $1 order by created_at, id`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var emails []*EmailLog
+
+	for rows.Next() {
+		var email EmailLog
+		var userID sql.NullInt64
+		err := rows.Scan(
+			&email.ID,
+			&userID,
+			&email.Recipient,
+			&email.Subject,
+			&email.Template,
+			&email.CreatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		email.UserID = int(userID.Int64)
+		emails = append(emails, &email)
+	}
+
+	return emails, rows.Err()
+}
@@ -0,0 +1,67 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// EmailPreferences is the type for the optional emails a user has chosen to get.
+// Emails which a user can't do without, such as payment reminders and account
+// confirmations, are always sent.
+type EmailPreferences struct {
+	UserID int
+	// Invoices is for invoices and credit notes
+	Invoices bool
+	// Manuals is for the user manual sent when subscribing to a plan
+	Manuals bool
+	// LoginAlerts is for notices of failed logins to the account
+	LoginAlerts bool
+	UpdatedAt   time.Time
+}
+
+// GetByUserID returns the email preferences of a user. A user who has never saved
+// any gets every email.
+func (e *EmailPreferences) GetByUserID(userID int) (*EmailPreferences, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select user_id, invoices, manuals, login_alerts, updated_at
+			from email_preferences where user_id = $1`
+
+	var prefs EmailPreferences
+	err := db.QueryRowContext(ctx, query, userID).Scan(
+		&prefs.UserID,
+		&prefs.Invoices,
+		&prefs.Manuals,
+		&prefs.LoginAlerts,
+		&prefs.UpdatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &EmailPreferences{UserID: userID, Invoices: true, Manuals: true, LoginAlerts: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &prefs, nil
+}
+
+// Upsert saves the email preferences of a user
+func (e *EmailPreferences) Upsert(prefs EmailPreferences) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into email_preferences (user_id, invoices, manuals, login_alerts, updated_at)
+			values ($1, $2, $3, $4, $5)
+			on conflict (user_id) do update set invoices = excluded.invoices, manuals = excluded.manuals,
+				login_alerts = excluded.login_alerts, updated_at = excluded.updated_at`
+
+	_, err := db.ExecContext(ctx, stmt, prefs.UserID, prefs.Invoices, prefs.Manuals, prefs.LoginAlerts, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
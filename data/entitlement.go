@@ -0,0 +1,192 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Entitlement is the type for one feature granted by a plan. A feature may carry a
+// numeric limit, such as the number of API tokens a member may create; features
+// without a limit are simply on or off.
+type Entitlement struct {
+	ID        int
+	PlanID    int
+	Feature   string
+	Limit     int
+	Limited   bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Entitlements is the set of features and limits a user is entitled to
+type Entitlements struct {
+	Features map[string]bool
+	Limits   map[string]int
+}
+
+// Has reports whether the feature is included. It is safe to call on a nil receiver,
+// which grants nothing.
+func (e *Entitlements) Has(feature string) bool {
+	if e == nil {
+		return false
+	}
+
+	return e.Features[feature]
+}
+
+// Limit returns the numeric limit of a feature. The second value is false if the
+// feature is not included or has no limit.
+func (e *Entitlements) Limit(feature string) (int, bool) {
+	if e == nil {
+		return 0, false
+	}
+
+	limit, ok := e.Limits[feature]
+	return limit, ok
+}
+
+// GetAllForPlan returns the entitlements of one plan, sorted by feature name
+func (e *Entitlement) GetAllForPlan(planID int) ([]*Entitlement, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, plan_id, feature, limit_value, created_at, updated_at
+			from plan_entitlements
+			where plan_id = $1
+			order by feature`
+
+	rows, err := db.QueryContext(ctx, query, planID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entitlements []*Entitlement
+
+	for rows.Next() {
+		var entitlement Entitlement
+		var limit sql.NullInt64
+		err := rows.Scan(
+			&entitlement.ID,
+			&entitlement.PlanID,
+			&entitlement.Feature,
+			&limit,
+			&entitlement.CreatedAt,
+			&entitlement.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		entitlement.Limit = int(limit.Int64)
+		entitlement.Limited = limit.Valid
+
+		entitlements = append(entitlements, &entitlement)
+	}
+
+	return entitlements, nil
+}
+
+// GetForPlan returns the set of features and limits granted by one plan
+func (e *Entitlement) GetForPlan(planID int) (*Entitlements, error) {
+	all, err := e.GetAllForPlan(planID)
+	if err != nil {
+		return nil, err
+	}
+
+	entitlements := &Entitlements{
+		Features: make(map[string]bool),
+		Limits:   make(map[string]int),
+	}
+
+	for _, x := range all {
+		entitlements.Features[x.Feature] = true
+		if x.Limited {
+			entitlements.Limits[x.Feature] = x.Limit
+		}
+	}
+
+	return entitlements, nil
+}
+
+// GetPlansWithFeature returns the plans which include a feature, cheapest first
+func (e *Entitlement) GetPlansWithFeature(feature string) ([]*Plan, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select p.id, p.plan_name, p.plan_amount, p.created_at, p.updated_at
+			from plans p
+			join plan_entitlements pe on (p.id = pe.plan_id)
+			where pe.feature = $1
+			order by p.plan_amount`
+
+	rows, err := db.QueryContext(ctx, query, feature)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var plans []*Plan
+
+	for rows.Next() {
+		var plan Plan
+		err := rows.Scan(
+			&plan.ID,
+			&plan.PlanName,
+			&plan.PlanAmount,
+			&plan.CreatedAt,
+			&plan.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		plan.PlanAmountFormatted = plan.AmountForDisplay()
+		plans = append(plans, &plan)
+	}
+
+	return plans, nil
+}
+
+// Upsert grants a feature to a plan, or changes its limit if the plan already has it
+func (e *Entitlement) Upsert(entitlement Entitlement) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var limit sql.NullInt64
+	if entitlement.Limited {
+		limit = sql.NullInt64{Int64: int64(entitlement.Limit), Valid: true}
+	}
+
+	stmt := `insert into plan_entitlements (plan_id, feature, limit_value, created_at, updated_at)
+			values ($1, $2, $3, $4, $5)
+			on conflict (plan_id, feature) do update set
+				limit_value = excluded.limit_value,
+				updated_at = excluded.updated_at`
+
+	_, err := db.ExecContext(ctx, stmt, entitlement.PlanID, entitlement.Feature, limit, time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteByID removes one entitlement from its plan
+func (e *Entitlement) DeleteByID(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from plan_entitlements where id = $1`
+
+	_, err := db.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package data
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Identity is the type for a user's account at an OpenID Connect identity provider,
+// which they can log in with
+type Identity struct {
+	ID     int
+	UserID int
+	// Issuer is the URL of the provider
+	Issuer string
+	// Subject is the provider's ID of the account, which never changes
+	Subject string
+	// Email is the address the provider had for the account when it was linked
+	Email       string
+	CreatedAt   time.Time
+	LastLoginAt time.Time
+}
+
+const identityColumns = `id, user_id, issuer, subject, email, created_at, last_login_at`
+
+func scanIdentity(row scanner) (*Identity, error) {
+	var identity Identity
+	err := row.Scan(
+		&identity.ID,
+		&identity.UserID,
+		&identity.Issuer,
+		&identity.Subject,
+		&identity.Email,
+		&identity.CreatedAt,
+		&identity.LastLoginAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &identity, nil
+}
+
+// GetBySubject returns the identity of an account at a provider, or sql.ErrNoRows
+// if no user has linked it
+func (i *Identity) GetBySubject(issuer, subject string) (*Identity, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + identityColumns + ` from user_identities where issuer = $1 and subject = $2`
+
+	return scanIdentity(db.QueryRowContext(ctx, query, issuer, subject))
+}
+
+// GetAllForUser returns the identities a user has linked, oldest first
+func (i *Identity) GetAllForUser(userID int) ([]*Identity, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + identityColumns + ` from user_identities where user_id = $1 order by created_at`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []*Identity
+
+	for rows.Next() {
+		identity, err := scanIdentity(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		identities = append(identities, identity)
+	}
+
+	return identities, rows.Err()
+}
+
+// Insert links an account at a provider to a user, and returns the new ID
+func (i *Identity) Insert(identity Identity) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into user_identities (user_id, issuer, subject, email, created_at, last_login_at)
+			values ($1, $2, $3, $4, $5, $6) returning id`
+
+	var newID int
+	err := db.QueryRowContext(ctx, stmt,
+		identity.UserID,
+		identity.Issuer,
+		identity.Subject,
+		identity.Email,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Touch records that the identity was just used to log in
+func (i *Identity) Touch() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := db.ExecContext(ctx, `update user_identities set last_login_at = $1 where id = $2`, time.Now(), i.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
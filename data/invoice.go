@@ -0,0 +1,360 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Invoice is the type for invoices issued to users. The plan and billing details are
+// copied onto the invoice when it is issued, so later changes to the user's billing
+// profile or to the plan do not alter invoices which have already been sent.
+type Invoice struct {
+	ID               int
+	UserID           int
+	PlanID           int
+	PlanName         string
+	Amount           int
+	BillingName      string
+	BillingEmail     string
+	Billing          BillingProfile
+	AmountPaid       int
+	AmountRefunded   int
+	PaymentReference string
+	PaidAt           time.Time
+	// PeriodStart is the start of the billing period a renewal invoice pays for;
+	// it is zero on the first invoice of a subscription
+	PeriodStart time.Time
+	LineItems   []*LineItem
+	IssuedAt    time.Time
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+// LineItem is one line of an invoice. Amount is the total of the line, which for
+// tiered usage pricing is not simply Quantity times UnitAmount.
+type LineItem struct {
+	ID          int
+	InvoiceID   int
+	Description string
+	Quantity    int
+	UnitAmount  int
+	Amount      int
+	CreatedAt   time.Time
+}
+
+const invoiceColumns = `id, user_id, plan_id, plan_name, amount, billing_name, billing_email,
+	billing_company_name, billing_tax_id, billing_address_line1, billing_address_line2, billing_city,
+	billing_state, billing_postal_code, billing_country, amount_paid, amount_refunded, payment_reference,
+	paid_at, period_start, issued_at, created_at, updated_at`
+
+// scanner is satisfied by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanInvoice(row scanner) (*Invoice, error) {
+	var invoice Invoice
+	var paidAt, periodStart sql.NullTime
+	err := row.Scan(
+		&invoice.ID,
+		&invoice.UserID,
+		&invoice.PlanID,
+		&invoice.PlanName,
+		&invoice.Amount,
+		&invoice.BillingName,
+		&invoice.BillingEmail,
+		&invoice.Billing.CompanyName,
+		&invoice.Billing.TaxID,
+		&invoice.Billing.AddressLine1,
+		&invoice.Billing.AddressLine2,
+		&invoice.Billing.City,
+		&invoice.Billing.State,
+		&invoice.Billing.PostalCode,
+		&invoice.Billing.Country,
+		&invoice.AmountPaid,
+		&invoice.AmountRefunded,
+		&invoice.PaymentReference,
+		&paidAt,
+		&periodStart,
+		&invoice.IssuedAt,
+		&invoice.CreatedAt,
+		&invoice.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	invoice.Billing.UserID = invoice.UserID
+	invoice.PaidAt = paidAt.Time
+	invoice.PeriodStart = periodStart.Time
+
+	return &invoice, nil
+}
+
+// GetOne returns one invoice by id
+func (i *Invoice) GetOne(id int) (*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`select %s from invoices where id = $1`, invoiceColumns)
+
+	invoice, err := scanInvoice(db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return nil, err
+	}
+
+	query = `select id, invoice_id, description, quantity, unit_amount, amount, created_at
+			from invoice_line_items
+			where invoice_id = $1
+			order by id`
+
+	rows, err := db.QueryContext(ctx, query, invoice.ID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item LineItem
+		err := rows.Scan(
+			&item.ID,
+			&item.InvoiceID,
+			&item.Description,
+			&item.Quantity,
+			&item.UnitAmount,
+			&item.Amount,
+			&item.CreatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		invoice.LineItems = append(invoice.LineItems, &item)
+	}
+
+	return invoice, nil
+}
+
+// GetRenewal returns the renewal invoice of a user for the billing period which
+// starts at periodStart, with its line items
+func (i *Invoice) GetRenewal(userID int, periodStart time.Time) (*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var id int
+	query := `select id from invoices where user_id = $1 and period_start = $2`
+	err := db.QueryRowContext(ctx, query, userID, periodStart).Scan(&id)
+	if err != nil {
+		return nil, err
+	}
+
+	return i.GetOne(id)
+}
+
+// GetAll returns all invoices, newest first
+func (i *Invoice) GetAll() ([]*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`select %s from invoices order by issued_at desc`, invoiceColumns)
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invoices []*Invoice
+
+	for rows.Next() {
+		invoice, err := scanInvoice(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		invoices = append(invoices, invoice)
+	}
+
+	return invoices, nil
+}
+
+// GetAllForUser returns all invoices issued to a user, newest first
+func (i *Invoice) GetAllForUser(userID int) ([]*Invoice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := fmt.Sprintf(`select %s from invoices where user_id = $1 order by issued_at desc`, invoiceColumns)
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invoices []*Invoice
+
+	for rows.Next() {
+		invoice, err := scanInvoice(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		invoices = append(invoices, invoice)
+	}
+
+	return invoices, nil
+}
+
+// GetPageForUser returns one page of the invoices issued to a user, newest first,
+// together with the total number of invoices the user has
+func (i *Invoice) GetPageForUser(userID int, limit, offset int) ([]*Invoice, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var total int
+	query := `select count(*) from invoices where user_id = $1`
+	err := db.QueryRowContext(ctx, query, userID).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query = fmt.Sprintf(`select %s from invoices where user_id = $1 order by issued_at desc, id desc
+		limit $2 offset $3`, invoiceColumns)
+
+	rows, err := db.QueryContext(ctx, query, userID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var invoices []*Invoice
+
+	for rows.Next() {
+		invoice, err := scanInvoice(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, 0, err
+		}
+
+		invoices = append(invoices, invoice)
+	}
+
+	return invoices, total, nil
+}
+
+// Insert inserts a new invoice and its line items into the database, and returns the
+// ID of the newly inserted invoice
+func (i *Invoice) Insert(invoice Invoice) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var newID int
+	stmt := `insert into invoices (user_id, plan_id, plan_name, amount, billing_name, billing_email,
+				billing_company_name, billing_tax_id, billing_address_line1, billing_address_line2, billing_city,
+				billing_state, billing_postal_code, billing_country, period_start, issued_at, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		invoice.UserID,
+		invoice.PlanID,
+		invoice.PlanName,
+		invoice.Amount,
+		invoice.BillingName,
+		invoice.BillingEmail,
+		invoice.Billing.CompanyName,
+		invoice.Billing.TaxID,
+		invoice.Billing.AddressLine1,
+		invoice.Billing.AddressLine2,
+		invoice.Billing.City,
+		invoice.Billing.State,
+		invoice.Billing.PostalCode,
+		invoice.Billing.Country,
+		sql.NullTime{Time: invoice.PeriodStart, Valid: !invoice.PeriodStart.IsZero()},
+		invoice.IssuedAt,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	stmt = `insert into invoice_line_items (invoice_id, description, quantity, unit_amount, amount, created_at)
+			values ($1, $2, $3, $4, $5, $6)`
+
+	for _, item := range invoice.LineItems {
+		_, err = tx.ExecContext(ctx, stmt, newID, item.Description, item.Quantity, item.UnitAmount, item.Amount, time.Now())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// MarkPaid records a successful charge of the full invoice amount
+func (i *Invoice) MarkPaid(reference string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update invoices set amount_paid = amount, payment_reference = $1, paid_at = $2, updated_at = $3
+			where id = $4`
+
+	_, err := db.ExecContext(ctx, stmt, reference, time.Now(), time.Now(), i.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Refundable returns the amount, in cents, which can still be refunded on this invoice
+func (i *Invoice) Refundable() int {
+	return i.AmountPaid - i.AmountRefunded
+}
+
+// IsPaid reports whether the invoice has been charged
+func (i *Invoice) IsPaid() bool {
+	return i.AmountPaid > 0
+}
+
+// Number returns the human readable invoice number
+func (i *Invoice) Number() string {
+	return fmt.Sprintf("INV-%06d", i.ID)
+}
+
+// AmountForDisplay formats the invoice amount as a currency string
+func (i *Invoice) AmountForDisplay() string {
+	return formatCurrency(i.Amount)
+}
+
+// RefundableForDisplay formats the refundable amount as a currency string
+func (i *Invoice) RefundableForDisplay() string {
+	return formatCurrency(i.Refundable())
+}
+
+// AmountForDisplay formats the line item amount as a currency string
+func (l *LineItem) AmountForDisplay() string {
+	return formatCurrency(l.Amount)
+}
+
+// formatCurrency formats an amount in cents as a currency string
+func formatCurrency(cents int) string {
+	return fmt.Sprintf("$%.2f", float64(cents)/100.0)
+}
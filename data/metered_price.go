@@ -0,0 +1,236 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Pricing models for metered usage
+const (
+	PricingPerUnit = "per_unit"
+	PricingTiered  = "tiered"
+)
+
+// PriceTier is one tier of tiered pricing. Units up to and including UpTo are charged
+// UnitAmount cents each; an UpTo of 0 means the tier has no upper bound.
+type PriceTier struct {
+	UpTo       int `json:"up_to"`
+	UnitAmount int `json:"unit_amount"`
+}
+
+// MeteredPrice is the type for the price of one usage metric on a plan. Usage is
+// billed in arrears, at the end of each billing period.
+type MeteredPrice struct {
+	ID           int
+	PlanID       int
+	Metric       string
+	PricingModel string
+	UnitAmount   int
+	Tiers        []PriceTier
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
+}
+
+// GetAllForPlan returns the metered prices of one plan, sorted by metric
+func (m *MeteredPrice) GetAllForPlan(planID int) ([]*MeteredPrice, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, plan_id, metric, pricing_model, unit_amount, tiers, created_at, updated_at
+			from plan_metered_prices
+			where plan_id = $1
+			order by metric`
+
+	rows, err := db.QueryContext(ctx, query, planID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var prices []*MeteredPrice
+
+	for rows.Next() {
+		var price MeteredPrice
+		var tiers []byte
+		err := rows.Scan(
+			&price.ID,
+			&price.PlanID,
+			&price.Metric,
+			&price.PricingModel,
+			&price.UnitAmount,
+			&tiers,
+			&price.CreatedAt,
+			&price.UpdatedAt,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		err = json.Unmarshal(tiers, &price.Tiers)
+		if err != nil {
+			return nil, err
+		}
+
+		prices = append(prices, &price)
+	}
+
+	return prices, nil
+}
+
+// Upsert sets the price of a metric on a plan
+func (m *MeteredPrice) Upsert(price MeteredPrice) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	if price.Tiers == nil {
+		price.Tiers = []PriceTier{}
+	}
+
+	tiers, err := json.Marshal(price.Tiers)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into plan_metered_prices (plan_id, metric, pricing_model, unit_amount, tiers, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7)
+			on conflict (plan_id, metric) do update set
+				pricing_model = excluded.pricing_model,
+				unit_amount = excluded.unit_amount,
+				tiers = excluded.tiers,
+				updated_at = excluded.updated_at`
+
+	_, err = db.ExecContext(ctx, stmt,
+		price.PlanID,
+		price.Metric,
+		price.PricingModel,
+		price.UnitAmount,
+		tiers,
+		time.Now(),
+		time.Now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteByID removes a metered price from its plan
+func (m *MeteredPrice) DeleteByID(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from plan_metered_prices where id = $1`
+
+	_, err := db.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Amount returns the charge, in cents, for quantity units of usage. Tiered prices are
+// graduated: each unit is charged at the rate of the tier it falls into.
+func (m *MeteredPrice) Amount(quantity int) int {
+	if quantity <= 0 {
+		return 0
+	}
+
+	if m.PricingModel != PricingTiered {
+		return quantity * m.UnitAmount
+	}
+
+	amount := 0
+	previous := 0
+	for _, tier := range m.Tiers {
+		if tier.UpTo == 0 || quantity <= tier.UpTo {
+			return amount + (quantity-previous)*tier.UnitAmount
+		}
+
+		amount += (tier.UpTo - previous) * tier.UnitAmount
+		previous = tier.UpTo
+	}
+
+	// usage beyond the last tier is charged at the last tier's rate
+	if len(m.Tiers) > 0 {
+		amount += (quantity - previous) * m.Tiers[len(m.Tiers)-1].UnitAmount
+	}
+
+	return amount
+}
+
+// Describe returns a short description of the price, for display
+func (m *MeteredPrice) Describe() string {
+	if m.PricingModel != PricingTiered {
+		return fmt.Sprintf("%s per unit", formatCurrency(m.UnitAmount))
+	}
+
+	return FormatPriceTiers(m.Tiers)
+}
+
+// ParsePriceTiers parses tiers written as comma separated up_to:unit_amount pairs,
+// with amounts in cents and "inf" for the open-ended last tier, for example
+// "1000:0, 10000:2, inf:1". The bounds must be increasing and only the last tier
+// may be open-ended.
+func ParsePriceTiers(s string) ([]PriceTier, error) {
+	var tiers []PriceTier
+
+	for _, x := range strings.Split(s, ",") {
+		x = strings.TrimSpace(x)
+		if x == "" {
+			continue
+		}
+
+		if len(tiers) > 0 && tiers[len(tiers)-1].UpTo == 0 {
+			return nil, fmt.Errorf("invalid tiers %q: only the last tier may be open-ended", s)
+		}
+
+		upTo, unitAmount, found := strings.Cut(x, ":")
+		if !found {
+			return nil, fmt.Errorf("invalid tier %q: expected up_to:unit_amount", x)
+		}
+
+		var tier PriceTier
+		var err error
+
+		if strings.TrimSpace(upTo) != "inf" {
+			tier.UpTo, err = strconv.Atoi(strings.TrimSpace(upTo))
+			if err != nil || tier.UpTo <= 0 {
+				return nil, fmt.Errorf("invalid tier %q: bad upper bound", x)
+			}
+			if len(tiers) > 0 && tier.UpTo <= tiers[len(tiers)-1].UpTo {
+				return nil, fmt.Errorf("invalid tiers %q: bounds must be increasing", s)
+			}
+		}
+
+		tier.UnitAmount, err = strconv.Atoi(strings.TrimSpace(unitAmount))
+		if err != nil || tier.UnitAmount < 0 {
+			return nil, fmt.Errorf("invalid tier %q: bad unit amount", x)
+		}
+
+		tiers = append(tiers, tier)
+	}
+
+	return tiers, nil
+}
+
+// FormatPriceTiers is the inverse of ParsePriceTiers
+func FormatPriceTiers(tiers []PriceTier) string {
+	parts := make([]string, len(tiers))
+	for i, tier := range tiers {
+		upTo := "inf"
+		if tier.UpTo > 0 {
+			upTo = strconv.Itoa(tier.UpTo)
+		}
+		parts[i] = fmt.Sprintf("%s:%d", upTo, tier.UnitAmount)
+	}
+
+	return strings.Join(parts, ", ")
+}
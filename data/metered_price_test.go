@@ -0,0 +1,96 @@
+package data
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMeteredPriceAmount(t *testing.T) {
+	tiered := &MeteredPrice{
+		PricingModel: PricingTiered,
+		Tiers: []PriceTier{
+			{UpTo: 1000, UnitAmount: 0},
+			{UpTo: 10000, UnitAmount: 2},
+			{UpTo: 0, UnitAmount: 1},
+		},
+	}
+	bounded := &MeteredPrice{
+		PricingModel: PricingTiered,
+		Tiers: []PriceTier{
+			{UpTo: 10, UnitAmount: 5},
+			{UpTo: 20, UnitAmount: 3},
+		},
+	}
+	perUnit := &MeteredPrice{PricingModel: PricingPerUnit, UnitAmount: 7}
+
+	tests := []struct {
+		name     string
+		price    *MeteredPrice
+		quantity int
+		want     int
+	}{
+		{"per unit", perUnit, 3, 21},
+		{"per unit, none", perUnit, 0, 0},
+		{"per unit, negative", perUnit, -4, 0},
+		{"first tier free", tiered, 1000, 0},
+		{"first unit of second tier", tiered, 1001, 2},
+		{"end of second tier", tiered, 10000, 18000},
+		{"into the open tier", tiered, 10500, 18500},
+		{"none", tiered, 0, 0},
+		{"within the first bounded tier", bounded, 4, 20},
+		{"end of the last bounded tier", bounded, 20, 80},
+		{"beyond the last tier at its rate", bounded, 25, 95},
+		{"no tiers", &MeteredPrice{PricingModel: PricingTiered}, 100, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.price.Amount(tt.quantity); got != tt.want {
+				t.Errorf("Amount(%d) = %d, want %d", tt.quantity, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePriceTiers(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []PriceTier
+		wantErr bool
+	}{
+		{"graduated", "1000:0, 10000:2, inf:1", []PriceTier{{1000, 0}, {10000, 2}, {0, 1}}, false},
+		{"bounded", "10:5,20:3", []PriceTier{{10, 5}, {20, 3}}, false},
+		{"trailing comma", "10:5,", []PriceTier{{10, 5}}, false},
+		{"open tier not last", "inf:1, 100:2", nil, true},
+		{"decreasing bounds", "100:2, 50:1", nil, true},
+		{"equal bounds", "100:2, 100:1", nil, true},
+		{"zero bound", "0:1", nil, true},
+		{"negative amount", "100:-1", nil, true},
+		{"missing amount", "100", nil, true},
+		{"not a number", "ten:1", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePriceTiers(tt.input)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParsePriceTiers(%q) = %v, want an error", tt.input, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParsePriceTiers(%q): %v", tt.input, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParsePriceTiers(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+
+			again, err := ParsePriceTiers(FormatPriceTiers(got))
+			if err != nil || !reflect.DeepEqual(again, got) {
+				t.Errorf("FormatPriceTiers(%v) does not parse back: %v, %v", got, again, err)
+			}
+		})
+	}
+}
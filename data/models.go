@@ -15,8 +15,24 @@ func New(dbPool *sql.DB) Models {
 	db = dbPool
 
 	return Models{
-		User: User{},
-		Plan: Plan{},
+		User:             User{},
+		Plan:             Plan{},
+		BillingProfile:   BillingProfile{},
+		Invoice:          Invoice{},
+		CreditNote:       CreditNote{},
+		Subscription:     Subscription{},
+		Entitlement:      Entitlement{},
+		UsageRecord:      UsageRecord{},
+		MeteredPrice:     MeteredPrice{},
+		Token:            Token{},
+		WebhookEndpoint:  WebhookEndpoint{},
+		WebhookDelivery:  WebhookDelivery{},
+		AuditLog:         AuditLog{},
+		TwoFactor:        TwoFactor{},
+		Setting:          Setting{},
+		EmailPreferences: EmailPreferences{},
+		EmailLog:         EmailLog{},
+		Identity:         Identity{},
 	}
 }
 
@@ -24,6 +40,22 @@ func New(dbPool *sql.DB) Models {
 // in this type is available to us throughout the application, anywhere that the
 // app variable is used, provided that the model is also added in the New function.
 type Models struct {
-	User User
-	Plan Plan
+	User             User
+	Plan             Plan
+	BillingProfile   BillingProfile
+	Invoice          Invoice
+	CreditNote       CreditNote
+	Subscription     Subscription
+	Entitlement      Entitlement
+	UsageRecord      UsageRecord
+	MeteredPrice     MeteredPrice
+	Token            Token
+	WebhookEndpoint  WebhookEndpoint
+	WebhookDelivery  WebhookDelivery
+	AuditLog         AuditLog
+	TwoFactor        TwoFactor
+	Setting          Setting
+	EmailPreferences EmailPreferences
+	EmailLog         EmailLog
+	Identity         Identity
 }
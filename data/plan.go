@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -13,6 +15,7 @@ type Plan struct {
 	PlanName            string
 	PlanAmount          int
 	PlanAmountFormatted string
+	DunningSchedule     []int
 	CreatedAt           time.Time
 	UpdatedAt           time.Time
 }
@@ -21,7 +24,7 @@ func (p *Plan) GetAll() ([]*Plan, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, plan_name, plan_amount, created_at, updated_at
+	query := `select id, plan_name, plan_amount, dunning_schedule, created_at, updated_at
 	from plans order by id`
 
 	rows, err := db.QueryContext(ctx, query)
@@ -34,10 +37,12 @@ func (p *Plan) GetAll() ([]*Plan, error) {
 
 	for rows.Next() {
 		var plan Plan
+		var schedule string
 		err := rows.Scan(
 			&plan.ID,
 			&plan.PlanName,
 			&plan.PlanAmount,
+			&schedule,
 			&plan.CreatedAt,
 			&plan.UpdatedAt,
 		)
@@ -48,6 +53,11 @@ func (p *Plan) GetAll() ([]*Plan, error) {
 			return nil, err
 		}
 
+		plan.DunningSchedule, err = ParseDunningSchedule(schedule)
+		if err != nil {
+			return nil, err
+		}
+
 		plans = append(plans, &plan)
 	}
 
@@ -59,15 +69,17 @@ func (p *Plan) GetOne(id int) (*Plan, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, plan_name, plan_amount, created_at, updated_at from plans where id = $1`
+	query := `select id, plan_name, plan_amount, dunning_schedule, created_at, updated_at from plans where id = $1`
 
 	var plan Plan
+	var schedule string
 	row := db.QueryRowContext(ctx, query, id)
 
 	err := row.Scan(
 		&plan.ID,
 		&plan.PlanName,
 		&plan.PlanAmount,
+		&schedule,
 		&plan.CreatedAt,
 		&plan.UpdatedAt,
 	)
@@ -76,6 +88,12 @@ func (p *Plan) GetOne(id int) (*Plan, error) {
 		return nil, err
 	}
 
+	plan.PlanAmountFormatted = plan.AmountForDisplay()
+	plan.DunningSchedule, err = ParseDunningSchedule(schedule)
+	if err != nil {
+		return nil, err
+	}
+
 	return &plan, nil
 }
 
@@ -92,11 +110,18 @@ func (p *Plan) SubscribeUserToPlan(user User, plan Plan) error {
 		return err
 	}
 
-	// subscribe to new plan
-	stmt = `insert into user_plans (user_id, plan_id, created_at, updated_at)
-			values ($1, $2, $3, $4)`
-
-	_, err = db.ExecContext(ctx, stmt, user.ID, plan.ID, time.Now(), time.Now())
+	// subscribe to new plan, with the first billing period starting now
+	stmt = `insert into user_plans (user_id, plan_id, status, current_period_end, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6)`
+
+	_, err = db.ExecContext(ctx, stmt,
+		user.ID,
+		plan.ID,
+		SubscriptionActive,
+		time.Now().AddDate(0, 1, 0),
+		time.Now(),
+		time.Now(),
+	)
 	if err != nil {
 		return err
 	}
@@ -108,3 +133,55 @@ func (p *Plan) AmountForDisplay() string {
 	amount := float64(p.PlanAmount) / 100.0
 	return fmt.Sprintf("$%.2f", amount)
 }
+
+// UpdateDunningSchedule sets the days, counted from the first failed renewal, on which
+// a failed payment is retried before the subscription is cancelled
+func (p *Plan) UpdateDunningSchedule(schedule []int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update plans set dunning_schedule = $1, updated_at = $2 where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, FormatDunningSchedule(schedule), time.Now(), p.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ParseDunningSchedule parses a comma separated list of days, such as "1,3,7,14". The
+// days must be positive and in increasing order.
+func ParseDunningSchedule(s string) ([]int, error) {
+	var schedule []int
+
+	for _, x := range strings.Split(s, ",") {
+		x = strings.TrimSpace(x)
+		if x == "" {
+			continue
+		}
+
+		day, err := strconv.Atoi(x)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dunning schedule %q: %w", s, err)
+		}
+
+		if day <= 0 || (len(schedule) > 0 && day <= schedule[len(schedule)-1]) {
+			return nil, fmt.Errorf("invalid dunning schedule %q: days must be positive and increasing", s)
+		}
+
+		schedule = append(schedule, day)
+	}
+
+	return schedule, nil
+}
+
+// FormatDunningSchedule is the inverse of ParseDunningSchedule
+func FormatDunningSchedule(schedule []int) string {
+	days := make([]string, len(schedule))
+	for i, day := range schedule {
+		days[i] = strconv.Itoa(day)
+	}
+
+	return strings.Join(days, ",")
+}
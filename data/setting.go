@@ -0,0 +1,57 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+)
+
+// Settings which admins can change
+const (
+	// SettingRequireAdmin2FA makes admins turn on two-factor authentication before
+	// they can use the admin pages
+	SettingRequireAdmin2FA = "require_admin_2fa"
+)
+
+// Setting is the type for application-wide settings, stored by name
+type Setting struct {
+	Name      string
+	Value     string
+	UpdatedAt time.Time
+}
+
+// GetBool returns the value of a true/false setting. A setting which was never
+// saved is false.
+func (s *Setting) GetBool(name string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var value string
+	err := db.QueryRowContext(ctx, `select value from settings where name = $1`, name).Scan(&value)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return strconv.ParseBool(value)
+}
+
+// SetBool saves the value of a true/false setting
+func (s *Setting) SetBool(name string, value bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `insert into settings (name, value, updated_at) values ($1, $2, $3)
+			on conflict (name) do update set value = excluded.value, updated_at = excluded.updated_at`
+
+	_, err := db.ExecContext(ctx, stmt, name, strconv.FormatBool(value), time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,180 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// Subscription statuses
+const (
+	SubscriptionActive    = "active"
+	SubscriptionPastDue   = "past_due"
+	SubscriptionCancelled = "cancelled"
+)
+
+// Subscription is the type for a user's subscription to a plan, stored in the
+// user_plans table
+type Subscription struct {
+	UserID           int
+	PlanID           int
+	Status           string
+	CurrentPeriodEnd time.Time
+	PastDueSince     time.Time
+	DunningStep      int
+	LastInvoiceID    int
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
+
+const subscriptionColumns = `user_id, plan_id, status, current_period_end, past_due_since, dunning_step,
+	last_invoice_id, created_at, updated_at`
+
+func scanSubscription(row scanner) (*Subscription, error) {
+	var sub Subscription
+	var pastDueSince sql.NullTime
+	var lastInvoiceID sql.NullInt64
+	err := row.Scan(
+		&sub.UserID,
+		&sub.PlanID,
+		&sub.Status,
+		&sub.CurrentPeriodEnd,
+		&pastDueSince,
+		&sub.DunningStep,
+		&lastInvoiceID,
+		&sub.CreatedAt,
+		&sub.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	sub.PastDueSince = pastDueSince.Time
+	sub.LastInvoiceID = int(lastInvoiceID.Int64)
+
+	return &sub, nil
+}
+
+func getSubscriptions(query string, args ...any) ([]*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []*Subscription
+
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		subs = append(subs, sub)
+	}
+
+	return subs, nil
+}
+
+// GetByUserID returns the subscription of one user
+func (s *Subscription) GetByUserID(userID int) (*Subscription, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + subscriptionColumns + ` from user_plans where user_id = $1`
+
+	return scanSubscription(db.QueryRowContext(ctx, query, userID))
+}
+
+// GetDueForRenewal returns all active subscriptions whose current period has ended
+func (s *Subscription) GetDueForRenewal(now time.Time) ([]*Subscription, error) {
+	query := `select ` + subscriptionColumns + ` from user_plans
+			where status = $1 and current_period_end <= $2
+			order by current_period_end`
+
+	return getSubscriptions(query, SubscriptionActive, now)
+}
+
+// GetPastDue returns all subscriptions whose renewal charge has failed
+func (s *Subscription) GetPastDue() ([]*Subscription, error) {
+	query := `select ` + subscriptionColumns + ` from user_plans
+			where status = $1
+			order by past_due_since`
+
+	return getSubscriptions(query, SubscriptionPastDue)
+}
+
+// Renew starts a new billing period which ends at periodEnd, and clears any dunning state
+func (s *Subscription) Renew(invoiceID int, periodEnd time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_plans set status = $1, current_period_end = $2, past_due_since = null,
+				dunning_step = 0, last_invoice_id = $3, updated_at = $4
+			where user_id = $5`
+
+	_, err := db.ExecContext(ctx, stmt, SubscriptionActive, periodEnd, invoiceID, time.Now(), s.UserID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MarkPastDue moves the subscription into the past_due state after the renewal
+// charge for invoiceID failed
+func (s *Subscription) MarkPastDue(invoiceID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_plans set status = $1, past_due_since = $2, dunning_step = 0,
+				last_invoice_id = $3, updated_at = $4
+			where user_id = $5`
+
+	_, err := db.ExecContext(ctx, stmt, SubscriptionPastDue, time.Now(), invoiceID, time.Now(), s.UserID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetDunningStep records how many retries of the dunning schedule have been made
+func (s *Subscription) SetDunningStep(step int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_plans set dunning_step = $1, updated_at = $2 where user_id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, step, time.Now(), s.UserID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Cancel cancels the subscription
+func (s *Subscription) Cancel() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_plans set status = $1, updated_at = $2 where user_id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, SubscriptionCancelled, time.Now(), s.UserID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// IsPastDue reports whether the subscription has an unpaid renewal
+func (s *Subscription) IsPastDue() bool {
+	return s.Status == SubscriptionPastDue
+}
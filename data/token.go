@@ -0,0 +1,187 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Token scopes
+const (
+	ScopeRead  = "read"
+	ScopeWrite = "write"
+)
+
+// tokenPrefix makes our tokens easy to recognise, e.g. by secret scanners
+const tokenPrefix = "sst_"
+
+// Token is the type for personal access tokens, which authenticate requests to the
+// JSON API. Only a SHA-256 hash of the token is stored; the plain text is available
+// once, right after the token is generated.
+type Token struct {
+	ID         int
+	UserID     int
+	Name       string
+	Scopes     []string
+	PlainText  string
+	Hash       []byte
+	LastUsedAt time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+// GenerateToken creates a new random token for a user. It is not saved until it is
+// passed to Insert.
+func (t *Token) GenerateToken(userID int, name string, scopes []string) (*Token, error) {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &Token{
+		UserID: userID,
+		Name:   name,
+		Scopes: scopes,
+	}
+	token.PlainText = tokenPrefix + strings.ToLower(base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes))
+	token.Hash = hashToken(token.PlainText)
+
+	return token, nil
+}
+
+func hashToken(plainText string) []byte {
+	hash := sha256.Sum256([]byte(plainText))
+	return hash[:]
+}
+
+// Insert saves a generated token, and returns the ID of the newly inserted row
+func (t *Token) Insert(token Token) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into api_tokens (user_id, name, token_hash, scopes, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6) returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		token.UserID,
+		token.Name,
+		token.Hash,
+		strings.Join(token.Scopes, ","),
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetAllForUser returns the tokens of a user which have not been revoked, newest first
+func (t *Token) GetAllForUser(userID int) ([]*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, name, scopes, last_used_at, created_at, updated_at
+			from api_tokens
+			where user_id = $1 and revoked_at is null
+			order by created_at desc`
+
+	rows, err := db.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*Token
+
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		tokens = append(tokens, token)
+	}
+
+	return tokens, nil
+}
+
+// GetByPlainText looks up an unrevoked token by its plain text, and records that it
+// has just been used
+func (t *Token) GetByPlainText(plainText string) (*Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `update api_tokens set last_used_at = $1
+			where token_hash = $2 and revoked_at is null
+			returning id, user_id, name, scopes, last_used_at, created_at, updated_at`
+
+	return scanToken(db.QueryRowContext(ctx, query, time.Now(), hashToken(plainText)))
+}
+
+// Revoke revokes one token of a user. It returns sql.ErrNoRows if the user has no
+// such token, or it has already been revoked.
+func (t *Token) Revoke(id, userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update api_tokens set revoked_at = $1, updated_at = $2
+			where id = $3 and user_id = $4 and revoked_at is null`
+
+	result, err := db.ExecContext(ctx, stmt, time.Now(), time.Now(), id, userID)
+	if err != nil {
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// HasScope reports whether the token was granted a scope
+func (t *Token) HasScope(scope string) bool {
+	return slices.Contains(t.Scopes, scope)
+}
+
+func scanToken(row scanner) (*Token, error) {
+	var token Token
+	var scopes string
+	var lastUsedAt sql.NullTime
+	err := row.Scan(
+		&token.ID,
+		&token.UserID,
+		&token.Name,
+		&scopes,
+		&lastUsedAt,
+		&token.CreatedAt,
+		&token.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if scopes != "" {
+		token.Scopes = strings.Split(scopes, ",")
+	}
+	token.LastUsedAt = lastUsedAt.Time
+
+	return &token, nil
+}
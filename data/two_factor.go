@@ -0,0 +1,202 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"strings"
+	"time"
+)
+
+// recoveryCodeCount is how many recovery codes a user gets at a time
+const recoveryCodeCount = 10
+
+// TwoFactor is the type for a user's time-based one-time password (TOTP) settings.
+// A user has one only while two-factor authentication is turned on.
+type TwoFactor struct {
+	UserID    int
+	Secret    string
+	EnabledAt time.Time
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// GetByUserID returns the two-factor settings of a user, or sql.ErrNoRows if the
+// user hasn't turned it on
+func (t *TwoFactor) GetByUserID(userID int) (*TwoFactor, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select user_id, secret, enabled_at, created_at, updated_at
+			from user_two_factor where user_id = $1`
+
+	var twoFactor TwoFactor
+	err := db.QueryRowContext(ctx, query, userID).Scan(
+		&twoFactor.UserID,
+		&twoFactor.Secret,
+		&twoFactor.EnabledAt,
+		&twoFactor.CreatedAt,
+		&twoFactor.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &twoFactor, nil
+}
+
+// Enable turns on two-factor authentication for a user with a TOTP secret, and
+// replaces any recovery codes they had with recoveryCodes
+func (t *TwoFactor) Enable(userID int, secret string, recoveryCodes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `insert into user_two_factor (user_id, secret, enabled_at, created_at, updated_at)
+			values ($1, $2, $3, $4, $5)
+			on conflict (user_id) do update set secret = excluded.secret, enabled_at = excluded.enabled_at,
+				updated_at = excluded.updated_at`
+
+	_, err = tx.ExecContext(ctx, stmt, userID, secret, time.Now(), time.Now(), time.Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		_, err = tx.ExecContext(ctx, `insert into recovery_codes (user_id, code_hash, created_at) values ($1, $2, $3)`,
+			userID, hashRecoveryCode(code), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Disable turns off two-factor authentication for a user, and deletes their
+// recovery codes
+func (t *TwoFactor) Disable(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from user_two_factor where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `delete from recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReplaceRecoveryCodes replaces the recovery codes of a user with new ones
+func (t *TwoFactor) ReplaceRecoveryCodes(userID int, recoveryCodes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `delete from recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		_, err = tx.ExecContext(ctx, `insert into recovery_codes (user_id, code_hash, created_at) values ($1, $2, $3)`,
+			userID, hashRecoveryCode(code), time.Now())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseRecoveryCode marks an unused recovery code of a user as used. It reports
+// whether the code was valid; each code works only once.
+func (t *TwoFactor) UseRecoveryCode(userID int, code string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update recovery_codes set used_at = $1
+			where user_id = $2 and code_hash = $3 and used_at is null`
+
+	result, err := db.ExecContext(ctx, stmt, time.Now(), userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// RemainingRecoveryCodes returns how many unused recovery codes a user has
+func (t *TwoFactor) RemainingRecoveryCodes(userID int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var n int
+	err := db.QueryRowContext(ctx, `select count(*) from recovery_codes where user_id = $1 and used_at is null`, userID).Scan(&n)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// GenerateRecoveryCodes returns a new set of random recovery codes, like
+// "k3j9d-2mxq7". They are not saved until passed to Enable or ReplaceRecoveryCodes.
+func (t *TwoFactor) GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		randomBytes := make([]byte, 10)
+
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(randomBytes))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+
+	return codes, nil
+}
+
+// hashRecoveryCode hashes a recovery code as typed by the user, ignoring case,
+// spaces and dashes. Codes are random enough that a plain SHA-256 will do.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
@@ -0,0 +1,32 @@
+package data
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestHashRecoveryCode(t *testing.T) {
+	const code = "k3j9d-2mxq7"
+
+	tests := []struct {
+		name  string
+		typed string
+		same  bool
+	}{
+		{"as shown", "k3j9d-2mxq7", true},
+		{"in capitals", "K3J9D-2MXQ7", true},
+		{"without the dash", "k3j9d2mxq7", true},
+		{"with spaces", " k3j9d 2mxq7 ", true},
+		{"another code", "k3j9d-2mxq8", false},
+		{"part of the code", "k3j9d", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			same := bytes.Equal(hashRecoveryCode(tt.typed), hashRecoveryCode(code))
+			if same != tt.same {
+				t.Errorf("hash of %q matches %q: %v, want %v", tt.typed, code, same, tt.same)
+			}
+		})
+	}
+}
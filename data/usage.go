@@ -0,0 +1,92 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+)
+
+// UsageRecord is the type for one report of metered usage, such as a number of API
+// calls made by a user
+type UsageRecord struct {
+	ID             int
+	UserID         int
+	Metric         string
+	Quantity       int
+	IdempotencyKey string
+	RecordedAt     time.Time
+	CreatedAt      time.Time
+}
+
+// Insert records usage and returns the ID of the newly inserted row. Reporting the
+// same non-empty idempotency key twice records the usage only once, and returns the
+// ID of the original record.
+func (u *UsageRecord) Insert(record UsageRecord) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var key sql.NullString
+	if record.IdempotencyKey != "" {
+		key = sql.NullString{String: record.IdempotencyKey, Valid: true}
+	}
+
+	var newID int
+	stmt := `insert into usage_records (user_id, metric, quantity, idempotency_key, recorded_at, created_at)
+			values ($1, $2, $3, $4, $5, $6)
+			on conflict (idempotency_key) do nothing
+			returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		record.UserID,
+		record.Metric,
+		record.Quantity,
+		key,
+		record.RecordedAt,
+		time.Now(),
+	).Scan(&newID)
+
+	if err == sql.ErrNoRows {
+		query := `select id from usage_records where idempotency_key = $1`
+		err = db.QueryRowContext(ctx, query, key).Scan(&newID)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// TotalsForPeriod returns the total usage of a user in [start, end), keyed by metric
+func (u *UsageRecord) TotalsForPeriod(userID int, start, end time.Time) (map[string]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select metric, sum(quantity)
+			from usage_records
+			where user_id = $1 and recorded_at >= $2 and recorded_at < $3
+			group by metric`
+
+	rows, err := db.QueryContext(ctx, query, userID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := make(map[string]int)
+
+	for rows.Next() {
+		var metric string
+		var total int
+		err := rows.Scan(&metric, &total)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		totals[metric] = total
+	}
+
+	return totals, nil
+}
@@ -3,11 +3,49 @@ package data
 import (
 	"context"
 	"errors"
-	"golang.org/x/crypto/bcrypt"
+	"fmt"
 	"log"
+	"slices"
+	"strings"
+	"subscription-service/passwords"
 	"time"
 )
 
+// ErrEmailTaken is returned when an email address is already used by another account
+var ErrEmailTaken = errors.New("email address already in use")
+
+// passwordHashing hashes and verifies the passwords of users
+var passwordHashing = passwords.DefaultHashing()
+
+// SessionRevoker logs a user out of every session they have
+type SessionRevoker interface {
+	RevokeAllSessions(userID int) error
+}
+
+// sessionRevoker is told when a user's sessions have to end, on a password
+// change or account deletion. Sessions live outside the database, so this is
+// left to the caller to set.
+var sessionRevoker SessionRevoker
+
+// UsePasswordHashing sets how the passwords of users are hashed from now on.
+// Passwords hashed before stay valid as long as hashing still verifies them.
+func UsePasswordHashing(hashing passwords.Hashing) {
+	passwordHashing = hashing
+}
+
+// UseSessionRevoker sets what revokes the sessions of users
+func UseSessionRevoker(revoker SessionRevoker) {
+	sessionRevoker = revoker
+}
+
+func revokeSessions(userID int) error {
+	if sessionRevoker == nil {
+		return nil
+	}
+
+	return sessionRevoker.RevokeAllSessions(userID)
+}
+
 // User is the structure which holds one user from the database.
 type User struct {
 	ID        int
@@ -75,7 +113,7 @@ func (u *User) GetAll() ([]*User, error) {
 	return users, nil
 }
 
-// GetByEmail returns one user by email
+// GetByEmail returns one user by email, whatever the case it was given in
 func (u *User) GetByEmail(email string) (*User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
@@ -94,7 +132,7 @@ func (u *User) GetByEmail(email string) (*User, error) {
 			from 
 			    users 
 			where 
-			    email = $1`
+			    lower(email) = lower($1)`
 
 	var user User
 	row := db.QueryRowContext(ctx, query, email)
@@ -119,7 +157,7 @@ func (u *User) GetByEmail(email string) (*User, error) {
 	query = `select p.id, p.plan_name, p.plan_amount, p.created_at, p.updated_at from 
 			plans p
 			left join user_plans up on (p.id = up.plan_id)
-			where up.user_id = $1`
+			where up.user_id = $1 and up.status <> 'cancelled'`
 
 	var plan Plan
 	row = db.QueryRowContext(ctx, query, user.ID)
@@ -171,7 +209,7 @@ func (u *User) GetOne(id int) (*User, error) {
 	query = `select p.id, p.plan_name, p.plan_amount, p.created_at, p.updated_at from 
 			plans p
 			left join user_plans up on (p.id = up.plan_id)
-			where up.user_id = $1`
+			where up.user_id = $1 and up.status <> 'cancelled'`
 
 	var plan Plan
 	row = db.QueryRowContext(ctx, query, user.ID)
@@ -194,21 +232,20 @@ func (u *User) GetOne(id int) (*User, error) {
 }
 
 // Update updates one user in the database, using the information
-// stored in the receiver u
+// stored in the receiver u. The email address is left alone: it can only be
+// changed by UpdateEmail, once the new address has been confirmed.
 func (u *User) Update() error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
 	stmt := `update users set
-		email = $1,
-		first_name = $2,
-		last_name = $3,
-		user_active = $4,
-		updated_at = $5
-		where id = $6`
+		first_name = $1,
+		last_name = $2,
+		user_active = $3,
+		updated_at = $4
+		where id = $5`
 
 	_, err := db.ExecContext(ctx, stmt,
-		u.Email,
 		u.FirstName,
 		u.LastName,
 		u.Active,
@@ -223,34 +260,133 @@ func (u *User) Update() error {
 	return nil
 }
 
-// Delete deletes one user from the database, by User.ID
-func (u *User) Delete() error {
+// UpdateEmail changes the email address of the user. It returns ErrEmailTaken if
+// another account already uses the address.
+func (u *User) UpdateEmail(email string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	stmt := `delete from users where id = $1`
+	stmt := `update users set email = $1, updated_at = $2
+		where id = $3 and not exists (select 1 from users where lower(email) = lower($1) and id <> $3)`
 
-	_, err := db.ExecContext(ctx, stmt, u.ID)
+	result, err := db.ExecContext(ctx, stmt, email, time.Now(), u.ID)
 	if err != nil {
 		return err
 	}
 
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrEmailTaken
+	}
+
+	u.Email = email
+
 	return nil
 }
 
-// DeleteByID deletes one user from the database, by ID
-func (u *User) DeleteByID(id int) error {
+// Delete deletes the account of one user, by User.ID. The users row is kept, with
+// the name, email address and password wiped, so that invoices and credit notes,
+// which have to be retained, still belong to it; everything else personal to the
+// user is removed and their subscription is cancelled. Records which have to stay,
+// the audit log and webhook deliveries, are kept with the personal data in them
+// redacted, in the same transaction. The user is logged out everywhere.
+func (u *User) Delete() error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	stmt := `delete from users where id = $1`
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-	_, err := db.ExecContext(ctx, stmt, id)
+	var email string
+	err = tx.QueryRowContext(ctx, `select email from users where id = $1 for update`, u.ID).Scan(&email)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	// every address the user has had may have been logged, not just the current one
+	emails, err := auditedEmails(ctx, tx, u.ID)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(emails, strings.ToLower(email)) {
+		emails = append(emails, strings.ToLower(email))
+	}
+
+	stmt := `update users set
+		email = $1,
+		first_name = 'Deleted',
+		last_name = 'User',
+		password = '',
+		user_active = 0,
+		is_admin = 0,
+		deleted_at = $2,
+		updated_at = $2
+		where id = $3`
+
+	_, err = tx.ExecContext(ctx, stmt, fmt.Sprintf("deleted-%d@deleted.invalid", u.ID), time.Now(), u.ID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `update user_plans set status = $1, updated_at = $2 where user_id = $3`,
+		SubscriptionCancelled, time.Now(), u.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, table := range []string{
+		"billing_profiles",
+		"api_tokens",
+		"user_two_factor",
+		"recovery_codes",
+		"email_preferences",
+		"usage_records",
+		"email_log",
+		"user_identities",
+	} {
+		_, err = tx.ExecContext(ctx, fmt.Sprintf(`delete from %s where user_id = $1`, table), u.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	// emails sent before the account existed, or to an address it has since left,
+	// aren't linked to it by user_id
+	for _, address := range emails {
+		_, err = tx.ExecContext(ctx, `delete from email_log where lower(recipient) = $1`, address)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = redactAuditLog(ctx, tx, u.ID, emails)
+	if err != nil {
+		return err
+	}
+
+	err = redactWebhookDeliveries(ctx, tx, u.ID)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	return revokeSessions(u.ID)
+}
+
+// DeleteByID deletes the account of one user, by ID, as Delete does
+func (u *User) DeleteByID(id int) error {
+	user := User{ID: id}
+	return user.Delete()
 }
 
 // Insert inserts a new user into the database, and returns the ID of the newly inserted row
@@ -258,7 +394,7 @@ func (u *User) Insert(user User) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+	hashedPassword, err := passwordHashing.Hash(user.Password)
 	if err != nil {
 		return 0, err
 	}
@@ -284,12 +420,28 @@ func (u *User) Insert(user User) (int, error) {
 	return newID, nil
 }
 
-// ResetPassword is the method we will use to change a user's password.
+// ResetPassword is the method we will use to change a user's password. Every
+// session of the user is revoked, so anyone else logged in as them is logged out.
 func (u *User) ResetPassword(password string) error {
+	err := u.savePassword(password)
+	if err != nil {
+		return err
+	}
+
+	return revokeSessions(u.ID)
+}
+
+// RehashPassword saves the hash of the user's current password again, with the
+// preferred algorithm. The password itself is unchanged, so the user stays logged in.
+func (u *User) RehashPassword(password string) error {
+	return u.savePassword(password)
+}
+
+func (u *User) savePassword(password string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	hashedPassword, err := passwordHashing.Hash(password)
 	if err != nil {
 		return err
 	}
@@ -303,20 +455,16 @@ func (u *User) ResetPassword(password string) error {
 	return nil
 }
 
-// PasswordMatches uses Go's bcrypt package to compare a user supplied password
-// with the hash we have stored for a given user in the database. If the password
-// and hash match, we return true; otherwise, we return false.
+// PasswordMatches compares a user supplied password with the hash we have stored
+// for a given user in the database, whichever algorithm made the hash. If the
+// password and hash match, we return true; otherwise, we return false.
 func (u *User) PasswordMatches(plainText string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(plainText))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			// invalid password
-			return false, nil
-		default:
-			return false, err
-		}
-	}
+	return passwordHashing.Verify(plainText, u.Password)
+}
 
-	return true, nil
+// PasswordOutdated reports whether the user's password hash was made with an old
+// algorithm or weaker parameters than we use now. It can only be replaced when the
+// user next gives us their password.
+func (u *User) PasswordOutdated() bool {
+	return passwordHashing.Outdated(u.Password)
 }
@@ -0,0 +1,385 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Webhook delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryFailed    = "failed"
+)
+
+// WebhookEndpoint is the type for a URL, configured by an admin, which is sent the
+// events it subscribes to. Every request is signed with the endpoint's secret.
+type WebhookEndpoint struct {
+	ID        int
+	URL       string
+	Secret    string
+	Events    []string
+	Active    bool
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// WebhookDelivery is the type for one event sent, or to be sent, to one endpoint
+type WebhookDelivery struct {
+	ID             int
+	EndpointID     int
+	EventID        string
+	EventType      string
+	Payload        []byte
+	Status         string
+	Attempts       int
+	NextAttemptAt  time.Time
+	ResponseStatus int
+	LastError      string
+	DeliveredAt    time.Time
+	CreatedAt      time.Time
+	UpdatedAt      time.Time
+}
+
+// GetAll returns all webhook endpoints
+func (e *WebhookEndpoint) GetAll() ([]*WebhookEndpoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, url, secret, events, active, created_at, updated_at
+			from webhook_endpoints order by id`
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var endpoints []*WebhookEndpoint
+
+	for rows.Next() {
+		endpoint, err := scanWebhookEndpoint(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		endpoints = append(endpoints, endpoint)
+	}
+
+	return endpoints, nil
+}
+
+// GetActiveForEvent returns the active endpoints which subscribe to an event type
+func (e *WebhookEndpoint) GetActiveForEvent(eventType string) ([]*WebhookEndpoint, error) {
+	all, err := e.GetAll()
+	if err != nil {
+		return nil, err
+	}
+
+	var endpoints []*WebhookEndpoint
+	for _, endpoint := range all {
+		if endpoint.Active && endpoint.Subscribes(eventType) {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	return endpoints, nil
+}
+
+// GetOne returns one webhook endpoint by id
+func (e *WebhookEndpoint) GetOne(id int) (*WebhookEndpoint, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, url, secret, events, active, created_at, updated_at
+			from webhook_endpoints where id = $1`
+
+	return scanWebhookEndpoint(db.QueryRowContext(ctx, query, id))
+}
+
+// Insert saves a new endpoint, and returns the ID of the newly inserted row
+func (e *WebhookEndpoint) Insert(endpoint WebhookEndpoint) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into webhook_endpoints (url, secret, events, active, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6) returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		endpoint.URL,
+		endpoint.Secret,
+		strings.Join(endpoint.Events, ","),
+		endpoint.Active,
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// Update saves the URL, events and active flag of the endpoint in the receiver
+func (e *WebhookEndpoint) Update() error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update webhook_endpoints set url = $1, events = $2, active = $3, updated_at = $4
+			where id = $5`
+
+	_, err := db.ExecContext(ctx, stmt,
+		e.URL,
+		strings.Join(e.Events, ","),
+		e.Active,
+		time.Now(),
+		e.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteByID deletes an endpoint along with its delivery log
+func (e *WebhookEndpoint) DeleteByID(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from webhook_endpoints where id = $1`
+
+	_, err := db.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Subscribes reports whether the endpoint is sent events of a type
+func (e *WebhookEndpoint) Subscribes(eventType string) bool {
+	return slices.Contains(e.Events, eventType)
+}
+
+func scanWebhookEndpoint(row scanner) (*WebhookEndpoint, error) {
+	var endpoint WebhookEndpoint
+	var events string
+	err := row.Scan(
+		&endpoint.ID,
+		&endpoint.URL,
+		&endpoint.Secret,
+		&events,
+		&endpoint.Active,
+		&endpoint.CreatedAt,
+		&endpoint.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if events != "" {
+		endpoint.Events = strings.Split(events, ",")
+	}
+
+	return &endpoint, nil
+}
+
+// Insert queues an event for delivery to an endpoint, and returns the ID of the
+// newly inserted row
+func (d *WebhookDelivery) Insert(delivery WebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into webhook_deliveries (endpoint_id, event_id, event_type, payload, status,
+				next_attempt_at, created_at, updated_at)
+			values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
+
+	err := db.QueryRowContext(ctx, stmt,
+		delivery.EndpointID,
+		delivery.EventID,
+		delivery.EventType,
+		delivery.Payload,
+		DeliveryPending,
+		time.Now(),
+		time.Now(),
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetDue returns up to limit pending deliveries whose next attempt is due, oldest first
+func (d *WebhookDelivery) GetDue(now time.Time, limit int) ([]*WebhookDelivery, error) {
+	query := `select ` + webhookDeliveryColumns + `
+			from webhook_deliveries
+			where status = 'pending' and next_attempt_at <= $1
+			order by next_attempt_at
+			limit $2`
+
+	return queryWebhookDeliveries(query, now, limit)
+}
+
+// GetRecentForEndpoint returns the latest deliveries to an endpoint, newest first
+func (d *WebhookDelivery) GetRecentForEndpoint(endpointID, limit int) ([]*WebhookDelivery, error) {
+	query := `select ` + webhookDeliveryColumns + `
+			from webhook_deliveries
+			where endpoint_id = $1
+			order by created_at desc, id desc
+			limit $2`
+
+	return queryWebhookDeliveries(query, endpointID, limit)
+}
+
+// GetOne returns one delivery by id
+func (d *WebhookDelivery) GetOne(id int) (*WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + webhookDeliveryColumns + ` from webhook_deliveries where id = $1`
+
+	return scanWebhookDelivery(db.QueryRowContext(ctx, query, id))
+}
+
+// RecordAttempt saves the outcome of one attempt at delivering the receiver. A
+// pending delivery is tried again at nextAttemptAt.
+func (d *WebhookDelivery) RecordAttempt(status string, responseStatus int, lastError string, nextAttemptAt time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var next, delivered sql.NullTime
+	if status == DeliveryPending {
+		next = sql.NullTime{Time: nextAttemptAt, Valid: true}
+	}
+	if status == DeliverySucceeded {
+		delivered = sql.NullTime{Time: time.Now(), Valid: true}
+	}
+
+	var response sql.NullInt64
+	if responseStatus > 0 {
+		response = sql.NullInt64{Int64: int64(responseStatus), Valid: true}
+	}
+
+	stmt := `update webhook_deliveries set
+				status = $1,
+				attempts = attempts + 1,
+				response_status = $2,
+				last_error = $3,
+				next_attempt_at = $4,
+				delivered_at = $5,
+				updated_at = $6
+			where id = $7`
+
+	_, err := db.ExecContext(ctx, stmt, status, response, lastError, next, delivered, time.Now(), d.ID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Redeliver queues a delivery to be sent again right away, whatever its status
+func (d *WebhookDelivery) Redeliver(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update webhook_deliveries set status = 'pending', next_attempt_at = $1, updated_at = $2
+			where id = $3`
+
+	_, err := db.ExecContext(ctx, stmt, time.Now(), time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// redactWebhookDeliveries replaces the data of the events about a user who is being
+// deleted, in the transaction deleting them. Those not yet delivered never will be.
+func redactWebhookDeliveries(ctx context.Context, tx *sql.Tx, userID int) error {
+	stmt := `update webhook_deliveries set
+				payload = payload || '{"data": {"redacted": true}}',
+				status = case when status = $1 then $2 else status end,
+				last_error = case when status = $1 then 'account deleted' else last_error end,
+				next_attempt_at = null,
+				updated_at = $3
+			where payload->'data'->'user'->>'id' = $4 or payload->'data'->>'user_id' = $4`
+
+	_, err := tx.ExecContext(ctx, stmt, DeliveryPending, DeliveryFailed, time.Now(), strconv.Itoa(userID))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+const webhookDeliveryColumns = `id, endpoint_id, event_id, event_type, payload, status, attempts,
+				next_attempt_at, response_status, last_error, delivered_at, created_at, updated_at`
+
+func queryWebhookDeliveries(query string, args ...any) ([]*WebhookDelivery, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*WebhookDelivery
+
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, nil
+}
+
+func scanWebhookDelivery(row scanner) (*WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	var nextAttemptAt, deliveredAt sql.NullTime
+	var responseStatus sql.NullInt64
+	err := row.Scan(
+		&delivery.ID,
+		&delivery.EndpointID,
+		&delivery.EventID,
+		&delivery.EventType,
+		&delivery.Payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&nextAttemptAt,
+		&responseStatus,
+		&delivery.LastError,
+		&deliveredAt,
+		&delivery.CreatedAt,
+		&delivery.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	delivery.NextAttemptAt = nextAttemptAt.Time
+	delivery.DeliveredAt = deliveredAt.Time
+	delivery.ResponseStatus = int(responseStatus.Int64)
+
+	return &delivery, nil
+}
@@ -0,0 +1,19 @@
+package forms
+
+// errors holds the validation error messages of a form, keyed by field name
+type errors map[string][]string
+
+// Add adds an error message for a form field
+func (e errors) Add(field, message string) {
+	e[field] = append(e[field], message)
+}
+
+// Get returns the first error message for a form field, or "" if it has none
+func (e errors) Get(field string) string {
+	messages := e[field]
+	if len(messages) == 0 {
+		return ""
+	}
+
+	return messages[0]
+}
@@ -0,0 +1,108 @@
+// Package forms validates submitted HTML forms. A Form keeps the submitted values
+// along with an error message per invalid field, so a page can be rendered again
+// with what the user typed and what is wrong with it.
+package forms
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// Form is a submitted form and its validation errors
+type Form struct {
+	url.Values
+	Errors errors
+}
+
+// New returns a Form for the submitted values, with no errors yet
+func New(values url.Values) *Form {
+	if values == nil {
+		values = url.Values{}
+	}
+
+	return &Form{
+		Values: values,
+		Errors: errors{},
+	}
+}
+
+// Valid reports whether the form has passed every check made so far
+func (f *Form) Valid() bool {
+	return len(f.Errors) == 0
+}
+
+// Has reports whether a field was filled in with more than white space
+func (f *Form) Has(field string) bool {
+	return strings.TrimSpace(f.Get(field)) != ""
+}
+
+// Check adds message as an error for field unless ok. It is for rules which are
+// particular to one form.
+func (f *Form) Check(ok bool, field, message string) {
+	if !ok {
+		f.Errors.Add(field, message)
+	}
+}
+
+// Required checks that each of the fields was filled in
+func (f *Form) Required(fields ...string) {
+	for _, field := range fields {
+		f.Check(f.Has(field), field, "This field is required")
+	}
+}
+
+// IsEmail checks that a field holds an email address, if it was filled in
+func (f *Form) IsEmail(field string) {
+	if !f.Has(field) {
+		return
+	}
+
+	value := strings.TrimSpace(f.Get(field))
+	address, err := mail.ParseAddress(value)
+	f.Check(err == nil && address.Address == value && strings.Contains(value, "."), field, "Enter a valid email address")
+}
+
+// MinLength checks that a field is at least n characters long, if it was filled in
+func (f *Form) MinLength(field string, n int) {
+	if !f.Has(field) {
+		return
+	}
+
+	f.Check(utf8.RuneCountInString(f.Get(field)) >= n, field, fmt.Sprintf("Must be at least %d characters long", n))
+}
+
+// MaxLength checks that a field is at most n characters long
+func (f *Form) MaxLength(field string, n int) {
+	f.Check(utf8.RuneCountInString(f.Get(field)) <= n, field, fmt.Sprintf("Must be at most %d characters long", n))
+}
+
+// Matches checks that field has the same value as other, e.g. a password and its
+// confirmation. The error goes on field.
+func (f *Form) Matches(field, other string) {
+	if !f.Has(field) {
+		return
+	}
+
+	f.Check(f.Get(field) == f.Get(other), field, "Does not match")
+}
+
+// Unique checks that the value of a field isn't already taken, according to taken,
+// if it was filled in and is otherwise valid. It returns the error taken returns,
+// leaving the field without an error, so a failed lookup isn't blamed on the user.
+func (f *Form) Unique(field, message string, taken func(value string) (bool, error)) error {
+	if !f.Has(field) || f.Errors.Get(field) != "" {
+		return nil
+	}
+
+	exists, err := taken(strings.TrimSpace(f.Get(field)))
+	if err != nil {
+		return err
+	}
+
+	f.Check(!exists, field, message)
+
+	return nil
+}
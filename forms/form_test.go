@@ -0,0 +1,210 @@
+package forms
+
+import (
+	"fmt"
+	"net/url"
+	"testing"
+)
+
+func TestRequired(t *testing.T) {
+	tests := []struct {
+		name   string
+		values url.Values
+		want   string
+	}{
+		{"filled in", url.Values{"name": {"Jane"}}, ""},
+		{"missing", url.Values{}, "This field is required"},
+		{"empty", url.Values{"name": {""}}, "This field is required"},
+		{"white space", url.Values{"name": {" \t\n"}}, "This field is required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := New(tt.values)
+			form.Required("name")
+
+			if got := form.Errors.Get("name"); got != tt.want {
+				t.Errorf("error = %q, want %q", got, tt.want)
+			}
+			if form.Valid() != (tt.want == "") {
+				t.Errorf("Valid() = %v with error %q", form.Valid(), tt.want)
+			}
+		})
+	}
+}
+
+func TestIsEmail(t *testing.T) {
+	tests := []struct {
+		email string
+		valid bool
+	}{
+		{"jane@example.com", true},
+		{"jane.doe+billing@mail.example.co.uk", true},
+		{" jane@example.com ", true},
+		{"", true}, // not filled in is for Required to report
+		{"jane", false},
+		{"jane@", false},
+		{"@example.com", false},
+		{"jane@localhost", false},
+		{"jane@@example.com", false},
+		{"jane doe@example.com", false},
+		{"Jane <jane@example.com>", false},
+		{"jane@example.com, joe@example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			form := New(url.Values{"email": {tt.email}})
+			form.IsEmail("email")
+
+			if form.Valid() != tt.valid {
+				t.Errorf("IsEmail(%q): valid = %v, want %v", tt.email, form.Valid(), tt.valid)
+			}
+		})
+	}
+}
+
+func TestLength(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		check func(f *Form)
+		want  string
+	}{
+		{"min, long enough", "secret", func(f *Form) { f.MinLength("field", 6) }, ""},
+		{"min, too short", "short", func(f *Form) { f.MinLength("field", 6) }, "Must be at least 6 characters long"},
+		{"min, counts characters not bytes", "héllo", func(f *Form) { f.MinLength("field", 6) }, "Must be at least 6 characters long"},
+		{"min, not filled in", "", func(f *Form) { f.MinLength("field", 6) }, ""},
+		{"max, short enough", "héllo", func(f *Form) { f.MaxLength("field", 5) }, ""},
+		{"max, too long", "hello!", func(f *Form) { f.MaxLength("field", 5) }, "Must be at most 5 characters long"},
+		{"max, empty", "", func(f *Form) { f.MaxLength("field", 5) }, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := New(url.Values{"field": {tt.value}})
+			tt.check(form)
+
+			if got := form.Errors.Get("field"); got != tt.want {
+				t.Errorf("error = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		name         string
+		password     string
+		confirmation string
+		want         string
+	}{
+		{"same", "correct horse", "correct horse", ""},
+		{"different", "correct horse", "correct house", "Does not match"},
+		{"different case", "Secret", "secret", "Does not match"},
+		{"confirmation missing", "correct horse", "", "Does not match"},
+		{"password not filled in", "", "correct horse", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := New(url.Values{"password": {tt.password}, "verify-password": {tt.confirmation}})
+			form.Matches("password", "verify-password")
+
+			if got := form.Errors.Get("password"); got != tt.want {
+				t.Errorf("error = %q, want %q", got, tt.want)
+			}
+			if got := form.Errors.Get("verify-password"); got != "" {
+				t.Errorf("confirmation has error %q, want it on the password", got)
+			}
+		})
+	}
+}
+
+func TestUnique(t *testing.T) {
+	errLookup := fmt.Errorf("database unavailable")
+
+	tests := []struct {
+		name        string
+		value       string
+		invalid     bool
+		taken       bool
+		lookupErr   error
+		wantLookup  string
+		wantMessage string
+		wantErr     error
+	}{
+		{"free", "jane@example.com", false, false, nil, "jane@example.com", "", nil},
+		{"taken", "jane@example.com", false, true, nil, "jane@example.com", "Already taken", nil},
+		{"looked up trimmed", "  jane@example.com ", false, false, nil, "jane@example.com", "", nil},
+		{"lookup fails", "jane@example.com", false, false, errLookup, "jane@example.com", "", errLookup},
+		{"not filled in", "", false, true, nil, "", "", nil},
+		{"already invalid", "jane", true, true, nil, "", "Enter a valid email address", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := New(url.Values{"email": {tt.value}})
+			if tt.invalid {
+				form.IsEmail("email")
+			}
+
+			var lookedUp string
+			err := form.Unique("email", "Already taken", func(value string) (bool, error) {
+				lookedUp = value
+				return tt.taken, tt.lookupErr
+			})
+
+			if err != tt.wantErr {
+				t.Errorf("err = %v, want %v", err, tt.wantErr)
+			}
+			if lookedUp != tt.wantLookup {
+				t.Errorf("looked up %q, want %q", lookedUp, tt.wantLookup)
+			}
+			if got := form.Errors.Get("email"); got != tt.wantMessage {
+				t.Errorf("error = %q, want %q", got, tt.wantMessage)
+			}
+			if n := len(form.Errors["email"]); n > 1 {
+				t.Errorf("field has %d errors, want at most one", n)
+			}
+		})
+	}
+}
+
+func TestFormKeepsValues(t *testing.T) {
+	form := New(nil)
+	form.Required("email")
+	if form.Get("email") != "" || form.Valid() {
+		t.Errorf("New(nil): value %q, valid %v", form.Get("email"), form.Valid())
+	}
+
+	form = New(url.Values{"email": {"jane"}, "first-name": {"Jane"}})
+	form.Required("email", "first-name", "last-name")
+	form.IsEmail("email")
+	form.Check(false, "email", "Second message")
+
+	tests := []struct {
+		field     string
+		wantValue string
+		wantError string
+		wantCount int
+	}{
+		{"email", "jane", "Enter a valid email address", 2},
+		{"first-name", "Jane", "", 0},
+		{"last-name", "", "This field is required", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.field, func(t *testing.T) {
+			if got := form.Get(tt.field); got != tt.wantValue {
+				t.Errorf("value = %q, want %q", got, tt.wantValue)
+			}
+			if got := form.Errors.Get(tt.field); got != tt.wantError {
+				t.Errorf("first error = %q, want %q", got, tt.wantError)
+			}
+			if got := len(form.Errors[tt.field]); got != tt.wantCount {
+				t.Errorf("%d errors, want %d", got, tt.wantCount)
+			}
+		})
+	}
+}
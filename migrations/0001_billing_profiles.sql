@@ -0,0 +1,37 @@
+create table billing_profiles (
+    id            serial primary key,
+    user_id       integer      not null unique references users (id) on delete cascade,
+    company_name  varchar(255) not null default '',
+    tax_id        varchar(32)  not null default '',
+    address_line1 varchar(255) not null,
+    address_line2 varchar(255) not null default '',
+    city          varchar(255) not null,
+    state         varchar(255) not null default '',
+    postal_code   varchar(20)  not null,
+    country       char(2)      not null,
+    created_at    timestamp    not null default now(),
+    updated_at    timestamp    not null default now()
+);
+
+create table invoices (
+    id                    serial primary key,
+    user_id               integer      not null references users (id),
+    plan_id               integer      not null references plans (id),
+    plan_name             varchar(255) not null,
+    amount                integer      not null,
+    billing_name          varchar(255) not null,
+    billing_email         varchar(255) not null,
+    billing_company_name  varchar(255) not null default '',
+    billing_tax_id        varchar(32)  not null default '',
+    billing_address_line1 varchar(255) not null default '',
+    billing_address_line2 varchar(255) not null default '',
+    billing_city          varchar(255) not null default '',
+    billing_state         varchar(255) not null default '',
+    billing_postal_code   varchar(20)  not null default '',
+    billing_country       char(2)      not null default '',
+    issued_at             timestamp    not null,
+    created_at            timestamp    not null default now(),
+    updated_at            timestamp    not null default now()
+);
+
+create index invoices_user_id_idx on invoices (user_id);
@@ -0,0 +1,19 @@
+alter table invoices
+    add column amount_paid       integer      not null default 0,
+    add column amount_refunded   integer      not null default 0,
+    add column payment_reference varchar(255) not null default '',
+    add column paid_at           timestamp;
+
+create table credit_notes (
+    id               serial primary key,
+    invoice_id       integer      not null references invoices (id),
+    user_id          integer      not null references users (id),
+    amount           integer      not null check (amount > 0),
+    reason           text         not null default '',
+    refund_reference varchar(255) not null default '',
+    issued_at        timestamp    not null,
+    created_at       timestamp    not null default now(),
+    updated_at       timestamp    not null default now()
+);
+
+create index credit_notes_invoice_id_idx on credit_notes (invoice_id);
@@ -0,0 +1,16 @@
+alter table plans
+    add column dunning_schedule varchar(255) not null default '1,3,7,14';
+
+alter table user_plans
+    add column status             varchar(20) not null default 'active',
+    add column current_period_end timestamp,
+    add column past_due_since     timestamp,
+    add column dunning_step       integer     not null default 0,
+    add column last_invoice_id    integer references invoices (id);
+
+update user_plans set current_period_end = created_at + interval '1 month';
+
+alter table user_plans
+    alter column current_period_end set not null;
+
+create index user_plans_status_idx on user_plans (status, current_period_end);
@@ -0,0 +1,12 @@
+-- a feature without a limit_value is simply on; with one it is capped at that number
+create table plan_entitlements (
+    id          serial primary key,
+    plan_id     integer      not null references plans (id) on delete cascade,
+    feature     varchar(100) not null,
+    limit_value integer check (limit_value >= 0),
+    created_at  timestamp    not null default now(),
+    updated_at  timestamp    not null default now(),
+    unique (plan_id, feature)
+);
+
+create index plan_entitlements_feature_idx on plan_entitlements (feature);
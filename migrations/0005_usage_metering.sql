@@ -0,0 +1,35 @@
+create table usage_records (
+    id              bigserial primary key,
+    user_id         integer      not null references users (id) on delete cascade,
+    metric          varchar(100) not null,
+    quantity        integer      not null check (quantity > 0),
+    idempotency_key varchar(255) unique,
+    recorded_at     timestamp    not null,
+    created_at      timestamp    not null default now()
+);
+
+create index usage_records_user_metric_idx on usage_records (user_id, recorded_at, metric);
+
+create table plan_metered_prices (
+    id            serial primary key,
+    plan_id       integer      not null references plans (id) on delete cascade,
+    metric        varchar(100) not null,
+    pricing_model varchar(20)  not null check (pricing_model in ('per_unit', 'tiered')),
+    unit_amount   integer      not null default 0,
+    tiers         jsonb        not null default '[]',
+    created_at    timestamp    not null default now(),
+    updated_at    timestamp    not null default now(),
+    unique (plan_id, metric)
+);
+
+create table invoice_line_items (
+    id          serial primary key,
+    invoice_id  integer      not null references invoices (id) on delete cascade,
+    description varchar(255) not null,
+    quantity    integer      not null,
+    unit_amount integer      not null,
+    amount      integer      not null,
+    created_at  timestamp    not null default now()
+);
+
+create index invoice_line_items_invoice_id_idx on invoice_line_items (invoice_id);
@@ -0,0 +1,13 @@
+create table api_tokens (
+    id           serial primary key,
+    user_id      integer      not null references users (id) on delete cascade,
+    name         varchar(100) not null,
+    token_hash   bytea        not null unique,
+    scopes       varchar(255) not null default '',
+    last_used_at timestamp,
+    revoked_at   timestamp,
+    created_at   timestamp    not null default now(),
+    updated_at   timestamp    not null default now()
+);
+
+create index api_tokens_user_id_idx on api_tokens (user_id);
@@ -0,0 +1,30 @@
+create table webhook_endpoints (
+    id         serial primary key,
+    url        varchar(2048) not null,
+    secret     varchar(255)  not null,
+    events     varchar(1024) not null default '',
+    active     boolean       not null default true,
+    created_at timestamp     not null default now(),
+    updated_at timestamp     not null default now()
+);
+
+create table webhook_deliveries (
+    id              bigserial primary key,
+    endpoint_id     integer      not null references webhook_endpoints (id) on delete cascade,
+    event_id        varchar(64)  not null,
+    event_type      varchar(100) not null,
+    payload         jsonb        not null,
+    status          varchar(20)  not null default 'pending'
+        check (status in ('pending', 'succeeded', 'failed')),
+    attempts        integer      not null default 0,
+    next_attempt_at timestamp,
+    response_status integer,
+    last_error      text         not null default '',
+    delivered_at    timestamp,
+    created_at      timestamp    not null default now(),
+    updated_at      timestamp    not null default now(),
+    unique (endpoint_id, event_id)
+);
+
+create index webhook_deliveries_due_idx on webhook_deliveries (status, next_attempt_at);
+create index webhook_deliveries_endpoint_idx on webhook_deliveries (endpoint_id, created_at);
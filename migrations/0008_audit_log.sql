@@ -0,0 +1,28 @@
+-- actor_id deliberately has no foreign key: entries must outlive the users they name
+create table audit_log (
+    id          bigserial primary key,
+    actor_id    integer,
+    actor_email varchar(255) not null default '',
+    action      varchar(100) not null,
+    target_type varchar(50)  not null default '',
+    target_id   varchar(100) not null default '',
+    ip          varchar(45)  not null default '',
+    user_agent  varchar(512) not null default '',
+    metadata    jsonb        not null default '{}',
+    created_at  timestamp    not null default now()
+);
+
+create index audit_log_created_at_idx on audit_log (created_at);
+create index audit_log_action_idx on audit_log (action, created_at);
+create index audit_log_actor_idx on audit_log (actor_id, created_at);
+
+create function audit_log_append_only() returns trigger as
+$$
+begin
+    raise exception 'audit_log is append-only';
+end;
+$$ language plpgsql;
+
+create trigger audit_log_append_only
+    before update or delete on audit_log
+    for each row execute function audit_log_append_only();
@@ -0,0 +1,26 @@
+-- a row exists only while the user has two-factor authentication turned on
+create table user_two_factor (
+    user_id    integer     primary key references users (id) on delete cascade,
+    secret     varchar(64) not null,
+    enabled_at timestamp   not null default now(),
+    created_at timestamp   not null default now(),
+    updated_at timestamp   not null default now()
+);
+
+create table recovery_codes (
+    id         serial primary key,
+    user_id    integer   not null references users (id) on delete cascade,
+    code_hash  bytea     not null,
+    used_at    timestamp,
+    created_at timestamp not null default now()
+);
+
+create index recovery_codes_user_id_idx on recovery_codes (user_id);
+
+create table settings (
+    name       varchar(100) primary key,
+    value      text         not null default '',
+    updated_at timestamp    not null default now()
+);
+
+insert into settings (name, value) values ('require_admin_2fa', 'false');
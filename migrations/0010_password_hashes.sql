@@ -0,0 +1,2 @@
+-- argon2id hashes in the PHC string format are longer than bcrypt's 60 characters
+alter table users alter column password type varchar(255);
@@ -0,0 +1,8 @@
+-- users without a row get every email, as before preferences existed
+create table email_preferences (
+    user_id      integer   primary key references users (id) on delete cascade,
+    invoices     boolean   not null default true,
+    manuals      boolean   not null default true,
+    login_alerts boolean   not null default true,
+    updated_at   timestamp not null default now()
+);
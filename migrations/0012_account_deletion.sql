@@ -0,0 +1,16 @@
+-- deleted accounts keep their row, with the personal data wiped, so invoices and
+-- credit notes issued to them stay intact
+alter table users
+    add column deleted_at timestamp;
+
+-- every email handed to the mailer; user_id is null when the recipient has no account
+create table email_log (
+    id         bigserial    primary key,
+    user_id    integer      references users (id) on delete cascade,
+    recipient  varchar(255) not null,
+    subject    varchar(255) not null default '',
+    template   varchar(100) not null default '',
+    created_at timestamp    not null default now()
+);
+
+create index email_log_user_idx on email_log (user_id, created_at);
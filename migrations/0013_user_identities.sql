@@ -0,0 +1,14 @@
+-- accounts at OpenID Connect identity providers which users sign in with; a
+-- provider is identified by its issuer URL, and an account by its subject
+create table user_identities (
+    id            serial       primary key,
+    user_id       integer      not null references users (id) on delete cascade,
+    issuer        varchar(255) not null,
+    subject       varchar(255) not null,
+    email         varchar(255) not null default '',
+    created_at    timestamp    not null default now(),
+    last_login_at timestamp    not null default now(),
+    unique (issuer, subject)
+);
+
+create index user_identities_user_idx on user_identities (user_id);
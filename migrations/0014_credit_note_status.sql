@@ -0,0 +1,4 @@
+-- a credit note is pending from when its amount is reserved on the invoice until
+-- the payment provider has made the refund; earlier notes were all refunded
+alter table credit_notes
+    add column status varchar(20) not null default 'issued';
@@ -0,0 +1,7 @@
+-- a renewal invoice records the start of the billing period it pays for; there
+-- is only ever one per subscription and period, so a renewal which is run again
+-- finds the invoice it issued before instead of charging a second one
+alter table invoices
+    add column period_start timestamp;
+
+create unique index invoices_renewal_idx on invoices (user_id, period_start) where period_start is not null;
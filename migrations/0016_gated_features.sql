@@ -0,0 +1,10 @@
+-- the API and metered usage are now gated by entitlements; plans keep what they
+-- could do before: every plan gets the API, and plans with metered prices get
+-- metered usage
+insert into plan_entitlements (plan_id, feature)
+select id, 'api' from plans
+on conflict (plan_id, feature) do nothing;
+
+insert into plan_entitlements (plan_id, feature)
+select distinct plan_id, 'metered_usage' from plan_metered_prices
+on conflict (plan_id, feature) do nothing;
@@ -0,0 +1,5 @@
+-- email addresses are looked up without regard to case, so no two accounts may
+-- differ only in the case of theirs. Creating the index fails if some already do;
+-- merge or rename those accounts first. They are listed by
+--   select lower(email), array_agg(id order by id) from users group by 1 having count(*) > 1;
+create unique index users_email_lower_idx on users (lower(email));
@@ -0,0 +1,27 @@
+-- the audit log stays append-only, with one exception: when an account is deleted,
+-- the personal data in its entries is redacted, in the same transaction. That
+-- transaction sets app.redacting_audit_log, and may then only blank the actor's
+-- email, IP address and user agent, and drop keys from the metadata; what
+-- happened, to what and when stays as it was. Deleting entries is never allowed.
+create or replace function audit_log_append_only() returns trigger as
+$$
+begin
+    if tg_op = 'UPDATE'
+        and current_setting('app.redacting_audit_log', true) = 'on'
+        and new.id = old.id
+        and new.actor_id is not distinct from old.actor_id
+        and new.action = old.action
+        and new.target_type = old.target_type
+        and new.target_id = old.target_id
+        and new.created_at = old.created_at
+        and new.actor_email in ('', old.actor_email)
+        and new.ip in ('', old.ip)
+        and new.user_agent in ('', old.user_agent)
+        and old.metadata @> new.metadata
+    then
+        return new;
+    end if;
+
+    raise exception 'audit_log is append-only';
+end;
+$$ language plpgsql;
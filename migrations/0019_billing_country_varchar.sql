@@ -0,0 +1,7 @@
+-- char(2) pads an invoice's blank billing_country to two spaces, which then come
+-- back on the invoice and in account exports; varchar(2) keeps what was saved
+alter table invoices
+    alter column billing_country type varchar(2) using trim(billing_country);
+
+alter table billing_profiles
+    alter column country type varchar(2) using trim(country);
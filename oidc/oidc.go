@@ -0,0 +1,226 @@
+// Package oidc signs users in with an OpenID Connect identity provider. It finds
+// the provider's endpoints by discovery, sends the user through the authorization
+// code flow with PKCE, and validates the ID token which comes back.
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInvalidToken is returned for an ID token which fails validation
+var ErrInvalidToken = errors.New("oidc: invalid ID token")
+
+// Config is how the application is registered with a provider
+type Config struct {
+	// Issuer is the URL the provider identifies itself by, which its discovery
+	// document is found under
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is where the provider sends the user back to with a code
+	RedirectURL string
+	// Scopes are asked for besides openid
+	Scopes []string
+	// HTTPClient makes the requests to the provider; http.DefaultClient if nil
+	HTTPClient *http.Client
+}
+
+// Metadata is the part of a provider's discovery document we use
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider is an identity provider found by Discover
+type Provider struct {
+	config   Config
+	metadata Metadata
+	client   *http.Client
+
+	// now returns the current time, when checking the age of tokens
+	now func() time.Time
+
+	mu        sync.Mutex
+	keys      map[string]any
+	keysFetch time.Time
+}
+
+// Discover fetches the discovery document of the issuer in config. The document
+// has to name the same issuer, or tokens from it could not be trusted.
+func Discover(ctx context.Context, config Config) (*Provider, error) {
+	client := config.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	wellKnown := strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+
+	var metadata Metadata
+	err := getJSON(ctx, client, wellKnown, &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: discovery: %w", err)
+	}
+
+	if metadata.Issuer != config.Issuer {
+		return nil, fmt.Errorf("oidc: discovery: issuer %q does not match %q", metadata.Issuer, config.Issuer)
+	}
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery: document is missing endpoints")
+	}
+
+	return &Provider{
+		config:   config,
+		metadata: metadata,
+		client:   client,
+		now:      time.Now,
+	}, nil
+}
+
+// Issuer returns the URL the provider identifies itself by
+func (p *Provider) Issuer() string {
+	return p.metadata.Issuer
+}
+
+// AuthRequest holds the random values of one sign in, which have to be kept, in
+// the session, until the user comes back from the provider
+type AuthRequest struct {
+	// State ties the callback to the browser which started the sign in
+	State string
+	// Nonce ties the ID token to the sign in
+	Nonce string
+	// CodeVerifier is the PKCE secret, which only its hash is sent out with
+	CodeVerifier string
+}
+
+// NewAuthRequest returns fresh random values for a sign in
+func NewAuthRequest() (*AuthRequest, error) {
+	var values [3]string
+	for i := range values {
+		randomBytes := make([]byte, 32)
+
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		values[i] = base64.RawURLEncoding.EncodeToString(randomBytes)
+	}
+
+	return &AuthRequest{
+		State:        values[0],
+		Nonce:        values[1],
+		CodeVerifier: values[2],
+	}, nil
+}
+
+// AuthCodeURL returns the URL to send the user to, to sign in with the provider
+func (p *Provider) AuthCodeURL(req *AuthRequest) string {
+	challenge := sha256.Sum256([]byte(req.CodeVerifier))
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", p.config.ClientID)
+	query.Set("redirect_uri", p.config.RedirectURL)
+	query.Set("scope", strings.Join(append([]string{"openid"}, p.config.Scopes...), " "))
+	query.Set("state", req.State)
+	query.Set("nonce", req.Nonce)
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(p.metadata.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return p.metadata.AuthorizationEndpoint + separator + query.Encode()
+}
+
+// Tokens is the response of the token endpoint
+type Tokens struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	IDToken     string `json:"id_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+// Exchange trades the code the user came back with for tokens
+func (p *Provider) Exchange(ctx context.Context, code, codeVerifier string) (*Tokens, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", codeVerifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: token exchange: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("oidc: token exchange: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var oauthErr struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		_ = json.Unmarshal(body, &oauthErr)
+		return nil, fmt.Errorf("oidc: token exchange: %s %s %s", resp.Status, oauthErr.Error, oauthErr.Description)
+	}
+
+	var tokens Tokens
+	err = json.Unmarshal(body, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: token exchange: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("oidc: token exchange: no ID token in response")
+	}
+
+	return &tokens, nil
+}
+
+func getJSON(ctx context.Context, client *http.Client, url string, dst any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(dst)
+}
@@ -0,0 +1,385 @@
+package oidc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"subscription-service/oidc/oidctest"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID     = "subscription-service"
+	testClientSecret = "s3cret"
+	testRedirectURL  = "http://localhost:8080/login/oidc/callback"
+)
+
+func testProvider(t *testing.T) (*oidctest.Server, *Provider) {
+	t.Helper()
+
+	server := oidctest.NewServer(testClientID, testClientSecret)
+	t.Cleanup(server.Close)
+
+	provider, err := Discover(context.Background(), Config{
+		Issuer:       server.URL,
+		ClientID:     testClientID,
+		ClientSecret: testClientSecret,
+		RedirectURL:  testRedirectURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server, provider
+}
+
+// authorize sends a sign in to the provider, and returns the query it sends the
+// user back with
+func authorize(t *testing.T, provider *Provider, req *AuthRequest) url.Values {
+	t.Helper()
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(provider.AuthCodeURL(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	back, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: %s, Location %q", resp.Status, resp.Header.Get("Location"))
+	}
+	if !strings.HasPrefix(back.String(), testRedirectURL+"?") {
+		t.Fatalf("sent back to %s, want %s", back, testRedirectURL)
+	}
+
+	return back.Query()
+}
+
+func TestDiscover(t *testing.T) {
+	server := oidctest.NewServer(testClientID, testClientSecret)
+	defer server.Close()
+
+	incomplete := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(Metadata{
+			Issuer:                "http://" + r.Host,
+			AuthorizationEndpoint: "http://" + r.Host + "/authorize",
+		})
+	}))
+	defer incomplete.Close()
+
+	tests := []struct {
+		name    string
+		issuer  string
+		wantErr string
+	}{
+		{"provider", server.URL, ""},
+		{"issuer with a trailing slash", server.URL + "/", "does not match"},
+		{"no discovery document", server.URL + "/tenant", "404"},
+		{"missing endpoints", incomplete.URL, "missing endpoints"},
+		{"no provider", "http://127.0.0.1:1", "discovery"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider, err := Discover(context.Background(), Config{Issuer: tt.issuer, ClientID: testClientID})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Discover(%s) error = %v, want one mentioning %q", tt.issuer, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if provider.Issuer() != server.URL || provider.metadata.TokenEndpoint != server.URL+"/token" ||
+				provider.metadata.JWKSURI != server.URL+"/jwks" {
+				t.Errorf("metadata = %+v", provider.metadata)
+			}
+		})
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	_, provider := testProvider(t)
+	req := &AuthRequest{State: "state", Nonce: "nonce", CodeVerifier: "verifier"}
+
+	u, err := url.Parse(provider.AuthCodeURL(req))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	challenge := sha256.Sum256([]byte("verifier"))
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"redirect_uri":          testRedirectURL,
+		"scope":                 "openid",
+		"state":                 "state",
+		"nonce":                 "nonce",
+		"code_challenge":        base64.RawURLEncoding.EncodeToString(challenge[:]),
+		"code_challenge_method": "S256",
+	}
+	for name, value := range want {
+		if got := u.Query().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+	if u.Query().Has("code_verifier") || strings.Contains(u.RawQuery, "=verifier") {
+		t.Error("the code verifier is sent out with the authorization request")
+	}
+}
+
+// TestSignIn runs the whole authorization code flow against the mock provider
+func TestSignIn(t *testing.T) {
+	tests := []struct {
+		name      string
+		exchange  func(code string, req *AuthRequest) (string, string)
+		secret    string
+		wantErr   bool
+		nonce     func(req *AuthRequest) string
+		wantValid bool
+	}{
+		{
+			name:      "signed in",
+			exchange:  func(code string, req *AuthRequest) (string, string) { return code, req.CodeVerifier },
+			wantValid: true,
+		},
+		{
+			name:     "PKCE verifier of another sign in",
+			exchange: func(code string, req *AuthRequest) (string, string) { return code, req.CodeVerifier + "x" },
+			wantErr:  true,
+		},
+		{
+			name:     "no PKCE verifier",
+			exchange: func(code string, req *AuthRequest) (string, string) { return code, "" },
+			wantErr:  true,
+		},
+		{
+			name:     "unknown code",
+			exchange: func(code string, req *AuthRequest) (string, string) { return code + "x", req.CodeVerifier },
+			wantErr:  true,
+		},
+		{
+			name:     "wrong client secret",
+			exchange: func(code string, req *AuthRequest) (string, string) { return code, req.CodeVerifier },
+			secret:   "guess",
+			wantErr:  true,
+		},
+		{
+			name:     "nonce of another sign in",
+			exchange: func(code string, req *AuthRequest) (string, string) { return code, req.CodeVerifier },
+			nonce:    func(req *AuthRequest) string { return req.Nonce + "x" },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, provider := testProvider(t)
+			if tt.secret != "" {
+				provider.config.ClientSecret = tt.secret
+			}
+
+			req, err := NewAuthRequest()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			back := authorize(t, provider, req)
+			if back.Get("state") != req.State || back.Get("code") == "" {
+				t.Fatalf("sent back with %v", back)
+			}
+
+			code, verifier := tt.exchange(back.Get("code"), req)
+			tokens, err := provider.Exchange(context.Background(), code, verifier)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Exchange succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			nonce := req.Nonce
+			if tt.nonce != nil {
+				nonce = tt.nonce(req)
+			}
+
+			claims, err := provider.VerifyIDToken(context.Background(), tokens.IDToken, nonce)
+			if !tt.wantValid {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Fatalf("VerifyIDToken error = %v, want ErrInvalidToken", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if claims.Subject != "1234567890" || claims.Email != "jane@example.com" || !bool(claims.EmailVerified) ||
+				claims.GivenName != "Jane" || claims.FamilyName != "Doe" {
+				t.Errorf("claims = %+v", claims)
+			}
+
+			// a code can only be used once
+			_, err = provider.Exchange(context.Background(), code, verifier)
+			if err == nil {
+				t.Error("code exchanged a second time")
+			}
+		})
+	}
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	server, provider := testProvider(t)
+	const nonce = "the-nonce"
+	now := time.Now()
+
+	valid, err := server.IDToken(nonce, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(valid, ".")
+
+	tests := []struct {
+		name      string
+		overrides map[string]any
+		token     func() string
+		wantErr   string
+	}{
+		{name: "valid"},
+		{name: "audience list with us as authorized party", overrides: map[string]any{"aud": []string{testClientID, "other"}, "azp": testClientID}},
+		{name: "expired within the clock skew", overrides: map[string]any{"exp": now.Add(-time.Minute).Unix()}},
+		{name: "email verified as a string", overrides: map[string]any{"email_verified": "true"}},
+		{name: "wrong nonce", overrides: map[string]any{"nonce": "another-nonce"}, wantErr: "nonce"},
+		{name: "no nonce", overrides: map[string]any{"nonce": nil}, wantErr: "nonce"},
+		{name: "other audience", overrides: map[string]any{"aud": "another-client"}, wantErr: "not issued to this client"},
+		{name: "audience list without us", overrides: map[string]any{"aud": []string{"another-client"}}, wantErr: "not issued to this client"},
+		{name: "audience list, other authorized party", overrides: map[string]any{"aud": []string{testClientID, "other"}, "azp": "other"}, wantErr: "authorized party"},
+		{name: "no audience", overrides: map[string]any{"aud": nil}, wantErr: "not issued to this client"},
+		{name: "other issuer", overrides: map[string]any{"iss": "https://evil.example.com"}, wantErr: "issued by"},
+		{name: "no subject", overrides: map[string]any{"sub": ""}, wantErr: "no subject"},
+		{name: "expired", overrides: map[string]any{"exp": now.Add(-time.Hour).Unix()}, wantErr: "expired"},
+		{name: "no expiry", overrides: map[string]any{"exp": nil}, wantErr: "expired"},
+		{name: "issued in the future", overrides: map[string]any{"iat": now.Add(time.Hour).Unix()}, wantErr: "future"},
+		{
+			name: "alg none",
+			token: func() string {
+				return segment(t, map[string]string{"alg": "none", "typ": "JWT"}) + "." + parts[1] + "."
+			},
+			wantErr: `"none" not allowed`,
+		},
+		{
+			// the classic confusion: an HMAC keyed with the provider's public key,
+			// which anyone can fetch
+			name: "alg HS256",
+			token: func() string {
+				signed := segment(t, map[string]string{"alg": "HS256", "typ": "JWT", "kid": "test-key"}) + "." + parts[1]
+				mac := hmac.New(sha256.New, []byte(publicKeyOf(t, server)))
+				mac.Write([]byte(signed))
+				return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+			},
+			wantErr: `"HS256" not allowed`,
+		},
+		{
+			name: "claims changed after signing",
+			token: func() string {
+				var claims map[string]any
+				_ = decodeSegment(parts[1], &claims)
+				claims["sub"] = "someone-else"
+				return parts[0] + "." + segment(t, claims) + "." + parts[2]
+			},
+			wantErr: "verification error",
+		},
+		{
+			name: "unknown key",
+			token: func() string {
+				return segment(t, map[string]string{"alg": "RS256", "kid": "other-key"}) + "." + parts[1] + "." + parts[2]
+			},
+			wantErr: "unknown key",
+		},
+		{name: "malformed", token: func() string { return parts[0] + "." + parts[1] }, wantErr: "malformed"},
+		{name: "signature not base64", token: func() string { return parts[0] + "." + parts[1] + ".!!" }, wantErr: "signature"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := valid
+			switch {
+			case tt.token != nil:
+				token = tt.token()
+			case tt.overrides != nil:
+				token, err = server.IDToken(nonce, tt.overrides)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			claims, err := provider.VerifyIDToken(context.Background(), token, nonce)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("VerifyIDToken: %v", err)
+				}
+				if claims.Subject != "1234567890" || !bool(claims.EmailVerified) {
+					t.Errorf("claims = %+v", claims)
+				}
+				return
+			}
+
+			if !errors.Is(err, ErrInvalidToken) || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("VerifyIDToken error = %v, want ErrInvalidToken for %q", err, tt.wantErr)
+			}
+			if claims != nil {
+				t.Errorf("claims returned for an invalid token: %+v", claims)
+			}
+		})
+	}
+}
+
+func segment(t *testing.T, v any) string {
+	t.Helper()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// publicKeyOf returns the provider's published key set, as an attacker would get it
+func publicKeyOf(t *testing.T, server *oidctest.Server) string {
+	t.Helper()
+
+	resp, err := http.Get(server.URL + "/jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&set)
+	if err != nil || len(set.Keys) == 0 {
+		t.Fatalf("fetching keys: %v", err)
+	}
+
+	return set.Keys[0].N
+}
@@ -0,0 +1,358 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	// clockSkew is how far the provider's clock may be off from ours
+	clockSkew = 2 * time.Minute
+	// keysRefetchAfter stops a token with an unknown key ID from making us fetch
+	// the provider's keys on every request
+	keysRefetchAfter = time.Minute
+)
+
+// Claims are the claims of an ID token we use
+type Claims struct {
+	Issuer        string    `json:"iss"`
+	Subject       string    `json:"sub"`
+	Audience      audience  `json:"aud"`
+	AuthorizedBy  string    `json:"azp"`
+	Expiry        timestamp `json:"exp"`
+	IssuedAt      timestamp `json:"iat"`
+	Nonce         string    `json:"nonce"`
+	Email         string    `json:"email"`
+	EmailVerified boolish   `json:"email_verified"`
+	Name          string    `json:"name"`
+	GivenName     string    `json:"given_name"`
+	FamilyName    string    `json:"family_name"`
+}
+
+// audience is a JSON string or array of strings
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var one string
+	if json.Unmarshal(b, &one) == nil {
+		*a = audience{one}
+		return nil
+	}
+
+	var many []string
+	err := json.Unmarshal(b, &many)
+	if err != nil {
+		return err
+	}
+	*a = many
+
+	return nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// timestamp is a JSON number of seconds since the epoch
+type timestamp struct {
+	time.Time
+}
+
+func (t *timestamp) UnmarshalJSON(b []byte) error {
+	var seconds json.Number
+	err := json.Unmarshal(b, &seconds)
+	if err != nil {
+		return err
+	}
+
+	f, err := seconds.Float64()
+	if err != nil {
+		return err
+	}
+	t.Time = time.Unix(int64(f), 0)
+
+	return nil
+}
+
+// boolish is a JSON bool which some providers send as a string
+type boolish bool
+
+func (b *boolish) UnmarshalJSON(data []byte) error {
+	switch strings.Trim(string(data), `"`) {
+	case "true":
+		*b = true
+	case "false", "null":
+		*b = false
+	default:
+		return fmt.Errorf("oidc: %s is not a boolean", data)
+	}
+
+	return nil
+}
+
+// VerifyIDToken checks the signature of an ID token against the provider's keys,
+// and that it was issued by the provider, to us, for the sign in with nonce, and
+// hasn't expired. It returns the claims of a valid token, or an error wrapping
+// ErrInvalidToken.
+func (p *Provider) VerifyIDToken(ctx context.Context, raw, nonce string) (*Claims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidToken, err)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrInvalidToken, err)
+	}
+
+	key, err := p.key(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifySignature(header.Algorithm, key, parts[0]+"."+parts[1], signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	var claims Claims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrInvalidToken, err)
+	}
+
+	now := p.now()
+	switch {
+	case claims.Issuer != p.metadata.Issuer:
+		return nil, fmt.Errorf("%w: issued by %q", ErrInvalidToken, claims.Issuer)
+	case !claims.Audience.contains(p.config.ClientID):
+		return nil, fmt.Errorf("%w: not issued to this client", ErrInvalidToken)
+	case len(claims.Audience) > 1 && claims.AuthorizedBy != p.config.ClientID:
+		return nil, fmt.Errorf("%w: authorized party is %q", ErrInvalidToken, claims.AuthorizedBy)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	case claims.Expiry.IsZero() || now.After(claims.Expiry.Add(clockSkew)):
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	case claims.IssuedAt.After(now.Add(clockSkew)):
+		return nil, fmt.Errorf("%w: issued in the future", ErrInvalidToken)
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(nonce)) != 1:
+		return nil, fmt.Errorf("%w: nonce does not match", ErrInvalidToken)
+	}
+
+	return &claims, nil
+}
+
+func decodeSegment(segment string, dst any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, dst)
+}
+
+// verifySignature checks the signature of a token with one of the asymmetric
+// algorithms. "none" and the HMAC algorithms are never accepted.
+func verifySignature(algorithm string, key any, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch algorithm {
+	case "RS256", "ES256", "PS256":
+		hash = crypto.SHA256
+	case "RS384", "ES384", "PS384":
+		hash = crypto.SHA384
+	case "RS512", "ES512", "PS512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("algorithm %q not allowed", algorithm)
+	}
+
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch algorithm[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(key, hash, digest, signature)
+		case "PS":
+			return rsa.VerifyPSS(key, hash, digest, signature, nil)
+		}
+	case *ecdsa.PublicKey:
+		if algorithm[:2] != "ES" {
+			break
+		}
+
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return fmt.Errorf("signature has the wrong length")
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return fmt.Errorf("signature does not match")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("algorithm %q does not match the key", algorithm)
+}
+
+// key returns the provider's public key with the key ID. The keys are fetched
+// again when the ID is unknown, as providers rotate their keys.
+func (p *Provider) key(ctx context.Context, keyID string) (any, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.lookupKey(keyID); ok {
+		return key, nil
+	}
+
+	if p.now().Sub(p.keysFetch) < keysRefetchAfter {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, keyID)
+	}
+
+	keys, err := p.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	p.keys = keys
+	p.keysFetch = p.now()
+
+	if key, ok := p.lookupKey(keyID); ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, keyID)
+}
+
+// lookupKey finds a key by ID. A token without a key ID can only be checked when
+// the provider has just the one key.
+func (p *Provider) lookupKey(keyID string) (any, bool) {
+	if keyID == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+
+	key, ok := p.keys[keyID]
+	return key, ok
+}
+
+// jsonWebKey is one key of a JSON Web Key Set, as published at jwks_uri
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+// fetchKeys fetches the provider's signing keys. Keys of other types, or meant for
+// encryption, are skipped.
+func (p *Provider) fetchKeys(ctx context.Context) (map[string]any, error) {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	err := getJSON(ctx, p.client, p.metadata.JWKSURI, &set)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: fetching keys: %w", err)
+	}
+
+	keys := make(map[string]any)
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+
+		keys[jwk.KeyID] = key
+	}
+
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (any, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("RSA exponent too large")
+		}
+
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Curve)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("point is not on the curve")
+		}
+
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.KeyType)
+}
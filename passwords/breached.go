@@ -0,0 +1,58 @@
+package passwords
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+// breachedList holds the SHA-1 hashes of passwords known from data breaches, in
+// the form of the Have I Been Pwned range API: one line per hash, with the first
+// five hex digits of the hash, a colon, and the remaining 35. Only hashes are
+// shipped, never the passwords themselves. Lines starting with # are comments.
+//
+//go:embed breached.txt
+var breachedList []byte
+
+var (
+	breachedOnce     sync.Once
+	breachedSuffixes map[string]map[string]bool
+)
+
+// Breached reports whether password is on the breached list. As with the range
+// API, the hash is looked up by its five digit prefix, so a copy of the list on a
+// remote service could be queried without giving away the password.
+func Breached(password string) bool {
+	breachedOnce.Do(loadBreached)
+
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+
+	return breachedSuffixes[hash[:5]][hash[5:]]
+}
+
+func loadBreached() {
+	breachedSuffixes = make(map[string]map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(breachedList))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		prefix, suffix, ok := strings.Cut(strings.ToUpper(line), ":")
+		if !ok || len(prefix) != 5 || len(suffix) != 35 {
+			continue
+		}
+
+		if breachedSuffixes[prefix] == nil {
+			breachedSuffixes[prefix] = make(map[string]bool)
+		}
+		breachedSuffixes[prefix][suffix] = true
+	}
+}
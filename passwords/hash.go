@@ -0,0 +1,233 @@
+package passwords
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrUnknownHash is returned for a stored hash which no hasher recognises
+var ErrUnknownHash = errors.New("passwords: unknown hash format")
+
+// Hasher hashes passwords with one algorithm. Hashes are self-describing strings
+// which start with an identifier of the algorithm, and hold its parameters, so a
+// hash can be verified after the parameters have moved on.
+type Hasher interface {
+	// Hash returns the hash of password
+	Hash(password string) (string, error)
+	// Recognises reports whether encoded is a hash of this algorithm
+	Recognises(encoded string) bool
+	// Verify reports whether password matches encoded, a hash of this algorithm
+	Verify(password, encoded string) (bool, error)
+	// Outdated reports whether encoded, a hash of this algorithm, was made with
+	// weaker parameters than the hasher's
+	Outdated(encoded string) bool
+}
+
+// Hashing hashes new passwords with Preferred, and verifies passwords hashed with
+// it or any of Legacy. Hashes which aren't what Preferred would make now are
+// outdated, and should be replaced the next time the password is at hand.
+type Hashing struct {
+	Preferred Hasher
+	Legacy    []Hasher
+}
+
+// DefaultHashing hashes with argon2id, and still verifies bcrypt hashes
+func DefaultHashing() Hashing {
+	return Hashing{
+		Preferred: DefaultArgon2id(),
+		Legacy:    []Hasher{Bcrypt{Cost: 12}},
+	}
+}
+
+// Hash returns the hash of password, made with the preferred hasher
+func (h Hashing) Hash(password string) (string, error) {
+	return h.Preferred.Hash(password)
+}
+
+// Verify reports whether password matches encoded, whichever hasher made it
+func (h Hashing) Verify(password, encoded string) (bool, error) {
+	hasher := h.hasherFor(encoded)
+	if hasher == nil {
+		return false, ErrUnknownHash
+	}
+
+	return hasher.Verify(password, encoded)
+}
+
+// Outdated reports whether encoded should be replaced by a hash from the preferred
+// hasher, because it was made by another one or with weaker parameters
+func (h Hashing) Outdated(encoded string) bool {
+	if !h.Preferred.Recognises(encoded) {
+		return true
+	}
+
+	return h.Preferred.Outdated(encoded)
+}
+
+func (h Hashing) hasherFor(encoded string) Hasher {
+	for _, hasher := range append([]Hasher{h.Preferred}, h.Legacy...) {
+		if hasher.Recognises(encoded) {
+			return hasher
+		}
+	}
+
+	return nil
+}
+
+// Bcrypt hashes passwords with bcrypt, as $2a$<cost>$...
+type Bcrypt struct {
+	Cost int
+}
+
+func (b Bcrypt) Hash(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.Cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+func (b Bcrypt) Recognises(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+func (b Bcrypt) Verify(password, encoded string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (b Bcrypt) Outdated(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil {
+		return true
+	}
+
+	return cost < b.Cost
+}
+
+// Argon2id hashes passwords with argon2id, in the PHC string format:
+// $argon2id$v=19$m=<memory KiB>,t=<iterations>,p=<parallelism>$<salt>$<hash>
+type Argon2id struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  int
+	KeyLength   uint32
+}
+
+// DefaultArgon2id returns the parameters recommended by RFC 9106 for systems short
+// of memory
+func DefaultArgon2id() Argon2id {
+	return Argon2id{
+		Memory:      64 * 1024,
+		Iterations:  3,
+		Parallelism: 4,
+		SaltLength:  16,
+		KeyLength:   32,
+	}
+}
+
+func (a Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, a.SaltLength)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, a.Iterations, a.Memory, a.Parallelism, a.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, a.Memory, a.Iterations, a.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (a Argon2id) Recognises(encoded string) bool {
+	return strings.HasPrefix(encoded, "$argon2id$")
+}
+
+func (a Argon2id) Verify(password, encoded string) (bool, error) {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+
+	other := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, uint32(len(key)))
+
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (a Argon2id) Outdated(encoded string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+
+	return params.Memory < a.Memory ||
+		params.Iterations < a.Iterations ||
+		params.Parallelism < a.Parallelism ||
+		len(salt) < a.SaltLength ||
+		uint32(len(key)) < a.KeyLength
+}
+
+func decodeArgon2id(encoded string) (Argon2id, []byte, []byte, error) {
+	var params Argon2id
+
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return params, nil, nil, ErrUnknownHash
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return params, nil, nil, err
+	}
+	if version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("passwords: unsupported argon2 version %d", version)
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return params, nil, nil, err
+	}
+	// argon2 panics on parameters this low, rather than returning an error
+	if parts[3] != fmt.Sprintf("m=%d,t=%d,p=%d", params.Memory, params.Iterations, params.Parallelism) ||
+		params.Iterations < 1 || params.Parallelism < 1 || params.Memory < 8*uint32(params.Parallelism) {
+		return params, nil, nil, fmt.Errorf("passwords: invalid argon2id parameters %q", parts[3])
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+
+	// an empty key would match every password
+	if len(salt) == 0 || len(key) == 0 {
+		return params, nil, nil, errors.New("passwords: argon2id hash has no salt or key")
+	}
+
+	return params, salt, key, nil
+}
@@ -0,0 +1,174 @@
+package passwords
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testArgon2id and testBcrypt are as cheap as their algorithms allow, to keep the
+// tests fast; what is tested doesn't depend on the cost
+var (
+	testArgon2id = Argon2id{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+	testBcrypt   = Bcrypt{Cost: bcrypt.MinCost}
+)
+
+func testHash(t *testing.T, hasher Hasher, password string) string {
+	t.Helper()
+
+	encoded, err := hasher.Hash(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return encoded
+}
+
+func TestHashingVerify(t *testing.T) {
+	hashing := Hashing{Preferred: testArgon2id, Legacy: []Hasher{testBcrypt}}
+
+	const password = "correct horse battery staple"
+	argon2idHash := testHash(t, testArgon2id, password)
+	bcryptHash := testHash(t, testBcrypt, password)
+	salt, key, _ := strings.Cut(strings.TrimPrefix(argon2idHash, "$argon2id$v=19$m=64,t=1,p=1$"), "$")
+
+	tests := []struct {
+		name     string
+		password string
+		encoded  string
+		want     bool
+		wantErr  bool
+	}{
+		{"argon2id", password, argon2idHash, true, false},
+		{"argon2id, wrong password", "correct horse battery stapler", argon2idHash, false, false},
+		{"argon2id, empty password", "", argon2idHash, false, false},
+		{"bcrypt", password, bcryptHash, true, false},
+		{"bcrypt, wrong password", "Correct horse battery staple", bcryptHash, false, false},
+		{"bcrypt $2y$", password, "$2y$" + strings.TrimPrefix(bcryptHash, "$2a$"), true, false},
+		{"argon2id, other version", password, strings.Replace(argon2idHash, "v=19", "v=16", 1), false, true},
+		{"argon2id, missing part", password, "$argon2id$v=19$m=64,t=1,p=1$" + salt, false, true},
+		{"argon2id, salt not base64", password, "$argon2id$v=19$m=64,t=1,p=1$!!!$" + key, false, true},
+		{"argon2id, empty key", password, "$argon2id$v=19$m=64,t=1,p=1$" + salt + "$", false, true},
+		{"argon2id, empty salt", password, "$argon2id$v=19$m=64,t=1,p=1$$" + key, false, true},
+		{"argon2id, no iterations", password, "$argon2id$v=19$m=64,t=0,p=1$" + salt + "$" + key, false, true},
+		{"argon2id, no parallelism", password, "$argon2id$v=19$m=64,t=1,p=0$" + salt + "$" + key, false, true},
+		{"argon2id, too little memory", password, "$argon2id$v=19$m=7,t=1,p=1$" + salt + "$" + key, false, true},
+		{"argon2id, extra parameter", password, "$argon2id$v=19$m=64,t=1,p=1,x=2$" + salt + "$" + key, false, true},
+		{"bcrypt, truncated", password, bcryptHash[:20], false, true},
+		{"plain text", password, password, false, true},
+		{"empty", password, "", false, true},
+		{"other algorithm", password, "$scrypt$ln=15,r=8,p=1$c2FsdA$a2V5", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := hashing.Verify(tt.password, tt.encoded)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Verify(%q) error = %v, want an error: %v", tt.encoded, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Verify(%q) = %v, want %v", tt.encoded, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHashingVerifyUnknownHash(t *testing.T) {
+	hashing := Hashing{Preferred: testArgon2id, Legacy: []Hasher{testBcrypt}}
+
+	for _, encoded := range []string{"", "secret", "$1$salt$hash", "$argon2i$v=19$m=64,t=1,p=1$c2FsdA$a2V5"} {
+		_, err := hashing.Verify("secret", encoded)
+		if !errors.Is(err, ErrUnknownHash) {
+			t.Errorf("Verify(%q) error = %v, want ErrUnknownHash", encoded, err)
+		}
+	}
+
+	// without bcrypt among the hashers, its hashes aren't recognised either
+	bcryptHash := testHash(t, testBcrypt, "secret")
+	_, err := Hashing{Preferred: testArgon2id}.Verify("secret", bcryptHash)
+	if !errors.Is(err, ErrUnknownHash) {
+		t.Errorf("Verify(bcrypt) without a bcrypt hasher: error = %v, want ErrUnknownHash", err)
+	}
+}
+
+func TestHashingOutdated(t *testing.T) {
+	hashing := Hashing{Preferred: testArgon2id, Legacy: []Hasher{testBcrypt}}
+
+	weaker := testArgon2id
+	weaker.Iterations = 1
+	weaker.Memory = 32
+	stronger := testArgon2id
+	stronger.Iterations = 2
+	shortSalt := testArgon2id
+	shortSalt.SaltLength = 8
+	shortKey := testArgon2id
+	shortKey.KeyLength = 16
+
+	tests := []struct {
+		name    string
+		encoded string
+		want    bool
+	}{
+		{"preferred", testHash(t, testArgon2id, "secret"), false},
+		{"stronger", testHash(t, stronger, "secret"), false},
+		{"less memory", testHash(t, weaker, "secret"), true},
+		{"shorter salt", testHash(t, shortSalt, "secret"), true},
+		{"shorter key", testHash(t, shortKey, "secret"), true},
+		{"bcrypt", testHash(t, testBcrypt, "secret"), true},
+		{"malformed argon2id", "$argon2id$v=19$m=64,t=1,p=1$c2FsdA", true},
+		{"unknown", "secret", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hashing.Outdated(tt.encoded); got != tt.want {
+				t.Errorf("Outdated(%q) = %v, want %v", tt.encoded, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBcryptOutdated(t *testing.T) {
+	encoded := testHash(t, Bcrypt{Cost: bcrypt.MinCost + 1}, "secret")
+
+	tests := []struct {
+		name    string
+		cost    int
+		encoded string
+		want    bool
+	}{
+		{"lower cost wanted", bcrypt.MinCost, encoded, false},
+		{"same cost", bcrypt.MinCost + 1, encoded, false},
+		{"higher cost wanted", bcrypt.MinCost + 2, encoded, true},
+		{"malformed", bcrypt.MinCost, "$2a$xx", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (Bcrypt{Cost: tt.cost}).Outdated(tt.encoded); got != tt.want {
+				t.Errorf("Outdated with cost %d = %v, want %v", tt.cost, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArgon2idHash(t *testing.T) {
+	first := testHash(t, testArgon2id, "secret")
+	second := testHash(t, testArgon2id, "secret")
+
+	if first == second {
+		t.Error("two hashes of the same password are the same; the salt isn't random")
+	}
+	if !strings.HasPrefix(first, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("hash %q doesn't record its parameters", first)
+	}
+
+	// a hash made with other parameters is verified with its own
+	other := Argon2id{Memory: 128, Iterations: 2, Parallelism: 2, SaltLength: 8, KeyLength: 16}
+	ok, err := testArgon2id.Verify("secret", testHash(t, other, "secret"))
+	if err != nil || !ok {
+		t.Errorf("Verify of a hash with other parameters = %v, %v", ok, err)
+	}
+}
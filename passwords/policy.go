@@ -0,0 +1,104 @@
+// Package passwords decides whether a password is good enough to use. A Policy
+// checks its length and mix of characters, that it doesn't contain the user's own
+// details, and that it isn't on a list of passwords known from data breaches.
+package passwords
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Policy is a set of rules a password has to follow
+type Policy struct {
+	// MinLength is the fewest characters a password may have
+	MinLength int
+	// MaxLength is the most bytes a password may have. bcrypt ignores everything
+	// past 72 bytes, so a longer password would be weaker than it looks.
+	MaxLength int
+	// MinClasses is how many of lowercase letters, uppercase letters, digits and
+	// other characters a password has to contain
+	MinClasses int
+	// CheckBreached rejects passwords on the breached list
+	CheckBreached bool
+}
+
+// DefaultPolicy is the policy used unless it is configured otherwise
+func DefaultPolicy() Policy {
+	return Policy{
+		MinLength:     10,
+		MaxLength:     72,
+		MinClasses:    2,
+		CheckBreached: true,
+	}
+}
+
+// Check returns what is wrong with password under the policy, or nothing if it is
+// fine. personal holds the user's own details, such as their email address and
+// name, which the password mustn't contain.
+func (p Policy) Check(password string, personal ...string) []string {
+	var problems []string
+
+	if utf8.RuneCountInString(password) < p.MinLength {
+		problems = append(problems, fmt.Sprintf("Must be at least %d characters long", p.MinLength))
+	}
+
+	if p.MaxLength > 0 && len(password) > p.MaxLength {
+		problems = append(problems, fmt.Sprintf("Must be at most %d characters long", p.MaxLength))
+	}
+
+	if classes := characterClasses(password); classes < p.MinClasses {
+		problems = append(problems, fmt.Sprintf("Must mix at least %d of lowercase letters, uppercase letters, digits and symbols", p.MinClasses))
+	}
+
+	if containsPersonal(password, personal) {
+		problems = append(problems, "Must not contain your email address or name")
+	}
+
+	if p.CheckBreached && Breached(password) {
+		problems = append(problems, "This password has appeared in a data breach, so it is not safe to use. Please choose another.")
+	}
+
+	return problems
+}
+
+// characterClasses counts how many kinds of characters password contains
+func characterClasses(password string) int {
+	var lower, upper, digit, other int
+
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			other = 1
+		}
+	}
+
+	return lower + upper + digit + other
+}
+
+// containsPersonal reports whether password contains any of the personal details,
+// ignoring case. Of an email address, the part before the @ counts. Details too
+// short to be telling are ignored.
+func containsPersonal(password string, personal []string) bool {
+	password = strings.ToLower(password)
+
+	for _, detail := range personal {
+		detail = strings.ToLower(strings.TrimSpace(detail))
+		if local, _, ok := strings.Cut(detail, "@"); ok {
+			detail = local
+		}
+
+		if utf8.RuneCountInString(detail) >= 3 && strings.Contains(password, detail) {
+			return true
+		}
+	}
+
+	return false
+}
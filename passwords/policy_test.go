@@ -0,0 +1,128 @@
+package passwords
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPolicyCheck(t *testing.T) {
+	const (
+		tooShort   = "Must be at least 10 characters long"
+		tooLong    = "Must be at most 72 characters long"
+		tooSimple  = "Must mix at least 2 of lowercase letters, uppercase letters, digits and symbols"
+		personal   = "Must not contain your email address or name"
+		breached   = "This password has appeared in a data breach, so it is not safe to use. Please choose another."
+		seventyTwo = "abcdefghijklmnopqrstuvwxyz0123456789abcdefghijklmnopqrstuvwxyz0123456789"
+	)
+
+	details := []string{"jane.doe@example.com", "Jane", "Doe"}
+
+	tests := []struct {
+		name     string
+		policy   Policy
+		password string
+		want     []string
+	}{
+		{"good", DefaultPolicy(), "Tr0ub4dor&3x", nil},
+		{"long passphrase", DefaultPolicy(), "correct horse battery staple", nil},
+		{"too short", DefaultPolicy(), "Tr0ub4d&r", []string{tooShort}},
+		{"length counts characters", DefaultPolicy(), "ñññññññññ1", nil},
+		{"at the byte limit", DefaultPolicy(), seventyTwo, nil},
+		{"past the byte limit", DefaultPolicy(), seventyTwo + "a", []string{tooLong}},
+		{"byte limit counts bytes", DefaultPolicy(), "ñññññññññññññññññññññññññññññññññññññ1", []string{tooLong}},
+		{"one class", DefaultPolicy(), "abcdefghijkl", []string{tooSimple}},
+		{"digits only", DefaultPolicy(), "8642097531", []string{tooSimple}},
+		{"symbols count", DefaultPolicy(), "abcdefghij!", nil},
+		{"contains email name", DefaultPolicy(), "my jane.doe 2024", []string{personal}},
+		{"contains name, other case", DefaultPolicy(), "JANE-rules-99", []string{personal}},
+		{"contains surname", DefaultPolicy(), "xx-doe-xx-2024", []string{personal}},
+		{"breached", DefaultPolicy(), "Summer2024!", []string{breached}},
+		{"breached, not checked", Policy{MinLength: 10, MinClasses: 2}, "Summer2024!", nil},
+		{"everything wrong", DefaultPolicy(), "jane", []string{tooShort, tooSimple, personal}},
+		{"empty", DefaultPolicy(), "", []string{tooShort, tooSimple}},
+		{"no limits", Policy{}, "a", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.Check(tt.password, details...)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Check(%q) = %q, want %q", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainsPersonal(t *testing.T) {
+	tests := []struct {
+		name     string
+		password string
+		personal []string
+		want     bool
+	}{
+		{"name", "IamJaneOK", []string{"Jane"}, true},
+		{"local part of email", "xx-j.doe-xx", []string{"j.doe@example.com"}, true},
+		{"domain of email", "example-2024", []string{"j.doe@example.com"}, false},
+		{"padded detail", "bobcat-2024", []string{"  Bob "}, true},
+		{"detail too short", "al-is-here", []string{"Al"}, false},
+		{"no details", "anything", nil, false},
+		{"empty detail", "anything", []string{""}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := containsPersonal(tt.password, tt.personal); got != tt.want {
+				t.Errorf("containsPersonal(%q, %q) = %v, want %v", tt.password, tt.personal, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreached(t *testing.T) {
+	tests := []struct {
+		password string
+		want     bool
+	}{
+		{"password", true},
+		{"123456", true},
+		{"qwerty", true},
+		{"Password123", true},
+		{"Summer2024!", true},
+		{"pAsSwOrD", false}, // the hash is of the exact password
+		{"qwerty ", false},
+		{"correct horse battery staple", false},
+		{"zX9#qLm2$wPv", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			if got := Breached(tt.password); got != tt.want {
+				t.Errorf("Breached(%q) = %v, want %v", tt.password, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCharacterClasses(t *testing.T) {
+	tests := []struct {
+		password string
+		want     int
+	}{
+		{"", 0},
+		{"abc", 1},
+		{"abcDEF", 2},
+		{"abcDEF123", 3},
+		{"abcDEF123 ", 4},
+		{"ÉTÉ été", 3},
+		{"١٢٣", 1}, // digits of other scripts are digits
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.password, func(t *testing.T) {
+			if got := characterClasses(tt.password); got != tt.want {
+				t.Errorf("characterClasses(%q) = %d, want %d", tt.password, got, tt.want)
+			}
+		})
+	}
+}